@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// config is what login caches between invocations.
+type config struct {
+	Server string `json:"server"`
+	Token  string `json:"token"`
+}
+
+// configPath is $CALCCTL_CONFIG or calcctl/config.json in the user config
+// directory.
+func configPath() (string, error) {
+	if path := os.Getenv("CALCCTL_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("can't locate config directory, set CALCCTL_CONFIG: %w", err)
+	}
+	return filepath.Join(dir, "calcctl", "config.json"), nil
+}
+
+// loadConfig returns an empty config when nothing has been cached yet.
+func loadConfig() (config, error) {
+	var cfg config
+	path, err := configPath()
+	if err != nil {
+		return cfg, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("can't read %s: %w", path, err)
+	}
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("can't parse %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// saveConfig writes the config readable by the owner only, since it holds
+// the token.
+func saveConfig(cfg config) (string, error) {
+	path, err := configPath()
+	if err != nil {
+		return "", err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", fmt.Errorf("can't create config directory: %w", err)
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err = os.WriteFile(path, append(data, '\n'), 0o600); err != nil {
+		return "", fmt.Errorf("can't write %s: %w", path, err)
+	}
+	return path, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigPath(t *testing.T) {
+	t.Setenv("CALCCTL_CONFIG", "/tmp/custom.json")
+	if path, err := configPath(); err != nil || path != "/tmp/custom.json" {
+		t.Errorf("configPath = %q, %v; expected CALCCTL_CONFIG", path, err)
+	}
+
+	t.Setenv("CALCCTL_CONFIG", "")
+	t.Setenv("XDG_CONFIG_HOME", "/tmp/xdg")
+	t.Setenv("HOME", "/tmp/home")
+	dir, _ := os.UserConfigDir()
+	if path, err := configPath(); err != nil || path != filepath.Join(dir, "calcctl", "config.json") {
+		t.Errorf("configPath = %q, %v; expected the user config directory", path, err)
+	}
+}
+
+func TestSaveAndLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calcctl", "config.json")
+	t.Setenv("CALCCTL_CONFIG", path)
+
+	if cfg, err := loadConfig(); err != nil || cfg != (config{}) {
+		t.Fatalf("loadConfig without a file = %+v, %v; expected an empty config", cfg, err)
+	}
+
+	want := config{Server: "http://calc.local", Token: "secret"}
+	if saved, err := saveConfig(want); err != nil || saved != path {
+		t.Fatalf("saveConfig = %q, %v", saved, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("expected the config readable by the owner only, got %v, %v", info.Mode(), err)
+	}
+	if cfg, err := loadConfig(); err != nil || cfg != want {
+		t.Errorf("loadConfig = %+v, %v; expected %+v", cfg, err, want)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(); err == nil {
+		t.Error("expected an error for a broken config")
+	}
+}
@@ -0,0 +1,454 @@
+// Command calcctl submits expressions to the orchestrator and tracks them.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/pkg/client"
+)
+
+const usage = `calcctl — client for the distributed calculator
+
+Usage:
+  calcctl <command> [flags] [args]
+
+Commands:
+  register             create an account
+  login                log in and cache the token
+  calc <expression>    submit an expression (--wait to wait for the result)
+  list                 list expressions (--status to filter)
+  get <id>             show an expression
+  cancel <id>          cancel an unfinished expression
+  batch <file>         submit one expression per line ("-" reads stdin)
+
+Common flags:
+  --server URL         orchestrator address (env CALCCTL_SERVER, default http://localhost:8080)
+  -o, --output FORMAT  human, json or csv (default human)
+
+The token is cached in the calcctl config file (env CALCCTL_CONFIG) and can be
+overridden with CALCCTL_TOKEN.
+`
+
+type command func(ctx context.Context, args []string) error
+
+var commands = map[string]command{
+	"register": runRegister,
+	"login":    runLogin,
+	"calc":     runCalc,
+	"list":     runList,
+	"get":      runGet,
+	"cancel":   runCancel,
+	"batch":    runBatch,
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "-h" || os.Args[1] == "--help" || os.Args[1] == "help" {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "calcctl: unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := cmd(ctx, os.Args[2:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "calcctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// options are the flags shared by all commands.
+type options struct {
+	server string
+	output string
+}
+
+func newFlagSet(name string) (*flag.FlagSet, *options) {
+	fs := flag.NewFlagSet("calcctl "+name, flag.ContinueOnError)
+	opts := &options{}
+	fs.StringVar(&opts.server, "server", "", "orchestrator address")
+	fs.StringVar(&opts.output, "output", formatHuman, "output format: human, json or csv")
+	fs.StringVar(&opts.output, "o", formatHuman, "shorthand for --output")
+	return fs, opts
+}
+
+// parseArgs allows flags after positional arguments, e.g. calc "2+2" --wait.
+// Everything after "--" is positional.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		// fs.Parse drops the "--" it stops at.
+		rest := fs.Args()
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		args = rest
+		if len(args) == 0 {
+			return positional, nil
+		}
+		if args[0] == "--" {
+			return append(positional, args[1:]...), nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// newClient uses the cached login unless the server or token is overridden.
+func (o *options) newClient() (*client.Client, error) {
+	if _, err := newPrinter(o.output, io.Discard); err != nil {
+		return nil, err
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	server := o.serverURL(cfg)
+
+	// A cached token is only sent to the server it was issued by.
+	token := os.Getenv("CALCCTL_TOKEN")
+	if token == "" && server == cfg.Server {
+		token = cfg.Token
+	}
+	return client.New(server, client.WithToken(token)), nil
+}
+
+func (o *options) serverURL(cfg config) string {
+	server := firstNonEmpty(o.server, os.Getenv("CALCCTL_SERVER"), cfg.Server, client.DefaultBaseURL)
+	return strings.TrimRight(server, "/")
+}
+
+func (o *options) printer() *printer {
+	p, _ := newPrinter(o.output, os.Stdout)
+	return p
+}
+
+func requireLogin(c *client.Client) error {
+	if c.Token() == "" {
+		return errors.New("not logged in: run calcctl login first")
+	}
+	return nil
+}
+
+func runRegister(ctx context.Context, args []string) error {
+	fs, opts := newFlagSet("register")
+	login := fs.String("login", "", "user login")
+	password := fs.String("password", "", "password (read from stdin when empty)")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	c, err := opts.newClient()
+	if err != nil {
+		return err
+	}
+
+	user, pass, err := readCredentials(*login, *password)
+	if err != nil {
+		return err
+	}
+	if err = c.Register(ctx, user, pass); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "registered %s, now run calcctl login\n", user)
+	return nil
+}
+
+func runLogin(ctx context.Context, args []string) error {
+	fs, opts := newFlagSet("login")
+	login := fs.String("login", "", "user login")
+	password := fs.String("password", "", "password (read from stdin when empty)")
+	code := fs.String("code", "", "TOTP code for accounts with 2FA")
+	recoveryCode := fs.String("recovery-code", "", "2FA recovery code instead of --code")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	c, err := opts.newClient()
+	if err != nil {
+		return err
+	}
+
+	user, pass, err := readCredentials(*login, *password)
+	if err != nil {
+		return err
+	}
+	result, err := c.Login(ctx, user, pass)
+	if err != nil {
+		return err
+	}
+	if result.TwoFactorRequired {
+		if *code == "" && *recoveryCode == "" {
+			if *code, err = prompt("2FA code: "); err != nil {
+				return err
+			}
+		}
+		if _, err = c.LoginTwoFactor(ctx, result.ChallengeToken, *code, *recoveryCode); err != nil {
+			return err
+		}
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	path, err := saveConfig(config{Server: opts.serverURL(cfg), Token: c.Token()})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "logged in as %s, token saved to %s\n", user, path)
+	return nil
+}
+
+func runCalc(ctx context.Context, args []string) error {
+	fs, opts := newFlagSet("calc")
+	wait := fs.Bool("wait", false, "wait until the expression is finished")
+	timeout := fs.Duration("timeout", 5*time.Minute, "how long --wait waits")
+	interval := fs.Duration("interval", client.DefaultPollInterval, "polling interval for --wait")
+	priority := fs.Int("priority", 0, "priority from -10 to 10, higher is computed first")
+	deadline := fs.Duration("deadline", 0, "expire the expression if it isn't computed within this time")
+	noRebalance := fs.Bool("no-rebalance", false, "compute + and * chains in the written order")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return errors.New("usage: calcctl calc <expression> [--wait]")
+	}
+	submitOpts := client.SubmitOptions{Priority: *priority, NoRebalance: *noRebalance}
+	if *deadline > 0 {
+		submitOpts.Deadline = time.Now().Add(*deadline)
+	}
+	c, err := opts.newClient()
+	if err != nil {
+		return err
+	}
+	if err = requireLogin(c); err != nil {
+		return err
+	}
+
+	expr, err := c.SubmitWithOptions(ctx, strings.Join(positional, " "), submitOpts)
+	if err != nil {
+		return err
+	}
+	if *wait {
+		waitCtx, cancel := context.WithTimeout(ctx, *timeout)
+		defer cancel()
+		id := expr.ID
+		if expr, err = c.Wait(waitCtx, id, *interval); err != nil {
+			return fmt.Errorf("expression %d: %w", id, err)
+		}
+	}
+	if err = opts.printer().one(expr); err != nil {
+		return err
+	}
+	return expr.Err()
+}
+
+func runList(ctx context.Context, args []string) error {
+	fs, opts := newFlagSet("list")
+	status := fs.String("status", "", "only expressions with this status: pending, in_progress, done, error, cancelled or expired")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	c, err := opts.newClient()
+	if err != nil {
+		return err
+	}
+	if err = requireLogin(c); err != nil {
+		return err
+	}
+
+	list, err := c.List(ctx, *status)
+	if err != nil {
+		return err
+	}
+	return opts.printer().many(list)
+}
+
+func runGet(ctx context.Context, args []string) error {
+	return runByID(ctx, "get", args, (*client.Client).Get)
+}
+
+func runCancel(ctx context.Context, args []string) error {
+	return runByID(ctx, "cancel", args, (*client.Client).Cancel)
+}
+
+func runByID(ctx context.Context, name string, args []string, call func(*client.Client, context.Context, int64) (*client.Expression, error)) error {
+	fs, opts := newFlagSet(name)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: calcctl %s <id>", name)
+	}
+	id, err := strconv.ParseInt(positional[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid expression ID %q", positional[0])
+	}
+	c, err := opts.newClient()
+	if err != nil {
+		return err
+	}
+	if err = requireLogin(c); err != nil {
+		return err
+	}
+
+	expr, err := call(c, ctx, id)
+	if err != nil {
+		return err
+	}
+	return opts.printer().one(expr)
+}
+
+func runBatch(ctx context.Context, args []string) error {
+	fs, opts := newFlagSet("batch")
+	wait := fs.Bool("wait", false, "wait until all expressions are finished")
+	timeout := fs.Duration("timeout", 5*time.Minute, "how long --wait waits")
+	interval := fs.Duration("interval", client.DefaultPollInterval, "polling interval for --wait")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("usage: calcctl batch <file|-> [--wait]")
+	}
+	c, err := opts.newClient()
+	if err != nil {
+		return err
+	}
+	if err = requireLogin(c); err != nil {
+		return err
+	}
+
+	expressions, err := readBatch(positional[0])
+	if err != nil {
+		return err
+	}
+
+	submitted := make([]*client.Expression, 0, len(expressions))
+	var failed int
+	for _, line := range expressions {
+		expr, err := c.Submit(ctx, line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "can't submit %q: %v\n", line, err)
+			failed++
+			continue
+		}
+		submitted = append(submitted, expr)
+	}
+
+	if *wait {
+		waitCtx, cancel := context.WithTimeout(ctx, *timeout)
+		defer cancel()
+		for i, expr := range submitted {
+			finished, err := c.Wait(waitCtx, expr.ID, *interval)
+			if err != nil {
+				return fmt.Errorf("expression %d: %w", expr.ID, err)
+			}
+			submitted[i] = finished
+		}
+	}
+
+	list := make([]client.Expression, 0, len(submitted))
+	for _, expr := range submitted {
+		list = append(list, *expr)
+		if expr.Err() != nil {
+			failed++
+		}
+	}
+	if err = opts.printer().many(list); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d expressions failed", failed, len(expressions))
+	}
+	return nil
+}
+
+// readBatch returns the non-empty lines of path, skipping # comments.
+func readBatch(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var expressions []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		expressions = append(expressions, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("can't read %s: %w", path, err)
+	}
+	if len(expressions) == 0 {
+		return nil, fmt.Errorf("no expressions in %s", path)
+	}
+	return expressions, nil
+}
+
+func readCredentials(login, password string) (string, string, error) {
+	var err error
+	if login == "" {
+		if login, err = prompt("Login: "); err != nil {
+			return "", "", err
+		}
+	}
+	if password == "" {
+		password = os.Getenv("CALCCTL_PASSWORD")
+	}
+	if password == "" {
+		if password, err = prompt("Password: "); err != nil {
+			return "", "", err
+		}
+	}
+	return login, password, nil
+}
+
+var stdin = bufio.NewReader(os.Stdin)
+
+func prompt(label string) (string, error) {
+	fmt.Fprint(os.Stderr, label)
+	line, err := stdin.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", fmt.Errorf("can't read %s: %w", strings.TrimSuffix(strings.ToLower(label), ": "), err)
+	}
+	return strings.TrimSpace(line), nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
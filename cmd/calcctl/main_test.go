@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/atadzan/dist-arith-go/pkg/client"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		positional []string
+		wait       bool
+		output     string
+		wantErr    bool
+	}{
+		{"FlagsAfterExpression", []string{"2+2", "--wait"}, []string{"2+2"}, true, formatHuman, false},
+		{"FlagsBeforeExpression", []string{"-o", "json", "2+2"}, []string{"2+2"}, false, formatJSON, false},
+		{"SplitExpression", []string{"1", "+", "2", "--output=csv", "--wait"}, []string{"1", "+", "2"}, true, formatCSV, false},
+		{"DashDash", []string{"--wait", "--", "-1+2", "--output=csv"}, []string{"-1+2", "--output=csv"}, true, formatHuman, false},
+		{"NoArgs", nil, nil, false, formatHuman, false},
+		{"UnknownFlag", []string{"2+2", "--verbose"}, nil, false, formatHuman, true},
+	}
+	for _, tc := range tests {
+		fs, opts := newFlagSet("calc")
+		fs.SetOutput(io.Discard)
+		wait := fs.Bool("wait", false, "")
+		positional, err := parseArgs(fs, tc.args)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: parseArgs(%q) error = %v, wantErr %v", tc.name, tc.args, err, tc.wantErr)
+			continue
+		}
+		if tc.wantErr {
+			continue
+		}
+		if !slices.Equal(positional, tc.positional) || *wait != tc.wait || opts.output != tc.output {
+			t.Errorf("%s: parseArgs(%q) = %q, wait %v, output %q; want %q, %v, %q",
+				tc.name, tc.args, positional, *wait, opts.output, tc.positional, tc.wait, tc.output)
+		}
+	}
+}
+
+func TestServerURL(t *testing.T) {
+	tests := []struct {
+		name              string
+		flag, env, cached string
+		want              string
+	}{
+		{"Default", "", "", "", client.DefaultBaseURL},
+		{"Cached", "", "", "http://cached:8080", "http://cached:8080"},
+		{"EnvOverCached", "", "http://env:8080", "http://cached:8080", "http://env:8080"},
+		{"FlagOverEnv", "http://flag:8080/", "http://env:8080", "http://cached:8080", "http://flag:8080"},
+	}
+	for _, tc := range tests {
+		t.Setenv("CALCCTL_SERVER", tc.env)
+		opts := &options{server: tc.flag}
+		if got := opts.serverURL(config{Server: tc.cached}); got != tc.want {
+			t.Errorf("%s: serverURL = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNewClientToken(t *testing.T) {
+	t.Setenv("CALCCTL_CONFIG", filepath.Join(t.TempDir(), "config.json"))
+	t.Setenv("CALCCTL_SERVER", "")
+	if _, err := saveConfig(config{Server: "http://cached:8080", Token: "cached-token"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		server, env string
+		want        string
+	}{
+		{"CachedServer", "", "", "cached-token"},
+		{"SameServerWithSlash", "http://cached:8080/", "", "cached-token"},
+		// The cached token isn't sent to another server.
+		{"OtherServer", "http://other:8080", "", ""},
+		{"EnvToken", "http://other:8080", "env-token", "env-token"},
+	}
+	for _, tc := range tests {
+		t.Setenv("CALCCTL_TOKEN", tc.env)
+		opts := &options{server: tc.server, output: formatHuman}
+		c, err := opts.newClient()
+		if err != nil {
+			t.Errorf("%s: newClient error: %v", tc.name, err)
+			continue
+		}
+		if got := c.Token(); got != tc.want {
+			t.Errorf("%s: token %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := (&options{output: "yaml"}).newClient(); err == nil {
+		t.Error("expected an error for an unknown output format")
+	}
+}
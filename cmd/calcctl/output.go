@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/pkg/client"
+)
+
+const (
+	formatHuman = "human"
+	formatJSON  = "json"
+	formatCSV   = "csv"
+)
+
+type printer struct {
+	format string
+	w      io.Writer
+}
+
+func newPrinter(format string, w io.Writer) (*printer, error) {
+	switch format {
+	case formatHuman, formatJSON, formatCSV:
+		return &printer{format: format, w: w}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q, expected human, json or csv", format)
+}
+
+// one prints a single expression; in JSON it is an object, not an array.
+func (p *printer) one(expr *client.Expression) error {
+	if p.format == formatJSON {
+		return p.json(expr)
+	}
+	return p.many([]client.Expression{*expr})
+}
+
+func (p *printer) many(list []client.Expression) error {
+	switch p.format {
+	case formatJSON:
+		if list == nil {
+			list = []client.Expression{}
+		}
+		return p.json(list)
+	case formatCSV:
+		return p.csv(list)
+	}
+	return p.table(list)
+}
+
+func (p *printer) json(v any) error {
+	enc := json.NewEncoder(p.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+var csvHeader = []string{"id", "expression", "status", "result", "error", "created_at", "updated_at"}
+
+func (p *printer) csv(list []client.Expression) error {
+	w := csv.NewWriter(p.w)
+	w.Write(csvHeader)
+	for _, expr := range list {
+		w.Write([]string{
+			strconv.FormatInt(expr.ID, 10),
+			expr.Expression,
+			expr.Status,
+			formatResult(expr.Result),
+			expr.Error,
+			formatTime(expr.CreatedAt),
+			formatTime(expr.UpdatedAt),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func (p *printer) table(list []client.Expression) error {
+	if len(list) == 0 {
+		_, err := fmt.Fprintln(p.w, "no expressions")
+		return err
+	}
+	w := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tPROGRESS\tETA\tRESULT\tEXPRESSION\tERROR")
+	for _, expr := range list {
+		fmt.Fprintf(w, "%d\t%s\t%d/%d\t%s\t%s\t%s\t%s\n", expr.ID, expr.Status, expr.Progress.Done, expr.Progress.Total,
+			orDash(formatETA(expr.ETA)), orDash(formatResult(expr.Result)),
+			expr.Expression, orDash(strings.ReplaceAll(expr.Error, "\n", " ")))
+	}
+	return w.Flush()
+}
+
+func formatResult(result *float64) string {
+	if result == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*result, 'g', -1, 64)
+}
+
+// formatETA returns the time left until eta, e.g. "in 3s".
+func formatETA(eta *time.Time) string {
+	if eta == nil {
+		return ""
+	}
+	return "in " + max(time.Until(*eta), 0).Round(time.Second).String()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/pkg/client"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func testExpressions() []client.Expression {
+	created := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	result := 14.5
+	return []client.Expression{
+		{
+			ID: 1, Expression: "(2+3)*2.9", Status: client.StatusDone, Result: &result, Rebalance: true, Depth: 2, PlannedDepth: 2,
+			Progress: client.Progress{Done: 2, Total: 2}, CreatedAt: created, UpdatedAt: created.Add(3 * time.Second),
+		},
+		{
+			ID: 2, Expression: "1/0", Status: client.StatusError, Error: "division by zero,\nat task 3",
+			Progress: client.Progress{Done: 0, Total: 1}, CreatedAt: created, UpdatedAt: created.Add(time.Second),
+		},
+		{
+			ID: 3, Expression: "1+2+3", Status: client.StatusPending,
+			Progress: client.Progress{Done: 0, Total: 2}, CreatedAt: created, UpdatedAt: created,
+		},
+	}
+}
+
+func TestPrinterGolden(t *testing.T) {
+	tests := []struct {
+		name, format string
+		print        func(p *printer) error
+	}{
+		{"list.human", formatHuman, func(p *printer) error { return p.many(testExpressions()) }},
+		{"list.json", formatJSON, func(p *printer) error { return p.many(testExpressions()) }},
+		{"list.csv", formatCSV, func(p *printer) error { return p.many(testExpressions()) }},
+		{"one.human", formatHuman, func(p *printer) error { return p.one(&testExpressions()[0]) }},
+		{"one.json", formatJSON, func(p *printer) error { return p.one(&testExpressions()[0]) }},
+		{"one.csv", formatCSV, func(p *printer) error { return p.one(&testExpressions()[0]) }},
+		{"empty.human", formatHuman, func(p *printer) error { return p.many(nil) }},
+		{"empty.json", formatJSON, func(p *printer) error { return p.many(nil) }},
+		{"empty.csv", formatCSV, func(p *printer) error { return p.many(nil) }},
+	}
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		p, err := newPrinter(tc.format, &buf)
+		if err != nil {
+			t.Fatalf("%s: newPrinter error: %v", tc.name, err)
+		}
+		if err = tc.print(p); err != nil {
+			t.Errorf("%s: print error: %v", tc.name, err)
+			continue
+		}
+
+		golden := filepath.Join("testdata", tc.name+".golden")
+		if *update {
+			if err = os.WriteFile(golden, buf.Bytes(), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("%s: %v, run go test -update to create it", tc.name, err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("%s: output differs from %s:\n%s\nwant:\n%s", tc.name, golden, buf.String(), want)
+		}
+	}
+}
+
+func TestNewPrinterRejectsUnknownFormat(t *testing.T) {
+	if _, err := newPrinter("yaml", os.Stdout); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestFormatETA(t *testing.T) {
+	if got := formatETA(nil); got != "" {
+		t.Errorf("formatETA(nil) = %q, want empty", got)
+	}
+	eta := time.Now().Add(time.Hour + 300*time.Millisecond)
+	if got := formatETA(&eta); got != "in 1h0m0s" {
+		t.Errorf("formatETA in an hour = %q", got)
+	}
+	past := time.Now().Add(-time.Minute)
+	if got := formatETA(&past); got != "in 0s" {
+		t.Errorf("formatETA in the past = %q", got)
+	}
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 
+	"github.com/atadzan/dist-arith-go/internal/logging"
 	"github.com/atadzan/dist-arith-go/internal/repository"
+	"github.com/atadzan/dist-arith-go/internal/tracing"
 	"github.com/atadzan/dist-arith-go/pkg/database"
 
 	pb "github.com/atadzan/dist-arith-go/internal/worker/grpc/calc"
@@ -15,67 +18,178 @@ import (
 	"github.com/atadzan/dist-arith-go/internal/orchestrator"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 const (
 	httpPort     = ":8080"
 	grpcPort     = ":50051"
 	jwtSecretEnv = "JWT_SECRET"
+
+	workerAuthDisabledEnv = "WORKER_AUTH_DISABLED"
 )
 
 func main() {
-	fmt.Println("Orchestrator is running...")
+	logger, err := logging.FromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't init logger: %v\n", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+	logger.Info("orchestrator is starting")
+
 	dbConn, err := database.NewDBConn("calc.db")
 	if err != nil {
-		log.Fatalf(err.Error())
+		fatal("can't open db", err)
 	}
-	repo, err := repository.New(dbConn)
+	repo, err := repository.New(dbConn, logger)
 	if err != nil {
-		log.Fatalf("can't init db: %v", err)
+		fatal("can't init db", err)
 	}
 	defer dbConn.Close()
 
 	if err = repo.CreateTables(); err != nil {
-		log.Fatalf("migration err: %v", err)
+		fatal("migration failed", err)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "calc-orchestrator")
+	if err != nil {
+		fatal("can't init tracing", err)
 	}
+	defer shutdownTracing(context.Background())
 
 	jwtSecret := os.Getenv(jwtSecretEnv)
 	if jwtSecret == "" {
-		log.Fatalf("can't get %s from ENV", jwtSecretEnv)
+		fatal("can't init auth", fmt.Errorf("%s is not set", jwtSecretEnv))
+	}
+	passwordPolicy, err := orchestrator.NewPasswordPolicyFromEnv()
+	if err != nil {
+		fatal("can't init password policy", err)
+	}
+
+	schedulingWeights, err := orchestrator.SchedulingWeightsFromEnv()
+	if err != nil {
+		fatal("can't read scheduling weights", err)
 	}
+	if err = repo.SetSchedulingWeights(schedulingWeights); err != nil {
+		fatal("can't store scheduling weights", err)
+	}
+
 	authService := orchestrator.NewAuthService(repo, jwtSecret)
-	schedulerService := orchestrator.NewScheduler(repo)
-	grpcServerInstance := orchestrator.NewCalculatorGRPCServer(repo, schedulerService.GetOperationTimes(), schedulerService)
+	metrics := orchestrator.NewMetrics(repo, logger)
+	schedulerService := orchestrator.NewScheduler(repo, metrics, logger)
+	go schedulerService.RunLeaseReaper(context.Background())
+	go schedulerService.RunDeadlineReaper(context.Background())
+	grpcServerInstance := orchestrator.NewCalculatorGRPCServer(repo, schedulerService.GetOperationTimes(), schedulerService, metrics, logger)
+
+	httpHandlers := orchestrator.NewHTTPHandlers(authService, repo, schedulerService, passwordPolicy, orchestrator.NewLimitsFromEnv(), logger)
+
+	grpcOpts, err := workerServerOptions(metrics)
+	if err != nil {
+		fatal("can't configure worker gRPC server", err)
+	}
 
-	httpHandlers := orchestrator.NewHTTPHandlers(authService, repo, schedulerService)
+	// The health server starts as NOT_SERVING and is switched over once the
+	// gRPC listener is up, so /readyz fails until workers can connect.
+	grpcHealth := health.NewServer()
+	grpcHealth.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	grpcHealth.SetServingStatus(pb.CalcWorkerService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_NOT_SERVING)
 
 	go func() {
 		lis, err := net.Listen("tcp", grpcPort)
 		if err != nil {
-			log.Fatalf("error while starting gRPC port %s: %v", grpcPort, err)
+			fatal("can't listen on gRPC port", err, "addr", grpcPort)
 		}
-		s := grpc.NewServer()
+		s := grpc.NewServer(grpcOpts...)
 		pb.RegisterCalcWorkerServiceServer(s, grpcServerInstance)
+		healthpb.RegisterHealthServer(s, grpcHealth)
+		grpcHealth.Resume()
 
-		fmt.Printf("gRPC server listening %s\n", grpcPort)
+		logger.Info("gRPC server listening", "addr", grpcPort)
 		if err := s.Serve(lis); err != nil {
-			log.Fatalf("gRPC server error: %v", err)
+			fatal("gRPC server error", err)
 		}
 	}()
 
 	router := http.NewServeMux()
+	handle := func(route string, handler http.Handler) {
+		router.Handle(route, metrics.InstrumentHandler(route, handler))
+	}
 
-	router.HandleFunc("/api/v1/register", httpHandlers.RegisterHandler)
-	router.HandleFunc("/api/v1/login", httpHandlers.LoginHandler)
+	httpHandlers.RegisterRoutes(handle)
 
-	router.Handle("/api/v1/calculate", authService.JWTMiddleware(http.HandlerFunc(httpHandlers.CalculateHandler)))
-	router.Handle("/api/v1/expressions", authService.JWTMiddleware(http.HandlerFunc(httpHandlers.ExpressionsHandler)))
-	router.Handle("/api/v1/expressions/", authService.JWTMiddleware(http.HandlerFunc(httpHandlers.ExpressionsHandler)))
+	if oidcConfig, ok := orchestrator.OIDCConfigFromEnv(); ok {
+		oidcService := orchestrator.NewOIDCService(oidcConfig, authService, repo, logger)
+		handle("/api/v1/oidc/login", http.HandlerFunc(oidcService.LoginHandler))
+		handle("/api/v1/oidc/callback", http.HandlerFunc(oidcService.CallbackHandler))
+		logger.Info("OIDC login enabled", "issuer", oidcConfig.Issuer)
+	}
 
-	fmt.Printf("HTTP is listening on port: %s\n", httpPort)
-	corsRouter := orchestrator.EnableCORS(router)
+	openAPIDoc, err := orchestrator.LoadOpenAPI()
+	if err != nil {
+		fatal("can't load OpenAPI document", err)
+	}
+	openAPIHandler, err := orchestrator.OpenAPIHandler(openAPIDoc)
+	if err != nil {
+		fatal("can't serve OpenAPI document", err)
+	}
+	openAPIValidator, err := orchestrator.NewOpenAPIValidator(openAPIDoc, logger)
+	if err != nil {
+		fatal("can't create OpenAPI validator", err)
+	}
+	handle("/api/v1/openapi.json", openAPIHandler)
+
+	router.Handle("/metrics", metrics.Handler())
+
+	healthHandlers := orchestrator.NewHealth(repo, grpcHealth)
+	router.HandleFunc("/healthz", healthHandlers.LivenessHandler)
+	router.HandleFunc("/readyz", healthHandlers.ReadinessHandler)
+
+	logger.Info("HTTP server listening", "addr", httpPort)
+	corsRouter := orchestrator.EnableCORS(orchestrator.RequestIDMiddleware(openAPIValidator.Middleware(router)))
 	if err := http.ListenAndServe(httpPort, corsRouter); err != nil {
-		log.Fatalf("Ошибка старта HTTP сервера: %v", err)
+		fatal("HTTP server error", err)
+	}
+	logger.Info("orchestrator stopped")
+}
+
+// fatal logs err with the default logger and exits.
+func fatal(msg string, err error, args ...any) {
+	slog.Error(msg, append(args, "error", err)...)
+	os.Exit(1)
+}
+
+// workerServerOptions enables call metrics, worker authentication and, when
+// certificates are configured, TLS on the worker gRPC port.
+func workerServerOptions(metrics *orchestrator.Metrics) ([]grpc.ServerOption, error) {
+	opts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(metrics.UnaryInterceptor())}
+
+	certFile, keyFile := os.Getenv("GRPC_TLS_CERT"), os.Getenv("GRPC_TLS_KEY")
+	if certFile != "" || keyFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't load TLS key pair: %w", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+
+	tokens, err := orchestrator.WorkerTokensFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		if os.Getenv(workerAuthDisabledEnv) != "true" {
+			return nil, fmt.Errorf("no worker tokens configured: set WORKER_TOKENS or WORKER_TOKENS_FILE, or %s=true for local development", workerAuthDisabledEnv)
+		}
+		slog.Warn("worker authentication is disabled")
+		return opts, nil
+	}
+
+	authenticator, err := orchestrator.NewWorkerAuthenticator(tokens)
+	if err != nil {
+		return nil, err
 	}
-	fmt.Println("Orchestrator stopped")
+	return append(opts, grpc.ChainUnaryInterceptor(authenticator.UnaryInterceptor())), nil
 }
@@ -1,34 +1,137 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
 	"strconv"
+	"time"
 
+	"github.com/atadzan/dist-arith-go/internal/logging"
+	"github.com/atadzan/dist-arith-go/internal/tracing"
 	"github.com/atadzan/dist-arith-go/internal/worker"
 	"github.com/atadzan/dist-arith-go/internal/worker/grpc/calc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	defaultOrchestratorAddr = "localhost:50051"
+	// defaultHealthAddr serves /healthz unless HEALTH_ADDR is set. It may be
+	// taken by another worker on the same host.
+	defaultHealthAddr = ":9102"
 )
 
 func main() {
+	logger, err := logging.FromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't init logger: %v\n", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
 	computingPower := 1
 	if v := os.Getenv("COMPUTING_POWER"); v != "" {
 		if cp, err := strconv.Atoi(v); err == nil {
 			computingPower = cp
+		} else {
+			logger.Warn("invalid COMPUTING_POWER, using default", "value", v, "default", computingPower)
+		}
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "calc-worker")
+	if err != nil {
+		fatal("can't init tracing", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	orchestratorAddr := os.Getenv("ORCHESTRATOR_ADDR")
+	if orchestratorAddr == "" {
+		orchestratorAddr = defaultOrchestratorAddr
+	}
+
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	useTLS := false
+	if caFile := os.Getenv("ORCHESTRATOR_TLS_CA"); caFile != "" {
+		creds, err := credentials.NewClientTLSFromFile(caFile, "")
+		if err != nil {
+			fatal("can't load orchestrator CA", err, "file", caFile)
 		}
+		opts[0] = grpc.WithTransportCredentials(creds)
+		useTLS = true
+	}
+	if token := os.Getenv("WORKER_TOKEN"); token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(worker.NewBearerToken(token, useTLS)))
 	}
 
-	conn, err := grpc.Dial("localhost:50051", grpc.WithInsecure())
+	conn, err := grpc.Dial(orchestratorAddr, opts...)
 	if err != nil {
-		panic(err)
+		fatal("can't connect to orchestrator", err, "addr", orchestratorAddr)
 	}
 	defer conn.Close()
 
+	healthInterval := worker.DefaultHealthInterval
+	if v := os.Getenv("HEALTH_CHECK_INTERVAL_MS"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil && ms > 0 {
+			healthInterval = time.Duration(ms) * time.Millisecond
+		} else {
+			logger.Warn("invalid HEALTH_CHECK_INTERVAL_MS, using default", "value", v, "default", healthInterval)
+		}
+	}
+	healthMonitor := worker.NewHealthMonitor(conn, healthInterval, logger)
+	go healthMonitor.Run(context.Background())
+
+	// /healthz is always served, /metrics only with METRICS_ADDR; both share
+	// a listener when the addresses are the same. Several workers on a host
+	// can't all bind the default health address, so failing to bind it only
+	// disables /healthz of this worker.
+	healthAddr := os.Getenv("HEALTH_ADDR")
+	optionalAddr := ""
+	if healthAddr == "" {
+		healthAddr, optionalAddr = defaultHealthAddr, defaultHealthAddr
+	}
+	muxes := map[string]*http.ServeMux{healthAddr: http.NewServeMux()}
+	muxes[healthAddr].Handle("/healthz", healthMonitor.Handler())
+
+	registry := prometheus.NewRegistry()
+	metrics := worker.NewMetrics(registry)
+	if metricsAddr := os.Getenv("METRICS_ADDR"); metricsAddr != "" {
+		if muxes[metricsAddr] == nil {
+			muxes[metricsAddr] = http.NewServeMux()
+		}
+		muxes[metricsAddr].Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry}))
+		if metricsAddr == optionalAddr {
+			optionalAddr = ""
+		}
+	}
+	for addr, mux := range muxes {
+		go func() {
+			logger.Info("http server listening", "addr", addr)
+			err := http.ListenAndServe(addr, mux)
+			if addr == optionalAddr {
+				logger.Warn("can't serve /healthz on the default address, set HEALTH_ADDR", "addr", addr, "error", err)
+				return
+			}
+			fatal("http server error", err, "addr", addr)
+		}()
+	}
+
 	client := calc.NewCalcWorkerServiceClient(conn)
 	for i := 0; i < computingPower; i++ {
-		go worker.Worker(i, client)
+		go worker.Worker(i, client, metrics, logger)
 	}
 
-	fmt.Printf("Worker started with %d workers\n", computingPower)
+	logger.Info("workers started", "count", computingPower, "orchestrator", orchestratorAddr)
 	select {}
 }
+
+// fatal logs err with the default logger and exits.
+func fatal(msg string, err error, args ...any) {
+	slog.Error(msg, append(args, "error", err)...)
+	os.Exit(1)
+}
@@ -5,4 +5,16 @@ const (
 	StatusInProgress = "in_progress"
 	StatusDone       = "done"
 	StatusError      = "error"
+	StatusCancelled  = "cancelled"
+	StatusExpired    = "expired"
+)
+
+// Statuses are all statuses of expressions and tasks.
+var Statuses = []string{StatusPending, StatusInProgress, StatusDone, StatusError, StatusCancelled, StatusExpired}
+
+// Priorities of expressions; higher ones are scheduled first.
+const (
+	MinPriority     = -10
+	MaxPriority     = 10
+	DefaultPriority = 0
 )
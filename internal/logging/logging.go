@@ -0,0 +1,116 @@
+// Package logging builds the slog loggers used by the orchestrator and the
+// workers. Correlation IDs (request, expression, task, worker) are stored in
+// the context and added to every record logged with a *Context method.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	levelEnv  = "LOG_LEVEL"
+	formatEnv = "LOG_FORMAT"
+)
+
+// Correlation attribute keys.
+const (
+	RequestIDKey    = "request_id"
+	ExpressionIDKey = "expression_id"
+	TaskIDKey       = "task_id"
+	WorkerIDKey     = "worker_id"
+	UserIDKey       = "user_id"
+)
+
+type attrsKey struct{}
+
+// New returns a logger writing to w in the given format ("text" or "json").
+func New(w io.Writer, format string, level slog.Leveler) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+	return slog.New(contextHandler{handler}), nil
+}
+
+// FromEnv configures the logger from LOG_LEVEL (debug, info, warn, error;
+// info by default) and LOG_FORMAT (text or json; text by default).
+func FromEnv() (*slog.Logger, error) {
+	var level slog.Level
+	if v := os.Getenv(levelEnv); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", levelEnv, v, err)
+		}
+	}
+	return New(os.Stderr, os.Getenv(formatEnv), level)
+}
+
+// Discard returns a logger that drops everything, for tests.
+func Discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+}
+
+// With returns a copy of ctx whose log records carry the given key-value
+// pairs in addition to the ones already stored.
+func With(ctx context.Context, args ...any) context.Context {
+	r := slog.NewRecord(time.Time{}, 0, "", 0)
+	r.Add(args...)
+
+	attrs := append([]slog.Attr(nil), attrsFrom(ctx)...)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	return context.WithValue(ctx, attrsKey{}, attrs)
+}
+
+// RequestID returns the request ID stored in ctx by With, if any.
+func RequestID(ctx context.Context) string {
+	for _, a := range attrsFrom(ctx) {
+		if a.Key == RequestIDKey {
+			return a.Value.String()
+		}
+	}
+	return ""
+}
+
+func attrsFrom(ctx context.Context) []slog.Attr {
+	attrs, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	return attrs
+}
+
+// contextHandler adds the correlation attributes and the trace ID from the
+// context to each record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	r.AddAttrs(attrsFrom(ctx)...)
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
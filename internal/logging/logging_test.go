@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestContextAttributesAndTraceID(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := sdktrace.NewTracerProvider()
+	defer provider.Shutdown(context.Background())
+	ctx, span := provider.Tracer("test").Start(context.Background(), "op")
+	defer span.End()
+
+	ctx = With(ctx, RequestIDKey, "req-1", ExpressionIDKey, int64(7))
+	ctx = With(ctx, TaskIDKey, int64(42))
+	logger.With("component", "test").InfoContext(ctx, "task leased", WorkerIDKey, "w-1")
+
+	var record map[string]any
+	if err = json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, buf.String())
+	}
+	want := map[string]any{
+		"msg":           "task leased",
+		"component":     "test",
+		RequestIDKey:    "req-1",
+		ExpressionIDKey: float64(7),
+		TaskIDKey:       float64(42),
+		WorkerIDKey:     "w-1",
+		"trace_id":      span.SpanContext().TraceID().String(),
+	}
+	for key, value := range want {
+		if record[key] != value {
+			t.Errorf("%s = %v, want %v", key, record[key], value)
+		}
+	}
+	if got := RequestID(ctx); got != "req-1" {
+		t.Errorf("RequestID = %q, want req-1", got)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv(levelEnv, "warn")
+	t.Setenv(formatEnv, "text")
+	logger, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logger.Enabled(context.Background(), -4) || !logger.Enabled(context.Background(), 4) {
+		t.Fatal("LOG_LEVEL=warn must disable debug and enable warn")
+	}
+
+	t.Setenv(levelEnv, "loud")
+	if _, err = FromEnv(); err == nil {
+		t.Fatal("invalid level must be rejected")
+	}
+	t.Setenv(levelEnv, "")
+	t.Setenv(formatEnv, "xml")
+	if _, err = FromEnv(); err == nil || !strings.Contains(err.Error(), "xml") {
+		t.Fatalf("invalid format must be rejected, got %v", err)
+	}
+}
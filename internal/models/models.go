@@ -6,10 +6,16 @@ import (
 )
 
 type User struct {
-	ID           int64     `json:"id"`
-	Login        string    `json:"login"`
-	PasswordHash string    `json:"-"`
-	CreatedAt    time.Time `json:"created_at"`
+	ID           int64  `json:"id"`
+	Login        string `json:"login"`
+	PasswordHash string `json:"-"`
+	TokenVersion int64  `json:"-"`
+	TOTPSecret   string `json:"-"`
+	TOTPEnabled  bool   `json:"totp_enabled"`
+	TOTPLastStep int64  `json:"-"`
+	// ResultCacheDisabled makes every expression of the user computed anew.
+	ResultCacheDisabled bool      `json:"result_cache_disabled"`
+	CreatedAt           time.Time `json:"created_at"`
 }
 
 type Expression struct {
@@ -19,8 +25,19 @@ type Expression struct {
 	Status     string          `json:"status"`
 	Result     sql.NullFloat64 `json:"result,omitempty"`
 	Steps      sql.NullString  `json:"steps,omitempty"`
-	CreatedAt  time.Time       `json:"created_at"`
-	UpdatedAt  time.Time       `json:"updated_at"`
+	Priority   int             `json:"priority"`
+	Deadline   sql.NullTime    `json:"deadline"`
+	// RebalanceDisabled keeps the parsed tree instead of balancing chains
+	// of + and * for parallelism.
+	RebalanceDisabled bool `json:"rebalance_disabled"`
+	// Depth is the depth of the parsed tree, PlannedDepth of the tree the
+	// tasks are planned from.
+	Depth        int `json:"depth"`
+	PlannedDepth int `json:"planned_depth"`
+	// Operations is the number of tasks the expression is split into.
+	Operations int       `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
 }
 
 type Task struct {
@@ -31,6 +48,11 @@ type Task struct {
 	Arg2         float64         `json:"arg2"`
 	Result       sql.NullFloat64 `json:"result,omitempty"`
 	Status       string          `json:"status"`
+	WorkerID     string          `json:"worker_id,omitempty"`
+	LeaseToken   string          `json:"-"`
+	LeasedAt     sql.NullTime    `json:"leased_at,omitempty"`
+	CompletedAt  sql.NullTime    `json:"completed_at,omitempty"`
+	TraceContext string          `json:"-"`
 	CreatedAt    time.Time       `json:"created_at"`
 	UpdatedAt    time.Time       `json:"updated_at"`
 	Retries      int             `json:"retries"`
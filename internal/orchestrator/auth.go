@@ -5,10 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/atadzan/dist-arith-go/internal/logging"
+	"github.com/atadzan/dist-arith-go/internal/models"
 	"github.com/atadzan/dist-arith-go/internal/repository"
+	"github.com/atadzan/dist-arith-go/pkg/totp"
 
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
@@ -20,14 +25,27 @@ type contextKey string
 
 const userContextKey contextKey = "userID"
 
+// challengePurpose marks short-lived tokens issued after the password step of
+// a two-factor login. They are only accepted by the second login step.
+const challengePurpose = "2fa_challenge"
+
 type Claims struct {
-	UserID int64 `json:"user_id"`
+	UserID       int64  `json:"user_id"`
+	TokenVersion int64  `json:"token_version"`
+	Purpose      string `json:"purpose,omitempty"`
 	jwt.RegisteredClaims
 }
 
 type AuthService struct {
 	dbStore   repository.Repository
 	jwtSecret string
+
+	totp       totp.Config
+	totpIssuer string
+	now        func() time.Time
+
+	challengeMx       sync.Mutex
+	challengeFailures map[string]*challengeAttempts
 }
 
 func NewAuthService(db repository.Repository, secret string) *AuthService {
@@ -35,9 +53,18 @@ func NewAuthService(db repository.Repository, secret string) *AuthService {
 		panic("JWT secret cannot be empty")
 	}
 	jwtKey = []byte(secret)
+
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = defaultTOTPIssuer
+	}
 	return &AuthService{
-		dbStore:   db,
-		jwtSecret: secret,
+		dbStore:           db,
+		jwtSecret:         secret,
+		totp:              totp.DefaultConfig,
+		totpIssuer:        issuer,
+		now:               time.Now,
+		challengeFailures: make(map[string]*challengeAttempts),
 	}
 }
 
@@ -51,13 +78,14 @@ func CheckPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
-func (s *AuthService) GenerateJWT(userID int64) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+func (s *AuthService) GenerateJWT(user *models.User) (string, error) {
+	expirationTime := s.now().Add(24 * time.Hour)
 	claims := &Claims{
-		UserID: userID,
+		UserID:       user.ID,
+		TokenVersion: user.TokenVersion,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			IssuedAt:  jwt.NewNumericDate(s.now()),
 			Issuer:    "calc_orchestrator",
 		},
 	}
@@ -67,53 +95,87 @@ func (s *AuthService) GenerateJWT(userID int64) (string, error) {
 }
 
 func (s *AuthService) ValidateJWT(tokenStr string) (int64, error) {
+	claims, err := s.parseToken(tokenStr)
+	if err != nil {
+		return 0, err
+	}
+	if claims.Purpose != "" {
+		return 0, fmt.Errorf("token can't be used for API access")
+	}
+	return claims.UserID, nil
+}
+
+func (s *AuthService) parseToken(tokenStr string) (*Claims, error) {
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 		return jwtKey, nil
-	})
+	}, jwt.WithTimeFunc(s.now))
 	if err != nil {
 		if errors.Is(err, jwt.ErrTokenExpired) {
-			return 0, fmt.Errorf("token expired")
+			return nil, fmt.Errorf("token expired")
 		}
-		return 0, fmt.Errorf("token parsing error: %w", err)
+		return nil, fmt.Errorf("token parsing error: %w", err)
 	}
 
 	if !token.Valid {
-		return 0, fmt.Errorf("invalid token")
+		return nil, fmt.Errorf("invalid token")
 	}
 
-	return claims.UserID, nil
+	// Tokens are revoked by bumping the user's token version (password change)
+	// or by deleting the user altogether.
+	user, err := s.dbStore.GetUserByID(claims.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("can't load token owner: %w", err)
+	}
+	if user == nil {
+		return nil, fmt.Errorf("user not found")
+	}
+	if user.TokenVersion != claims.TokenVersion {
+		return nil, fmt.Errorf("token revoked")
+	}
+
+	return claims, nil
 }
 
-func (s *AuthService) JWTMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "empty Authorization header", http.StatusUnauthorized)
-			return
-		}
+// errMissingToken is returned by authenticate for requests without a Bearer
+// token in the Authorization header.
+var errMissingToken = errors.New("missing bearer token")
 
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-			http.Error(w, "invalid Authorization header (expected 'Bearer <token>')", http.StatusUnauthorized)
-			return
-		}
+// authenticate validates the Bearer token of the request.
+func (s *AuthService) authenticate(r *http.Request) (int64, error) {
+	authHeader := r.Header.Get("Authorization")
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+		return 0, errMissingToken
+	}
+	return s.ValidateJWT(parts[1])
+}
 
-		tokenStr := parts[1]
-		userID, err := s.ValidateJWT(tokenStr)
+func (s *AuthService) JWTMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := s.authenticate(r)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("token validation error: %v", err), http.StatusUnauthorized)
+			writeAuthError(w, r, err)
 			return
 		}
 
 		ctx := context.WithValue(r.Context(), userContextKey, userID)
+		ctx = logging.With(ctx, logging.UserIDKey, userID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+func writeAuthError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errMissingToken) {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, nil)
+		return
+	}
+	writeError(w, r, http.StatusUnauthorized, CodeInvalidToken, map[string]any{"reason": err.Error()})
+}
+
 func GetUserIDFromContext(ctx context.Context) (int64, bool) {
 	userID, ok := ctx.Value(userContextKey).(int64)
 	return userID, ok
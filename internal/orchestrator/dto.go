@@ -0,0 +1,146 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/internal/constants"
+	"github.com/atadzan/dist-arith-go/internal/logging"
+	"github.com/atadzan/dist-arith-go/internal/models"
+)
+
+// API versions served by HTTPHandlers. v1 encodes models.Expression as is;
+// v2 uses the response types below.
+const (
+	apiV1 = 1
+	apiV2 = 2
+)
+
+// CalculateResponse is the v1 answer to POST /calculate.
+type CalculateResponse struct {
+	ID         int64  `json:"id"`
+	Expression string `json:"expression"`
+	Status     string `json:"status"`
+}
+
+// ExpressionResponse is the v2 representation of an expression.
+type ExpressionResponse struct {
+	ID         int64    `json:"id"`
+	Expression string   `json:"expression"`
+	Status     string   `json:"status"`
+	Result     *float64 `json:"result"`
+	Steps      []string `json:"steps"`
+	// Error is the reason the expression failed, null otherwise.
+	Error     *string    `json:"error"`
+	Priority  int        `json:"priority"`
+	Deadline  *time.Time `json:"deadline"`
+	Rebalance bool       `json:"rebalance"`
+	// Depth is the number of operations on the longest path of the parsed
+	// expression, PlannedDepth of the tree the tasks are planned from.
+	Depth        int      `json:"depth"`
+	PlannedDepth int      `json:"planned_depth"`
+	Progress     Progress `json:"progress"`
+	// ETA is when the expression is expected to be done, see
+	// Scheduler.Estimate.
+	ETA       *time.Time `json:"eta"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// NewExpressionResponse converts the stored expression. The steps column
+// holds a JSON array of steps, or the error message for failed expressions.
+func NewExpressionResponse(expr models.Expression) ExpressionResponse {
+	resp := ExpressionResponse{
+		ID:           expr.ID,
+		Expression:   expr.Expression,
+		Status:       expr.Status,
+		Steps:        []string{},
+		Priority:     expr.Priority,
+		Rebalance:    !expr.RebalanceDisabled,
+		Depth:        expr.Depth,
+		PlannedDepth: expr.PlannedDepth,
+		CreatedAt:    expr.CreatedAt,
+		UpdatedAt:    expr.UpdatedAt,
+	}
+	if expr.Deadline.Valid {
+		deadline := expr.Deadline.Time
+		resp.Deadline = &deadline
+	}
+	if expr.Result.Valid {
+		result := expr.Result.Float64
+		resp.Result = &result
+	}
+	if expr.Steps.Valid && expr.Steps.String != "" {
+		var steps []string
+		if err := json.Unmarshal([]byte(expr.Steps.String), &steps); err == nil {
+			resp.Steps = steps
+		} else if expr.Status == constants.StatusError {
+			msg := expr.Steps.String
+			resp.Error = &msg
+		}
+	}
+	return resp
+}
+
+// expressionView returns the representation of expr for the API version.
+func (h *HTTPHandlers) expressionView(ctx context.Context, version int, expr models.Expression) any {
+	if version == apiV1 {
+		return expr
+	}
+	tasks, err := h.repo.GetAllTasksForExpression(expr.ID)
+	if err != nil {
+		h.logger.WarnContext(ctx, "can't estimate expression", logging.ExpressionIDKey, expr.ID, "error", err)
+		return NewExpressionResponse(expr)
+	}
+	return h.expressionResponse(expr, tasks, h.scheduler.useCache(ctx, expr.UserID))
+}
+
+// expressionsView returns the representation of the expressions of a user
+// for the API version. Only pending and in-progress expressions are
+// estimated from their tasks, which are loaded at once; the progress of the
+// others is taken from their computed tasks.
+func (h *HTTPHandlers) expressionsView(ctx context.Context, version int, userID int64, exprs []models.Expression) any {
+	if version == apiV1 {
+		return exprs
+	}
+	views := make([]ExpressionResponse, 0, len(exprs))
+	if len(exprs) == 0 {
+		return views
+	}
+	tasks, err := h.repo.GetActiveTasksByUserID(userID)
+	if err != nil {
+		h.logger.WarnContext(ctx, "can't estimate expressions", "error", err)
+		for _, expr := range exprs {
+			views = append(views, NewExpressionResponse(expr))
+		}
+		return views
+	}
+	done, err := h.repo.CountDoneTasksByUserID(userID)
+	if err != nil {
+		h.logger.WarnContext(ctx, "can't count computed tasks", "error", err)
+	}
+	useCache := h.scheduler.useCache(ctx, userID)
+	for _, expr := range exprs {
+		if expr.Status == constants.StatusPending || expr.Status == constants.StatusInProgress {
+			views = append(views, h.expressionResponse(expr, tasks[expr.ID], useCache))
+			continue
+		}
+		resp := NewExpressionResponse(expr)
+		resp.Progress = Progress{Done: done[expr.ID], Total: expr.Operations}
+		if expr.Status == constants.StatusDone {
+			// Operations answered from the cache have no tasks.
+			resp.Progress.Done = expr.Operations
+		}
+		views = append(views, resp)
+	}
+	return views
+}
+
+// expressionResponse converts expr with its progress and ETA as of now.
+func (h *HTTPHandlers) expressionResponse(expr models.Expression, tasks []models.Task, useCache bool) ExpressionResponse {
+	resp := NewExpressionResponse(expr)
+	estimate := h.scheduler.Estimate(expr, tasks, useCache, time.Now())
+	resp.Progress, resp.ETA = estimate.Progress, estimate.ETA
+	return resp
+}
@@ -0,0 +1,142 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrorCode identifies an API error. Codes are stable and meant for clients;
+// messages depend on the language of the request and may change.
+type ErrorCode string
+
+const (
+	CodeInternal         ErrorCode = "internal_error"
+	CodeMethodNotAllowed ErrorCode = "method_not_allowed"
+	CodeNotFound         ErrorCode = "not_found"
+
+	// Requests that don't match the OpenAPI document or can't be decoded.
+	CodeInvalidJSON      ErrorCode = "invalid_json"
+	CodeInvalidParameter ErrorCode = "invalid_parameter"
+	CodeInvalidBody      ErrorCode = "invalid_body"
+	CodeInvalidRequest   ErrorCode = "invalid_request"
+
+	CodeUnauthorized       ErrorCode = "unauthorized"
+	CodeInvalidToken       ErrorCode = "invalid_token"
+	CodeEmptyCredentials   ErrorCode = "empty_credentials"
+	CodeInvalidCredentials ErrorCode = "invalid_credentials"
+	CodeWeakPassword       ErrorCode = "weak_password"
+	CodeUserExists         ErrorCode = "user_exists"
+	CodeUserNotFound       ErrorCode = "user_not_found"
+	CodeEmptyPasswords     ErrorCode = "empty_passwords"
+	CodeWrongPassword      ErrorCode = "wrong_password"
+
+	CodeTwoFactorEnabled     ErrorCode = "two_factor_enabled"
+	CodeTwoFactorDisabled    ErrorCode = "two_factor_disabled"
+	CodeTwoFactorNotEnrolled ErrorCode = "two_factor_not_enrolled"
+	CodeInvalidCode          ErrorCode = "invalid_code"
+	CodeEmptyChallenge       ErrorCode = "empty_challenge"
+	CodeInvalidChallenge     ErrorCode = "invalid_challenge"
+
+	CodeEmptyExpression       ErrorCode = "empty_expression"
+	CodeInvalidExpression     ErrorCode = "invalid_expression"
+	CodeInvalidPriority       ErrorCode = "invalid_priority"
+	CodeInvalidDeadline       ErrorCode = "invalid_deadline"
+	CodeIdempotencyKeyTooLong ErrorCode = "idempotency_key_too_long"
+	CodeIdempotencyKeyReused  ErrorCode = "idempotency_key_reused"
+	CodeInvalidExpressionID   ErrorCode = "invalid_expression_id"
+	CodeExpressionNotFound    ErrorCode = "expression_not_found"
+	CodeExpressionFinished    ErrorCode = "expression_finished"
+
+	// Per-user limits, see Limits.
+	CodeRateLimited              ErrorCode = "rate_limited"
+	CodeTooManyActiveExpressions ErrorCode = "too_many_active_expressions"
+	CodeTooManyTasks             ErrorCode = "too_many_tasks"
+	CodeDailyQuotaExceeded       ErrorCode = "daily_quota_exceeded"
+
+	CodeProviderUnavailable ErrorCode = "oidc_provider_unavailable"
+	CodeProviderError       ErrorCode = "oidc_provider_error"
+	CodeMissingCodeOrState  ErrorCode = "oidc_missing_code_or_state"
+	CodeInvalidState        ErrorCode = "oidc_invalid_state"
+	CodeCodeExchangeFailed  ErrorCode = "oidc_code_exchange_failed"
+	CodeInvalidIDToken      ErrorCode = "oidc_invalid_id_token"
+)
+
+// ErrorResponse is the body of every error answer of the HTTP API.
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+type APIError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// Details carry the values the message is built from, e.g. the
+	// expression ID or the violated password rules.
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// writeError answers with the error envelope. The message is taken from the
+// catalog for the language of the request, see requestLanguage.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code ErrorCode, details map[string]any) {
+	lang := requestLanguage(r)
+	resp := ErrorResponse{Error: APIError{
+		Code:    code,
+		Message: localize(lang, code, details),
+		Details: details,
+	}}
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Language", lang)
+	w.Header().Add("Vary", "Accept-Language")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// localize fills the {name} placeholders of the catalog message with details.
+// Unknown codes fall back to the code itself.
+func localize(lang string, code ErrorCode, details map[string]any) string {
+	msg, ok := messageCatalogs[lang][code]
+	if !ok {
+		return string(code)
+	}
+	for name, value := range details {
+		placeholder := "{" + name + "}"
+		if !strings.Contains(msg, placeholder) {
+			continue
+		}
+		var text string
+		switch v := value.(type) {
+		case []string:
+			text = strings.Join(v, ", ")
+		default:
+			text = fmt.Sprint(v)
+		}
+		msg = strings.ReplaceAll(msg, placeholder, text)
+	}
+	return msg
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, map[string]any{"method": r.Method})
+}
+
+func internalError(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusInternalServerError, CodeInternal, nil)
+}
+
+func invalidJSON(w http.ResponseWriter, r *http.Request, err error) {
+	writeError(w, r, http.StatusBadRequest, CodeInvalidJSON, map[string]any{"reason": err.Error()})
+}
+
+// weakPassword reports the rules from a PasswordPolicyError.
+func weakPassword(w http.ResponseWriter, r *http.Request, err error) {
+	violations := []string{err.Error()}
+	var policyErr *PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		violations = policyErr.Violations
+	}
+	writeError(w, r, http.StatusBadRequest, CodeWeakPassword, map[string]any{"violations": violations})
+}
@@ -0,0 +1,68 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMessageCatalogsMatchOpenAPI(t *testing.T) {
+	doc, err := LoadOpenAPI()
+	if err != nil {
+		t.Fatalf("LoadOpenAPI: %v", err)
+	}
+	codes := doc.Components.Schemas["ErrorResponse"].Value.Properties["error"].Value.Properties["code"].Value.Enum
+	if len(codes) == 0 {
+		t.Fatal("ErrorResponse in the OpenAPI document lists no codes")
+	}
+
+	for _, lang := range supportedLanguages {
+		catalog := messageCatalogs[lang]
+		if len(catalog) != len(codes) {
+			t.Errorf("catalog %q has %d messages, the OpenAPI document lists %d codes", lang, len(catalog), len(codes))
+		}
+		for _, code := range codes {
+			if catalog[ErrorCode(code.(string))] == "" {
+				t.Errorf("catalog %q has no message for %q", lang, code)
+			}
+		}
+	}
+}
+
+func TestErrorLocalization(t *testing.T) {
+	h := setupHandlers(t)
+	registerAndLogin(t, h, "taken", "pass123")
+
+	tests := []struct {
+		acceptLanguage string
+		lang           string
+		message        string
+	}{
+		{"", langRussian, "Пользователь 'taken' уже существует"},
+		{"en-US,en;q=0.9", langEnglish, "User 'taken' already exists"},
+		{"de-DE, ru;q=0.5, en;q=0.8", langEnglish, "User 'taken' already exists"},
+		{"fr", langRussian, "Пользователь 'taken' уже существует"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/register", strings.NewReader(`{"login":"taken","password":"pass123"}`))
+		req.Header.Set("Accept-Language", tt.acceptLanguage)
+		rec := httptest.NewRecorder()
+		h.RegisterHandler(rec, req)
+
+		if rec.Code != http.StatusConflict {
+			t.Fatalf("Accept-Language %q: expected %d, got %d", tt.acceptLanguage, http.StatusConflict, rec.Code)
+		}
+		if got := rec.Header().Get("Content-Language"); got != tt.lang {
+			t.Errorf("Accept-Language %q: expected Content-Language %q, got %q", tt.acceptLanguage, tt.lang, got)
+		}
+		var resp ErrorResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("decode error: %v", err)
+		}
+		if resp.Error.Code != CodeUserExists || resp.Error.Message != tt.message || resp.Error.Details["login"] != "taken" {
+			t.Errorf("Accept-Language %q: unexpected error %+v", tt.acceptLanguage, resp.Error)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package orchestrator
+
+import (
+	"sync"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/internal/constants"
+	"github.com/atadzan/dist-arith-go/internal/models"
+)
+
+// Progress counts the operations of the planning tree of an expression
+// that are computed.
+type Progress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+// Estimate is the progress of an expression and when it will be done.
+type Estimate struct {
+	Progress Progress
+	// ETA is nil for finished expressions and while no worker is live.
+	ETA *time.Time
+}
+
+// workerTracker remembers when workers last polled for tasks or reported
+// results.
+type workerTracker struct {
+	// window is how long a worker counts as live after its last call.
+	window time.Duration
+
+	mx       sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+func newWorkerTracker(window time.Duration) *workerTracker {
+	return &workerTracker{window: window, lastSeen: make(map[string]time.Time)}
+}
+
+func (t *workerTracker) seen(workerID string, now time.Time) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.lastSeen[workerID] = now
+}
+
+// live returns the number of workers seen within the window and forgets
+// the others.
+func (t *workerTracker) live(now time.Time) int {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	for workerID, seen := range t.lastSeen {
+		if now.Sub(seen) > t.window {
+			delete(t.lastSeen, workerID)
+		}
+	}
+	return len(t.lastSeen)
+}
+
+// workerSeen records a call of a worker. Workers sharing a token, like the
+// goroutines of a worker process, are told apart by the ID they report.
+func (s *Scheduler) workerSeen(identity, reportedID string) {
+	if identity != reportedID {
+		identity += "/" + reportedID
+	}
+	s.workers.seen(identity, time.Now())
+}
+
+// Estimate returns the progress of expr with its tasks and its ETA at the
+// time now. The remaining time is the longer of the critical path of the
+// unfinished operations and their total time shared by the live workers, so
+// it is a lower bound that ignores tasks of other expressions in the queue.
+// Operations answered from the cache count as computed, useCache as in Trace.
+func (s *Scheduler) Estimate(expr models.Expression, tasks []models.Task, useCache bool, now time.Time) Estimate {
+	var traces []TaskTrace
+	_, ast, nodes := s.traceTree(expr, tasks, useCache, &traces)
+	if ast == nil {
+		return Estimate{}
+	}
+	tasksByID := make(map[int64]models.Task, len(tasks))
+	for _, task := range tasks {
+		tasksByID[task.ID] = task
+	}
+
+	var estimate Estimate
+	var work time.Duration
+	criticalPath := s.remaining(ast, nodes.tasks, tasksByID, now, &work, &estimate.Progress)
+
+	if expr.Status == constants.StatusPending || expr.Status == constants.StatusInProgress {
+		if workers := s.workers.live(now); workers > 0 {
+			eta := now.Add(max(criticalPath, work/time.Duration(workers)))
+			estimate.ETA = &eta
+		}
+	}
+	return estimate
+}
+
+// remaining returns the time until n is computed if its operations run as
+// soon as their operands are known, adds the time of its unfinished
+// operations to work and counts them in progress.
+func (s *Scheduler) remaining(n *Node, nodeTasks map[*Node]int64, tasks map[int64]models.Task, now time.Time, work *time.Duration, progress *Progress) time.Duration {
+	if n == nil || n.Op == "" {
+		return 0
+	}
+	progress.Total++
+	left := s.remaining(n.Left, nodeTasks, tasks, now, work, progress)
+	right := s.remaining(n.Right, nodeTasks, tasks, now, work, progress)
+	if n.Value != nil {
+		progress.Done++
+		return 0
+	}
+
+	own := time.Duration(s.opTimes.forOperation(n.Op)) * time.Millisecond
+	if taskID, ok := nodeTasks[n]; ok {
+		if task := tasks[taskID]; task.Status == constants.StatusInProgress && task.LeasedAt.Valid {
+			own = max(own-now.Sub(task.LeasedAt.Time), 0)
+		}
+	}
+	*work += own
+	return max(left, right) + own
+}
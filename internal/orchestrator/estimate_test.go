@@ -0,0 +1,170 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/internal/repository"
+)
+
+func TestWorkerTracker(t *testing.T) {
+	tracker := newWorkerTracker(30 * time.Second)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tracker.seen("a", now)
+	tracker.seen("b", now.Add(20*time.Second))
+	tracker.seen("a", now.Add(10*time.Second))
+
+	if live := tracker.live(now.Add(30 * time.Second)); live != 2 {
+		t.Errorf("expected 2 live workers, got %d", live)
+	}
+	if live := tracker.live(now.Add(45 * time.Second)); live != 1 {
+		t.Errorf("expected only the worker seen last to be live, got %d", live)
+	}
+}
+
+func TestWorkersSharingToken(t *testing.T) {
+	h := setupHandlers(t)
+	// Two processes with the same token run a goroutine with the same number.
+	h.scheduler.workerSeen("shared", "worker-0@host-1")
+	h.scheduler.workerSeen("shared", "worker-0@host-2")
+	h.scheduler.workerSeen("shared", "worker-0@host-1")
+	if live := h.scheduler.workers.live(time.Now()); live != 2 {
+		t.Errorf("expected 2 live workers, got %d", live)
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	h, handler, _ := setupLimitedHandlers(t, NewLimits())
+	token := registerAndLogin(t, h, "impatient", "pass123")
+	userID, _ := h.auth.ValidateJWT(token)
+	h.repo.SetResultCacheDisabled(userID, true)
+	*h.scheduler.opTimes = OperationTimes{Addition: 1000, Subtraction: 1000, Multiplication: 2000, Division: 2000}
+
+	const expression = "(1+2)*(3+4)"
+	exprID, _ := h.repo.CreateExpression(userID, expression)
+	if err := h.scheduler.ScheduleTasks(context.Background(), exprID, expression); err != nil {
+		t.Fatalf("ScheduleTasks error: %v", err)
+	}
+	estimate := func(now time.Time) Estimate {
+		t.Helper()
+		expr, _ := h.repo.GetExpressionByIDInternal(exprID)
+		tasks, err := h.repo.GetAllTasksForExpression(exprID)
+		if err != nil {
+			t.Fatalf("GetAllTasksForExpression error: %v", err)
+		}
+		return h.scheduler.Estimate(*expr, tasks, false, now)
+	}
+
+	now := time.Now()
+	if e := estimate(now); e.Progress != (Progress{Done: 0, Total: 3}) || e.ETA != nil {
+		t.Fatalf("expected no ETA without workers, got %+v", e)
+	}
+
+	// One worker computes the two sums and the product one after another,
+	// two workers compute the sums in parallel.
+	h.scheduler.workers.seen("w1", now)
+	if e := estimate(now); e.ETA == nil || !e.ETA.Equal(now.Add(4*time.Second)) {
+		t.Errorf("one worker: expected ETA in 4s, got %+v", e)
+	}
+	h.scheduler.workers.seen("w2", now)
+	if e := estimate(now); e.ETA == nil || !e.ETA.Equal(now.Add(3*time.Second)) {
+		t.Errorf("two workers: expected ETA in 3s, got %+v", e)
+	}
+
+	// The time a leased task has already run is subtracted.
+	sum, _ := h.repo.GetAndLeasePendingTask("w1")
+	leased, _ := h.repo.GetTaskByID(sum.ID)
+	at := leased.LeasedAt.Time.Add(400 * time.Millisecond)
+	h.scheduler.workers.seen("w1", at)
+	h.scheduler.workers.seen("w2", at)
+	if e := estimate(at); e.ETA == nil || !e.ETA.Equal(at.Add(3*time.Second)) {
+		t.Errorf("leased sum: expected ETA in 3s, got %+v", e)
+	}
+	if err := h.repo.CompleteTask(sum.ID, "w1", sum.LeaseToken, 3); err != nil {
+		t.Fatalf("CompleteTask error: %v", err)
+	}
+	h.scheduler.ProcessTaskCompletion(context.Background(), sum.ID)
+	if e := estimate(at); e.Progress != (Progress{Done: 1, Total: 3}) || e.ETA == nil || !e.ETA.Equal(at.Add(3*time.Second)) {
+		t.Errorf("computed sum: expected 1 of 3 done and ETA in 3s, got %+v", e)
+	}
+
+	computePending(t, h)
+	rec := serveJSON(handler, http.MethodGet, "/api/v2/expressions/"+strconv.FormatInt(exprID, 10), "", token)
+	var resp ExpressionResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if resp.Progress != (Progress{Done: 3, Total: 3}) || resp.ETA != nil {
+		t.Errorf("expected a done expression without ETA, got %+v", resp)
+	}
+}
+
+func TestEstimateCountsCachedOperations(t *testing.T) {
+	h, handler, _ := setupLimitedHandlers(t, NewLimits())
+	token := registerAndLogin(t, h, "thrifty", "pass123")
+	userID, _ := h.auth.ValidateJWT(token)
+	*h.scheduler.opTimes = OperationTimes{Addition: 1000, Subtraction: 1000, Multiplication: 2000, Division: 2000}
+	h.scheduler.results = newResultCache[resultCacheKey](100, time.Minute)
+	h.scheduler.results.put(newResultCacheKey("+", 1, 2), 3)
+	h.scheduler.workers.seen("w1", time.Now())
+
+	// 1+2 is answered from the cache, leaving 3+4 and the product to the
+	// worker.
+	const expression = "(1+2)*(3+4)"
+	exprID, _, _ := h.repo.CreateExpressionWithOptions(userID, expression, repository.ExpressionOptions{Operations: 3})
+	if err := h.scheduler.ScheduleTasks(context.Background(), exprID, expression); err != nil {
+		t.Fatalf("ScheduleTasks error: %v", err)
+	}
+	list := func() ExpressionResponse {
+		t.Helper()
+		rec := serveJSON(handler, http.MethodGet, "/api/v2/expressions", "", token)
+		var resp []ExpressionResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || len(resp) != 1 {
+			t.Fatalf("expected the expression, got %d: %s", rec.Code, rec.Body.String())
+		}
+		return resp[0]
+	}
+	before := time.Now()
+	if resp := list(); resp.Progress != (Progress{Done: 1, Total: 3}) || resp.ETA == nil || resp.ETA.After(time.Now().Add(3*time.Second)) || resp.ETA.Before(before.Add(3*time.Second)) {
+		t.Errorf("expected 1 of 3 done and ETA in 3s, got %+v", resp)
+	}
+
+	computePending(t, h)
+	if resp := list(); resp.Progress != (Progress{Done: 3, Total: 3}) || resp.ETA != nil {
+		t.Errorf("expected a done expression without ETA, got %+v", resp)
+	}
+}
+
+func TestListProgressOfFinishedExpressions(t *testing.T) {
+	h, handler, _ := setupLimitedHandlers(t, NewLimits())
+	token := registerAndLogin(t, h, "quitter", "pass123")
+	userID, _ := h.auth.ValidateJWT(token)
+	h.repo.SetResultCacheDisabled(userID, true)
+
+	const expression = "(1+2)*(3+4)"
+	exprID, _, _ := h.repo.CreateExpressionWithOptions(userID, expression, repository.ExpressionOptions{Operations: 3})
+	if err := h.scheduler.ScheduleTasks(context.Background(), exprID, expression); err != nil {
+		t.Fatalf("ScheduleTasks error: %v", err)
+	}
+	sum, _ := h.repo.GetAndLeasePendingTask("w1")
+	if err := h.repo.CompleteTask(sum.ID, "w1", sum.LeaseToken, sum.Arg1+sum.Arg2); err != nil {
+		t.Fatalf("CompleteTask error: %v", err)
+	}
+	h.scheduler.ProcessTaskCompletion(context.Background(), sum.ID)
+	if cancelled, err := h.repo.CancelExpression(exprID, userID); err != nil || !cancelled {
+		t.Fatalf("CancelExpression = %v, %v", cancelled, err)
+	}
+
+	rec := serveJSON(handler, http.MethodGet, "/api/v2/expressions", "", token)
+	var resp []ExpressionResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || len(resp) != 1 {
+		t.Fatalf("expected the expression, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if resp[0].Progress != (Progress{Done: 1, Total: 3}) || resp[0].ETA != nil {
+		t.Errorf("expected a cancelled expression with 1 of 3 done, got %+v", resp[0])
+	}
+}
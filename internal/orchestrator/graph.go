@@ -0,0 +1,213 @@
+package orchestrator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/internal/constants"
+	"github.com/atadzan/dist-arith-go/internal/models"
+)
+
+// Graph formats served by GET /expressions/{id}/graph.
+const (
+	graphFormatJSON    = "json"
+	graphFormatDOT     = "dot"
+	graphFormatMermaid = "mermaid"
+)
+
+// States of graph nodes besides the task statuses.
+const (
+	graphNodeNumber  = "number"
+	graphNodeWaiting = "waiting"
+	graphNodeCached  = "cached"
+)
+
+// graphColors are the fill colors of the node states; stuck nodes are
+// drawn in graphStuckColor and states missing here in graphUnknownColor.
+var graphColors = map[string]string{
+	graphNodeNumber:            "#ffffff",
+	graphNodeWaiting:           "#eeeeee",
+	graphNodeCached:            "#d0f0c0",
+	constants.StatusPending:    "#add8e6",
+	constants.StatusInProgress: "#ffd700",
+	constants.StatusDone:       "#98fb98",
+	constants.StatusCancelled:  "#c0c0c0",
+	constants.StatusExpired:    "#deb887",
+}
+
+const (
+	graphStuckColor   = "#ff6347"
+	graphStuckBorder  = "#b22222"
+	graphUnknownColor = "#ff00ff"
+)
+
+// ExpressionGraph is the tree the tasks of an expression are planned from,
+// see Scheduler.planningTree, with the task of every operation.
+type ExpressionGraph struct {
+	ID         int64       `json:"id"`
+	Expression string      `json:"expression"`
+	Status     string      `json:"status"`
+	Nodes      []GraphNode `json:"nodes"`
+	// Edges lead from operations to their operands.
+	Edges []GraphEdge `json:"edges"`
+}
+
+type GraphNode struct {
+	ID string `json:"id"`
+	// Label is the operation or the number.
+	Label string `json:"label"`
+	// Status is number, waiting for operands or for its task to be
+	// created, cached for operations answered from the result cache, or the
+	// status of the task.
+	Status string `json:"status"`
+	// Stuck marks unfinished tasks that were retried or whose lease has
+	// expired.
+	Stuck bool       `json:"stuck"`
+	Color string     `json:"color"`
+	Value *float64   `json:"value"`
+	Task  *TaskTrace `json:"task"`
+}
+
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Graph returns the graph of expr with its tasks at the time now, useCache
+// as in Trace. An expression that can't be parsed has no nodes.
+func (s *Scheduler) Graph(expr models.Expression, tasks []models.Task, useCache bool, now time.Time) ExpressionGraph {
+	graph := ExpressionGraph{
+		ID:         expr.ID,
+		Expression: expr.Expression,
+		Status:     expr.Status,
+		Nodes:      []GraphNode{},
+		Edges:      []GraphEdge{},
+	}
+
+	var traces []TaskTrace
+	_, ast, nodes := s.traceTree(expr, tasks, useCache, &traces)
+	if ast == nil {
+		return graph
+	}
+	tracesByID := make(map[int64]*TaskTrace, len(traces))
+	for i := range traces {
+		tracesByID[traces[i].ID] = &traces[i]
+	}
+
+	var add func(n *Node) string
+	add = func(n *Node) string {
+		node := GraphNode{ID: "n" + strconv.Itoa(len(graph.Nodes)), Value: n.Value}
+		graph.Nodes = append(graph.Nodes, node)
+		i := len(graph.Nodes) - 1
+
+		switch taskID, ok := nodes.tasks[n]; {
+		case n.Op == "":
+			node.Label, node.Status = fmt.Sprintf("%v", *n.Value), graphNodeNumber
+		case ok:
+			node.Label, node.Task = n.Op, tracesByID[taskID]
+			node.Status = node.Task.Status
+			node.Stuck = s.stuck(node.Task, now)
+		case nodes.cached[n]:
+			node.Label, node.Status = n.Op, graphNodeCached
+		default:
+			node.Label, node.Status = n.Op, graphNodeWaiting
+		}
+		node.Color = graphColors[node.Status]
+		if node.Color == "" {
+			node.Color = graphUnknownColor
+		}
+		if node.Stuck {
+			node.Color = graphStuckColor
+		}
+		graph.Nodes[i] = node
+
+		if n.Op != "" {
+			for _, operand := range []*Node{n.Left, n.Right} {
+				graph.Edges = append(graph.Edges, GraphEdge{From: node.ID, To: add(operand)})
+			}
+		}
+		return node.ID
+	}
+	add(ast)
+	return graph
+}
+
+// stuck reports whether an unfinished task was retried or is leased for
+// longer than the lease timeout.
+func (s *Scheduler) stuck(task *TaskTrace, now time.Time) bool {
+	switch task.Status {
+	case constants.StatusPending:
+		return task.Retries > 0
+	case constants.StatusInProgress:
+		return task.Retries > 0 || (task.LeasedAt != nil && now.Sub(*task.LeasedAt) > s.leaseTimeout)
+	}
+	return false
+}
+
+// lines returns the label of the node in the DOT and Mermaid formats.
+func (n GraphNode) lines() []string {
+	lines := []string{n.Label}
+	if n.Task != nil {
+		lines = append(lines, fmt.Sprintf("task %d: %s", n.Task.ID, n.Task.Status))
+		if n.Task.Result != nil {
+			lines = append(lines, fmt.Sprintf("= %v", *n.Task.Result))
+		}
+		if n.Task.WorkerID != "" {
+			lines = append(lines, "worker "+n.Task.WorkerID)
+		}
+		switch {
+		case n.Task.LeasedAt != nil && n.Task.CompletedAt != nil:
+			lines = append(lines, "took "+n.Task.CompletedAt.Sub(*n.Task.LeasedAt).String())
+		case n.Task.LeasedAt != nil:
+			lines = append(lines, "leased at "+n.Task.LeasedAt.UTC().Format("15:04:05.000"))
+		}
+		if n.Task.Retries > 0 {
+			lines = append(lines, fmt.Sprintf("retries %d", n.Task.Retries))
+		}
+	} else if n.Status != graphNodeNumber {
+		lines = append(lines, n.Status)
+	}
+	return lines
+}
+
+// DOT renders the graph for Graphviz.
+func (g ExpressionGraph) DOT() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %s {\n", strconv.Quote(fmt.Sprintf("expression %d", g.ID)))
+	b.WriteString("\tnode [shape=box, style=\"rounded,filled\"];\n")
+	for _, n := range g.Nodes {
+		fmt.Fprintf(&b, "\t%s [label=%s, fillcolor=%q", n.ID, strconv.Quote(strings.Join(n.lines(), "\n")), n.Color)
+		if n.Stuck {
+			fmt.Fprintf(&b, ", color=%q, penwidth=3", graphStuckBorder)
+		}
+		b.WriteString("];\n")
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(&b, "\t%s -> %s;\n", e.From, e.To)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Mermaid renders the graph as a Mermaid flowchart.
+func (g ExpressionGraph) Mermaid() string {
+	var b strings.Builder
+	b.WriteString("flowchart TD\n")
+	for _, n := range g.Nodes {
+		label := strings.ReplaceAll(strings.Join(n.lines(), "<br/>"), `"`, "#quot;")
+		fmt.Fprintf(&b, "\t%s[\"%s\"]\n", n.ID, label)
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(&b, "\t%s --> %s\n", e.From, e.To)
+	}
+	for _, n := range g.Nodes {
+		fmt.Fprintf(&b, "\tstyle %s fill:%s", n.ID, n.Color)
+		if n.Stuck {
+			fmt.Fprintf(&b, ",stroke:%s,stroke-width:3px", graphStuckBorder)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,179 @@
+package orchestrator
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/internal/constants"
+	"github.com/atadzan/dist-arith-go/internal/repository"
+)
+
+func TestExpressionGraph(t *testing.T) {
+	h, handler, _ := setupLimitedHandlers(t, NewLimits())
+	token := registerAndLogin(t, h, "drawn", "pass123")
+	userID, _ := h.auth.ValidateJWT(token)
+	h.repo.SetResultCacheDisabled(userID, true)
+
+	const expression = "(1+2)*(3+4)"
+	exprID, _ := h.repo.CreateExpression(userID, expression)
+	if err := h.scheduler.ScheduleTasks(context.Background(), exprID, expression); err != nil {
+		t.Fatalf("ScheduleTasks error: %v", err)
+	}
+	// 1+2 is computed, 3+4 fails once and goes back to the queue.
+	sum, _ := h.repo.GetAndLeasePendingTask("w1")
+	if err := h.repo.CompleteTask(sum.ID, "w1", sum.LeaseToken, 3); err != nil {
+		t.Fatalf("CompleteTask error: %v", err)
+	}
+	h.scheduler.ProcessTaskCompletion(context.Background(), sum.ID)
+	failed, _ := h.repo.GetAndLeasePendingTask("w2")
+	if err := h.repo.FailTask(failed.ID, "w2", failed.LeaseToken); err != nil {
+		t.Fatalf("FailTask error: %v", err)
+	}
+
+	graphPath := "/api/v2/expressions/" + strconv.FormatInt(exprID, 10) + "/graph"
+	rec := serveJSON(handler, http.MethodGet, graphPath, "", token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var graph ExpressionGraph
+	if err := json.NewDecoder(rec.Body).Decode(&graph); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+
+	want := []struct {
+		label, status string
+		stuck         bool
+	}{
+		{"*", graphNodeWaiting, false},
+		{"+", constants.StatusDone, false},
+		{"1", graphNodeNumber, false},
+		{"2", graphNodeNumber, false},
+		{"+", constants.StatusPending, true},
+		{"3", graphNodeNumber, false},
+		{"4", graphNodeNumber, false},
+	}
+	if len(graph.Nodes) != len(want) || len(graph.Edges) != len(want)-1 {
+		t.Fatalf("expected %d nodes of a tree, got %+v", len(want), graph)
+	}
+	for i, w := range want {
+		n := graph.Nodes[i]
+		if n.Label != w.label || n.Status != w.status || n.Stuck != w.stuck {
+			t.Errorf("node %d: expected %s %s (stuck %v), got %+v", i, w.label, w.status, w.stuck, n)
+		}
+	}
+	if done := graph.Nodes[1]; done.Task == nil || done.Task.WorkerID != "w1" || done.Value == nil || *done.Value != 3 || done.Color != graphColors[constants.StatusDone] {
+		t.Errorf("expected the computed sum with its task, got %+v", done)
+	}
+	if stuck := graph.Nodes[4]; stuck.Color != graphStuckColor || stuck.Task.Retries != 1 {
+		t.Errorf("expected the retried sum to stand out, got %+v", stuck)
+	}
+
+	rec = serveJSON(handler, http.MethodGet, graphPath+"?format=dot", "", token)
+	if dot := rec.Body.String(); rec.Code != http.StatusOK || !strings.HasPrefix(dot, `digraph "expression `) ||
+		!strings.Contains(dot, `n1 [label="+\ntask 1: done\n= 3\nworker w1\ntook `) ||
+		!strings.Contains(dot, `fillcolor="#ff6347", color="#b22222", penwidth=3];`) || !strings.Contains(dot, "n0 -> n4;") {
+		t.Errorf("unexpected DOT output %d:\n%s", rec.Code, dot)
+	}
+	rec = serveJSON(handler, http.MethodGet, graphPath+"?format=mermaid", "", token)
+	if mermaid := rec.Body.String(); rec.Code != http.StatusOK || !strings.HasPrefix(mermaid, "flowchart TD\n") ||
+		!strings.Contains(mermaid, `n0["*<br/>waiting"]`) || !strings.Contains(mermaid, "n0 --> n1") ||
+		!strings.Contains(mermaid, "style n4 fill:#ff6347,stroke:#b22222,stroke-width:3px") {
+		t.Errorf("unexpected Mermaid output %d:\n%s", rec.Code, mermaid)
+	}
+	if rec = serveJSON(handler, http.MethodGet, graphPath+"?format=svg", "", token); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), string(CodeInvalidParameter)) {
+		t.Errorf("expected %s for an unknown format, got %d: %s", CodeInvalidParameter, rec.Code, rec.Body.String())
+	}
+}
+
+func TestGraphMarksExpiredLeases(t *testing.T) {
+	h := setupHandlers(t)
+	leasedAt := time.Now().Add(-2 * h.scheduler.leaseTimeout)
+	task := &TaskTrace{Status: constants.StatusInProgress, LeasedAt: &leasedAt}
+	if !h.scheduler.stuck(task, time.Now()) {
+		t.Errorf("expected a task leased for twice the lease timeout to be stuck")
+	}
+	if h.scheduler.stuck(task, leasedAt.Add(time.Second)) {
+		t.Errorf("expected a fresh lease not to be stuck")
+	}
+}
+
+func TestGraphOfExpiredExpression(t *testing.T) {
+	h := setupHandlers(t)
+	uid, _ := h.repo.CreateUser("late", "h")
+	h.repo.SetResultCacheDisabled(uid, true)
+
+	const expression = "1+2"
+	exprID, _, _ := h.repo.CreateExpressionWithOptions(uid, expression, repository.ExpressionOptions{
+		Deadline: sql.NullTime{Time: time.Now().Add(-time.Second), Valid: true},
+	})
+	if err := h.scheduler.ScheduleTasks(context.Background(), exprID, expression); err != nil {
+		t.Fatalf("ScheduleTasks error: %v", err)
+	}
+	if expired, err := h.repo.ExpireOverdueExpressions(); err != nil || expired != 1 {
+		t.Fatalf("ExpireOverdueExpressions = %d, %v; expected 1", expired, err)
+	}
+
+	expr, _ := h.repo.GetExpressionByIDInternal(exprID)
+	tasks, _ := h.repo.GetAllTasksForExpression(exprID)
+	graph := h.scheduler.Graph(*expr, tasks, false, time.Now())
+	if sum := graph.Nodes[0]; sum.Status != constants.StatusExpired || sum.Color != graphColors[constants.StatusExpired] || sum.Stuck {
+		t.Errorf("expected the expired sum in its own color, got %+v", sum)
+	}
+	for _, n := range graph.Nodes {
+		if n.Color == "" {
+			t.Errorf("node %s has no color", n.ID)
+		}
+	}
+	if dot := graph.DOT(); !strings.Contains(dot, `fillcolor="#deb887"`) {
+		t.Errorf("unexpected DOT output:\n%s", dot)
+	}
+}
+
+func TestGraphResolvesCachedOperations(t *testing.T) {
+	h := setupHandlers(t)
+	uid, _ := h.repo.CreateUser("reused", "h")
+	h.scheduler.results = newResultCache[resultCacheKey](100, time.Minute)
+	h.scheduler.results.put(newResultCacheKey("+", 1, 2), 3)
+
+	const expression = "(1+2)*5"
+	graph := func(exprID int64) ExpressionGraph {
+		t.Helper()
+		expr, _ := h.repo.GetExpressionByIDInternal(exprID)
+		tasks, _ := h.repo.GetAllTasksForExpression(exprID)
+		return h.scheduler.Graph(*expr, tasks, true, time.Now())
+	}
+	expectNodes := func(g ExpressionGraph, product, sum string) {
+		t.Helper()
+		if g.Nodes[0].Status != product || g.Nodes[0].Task == nil || g.Nodes[1].Status != sum || g.Nodes[1].Task != nil ||
+			g.Nodes[1].Value == nil || *g.Nodes[1].Value != 3 {
+			t.Errorf("expected the product %s with its task and the sum %s, got %+v", product, sum, g.Nodes)
+		}
+	}
+
+	// 1+2 is answered from the cache, only the product goes to a worker.
+	exprID, _ := h.repo.CreateExpression(uid, expression)
+	if err := h.scheduler.ScheduleTasks(context.Background(), exprID, expression); err != nil {
+		t.Fatalf("ScheduleTasks error: %v", err)
+	}
+	expectNodes(graph(exprID), constants.StatusPending, graphNodeCached)
+	computePending(t, h)
+	expectDone(t, h, exprID, 15)
+	expectNodes(graph(exprID), constants.StatusDone, graphNodeCached)
+
+	// The whole expression is answered from the cache, without tasks.
+	exprID, n := scheduleAndCompute(t, h, uid, expression)
+	if n != 0 {
+		t.Fatalf("expected no tasks, got %d", n)
+	}
+	for _, node := range graph(exprID).Nodes {
+		if node.Status != graphNodeNumber && node.Status != graphNodeCached {
+			t.Errorf("expected cached operations, got %+v", node)
+		}
+	}
+}
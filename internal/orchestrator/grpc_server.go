@@ -2,13 +2,23 @@ package orchestrator
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
 
+	"github.com/atadzan/dist-arith-go/internal/constants"
+	"github.com/atadzan/dist-arith-go/internal/logging"
+	"github.com/atadzan/dist-arith-go/internal/models"
 	"github.com/atadzan/dist-arith-go/internal/repository"
+	"github.com/atadzan/dist-arith-go/internal/tracing"
 
 	pb "github.com/atadzan/dist-arith-go/internal/worker/grpc/calc"
 
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
@@ -17,27 +27,34 @@ type grpcServer struct {
 	repo      repository.Repository
 	opTimes   *OperationTimes
 	scheduler *Scheduler
+	metrics   *Metrics
+	logger    *slog.Logger
 }
 
-func NewCalculatorGRPCServer(repo repository.Repository, opTimes *OperationTimes, scheduler *Scheduler) *grpcServer {
+func NewCalculatorGRPCServer(repo repository.Repository, opTimes *OperationTimes, scheduler *Scheduler, metrics *Metrics, logger *slog.Logger) *grpcServer {
 	return &grpcServer{
 		repo:      repo,
 		opTimes:   opTimes,
 		scheduler: scheduler,
+		metrics:   metrics,
+		logger:    logger.With("component", "grpc"),
 	}
 }
 
 func (s *grpcServer) GetTask(ctx context.Context, req *pb.GetTaskRequest) (*pb.GetTaskResponse, error) {
-	log.Printf("gRPC: Get task from worker: %s", req.GetWorkerId())
+	identity := workerIdentity(ctx, req.GetWorkerId())
+	s.scheduler.workerSeen(identity, req.GetWorkerId())
+	ctx = logging.With(ctx, logging.WorkerIDKey, identity)
+	s.logger.DebugContext(ctx, "worker polls for a task", "reported_worker_id", req.GetWorkerId())
 
-	task, err := s.repo.GetAndLeasePendingTask()
+	task, err := s.repo.GetAndLeasePendingTask(identity)
 	if err != nil {
-		log.Printf("gRPC: can't get tasks from DB: %v", err)
+		s.logger.ErrorContext(ctx, "can't lease task", "error", err)
 		return nil, status.Errorf(codes.Internal, "task fetch error: %v", err)
 	}
 
 	if task == nil {
-		log.Println("gRPC: no available tasks for worker")
+		s.logger.DebugContext(ctx, "no tasks available")
 		return &pb.GetTaskResponse{
 			TaskInfo: &pb.GetTaskResponse_NoTask{
 				NoTask: &pb.NoTaskAvailable{
@@ -47,7 +64,10 @@ func (s *grpcServer) GetTask(ctx context.Context, req *pb.GetTaskRequest) (*pb.G
 		}, nil
 	}
 
-	log.Printf("gRPC: Sending task %d to worker %s", task.ID, req.GetWorkerId())
+	ctx = logging.With(ctx, logging.TaskIDKey, task.ID, logging.ExpressionIDKey, task.ExpressionID)
+	s.metrics.observeLeaseWait(task.Operation, task.CreatedAt)
+	s.traceLease(ctx, task, identity)
+	s.logger.InfoContext(ctx, "task leased", "operation", task.Operation, "retries", task.Retries)
 	return &pb.GetTaskResponse{
 		TaskInfo: &pb.GetTaskResponse_Task{
 			Task: &pb.Task{
@@ -56,43 +76,116 @@ func (s *grpcServer) GetTask(ctx context.Context, req *pb.GetTaskRequest) (*pb.G
 				Arg2:            task.Arg2,
 				Operation:       task.Operation,
 				OperationTimeMs: s.getOperationTimeMs(task.Operation),
+				LeaseToken:      task.LeaseToken,
 			},
 		},
 	}, nil
 }
 
 func (s *grpcServer) SubmitResult(ctx context.Context, req *pb.SubmitResultRequest) (*pb.SubmitResultResponse, error) {
-	log.Printf("gRPC: Received SubmitResult for task %d from worker: %s", req.TaskId, req.GetWorkerId())
-	var taskErr error
+	// The lease check is part of the conditional UPDATE in the repository, so
+	// stale, duplicate and foreign submissions can't race with each other.
+	identity := workerIdentity(ctx, req.GetWorkerId())
+	s.scheduler.workerSeen(identity, req.GetWorkerId())
+	ctx = logging.With(ctx, logging.WorkerIDKey, identity, logging.TaskIDKey, req.TaskId)
+
+	ctx, span := tracing.Tracer().Start(tracing.IncomingContext(ctx), "SubmitResult",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.Int64("task.id", req.TaskId), attribute.String("worker.id", identity)))
+	defer span.End()
+	var (
+		taskErr   error
+		completed bool
+	)
+
+	// Only needed for the execution time metric; a missing task is reported
+	// by the update below.
+	leased, err := s.repo.GetTaskByID(req.TaskId)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "can't get task", "error", err)
+	}
+	if leased != nil {
+		ctx = logging.With(ctx, logging.ExpressionIDKey, leased.ExpressionID)
+	}
 
 	switch result := req.ResultStatus.(type) {
 	case *pb.SubmitResultRequest_Result:
-		taskErr = s.repo.CompleteTask(req.TaskId, result.Result)
+		taskErr = s.repo.CompleteTask(req.TaskId, identity, req.GetLeaseToken(), result.Result)
 		if taskErr == nil {
-			log.Printf("gRPC: Task id %d completed in database", req.TaskId)
+			completed = true
+			s.logger.InfoContext(ctx, "task completed", "result", result.Result)
 		} else {
-			log.Printf("gRPC: occured error. TaskId %d, err: %v", req.TaskId, taskErr)
+			s.logger.WarnContext(ctx, "can't complete task", "error", taskErr)
 		}
 	case *pb.SubmitResultRequest_Error:
-		log.Printf("gRPC: TaskId %d finished with err: %s", req.TaskId, result.Error.Message)
-		taskErr = s.repo.FailTask(req.TaskId)
+		s.logger.WarnContext(ctx, "worker reported task error", "task_error", result.Error.Message)
+		taskErr = s.repo.FailTask(req.TaskId, identity, req.GetLeaseToken())
 		if taskErr != nil {
-			log.Printf("gRPC: occured error taskId %d, err: %v", req.TaskId, taskErr)
+			s.logger.WarnContext(ctx, "can't return task to the queue", "error", taskErr)
 		}
 	default:
-		log.Printf("gRPC: invalid task status %d", req.TaskId)
+		s.logger.WarnContext(ctx, "invalid task status")
 		return nil, status.Error(codes.InvalidArgument, "invalid task status")
 	}
 
+	if taskErr != nil {
+		span.SetStatus(otelcodes.Error, taskErr.Error())
+	}
+	if errors.Is(taskErr, repository.ErrStaleLease) {
+		return nil, status.Errorf(codes.FailedPrecondition, "task %d is not leased by worker %s with this lease token", req.TaskId, identity)
+	}
 	if taskErr != nil {
 		return nil, status.Errorf(codes.Internal, "occurred error: %v", taskErr)
 	}
 
-	go s.scheduler.ProcessTaskCompletion(req.TaskId)
+	if leased != nil && leased.LeasedAt.Valid {
+		outcome := constants.StatusDone
+		if !completed {
+			outcome = constants.StatusError
+		}
+		s.metrics.observeTaskExecution(leased.Operation, outcome, leased.LeasedAt.Time)
+	}
+	if !completed {
+		s.metrics.addRetries(retryReasonWorkerError, 1)
+	}
+
+	if completed {
+		go s.scheduler.ProcessTaskCompletion(context.WithoutCancel(ctx), req.TaskId)
+	}
 
 	return &pb.SubmitResultResponse{Acknowledged: true}, nil
 }
 
+// traceLease records the time the task spent in the queue and the hand-off
+// to the worker as part of the expression's trace, and sends the trace
+// context to the worker in the response header metadata.
+func (s *grpcServer) traceLease(ctx context.Context, task *models.Task, identity string) {
+	attrs := trace.WithAttributes(attribute.Int64("task.id", task.ID), attribute.String("task.operation", task.Operation))
+	taskCtx := tracing.Restore(ctx, task.TraceContext)
+
+	_, queued := tracing.Tracer().Start(taskCtx, "task.queued", trace.WithTimestamp(task.CreatedAt), attrs)
+	queued.End()
+
+	taskCtx, span := tracing.Tracer().Start(taskCtx, "GetTask", trace.WithSpanKind(trace.SpanKindServer), attrs,
+		trace.WithAttributes(attribute.String("worker.id", identity)))
+	defer span.End()
+
+	md := metadata.MD{}
+	tracing.InjectMetadata(taskCtx, md)
+	if err := grpc.SetHeader(ctx, md); err != nil {
+		s.logger.DebugContext(ctx, "can't send trace context", "error", err)
+	}
+}
+
+// workerIdentity prefers the name established by WorkerAuthenticator; when
+// authentication is disabled the self-reported worker ID is used instead.
+func workerIdentity(ctx context.Context, reportedID string) string {
+	if name, ok := WorkerIdentityFromContext(ctx); ok {
+		return name
+	}
+	return reportedID
+}
+
 func (s *grpcServer) getOperationTimeMs(op string) int32 {
 	var t int
 	switch op {
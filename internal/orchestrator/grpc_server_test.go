@@ -3,42 +3,35 @@ package orchestrator
 import (
 	"context"
 	"net"
-	"strings"
 	"testing"
 
+	"github.com/atadzan/dist-arith-go/internal/logging"
 	"github.com/atadzan/dist-arith-go/internal/repository"
-	db "github.com/atadzan/dist-arith-go/pkg/database"
+	"github.com/atadzan/dist-arith-go/internal/worker"
 
 	pb "github.com/atadzan/dist-arith-go/internal/worker/grpc/calc"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
 )
 
 const bufSize = 1024 * 1024
 
-func dialer() (*grpc.ClientConn, func(), error) {
+func dialer(t *testing.T, opts ...grpc.ServerOption) (*grpc.ClientConn, func(), error) {
+	conn, _, cleanup, err := dialerWithRepo(t, opts...)
+	return conn, cleanup, err
+}
+
+func dialerWithRepo(t *testing.T, opts ...grpc.ServerOption) (*grpc.ClientConn, repository.Repository, func(), error) {
+	t.Helper()
 	lis := bufconn.Listen(bufSize)
-	srv := grpc.NewServer()
-	dbConn, err := db.NewDBConn(":memory:")
-	if err != nil {
-		return nil, nil, err
-	}
-	repo, err := repository.New(dbConn)
-	if err != nil {
-		if strings.Contains(err.Error(), "requires cgo") {
-			return nil, nil, nil
-		}
-		return nil, nil, err
-	}
-	if _, err := repo.GetAndLeasePendingTask(); err != nil {
-		if strings.Contains(err.Error(), "requires cgo") {
-			return nil, nil, nil
-		}
-		return nil, nil, err
-	}
-	scheduler := NewScheduler(repo)
-	pb.RegisterCalcWorkerServiceServer(srv, NewCalculatorGRPCServer(repo, scheduler.GetOperationTimes(), scheduler))
+	srv := grpc.NewServer(opts...)
+	repo := newTestRepo(t)
+	metrics := NewMetrics(repo, logging.Discard())
+	scheduler := NewScheduler(repo, metrics, logging.Discard())
+	pb.RegisterCalcWorkerServiceServer(srv, NewCalculatorGRPCServer(repo, scheduler.GetOperationTimes(), scheduler, metrics, logging.Discard()))
 	go srv.Serve(lis)
 
 	ctx := context.Background()
@@ -46,20 +39,17 @@ func dialer() (*grpc.ClientConn, func(), error) {
 		return lis.Dial()
 	}), grpc.WithInsecure())
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	cleanup := func() { conn.Close(); srv.Stop() }
-	return conn, cleanup, nil
+	return conn, repo, cleanup, nil
 }
 
 func TestGetTask_NoTask(t *testing.T) {
-	conn, cleanup, err := dialer()
+	conn, cleanup, err := dialer(t)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if conn == nil {
-		t.Skip("skip gRPC tests: cgo disabled or in-memory DB not available")
-	}
 	defer cleanup()
 
 	client := pb.NewCalcWorkerServiceClient(conn)
@@ -71,3 +61,107 @@ func TestGetTask_NoTask(t *testing.T) {
 		t.Errorf("expected NoTaskAvailable, got %T", resp.TaskInfo)
 	}
 }
+
+func TestWorkerAuthentication(t *testing.T) {
+	authenticator, err := NewWorkerAuthenticator(map[string]string{"node-a": "token-a", "node-b": "token-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, repo, cleanup, err := dialerWithRepo(t, grpc.ChainUnaryInterceptor(authenticator.UnaryInterceptor()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	client := pb.NewCalcWorkerServiceClient(conn)
+	asNodeA := grpc.PerRPCCredentials(worker.NewBearerToken("token-a", false))
+	asNodeB := grpc.PerRPCCredentials(worker.NewBearerToken("token-b", false))
+
+	_, err = client.GetTask(context.Background(), &pb.GetTaskRequest{WorkerId: "node-a"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("GetTask without token expected Unauthenticated, got %v", err)
+	}
+	_, err = client.GetTask(context.Background(), &pb.GetTaskRequest{WorkerId: "node-a"},
+		grpc.PerRPCCredentials(worker.NewBearerToken("forged", false)))
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("GetTask with unknown token expected Unauthenticated, got %v", err)
+	}
+
+	uid, _ := repo.CreateUser("owner", "h")
+	exprID, _ := repo.CreateExpression(uid, "2+3")
+	taskID, _ := repo.CreateTask(exprID, "+", 2, 3, "")
+
+	// The reported worker ID is ignored in favor of the token identity.
+	resp, err := client.GetTask(context.Background(), &pb.GetTaskRequest{WorkerId: "node-b"}, asNodeA)
+	if err != nil {
+		t.Fatalf("GetTask error: %v", err)
+	}
+	if resp.GetTask().GetId() != taskID {
+		t.Fatalf("expected task %d, got %+v", taskID, resp.TaskInfo)
+	}
+	leased, _ := repo.GetTaskByID(taskID)
+	if leased.WorkerID != "node-a" {
+		t.Fatalf("task must be bound to node-a, got %q", leased.WorkerID)
+	}
+
+	leaseToken := resp.GetTask().GetLeaseToken()
+	if leaseToken == "" {
+		t.Fatal("leased task must carry a lease token")
+	}
+
+	submit := &pb.SubmitResultRequest{TaskId: taskID, WorkerId: "node-a", LeaseToken: leaseToken, ResultStatus: &pb.SubmitResultRequest_Result{Result: 42}}
+	if _, err = client.SubmitResult(context.Background(), submit, asNodeB); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("SubmitResult from foreign worker expected FailedPrecondition, got %v", err)
+	}
+	if task, _ := repo.GetTaskByID(taskID); task.Result.Valid {
+		t.Fatalf("foreign result must not be stored: %+v", task)
+	}
+
+	submit.ResultStatus = &pb.SubmitResultRequest_Result{Result: 5}
+	if _, err = client.SubmitResult(context.Background(), submit, asNodeA); err != nil {
+		t.Fatalf("SubmitResult from lease holder error: %v", err)
+	}
+	if task, _ := repo.GetTaskByID(taskID); !task.Result.Valid || task.Result.Float64 != 5 {
+		t.Fatalf("result of lease holder not stored: %+v", task)
+	}
+
+	if _, err = client.SubmitResult(context.Background(), submit, asNodeA); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("duplicate SubmitResult expected FailedPrecondition, got %v", err)
+	}
+}
+
+func TestSubmitResult_StaleLease(t *testing.T) {
+	conn, repo, cleanup, err := dialerWithRepo(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	client := pb.NewCalcWorkerServiceClient(conn)
+
+	uid, _ := repo.CreateUser("owner", "h")
+	exprID, _ := repo.CreateExpression(uid, "2*3")
+	taskID, _ := repo.CreateTask(exprID, "*", 2, 3, "")
+
+	first, err := client.GetTask(context.Background(), &pb.GetTaskRequest{WorkerId: "slow"})
+	if err != nil || first.GetTask().GetId() != taskID {
+		t.Fatalf("GetTask returned %+v, err %v", first, err)
+	}
+	if _, err = repo.RequeueExpiredLeases(0); err != nil {
+		t.Fatal(err)
+	}
+	second, err := client.GetTask(context.Background(), &pb.GetTaskRequest{WorkerId: "fast"})
+	if err != nil || second.GetTask().GetId() != taskID {
+		t.Fatalf("GetTask returned %+v, err %v", second, err)
+	}
+
+	late := &pb.SubmitResultRequest{
+		TaskId: taskID, WorkerId: "slow", LeaseToken: first.GetTask().GetLeaseToken(),
+		ResultStatus: &pb.SubmitResultRequest_Result{Result: 6},
+	}
+	if _, err = client.SubmitResult(context.Background(), late, grpc.WaitForReady(true)); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("late SubmitResult expected FailedPrecondition, got %v", err)
+	}
+	if task, _ := repo.GetTaskByID(taskID); task.Status != "in_progress" || task.WorkerID != "fast" {
+		t.Fatalf("late result must not touch the new lease: %+v", task)
+	}
+}
@@ -1,50 +1,133 @@
 package orchestrator
 
 import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/atadzan/dist-arith-go/internal/constants"
+	"github.com/atadzan/dist-arith-go/internal/logging"
 	"github.com/atadzan/dist-arith-go/internal/models"
 	"github.com/atadzan/dist-arith-go/internal/repository"
+	"github.com/atadzan/dist-arith-go/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type HTTPHandlers struct {
-	auth      *AuthService
-	repo      repository.Repository
-	scheduler *Scheduler
+	auth           *AuthService
+	repo           repository.Repository
+	scheduler      *Scheduler
+	passwordPolicy *PasswordPolicy
+	limits         Limits
+	limiter        *rateLimiter
+	logger         *slog.Logger
 }
 
-func NewHTTPHandlers(auth *AuthService, repo repository.Repository, scheduler *Scheduler) *HTTPHandlers {
+func NewHTTPHandlers(auth *AuthService, repo repository.Repository, scheduler *Scheduler, passwordPolicy *PasswordPolicy, limits Limits, logger *slog.Logger) *HTTPHandlers {
 	return &HTTPHandlers{
-		auth:      auth,
-		repo:      repo,
-		scheduler: scheduler,
+		auth:           auth,
+		repo:           repo,
+		scheduler:      scheduler,
+		passwordPolicy: passwordPolicy,
+		limits:         limits,
+		limiter:        newRateLimiter(limits),
+		logger:         logger.With("component", "http"),
+	}
+}
+
+// RegisterRoutes passes every API route served by the handlers to handle.
+// /api/v2 differs from /api/v1 only in the expression representation; the
+// other routes are served under both prefixes.
+func (h *HTTPHandlers) RegisterRoutes(handle func(route string, handler http.Handler)) {
+	authenticated := func(handler http.HandlerFunc) http.Handler {
+		return h.auth.JWTMiddleware(h.RateLimitMiddleware(handler))
+	}
+
+	for _, prefix := range []string{"/api/v1", "/api/v2"} {
+		handle(prefix+"/register", http.HandlerFunc(h.RegisterHandler))
+		handle(prefix+"/login", http.HandlerFunc(h.LoginHandler))
+		handle(prefix+"/login/2fa", http.HandlerFunc(h.LoginTwoFactorHandler))
+		handle(prefix+"/me", authenticated(h.DeleteAccountHandler))
+		handle(prefix+"/me/password", authenticated(h.ChangePasswordHandler))
+		handle(prefix+"/me/usage", authenticated(h.UsageHandler))
+		handle(prefix+"/me/settings", authenticated(h.SettingsHandler))
+		handle(prefix+"/me/2fa", authenticated(h.TOTPDisableHandler))
+		handle(prefix+"/me/2fa/enroll", authenticated(h.TOTPEnrollHandler))
+		handle(prefix+"/me/2fa/verify", authenticated(h.TOTPVerifyHandler))
+		handle(prefix+"/plan", authenticated(h.PlanHandler))
+	}
+
+	handle("/api/v1/calculate", authenticated(h.CalculateHandler))
+	handle("/api/v1/expressions", authenticated(h.ExpressionsHandler))
+	handle("/api/v1/expressions/", authenticated(h.ExpressionsHandler))
+	handle("/api/v2/calculate", authenticated(h.CalculateV2Handler))
+	handle("/api/v2/expressions", authenticated(h.ExpressionsV2Handler))
+	handle("/api/v2/expressions/", authenticated(h.ExpressionsV2Handler))
+}
+
+// userID returns the user authenticated by JWTMiddleware or, for handlers
+// served without it, by the Bearer token of the request. Unauthenticated
+// requests are answered with 401.
+func (h *HTTPHandlers) userID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	if userID, ok := GetUserIDFromContext(r.Context()); ok {
+		return userID, true
 	}
+	userID, err := h.auth.authenticate(r)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return 0, false
+	}
+	return userID, true
 }
 
+const (
+	requestIDHeader = "X-Request-ID"
+
+	// A retried POST /calculate with the same Idempotency-Key returns the
+	// expression created by the first attempt instead of a new one.
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+)
+
 type AuthRequest struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
 }
 
+type RegisterResponse struct {
+	ID    int64  `json:"id"`
+	Login string `json:"login"`
+}
+
+// LoginResponse carries either the API token or, for users with 2FA enabled,
+// a challenge token that has to be exchanged via LoginTwoFactorHandler.
 type LoginResponse struct {
-	Token string `json:"token"`
+	Token             string `json:"token,omitempty"`
+	TwoFactorRequired bool   `json:"two_factor_required,omitempty"`
+	ChallengeToken    string `json:"challenge_token,omitempty"`
 }
 
 func (h *HTTPHandlers) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Метод не разрешен", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r)
 		return
 	}
 
 	var req AuthRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Ошибка декодирования запроса: "+err.Error(), http.StatusBadRequest)
+		invalidJSON(w, r, err)
 		return
 	}
 
@@ -52,46 +135,47 @@ func (h *HTTPHandlers) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	password := strings.TrimSpace(req.Password)
 
 	if login == "" || password == "" {
-		http.Error(w, "Логин и пароль не могут быть пустыми", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeEmptyCredentials, nil)
 		return
 	}
 
-	if len(password) < 6 {
-		http.Error(w, "Пароль должен быть не менее 6 символов", http.StatusBadRequest)
+	if err := h.passwordPolicy.Validate(login, password); err != nil {
+		weakPassword(w, r, err)
 		return
 	}
 
 	hashedPassword, err := HashPassword(password)
 	if err != nil {
-		log.Printf("Ошибка хэширования пароля для пользователя %s: %v", login, err)
-		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		h.logger.ErrorContext(r.Context(), "can't hash password", "login", login, "error", err)
+		internalError(w, r)
 		return
 	}
 
-	_, err = h.repo.CreateUser(login, hashedPassword)
+	userID, err := h.repo.CreateUser(login, hashedPassword)
+	if errors.Is(err, repository.ErrUserExists) {
+		writeError(w, r, http.StatusConflict, CodeUserExists, map[string]any{"login": login})
+		return
+	}
 	if err != nil {
-		if strings.Contains(err.Error(), "уже существует") {
-			http.Error(w, err.Error(), http.StatusConflict)
-		} else {
-			log.Printf("Ошибка создания пользователя %s в БД: %v", login, err)
-			http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
-		}
+		h.logger.ErrorContext(r.Context(), "can't create user", "login", login, "error", err)
+		internalError(w, r)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Пользователь '%s' успешно зарегистрирован", login)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(RegisterResponse{ID: userID, Login: login})
 }
 
 func (h *HTTPHandlers) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Метод не разрешен", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r)
 		return
 	}
 
 	var req AuthRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Ошибка декодирования запроса: "+err.Error(), http.StatusBadRequest)
+		invalidJSON(w, r, err)
 		return
 	}
 
@@ -99,26 +183,39 @@ func (h *HTTPHandlers) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	password := strings.TrimSpace(req.Password)
 
 	if login == "" || password == "" {
-		http.Error(w, "Логин и пароль не могут быть пустыми", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeEmptyCredentials, nil)
 		return
 	}
 
 	user, err := h.repo.GetUserByLogin(login)
 	if err != nil {
-		log.Printf("Ошибка получения пользователя %s из БД: %v", login, err)
-		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		h.logger.ErrorContext(r.Context(), "can't get user", "login", login, "error", err)
+		internalError(w, r)
 		return
 	}
 
 	if user == nil || !CheckPasswordHash(password, user.PasswordHash) {
-		http.Error(w, "Неверный логин или пароль", http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeInvalidCredentials, nil)
+		return
+	}
+
+	if user.TOTPEnabled {
+		challenge, err := h.auth.GenerateChallengeToken(user)
+		if err != nil {
+			h.logger.ErrorContext(r.Context(), "can't generate 2FA challenge", logging.UserIDKey, user.ID, "error", err)
+			internalError(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(LoginResponse{TwoFactorRequired: true, ChallengeToken: challenge})
 		return
 	}
 
-	tokenString, err := h.auth.GenerateJWT(user.ID)
+	tokenString, err := h.auth.GenerateJWT(user)
 	if err != nil {
-		log.Printf("Ошибка генерации JWT для пользователя %s (ID: %d): %v", login, user.ID, err)
-		http.Error(w, "Внутренняя ошибка сервера", http.StatusInternalServerError)
+		h.logger.ErrorContext(r.Context(), "can't generate JWT", logging.UserIDKey, user.ID, "error", err)
+		internalError(w, r)
 		return
 	}
 
@@ -128,69 +225,323 @@ func (h *HTTPHandlers) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+type ChangePasswordRequest struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+// ChangePasswordHandler replaces the password of the current user. All
+// previously issued tokens are revoked, so a fresh one is returned.
+func (h *HTTPHandlers) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	userID, ok := h.userID(w, r)
+	if !ok {
+		return
+	}
+
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		invalidJSON(w, r, err)
+		return
+	}
+
+	oldPassword := strings.TrimSpace(req.OldPassword)
+	newPassword := strings.TrimSpace(req.NewPassword)
+	if oldPassword == "" || newPassword == "" {
+		writeError(w, r, http.StatusBadRequest, CodeEmptyPasswords, nil)
+		return
+	}
+
+	user, err := h.repo.GetUserByID(userID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "can't get user", "error", err)
+		internalError(w, r)
+		return
+	}
+	if user == nil {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, nil)
+		return
+	}
+
+	if !CheckPasswordHash(oldPassword, user.PasswordHash) {
+		writeError(w, r, http.StatusForbidden, CodeWrongPassword, nil)
+		return
+	}
+
+	if err = h.passwordPolicy.Validate(user.Login, newPassword); err != nil {
+		weakPassword(w, r, err)
+		return
+	}
+
+	hashedPassword, err := HashPassword(newPassword)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "can't hash password", "error", err)
+		internalError(w, r)
+		return
+	}
+
+	user.TokenVersion, err = h.repo.UpdateUserPassword(userID, hashedPassword)
+	if errors.Is(err, repository.ErrUserNotFound) {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, nil)
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "can't update password", "error", err)
+		internalError(w, r)
+		return
+	}
+
+	tokenString, err := h.auth.GenerateJWT(user)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "can't generate JWT", "error", err)
+		internalError(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(LoginResponse{Token: tokenString})
+}
+
+// DeleteAccountHandler removes the current user with all expressions and tasks.
+func (h *HTTPHandlers) DeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	userID, ok := h.userID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.repo.DeleteUser(userID); err != nil {
+		h.logger.ErrorContext(r.Context(), "can't delete user", "error", err)
+		internalError(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 type CalculateRequest struct {
 	Expression string `json:"expression"`
+	// Priority ranges from constants.MinPriority to constants.MaxPriority;
+	// higher ones are computed first.
+	Priority *int `json:"priority,omitempty"`
+	// Deadline is the time the expression expires at if it isn't done.
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// Rebalance, true by default, balances chains of + and * so more tasks
+	// run in parallel. Disable it where the floating-point result must not
+	// depend on the order of operations.
+	Rebalance *bool `json:"rebalance,omitempty"`
 }
 
+// CalculateHandler serves POST /api/v1/calculate.
 func (h *HTTPHandlers) CalculateHandler(w http.ResponseWriter, r *http.Request) {
+	h.calculate(w, r, apiV1)
+}
+
+// CalculateV2Handler serves POST /api/v2/calculate and answers with the
+// full ExpressionResponse.
+func (h *HTTPHandlers) CalculateV2Handler(w http.ResponseWriter, r *http.Request) {
+	h.calculate(w, r, apiV2)
+}
+
+func (h *HTTPHandlers) calculate(w http.ResponseWriter, r *http.Request, version int) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Метод не разрешен", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r)
 		return
 	}
 
-	userID, ok := GetUserIDFromContext(r.Context())
+	ctx, span := tracing.Tracer().Start(tracing.ExtractHTTP(r), "CalculateHandler")
+	defer span.End()
+
+	userID, ok := h.userID(w, r)
 	if !ok {
-		log.Println("Ошибка: не удалось получить userID из контекста в CalculateHandler")
-		http.Error(w, "Внутренняя ошибка сервера (контекст пользователя)", http.StatusInternalServerError)
 		return
 	}
 
 	var req CalculateRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Ошибка декодирования JSON: "+err.Error(), http.StatusBadRequest)
+		invalidJSON(w, r, err)
 		return
 	}
 	exprStr := strings.TrimSpace(req.Expression) // Восстановлено определение exprStr
 
 	if exprStr == "" {
-		http.Error(w, "Пустое выражение недопустимо", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeEmptyExpression, nil)
 		return
 	}
 
-	exprID, err := h.repo.CreateExpression(userID, exprStr) // userID и exprStr теперь определены
+	idempotencyKey := r.Header.Get(idempotencyKeyHeader)
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		writeError(w, r, http.StatusBadRequest, CodeIdempotencyKeyTooLong, map[string]any{"max_length": maxIdempotencyKeyLength})
+		return
+	}
+
+	opts := repository.ExpressionOptions{IdempotencyKey: idempotencyKey, Priority: constants.DefaultPriority}
+	if req.Priority != nil {
+		if *req.Priority < constants.MinPriority || *req.Priority > constants.MaxPriority {
+			details := map[string]any{"priority": *req.Priority, "min": constants.MinPriority, "max": constants.MaxPriority}
+			writeError(w, r, http.StatusBadRequest, CodeInvalidPriority, details)
+			return
+		}
+		opts.Priority = *req.Priority
+	}
+	if req.Deadline != nil {
+		if !req.Deadline.After(time.Now()) {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidDeadline, map[string]any{"deadline": req.Deadline.Format(time.RFC3339)})
+			return
+		}
+		opts.Deadline = sql.NullTime{Time: *req.Deadline, Valid: true}
+	}
+
+	if req.Rebalance != nil {
+		opts.RebalanceDisabled = !*req.Rebalance
+	}
+
+	// A retried request gets its expression even if the limits are reached
+	// in the meantime.
+	if idempotencyKey != "" {
+		exprID, err := h.repo.GetExpressionIDByIdempotencyKey(userID, idempotencyKey)
+		if err != nil {
+			h.logger.ErrorContext(ctx, "can't look up idempotency key", "error", err)
+			internalError(w, r)
+			return
+		}
+		if exprID != 0 {
+			h.replayCalculate(ctx, w, r, version, exprID, userID, exprStr)
+			return
+		}
+	}
+
+	// Expressions that can't be parsed are rejected by the scheduler with
+	// the parse error, so only those that will spawn tasks are checked here.
+	if ast, err := NewParser(exprStr).Parse(); err == nil {
+		opts.Depth = ast.Depth()
+		planned, _ := h.scheduler.planningTree(ast, opts.RebalanceDisabled)
+		opts.PlannedDepth = planned.Depth()
+		opts.Operations = countOperations(planned)
+		if !h.checkTaskLimit(w, r, opts.Operations) {
+			return
+		}
+		h.setExpressionLimits(&opts)
+	}
+
+	exprID, created, err := h.repo.CreateExpressionWithOptions(userID, exprStr, opts)
+	if err == nil && !created {
+		h.replayCalculate(ctx, w, r, version, exprID, userID, exprStr)
+		return
+	}
 	if err != nil {
-		log.Printf("Ошибка создания выражения в БД для пользователя %d: %v", userID, err)
-		http.Error(w, "Внутренняя ошибка сервера при сохранении выражения", http.StatusInternalServerError)
+		if h.writeLimitError(w, r, err, opts.Operations) {
+			return
+		}
+		h.logger.ErrorContext(ctx, "can't create expression", "error", err)
+		internalError(w, r)
 		return
 	}
 
-	log.Printf("Создано выражение ID %d для пользователя %d: %s", exprID, userID, exprStr)
+	ctx = logging.With(ctx, logging.ExpressionIDKey, exprID)
+	h.logger.InfoContext(ctx, "expression created", "expression", exprStr)
+	span.SetAttributes(attribute.Int64("expression.id", exprID), attribute.Int64("user.id", userID))
 
+	// Планирование переживает запрос, но остаётся в той же трассировке и
+	// сохраняет идентификаторы для логов.
+	scheduleCtx := context.WithoutCancel(ctx)
 	go func(id int64, expression string) {
-		err := h.scheduler.ScheduleTasks(id, expression)
+		err := h.scheduler.ScheduleTasks(scheduleCtx, id, expression)
 		if err != nil {
-			log.Printf("Асинхронная ошибка планирования задач для выражения ID %d: %v", id, err)
+			h.logger.ErrorContext(scheduleCtx, "can't schedule expression", "error", err)
 		}
 	}(exprID, exprStr)
 
-	respData := map[string]interface{}{
-		"id":         exprID,
-		"expression": exprStr,
-		"status":     constants.StatusPending,
+	var respData any = CalculateResponse{ID: exprID, Expression: exprStr, Status: constants.StatusPending}
+	if version != apiV1 {
+		expression, err := h.repo.GetExpressionByID(exprID, userID)
+		if err != nil || expression == nil {
+			h.logger.ErrorContext(ctx, "can't get created expression", "error", err)
+			internalError(w, r)
+			return
+		}
+		respData = h.expressionView(ctx, version, *expression)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated) // 201 Created
 	if err := json.NewEncoder(w).Encode(respData); err != nil {
-		log.Printf("Ошибка записи JSON ответа для CalculateHandler (exprID: %d): %v", exprID, err)
+		h.logger.WarnContext(ctx, "can't write response", "error", err)
+	}
+}
+
+// PlanHandler serves POST /plan: the expression is parsed and planned in
+// memory and nothing is stored, so no limits but the request rate apply.
+func (h *HTTPHandlers) PlanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	var req PlanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		invalidJSON(w, r, err)
+		return
+	}
+	exprStr := strings.TrimSpace(req.Expression)
+	if exprStr == "" {
+		writeError(w, r, http.StatusBadRequest, CodeEmptyExpression, nil)
+		return
+	}
+	ast, err := NewParser(exprStr).Parse()
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidExpression, map[string]any{"reason": err.Error()})
+		return
+	}
+
+	plan := h.scheduler.Plan(exprStr, ast, req.Rebalance != nil && !*req.Rebalance, time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(plan); err != nil {
+		h.logger.WarnContext(r.Context(), "can't write response", "error", err)
 	}
 }
 
+// replayCalculate answers a repeated request with an already used
+// idempotency key with the expression created by the first one.
+func (h *HTTPHandlers) replayCalculate(ctx context.Context, w http.ResponseWriter, r *http.Request, version int, exprID, userID int64, exprStr string) {
+	ctx = logging.With(ctx, logging.ExpressionIDKey, exprID)
+
+	expression, err := h.repo.GetExpressionByID(exprID, userID)
+	if err != nil || expression == nil {
+		h.logger.ErrorContext(ctx, "can't get expression for idempotent replay", "error", err)
+		internalError(w, r)
+		return
+	}
+	if expression.Expression != exprStr {
+		writeError(w, r, http.StatusUnprocessableEntity, CodeIdempotencyKeyReused, nil)
+		return
+	}
+
+	h.logger.InfoContext(ctx, "idempotent calculate replayed")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.WriteHeader(http.StatusOK)
+	var respData any = CalculateResponse{ID: expression.ID, Expression: expression.Expression, Status: expression.Status}
+	if version != apiV1 {
+		respData = h.expressionView(ctx, version, *expression)
+	}
+	json.NewEncoder(w).Encode(respData)
+}
+
 func EnableCORS(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")                                                                                   // Разрешаем все источники (для разработки)
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")                                                    // Разрешенные методы
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization") // Разрешенные заголовки
+		w.Header().Set("Access-Control-Allow-Origin", "*")                                                                                                                  // Разрешаем все источники (для разработки)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")                                                                                   // Разрешенные методы
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-Request-ID, Idempotency-Key") // Разрешенные заголовки
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -201,59 +552,223 @@ func EnableCORS(handler http.Handler) http.Handler {
 	})
 }
 
+// RequestIDMiddleware keeps the caller's X-Request-ID (or generates one),
+// echoes it in the response and attaches it to the log context.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if requestID == "" || len(requestID) > 128 {
+			buf := make([]byte, 8)
+			rand.Read(buf)
+			requestID = hex.EncodeToString(buf)
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		next.ServeHTTP(w, r.WithContext(logging.With(r.Context(), logging.RequestIDKey, requestID)))
+	})
+}
+
+// ExpressionsHandler serves GET /expressions (optionally filtered with
+// ?status=), GET /expressions/{id}, GET /expressions/{id}/trace,
+// GET /expressions/{id}/graph and POST /expressions/{id}/cancel under /api/v1.
 func (h *HTTPHandlers) ExpressionsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Метод не разрешен", http.StatusMethodNotAllowed)
+	h.expressions(w, r, apiV1)
+}
+
+// ExpressionsV2Handler serves the same routes under /api/v2 with
+// ExpressionResponse bodies.
+func (h *HTTPHandlers) ExpressionsV2Handler(w http.ResponseWriter, r *http.Request) {
+	h.expressions(w, r, apiV2)
+}
+
+func (h *HTTPHandlers) expressions(w http.ResponseWriter, r *http.Request, version int) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, fmt.Sprintf("/api/v%d/expressions", version)), "/")
+	idStr, action, _ := strings.Cut(path, "/")
+
+	switch {
+	case action == "cancel" && r.Method == http.MethodPost:
+	case (action == "" || action == "trace" || action == "graph") && r.Method == http.MethodGet:
+	case action != "" && action != "cancel" && action != "trace" && action != "graph":
+		writeError(w, r, http.StatusNotFound, CodeNotFound, nil)
+		return
+	default:
+		methodNotAllowed(w, r)
 		return
 	}
 
-	userID, ok := GetUserIDFromContext(r.Context())
+	userID, ok := h.userID(w, r)
 	if !ok {
-		log.Println("Ошибка: не удалось получить userID из контекста в ExpressionsHandler")
-		http.Error(w, "Внутренняя ошибка сервера (контекст пользователя)", http.StatusInternalServerError)
 		return
 	}
 
-	path := strings.TrimPrefix(r.URL.Path, "/api/v1/expressions")
-	idStr := strings.Trim(path, "/")
-
 	w.Header().Set("Content-Type", "application/json")
 
 	if idStr == "" {
 		expressions, err := h.repo.GetExpressionsByUserID(userID)
 		if err != nil {
-			log.Printf("Ошибка получения списка выражений для пользователя %d: %v", userID, err)
-			http.Error(w, "Внутренняя ошибка сервера при получении выражений", http.StatusInternalServerError)
+			h.logger.ErrorContext(r.Context(), "can't list expressions", "error", err)
+			internalError(w, r)
 			return
 		}
+		if status := r.URL.Query().Get("status"); status != "" {
+			filtered := make([]models.Expression, 0, len(expressions))
+			for _, expr := range expressions {
+				if expr.Status == status {
+					filtered = append(filtered, expr)
+				}
+			}
+			expressions = filtered
+		}
 		if expressions == nil {
 			expressions = make([]models.Expression, 0)
 		}
-		if err := json.NewEncoder(w).Encode(expressions); err != nil {
-			log.Printf("Ошибка записи JSON ответа для списка выражений (userID: %d): %v", userID, err)
+		if err := json.NewEncoder(w).Encode(h.expressionsView(r.Context(), version, userID, expressions)); err != nil {
+			h.logger.WarnContext(r.Context(), "can't write response", "error", err)
 		}
 		return
 	}
 
 	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil {
-		http.Error(w, "Неверный ID выражения: "+idStr, http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeInvalidExpressionID, map[string]any{"id": idStr})
+		return
+	}
+
+	if action == "cancel" {
+		h.cancelExpression(w, r, version, id, userID)
+		return
+	}
+	if action == "trace" {
+		h.traceExpression(w, r, id, userID)
+		return
+	}
+	if action == "graph" {
+		h.graphExpression(w, r, id, userID)
+		return
+	}
+
+	expression, err := h.repo.GetExpressionByID(id, userID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "can't get expression", logging.ExpressionIDKey, id, "error", err)
+		internalError(w, r)
 		return
 	}
 
+	if expression == nil {
+		writeError(w, r, http.StatusNotFound, CodeExpressionNotFound, map[string]any{"id": id})
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(h.expressionView(r.Context(), version, *expression)); err != nil {
+		h.logger.WarnContext(r.Context(), "can't write response", logging.ExpressionIDKey, id, "error", err)
+	}
+}
+
+// traceExpression returns the tasks of an expression with their results,
+// workers and timings, see ExpressionTrace. It is the same in every version.
+func (h *HTTPHandlers) traceExpression(w http.ResponseWriter, r *http.Request, id, userID int64) {
+	ctx := logging.With(r.Context(), logging.ExpressionIDKey, id)
+
 	expression, err := h.repo.GetExpressionByID(id, userID)
 	if err != nil {
-		log.Printf("Ошибка получения выражения ID %d для пользователя %d: %v", id, userID, err)
-		http.Error(w, "Внутренняя ошибка сервера при получении выражения", http.StatusInternalServerError)
+		h.logger.ErrorContext(ctx, "can't get expression", "error", err)
+		internalError(w, r)
+		return
+	}
+	if expression == nil {
+		writeError(w, r, http.StatusNotFound, CodeExpressionNotFound, map[string]any{"id": id})
+		return
+	}
+	tasks, err := h.repo.GetAllTasksForExpression(id)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "can't get tasks of expression", "error", err)
+		internalError(w, r)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(h.scheduler.Trace(*expression, tasks, h.scheduler.useCache(ctx, userID))); err != nil {
+		h.logger.WarnContext(ctx, "can't write response", "error", err)
+	}
+}
+
+// graphExpression renders the task graph of an expression in the format of
+// ?format=: json (the default), dot or mermaid.
+func (h *HTTPHandlers) graphExpression(w http.ResponseWriter, r *http.Request, id, userID int64) {
+	ctx := logging.With(r.Context(), logging.ExpressionIDKey, id)
+
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = graphFormatJSON
+	case graphFormatJSON, graphFormatDOT, graphFormatMermaid:
+	default:
+		writeError(w, r, http.StatusBadRequest, CodeInvalidParameter, map[string]any{
+			"parameter": "format", "in": "query", "reason": "expected json, dot or mermaid",
+		})
 		return
 	}
 
+	expression, err := h.repo.GetExpressionByID(id, userID)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "can't get expression", "error", err)
+		internalError(w, r)
+		return
+	}
 	if expression == nil {
-		http.Error(w, fmt.Sprintf("Выражение с ID %d не найдено или доступ запрещен", id), http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, CodeExpressionNotFound, map[string]any{"id": id})
+		return
+	}
+	tasks, err := h.repo.GetAllTasksForExpression(id)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "can't get tasks of expression", "error", err)
+		internalError(w, r)
+		return
+	}
+
+	graph := h.scheduler.Graph(*expression, tasks, h.scheduler.useCache(ctx, userID), time.Now())
+	switch format {
+	case graphFormatDOT:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, err = io.WriteString(w, graph.DOT())
+	case graphFormatMermaid:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, err = io.WriteString(w, graph.Mermaid())
+	default:
+		err = json.NewEncoder(w).Encode(graph)
+	}
+	if err != nil {
+		h.logger.WarnContext(ctx, "can't write response", "error", err)
+	}
+}
+
+// cancelExpression stops an expression that is still being computed and
+// returns it with the cancelled status.
+func (h *HTTPHandlers) cancelExpression(w http.ResponseWriter, r *http.Request, version int, id, userID int64) {
+	ctx := logging.With(r.Context(), logging.ExpressionIDKey, id)
+
+	cancelled, err := h.repo.CancelExpression(id, userID)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "can't cancel expression", "error", err)
+		internalError(w, r)
+		return
+	}
+
+	expression, err := h.repo.GetExpressionByID(id, userID)
+	if err != nil {
+		h.logger.ErrorContext(ctx, "can't get expression", "error", err)
+		internalError(w, r)
+		return
+	}
+	if expression == nil {
+		writeError(w, r, http.StatusNotFound, CodeExpressionNotFound, map[string]any{"id": id})
+		return
+	}
+	if !cancelled {
+		writeError(w, r, http.StatusConflict, CodeExpressionFinished, map[string]any{"id": id, "status": expression.Status})
 		return
 	}
 
-	if err := json.NewEncoder(w).Encode(expression); err != nil {
-		log.Printf("Ошибка записи JSON ответа для выражения ID %d (userID: %d): %v", id, userID, err)
+	h.logger.InfoContext(ctx, "expression cancelled")
+	if err := json.NewEncoder(w).Encode(h.expressionView(ctx, version, *expression)); err != nil {
+		h.logger.WarnContext(ctx, "can't write response", "error", err)
 	}
 }
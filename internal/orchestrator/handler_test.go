@@ -1,38 +1,56 @@
 package orchestrator
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/atadzan/dist-arith-go/internal/constants"
+	"github.com/atadzan/dist-arith-go/internal/logging"
 	"github.com/atadzan/dist-arith-go/internal/models"
 	"github.com/atadzan/dist-arith-go/internal/repository"
 	"github.com/atadzan/dist-arith-go/pkg/database"
 )
 
-func setupHandlers(t *testing.T) *HTTPHandlers {
-	testingDb, err := database.NewDBConn(":memory:")
+// newTestRepo returns a migrated in-memory repository closed with the test.
+func newTestRepo(t *testing.T) repository.Repository {
+	t.Helper()
+	testingDb, err := database.GetMemoryDBConn()
 	if err != nil {
-		return nil
+		if strings.Contains(err.Error(), "CGO_ENABLED") {
+			t.Skipf("skip tests due DB init error: %v", err)
+		}
+		t.Fatalf("GetMemoryDBConn error: %v", err)
 	}
-	repo, err := repository.New(testingDb)
+	t.Cleanup(func() { testingDb.Close() })
+	repo, err := repository.New(testingDb, logging.Discard())
 	if err != nil {
 		if strings.Contains(err.Error(), "CGO_ENABLED") {
-			t.Skipf("skip HTTP handler tests due DB init error: %v", err)
+			t.Skipf("skip tests due DB init error: %v", err)
 		}
 		t.Fatalf("NewStore error: %v", err)
 	}
 	if err := repo.CreateTables(); err != nil {
 		if strings.Contains(err.Error(), "CGO_ENABLED") {
-			t.Skipf("skip HTTP handler tests due DB migration error: %v", err)
+			t.Skipf("skip tests due DB migration error: %v", err)
 		}
 		t.Fatalf("InitDB error: %v", err)
 	}
+	return repo
+}
+
+func setupHandlers(t *testing.T) *HTTPHandlers {
+	repo := newTestRepo(t)
 	authService := NewAuthService(repo, "testsecret")
-	scheduler := NewScheduler(repo)
-	return NewHTTPHandlers(authService, repo, scheduler)
+	scheduler := NewScheduler(repo, NewMetrics(repo, logging.Discard()), logging.Discard())
+	return NewHTTPHandlers(authService, repo, scheduler, NewPasswordPolicy(), NewLimits(), logging.Discard())
 }
 
 func TestRegisterLoginCalculateFlow(t *testing.T) {
@@ -112,3 +130,375 @@ func TestRegisterLoginCalculateFlow(t *testing.T) {
 		t.Fatalf("Expected 1 expression, got %d", len(list))
 	}
 }
+
+func registerAndLogin(t *testing.T, h *HTTPHandlers, login, password string) string {
+	t.Helper()
+	body := `{"login":"` + login + `","password":"` + password + `"}`
+
+	rec := httptest.NewRecorder()
+	h.RegisterHandler(rec, httptest.NewRequest(http.MethodPost, "/api/v1/register", strings.NewReader(body)))
+	if rec.Code >= http.StatusBadRequest {
+		t.Fatalf("Register failed: %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	h.LoginHandler(rec, httptest.NewRequest(http.MethodPost, "/api/v1/login", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Login failed: %d %s", rec.Code, rec.Body.String())
+	}
+	var loginResp LoginResponse
+	if err := json.NewDecoder(rec.Body).Decode(&loginResp); err != nil {
+		t.Fatalf("Login decode error: %v", err)
+	}
+	return loginResp.Token
+}
+
+func TestChangePasswordAndDeleteAccount(t *testing.T) {
+	h := setupHandlers(t)
+	token := registerAndLogin(t, h, "owner", "pass123")
+
+	changePassword := h.auth.JWTMiddleware(http.HandlerFunc(h.ChangePasswordHandler))
+	deleteAccount := h.auth.JWTMiddleware(http.HandlerFunc(h.DeleteAccountHandler))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/api/v1/me/password", strings.NewReader(`{"old_password":"wrong1","new_password":"newpass456"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	changePassword.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("Change with wrong old password expected %d, got %d", http.StatusForbidden, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPut, "/api/v1/me/password", strings.NewReader(`{"old_password":"pass123","new_password":"short"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	changePassword.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Change to weak password expected %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPut, "/api/v1/me/password", strings.NewReader(`{"old_password":"pass123","new_password":"newpass456"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	changePassword.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Change password expected %d, got %d body=%s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var changeResp LoginResponse
+	if err := json.NewDecoder(rec.Body).Decode(&changeResp); err != nil || changeResp.Token == "" {
+		t.Fatalf("Change password returned no token: %v", err)
+	}
+
+	if _, err := h.auth.ValidateJWT(token); err == nil {
+		t.Fatal("old token must be revoked after password change")
+	}
+	if _, err := h.auth.ValidateJWT(changeResp.Token); err != nil {
+		t.Fatalf("new token rejected: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	h.LoginHandler(rec, httptest.NewRequest(http.MethodPost, "/api/v1/login", strings.NewReader(`{"login":"owner","password":"pass123"}`)))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Login with old password expected %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodDelete, "/api/v1/me", nil)
+	req.Header.Set("Authorization", "Bearer "+changeResp.Token)
+	deleteAccount.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Delete account expected %d, got %d body=%s", http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+
+	if _, err := h.auth.ValidateJWT(changeResp.Token); err == nil {
+		t.Fatal("token of deleted user must be rejected")
+	}
+	user, err := h.repo.GetUserByLogin("owner")
+	if err != nil || user != nil {
+		t.Fatalf("user must be gone after deletion, got %+v, err %v", user, err)
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var seen string
+	handler := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = logging.RequestID(r.Context())
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/expressions", nil)
+	req.Header.Set("X-Request-ID", "client-id")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if seen != "client-id" || rec.Header().Get("X-Request-ID") != "client-id" {
+		t.Fatalf("client request ID not kept: context %q, header %q", seen, rec.Header().Get("X-Request-ID"))
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/expressions", nil))
+	if seen == "" || seen == "client-id" || rec.Header().Get("X-Request-ID") != seen {
+		t.Fatalf("request ID not generated: context %q, header %q", seen, rec.Header().Get("X-Request-ID"))
+	}
+}
+
+func TestCancelExpression(t *testing.T) {
+	h := setupHandlers(t)
+	token := registerAndLogin(t, h, "owner", "pass123")
+	otherToken := registerAndLogin(t, h, "stranger", "pass123")
+	expressions := h.auth.JWTMiddleware(http.HandlerFunc(h.ExpressionsHandler))
+
+	user, err := h.repo.GetUserByLogin("owner")
+	if err != nil || user == nil {
+		t.Fatalf("GetUserByLogin: %v", err)
+	}
+	// Created directly so the scheduler doesn't race with the cancellation.
+	exprID, err := h.repo.CreateExpression(user.ID, "(1+2)*3")
+	if err != nil {
+		t.Fatalf("CreateExpression: %v", err)
+	}
+	if _, err = h.repo.CreateTask(exprID, "+", 1, 2, ""); err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		expressions.ServeHTTP(rec, req)
+		return rec
+	}
+	cancelPath := "/api/v1/expressions/" + strconv.FormatInt(exprID, 10) + "/cancel"
+
+	if rec := do(http.MethodGet, cancelPath, token); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET cancel expected %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+	if rec := do(http.MethodPost, cancelPath, otherToken); rec.Code != http.StatusNotFound {
+		t.Fatalf("Cancel of foreign expression expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	rec := do(http.MethodPost, cancelPath, token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Cancel expected %d, got %d body=%s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var expr models.Expression
+	if err := json.NewDecoder(rec.Body).Decode(&expr); err != nil || expr.Status != constants.StatusCancelled {
+		t.Fatalf("Cancel returned %+v, err %v", expr, err)
+	}
+
+	tasks, err := h.repo.GetAllTasksForExpression(exprID)
+	if err != nil || len(tasks) != 1 || tasks[0].Status != constants.StatusCancelled {
+		t.Fatalf("task must be cancelled, got %+v, err %v", tasks, err)
+	}
+	if leased, err := h.repo.GetAndLeasePendingTask("worker-0"); err != nil || leased != nil {
+		t.Fatalf("cancelled task must not be leased, got %+v, err %v", leased, err)
+	}
+	if _, err = h.repo.CreateTask(exprID, "*", 3, 3, ""); !errors.Is(err, repository.ErrExpressionCancelled) {
+		t.Fatalf("CreateTask for cancelled expression expected ErrExpressionCancelled, got %v", err)
+	}
+	h.repo.UpdateExpressionStatusResult(exprID, constants.StatusDone, sql.NullFloat64{Float64: 9, Valid: true}, sql.NullString{})
+
+	if rec := do(http.MethodPost, cancelPath, token); rec.Code != http.StatusConflict {
+		t.Fatalf("Second cancel expected %d, got %d", http.StatusConflict, rec.Code)
+	}
+
+	rec = do(http.MethodGet, "/api/v1/expressions?status="+constants.StatusCancelled, token)
+	var list []models.Expression
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil || len(list) != 1 || list[0].Status != constants.StatusCancelled {
+		t.Fatalf("Expected the cancelled expression in the filtered list, got %+v, err %v", list, err)
+	}
+	rec = do(http.MethodGet, "/api/v1/expressions?status="+constants.StatusDone, token)
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil || len(list) != 0 {
+		t.Fatalf("Expected no done expressions, got %+v, err %v", list, err)
+	}
+}
+
+func TestExpressionsV2Representation(t *testing.T) {
+	h := setupHandlers(t)
+	token := registerAndLogin(t, h, "owner", "pass123")
+	user, err := h.repo.GetUserByLogin("owner")
+	if err != nil || user == nil {
+		t.Fatalf("GetUserByLogin: %v", err)
+	}
+
+	doneID, _ := h.repo.CreateExpression(user.ID, "(2+3)*4")
+	h.repo.UpdateExpressionStatusResult(doneID, constants.StatusDone,
+		sql.NullFloat64{Float64: 20, Valid: true}, sql.NullString{String: `["Result: 5","Result: 20"]`, Valid: true})
+	failedID, _ := h.repo.CreateExpression(user.ID, "(1+")
+	h.repo.UpdateExpressionStatusResult(failedID, constants.StatusError,
+		sql.NullFloat64{}, sql.NullString{String: "parse error: unexpected end", Valid: true})
+
+	get := func(handler http.HandlerFunc, path string) map[string]any {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		h.auth.JWTMiddleware(handler).ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s expected %d, got %d", path, http.StatusOK, rec.Code)
+		}
+		var body map[string]any
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatalf("GET %s decode: %v", path, err)
+		}
+		return body
+	}
+
+	done := get(h.ExpressionsV2Handler, "/api/v2/expressions/"+strconv.FormatInt(doneID, 10))
+	steps, _ := done["steps"].([]any)
+	if done["result"] != float64(20) || len(steps) != 2 || done["error"] != nil {
+		t.Fatalf("unexpected v2 done expression: %v", done)
+	}
+
+	failed := get(h.ExpressionsV2Handler, "/api/v2/expressions/"+strconv.FormatInt(failedID, 10))
+	steps, _ = failed["steps"].([]any)
+	if failed["result"] != nil || steps == nil || len(steps) != 0 || failed["error"] != "parse error: unexpected end" {
+		t.Fatalf("unexpected v2 failed expression: %v", failed)
+	}
+
+	// v1 keeps encoding the model for existing clients.
+	v1 := get(h.ExpressionsHandler, "/api/v1/expressions/"+strconv.FormatInt(doneID, 10))
+	if result, ok := v1["result"].(map[string]any); !ok || result["Float64"] != float64(20) {
+		t.Fatalf("unexpected v1 expression: %v", v1)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/v2/calculate", strings.NewReader(`{"expression":"7"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	h.auth.JWTMiddleware(http.HandlerFunc(h.CalculateV2Handler)).ServeHTTP(rec, req)
+	var created ExpressionResponse
+	if rec.Code != http.StatusCreated || json.NewDecoder(rec.Body).Decode(&created) != nil ||
+		created.ID == 0 || created.Status != constants.StatusPending || created.CreatedAt.IsZero() {
+		t.Fatalf("unexpected v2 calculate response: %d %+v", rec.Code, created)
+	}
+}
+
+func TestCalculatePriorityAndDeadline(t *testing.T) {
+	h, handler, _ := setupLimitedHandlers(t, NewLimits())
+	token := registerAndLogin(t, h, "scheduler", "pass123")
+
+	for _, tt := range []struct {
+		body string
+		code ErrorCode
+	}{
+		{`{"expression":"1+1","priority":11}`, CodeInvalidPriority},
+		{`{"expression":"1+1","priority":-11}`, CodeInvalidPriority},
+		{`{"expression":"1+1","deadline":"2000-01-01T00:00:00Z"}`, CodeInvalidDeadline},
+	} {
+		rec := serveJSON(handler, http.MethodPost, "/api/v1/calculate", tt.body, token)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), string(tt.code)) {
+			t.Errorf("%s: expected %s, got %d: %s", tt.body, tt.code, rec.Code, rec.Body.String())
+		}
+	}
+
+	deadline := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	rec := serveJSON(handler, http.MethodPost, "/api/v2/calculate",
+		`{"expression":"1+1","priority":7,"deadline":"`+deadline.Format(time.RFC3339)+`"}`, token)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+	var expr ExpressionResponse
+	if err := json.NewDecoder(rec.Body).Decode(&expr); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if expr.Priority != 7 || expr.Deadline == nil || !expr.Deadline.Equal(deadline) {
+		t.Fatalf("expected priority 7 and deadline %v, got %+v", deadline, expr)
+	}
+}
+
+func TestSettingsHandler(t *testing.T) {
+	h, handler, _ := setupLimitedHandlers(t, NewLimits())
+	token := registerAndLogin(t, h, "settled", "pass123")
+
+	settings := func(rec *httptest.ResponseRecorder) UserSettings {
+		t.Helper()
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		var resp UserSettings
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("decode error: %v", err)
+		}
+		return resp
+	}
+
+	if got := settings(serveJSON(handler, http.MethodGet, "/api/v2/me/settings", "", token)); !got.ResultCache {
+		t.Fatalf("the result cache must be enabled by default, got %+v", got)
+	}
+	if got := settings(serveJSON(handler, http.MethodPut, "/api/v2/me/settings", `{"result_cache":false}`, token)); got.ResultCache {
+		t.Fatalf("expected the result cache disabled, got %+v", got)
+	}
+	if user, _ := h.repo.GetUserByLogin("settled"); !user.ResultCacheDisabled {
+		t.Fatal("the setting must be stored")
+	}
+	if rec := serveJSON(handler, http.MethodPut, "/api/v2/me/settings", `{}`, token); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected %d without result_cache, got %d", http.StatusBadRequest, rec.Code)
+	}
+	if rec := serveJSON(handler, http.MethodPost, "/api/v2/me/settings", `{}`, token); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected %d for POST, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestCalculateReportsDepth(t *testing.T) {
+	h, handler, _ := setupLimitedHandlers(t, NewLimits())
+	token := registerAndLogin(t, h, "deep", "pass123")
+
+	for _, tt := range []struct {
+		body         string
+		rebalance    bool
+		plannedDepth int
+	}{
+		{`{"expression":"1+2+3+4+5+6+7+8"}`, true, 3},
+		{`{"expression":"1+2+3+4+5+6+7+8","rebalance":false}`, false, 7},
+	} {
+		rec := serveJSON(handler, http.MethodPost, "/api/v2/calculate", tt.body, token)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("expected %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+		}
+		var expr ExpressionResponse
+		if err := json.NewDecoder(rec.Body).Decode(&expr); err != nil {
+			t.Fatalf("decode error: %v", err)
+		}
+		if expr.Rebalance != tt.rebalance || expr.Depth != 7 || expr.PlannedDepth != tt.plannedDepth {
+			t.Errorf("%s: expected rebalance %v and depth 7 -> %d, got %+v", tt.body, tt.rebalance, tt.plannedDepth, expr)
+		}
+	}
+}
+
+func TestExpressionTrace(t *testing.T) {
+	h, handler, _ := setupLimitedHandlers(t, NewLimits())
+	token := registerAndLogin(t, h, "traced", "pass123")
+	otherToken := registerAndLogin(t, h, "curious", "pass123")
+	userID, _ := h.auth.ValidateJWT(token)
+	h.repo.SetResultCacheDisabled(userID, true)
+
+	exprID, _ := scheduleAndCompute(t, h, userID, "(1+2)*(3+4)")
+	expectDone(t, h, exprID, 21)
+	tracePath := "/api/v2/expressions/" + strconv.FormatInt(exprID, 10) + "/trace"
+
+	if rec := serveJSON(handler, http.MethodGet, tracePath, "", otherToken); rec.Code != http.StatusNotFound {
+		t.Fatalf("trace of a foreign expression: expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	rec := serveJSON(handler, http.MethodGet, tracePath, "", token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var trace ExpressionTrace
+	if err := json.NewDecoder(rec.Body).Decode(&trace); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if trace.Status != constants.StatusDone || trace.Result == nil || *trace.Result != 21 || len(trace.Tasks) != 3 {
+		t.Fatalf("expected a done trace with 3 tasks, got %+v", trace)
+	}
+	last := trace.Tasks[2]
+	if last.Operation != "*" || !reflect.DeepEqual(last.DependsOn, []int64{trace.Tasks[0].ID, trace.Tasks[1].ID}) {
+		t.Errorf("expected the product after both sums, got %+v", trace.Tasks)
+	}
+	for _, task := range trace.Tasks {
+		if task.WorkerID != "w" || task.Result == nil || task.LeasedAt == nil || task.CompletedAt == nil || task.CompletedAt.Before(*task.LeasedAt) {
+			t.Errorf("expected a computed task with its worker and timestamps, got %+v", task)
+		}
+	}
+
+	expr, _ := h.repo.GetExpressionByIDInternal(exprID)
+	if steps := NewExpressionResponse(*expr).Steps; !reflect.DeepEqual(steps, trace.Steps()) || len(steps) != 4 {
+		t.Errorf("expected the steps of the trace, got %q", steps)
+	}
+}
@@ -0,0 +1,92 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/internal/repository"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const readinessTimeout = 2 * time.Second
+
+// Health serves the liveness and readiness probes. The gRPC part of the
+// readiness comes from the standard health server registered on the worker
+// gRPC port, which is switched to SERVING once the listener is up.
+type Health struct {
+	repo       repository.Repository
+	grpcHealth *health.Server
+}
+
+func NewHealth(repo repository.Repository, grpcHealth *health.Server) *Health {
+	return &Health{repo: repo, grpcHealth: grpcHealth}
+}
+
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// LivenessHandler answers as long as the process can serve HTTP.
+func (h *Health) LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// ReadinessHandler reports whether the orchestrator can accept work: the
+// database answers, migrations are applied and the gRPC server is serving.
+func (h *Health) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := map[string]string{
+		"database":   checkResult(h.repo.Ping(ctx)),
+		"migrations": checkResult(h.repo.CheckMigrations()),
+		"grpc":       checkResult(h.checkGRPC(ctx)),
+	}
+
+	resp, code := HealthResponse{Status: "ready", Checks: checks}, http.StatusOK
+	for _, result := range checks {
+		if result != "ok" {
+			resp.Status, code = "not_ready", http.StatusServiceUnavailable
+			break
+		}
+	}
+	writeHealth(w, code, resp)
+}
+
+func (h *Health) checkGRPC(ctx context.Context) error {
+	resp, err := h.grpcHealth.Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return err
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return errNotServing{status: resp.GetStatus()}
+	}
+	return nil
+}
+
+type errNotServing struct {
+	status healthpb.HealthCheckResponse_ServingStatus
+}
+
+func (e errNotServing) Error() string {
+	return "gRPC server is " + e.status.String()
+}
+
+func checkResult(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+func writeHealth(w http.ResponseWriter, code int, resp HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,55 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestHealthAndReadiness(t *testing.T) {
+	h := setupHandlers(t)
+	if h == nil {
+		t.Skip("skip health tests: no DB")
+	}
+	grpcHealth := health.NewServer()
+	grpcHealth.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	probes := NewHealth(h.repo, grpcHealth)
+
+	readiness := func() (int, HealthResponse) {
+		rr := httptest.NewRecorder()
+		probes.ReadinessHandler(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var resp HealthResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("decode readiness: %v", err)
+		}
+		return rr.Code, resp
+	}
+
+	rr := httptest.NewRecorder()
+	probes.LivenessHandler(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected liveness 200, got %d", rr.Code)
+	}
+
+	code, resp := readiness()
+	if code != http.StatusServiceUnavailable || resp.Checks["grpc"] == "ok" {
+		t.Fatalf("expected not ready before gRPC serves, got %d %+v", code, resp)
+	}
+	if resp.Checks["database"] != "ok" || resp.Checks["migrations"] != "ok" {
+		t.Fatalf("expected database checks to pass, got %+v", resp.Checks)
+	}
+
+	grpcHealth.Resume()
+	if code, resp = readiness(); code != http.StatusOK || resp.Status != "ready" {
+		t.Fatalf("expected ready, got %d %+v", code, resp)
+	}
+
+	grpcHealth.Shutdown()
+	if code, _ = readiness(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected not ready after gRPC shutdown, got %d", code)
+	}
+}
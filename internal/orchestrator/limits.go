@@ -0,0 +1,285 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/internal/repository"
+)
+
+// Limits are the per-user limits of the HTTP API. Zero disables a limit.
+type Limits struct {
+	// RequestsPerSecond and Burst configure the token bucket of a user for
+	// authenticated requests.
+	RequestsPerSecond int
+	Burst             int
+	// MaxActiveExpressions caps pending and in-progress expressions.
+	MaxActiveExpressions int
+	// MaxTasksPerExpression caps the operations of a single expression.
+	MaxTasksPerExpression int
+	// DailyTaskQuota caps the tasks created for a user per UTC day.
+	DailyTaskQuota int
+}
+
+// activeExpressionsRetryAfter is suggested to clients that hit
+// MaxActiveExpressions, as there is no telling when an expression finishes.
+const activeExpressionsRetryAfter = 5 * time.Second
+
+func NewLimits() Limits {
+	return Limits{
+		RequestsPerSecond:     10,
+		Burst:                 50,
+		MaxActiveExpressions:  20,
+		MaxTasksPerExpression: 500,
+		DailyTaskQuota:        10000,
+	}
+}
+
+// NewLimitsFromEnv reads the limits from RATE_LIMIT_RPS, RATE_LIMIT_BURST,
+// MAX_ACTIVE_EXPRESSIONS, MAX_TASKS_PER_EXPRESSION and DAILY_TASK_QUOTA.
+func NewLimitsFromEnv() Limits {
+	l := NewLimits()
+	l.RequestsPerSecond = readIntEnv("RATE_LIMIT_RPS", l.RequestsPerSecond)
+	l.Burst = readIntEnv("RATE_LIMIT_BURST", l.Burst)
+	l.MaxActiveExpressions = readIntEnv("MAX_ACTIVE_EXPRESSIONS", l.MaxActiveExpressions)
+	l.MaxTasksPerExpression = readIntEnv("MAX_TASKS_PER_EXPRESSION", l.MaxTasksPerExpression)
+	l.DailyTaskQuota = readIntEnv("DAILY_TASK_QUOTA", l.DailyTaskQuota)
+	return l
+}
+
+// rateLimiter keeps a token bucket per user. Buckets that have been refilled
+// completely are dropped from time to time, so idle users cost nothing.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mx        sync.Mutex
+	buckets   map[int64]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(limits Limits) *rateLimiter {
+	burst := limits.Burst
+	if burst < limits.RequestsPerSecond {
+		burst = limits.RequestsPerSecond
+	}
+	return &rateLimiter{
+		rate:    float64(limits.RequestsPerSecond),
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[int64]*tokenBucket),
+	}
+}
+
+// allow takes a token from the bucket of the user. Otherwise it returns
+// false and the time until the next token.
+func (l *rateLimiter) allow(userID int64) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[userID]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[userID] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// available returns the tokens left in the bucket of the user.
+func (l *rateLimiter) available(userID int64) int {
+	if l.rate <= 0 {
+		return 0
+	}
+
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	b, ok := l.buckets[userID]
+	if !ok {
+		return int(l.burst)
+	}
+	return int(l.refill(b, l.now()))
+}
+
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for userID, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, userID)
+		}
+	}
+}
+
+// RateLimitMiddleware limits the requests of the user authenticated by
+// JWTMiddleware, so it has to be wrapped by it.
+func (h *HTTPHandlers) RateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := GetUserIDFromContext(r.Context())
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if allowed, retryAfter := h.limiter.allow(userID); !allowed {
+			h.logger.InfoContext(r.Context(), "request rate limited", "retry_after", retryAfter)
+			tooManyRequests(w, r, retryAfter, CodeRateLimited, map[string]any{"limit": h.limits.RequestsPerSecond})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkTaskLimit tells whether the user may submit an expression of the
+// given number of operations and otherwise answers with the limit hit.
+func (h *HTTPHandlers) checkTaskLimit(w http.ResponseWriter, r *http.Request, tasks int) bool {
+	if limit := h.limits.MaxTasksPerExpression; limit > 0 && tasks > limit {
+		writeError(w, r, http.StatusUnprocessableEntity, CodeTooManyTasks, map[string]any{"limit": limit, "tasks": tasks})
+		return false
+	}
+	return true
+}
+
+// setExpressionLimits passes MaxActiveExpressions and DailyTaskQuota to
+// CreateExpressionWithOptions, which checks them in the transaction of the
+// insert.
+func (h *HTTPHandlers) setExpressionLimits(opts *repository.ExpressionOptions) {
+	opts.MaxActive = h.limits.MaxActiveExpressions
+	if quota := h.limits.DailyTaskQuota; quota > 0 {
+		opts.TaskQuota = quota
+		opts.QuotaSince, _ = quotaDay(h.limiter.now())
+	}
+}
+
+// writeLimitError answers with the limit hit if err is one of the limit
+// errors of CreateExpressionWithOptions and tells whether it was.
+func (h *HTTPHandlers) writeLimitError(w http.ResponseWriter, r *http.Request, err error, tasks int) bool {
+	var quotaErr *repository.QuotaExceededError
+	switch {
+	case errors.Is(err, repository.ErrTooManyActiveExpressions):
+		tooManyRequests(w, r, activeExpressionsRetryAfter, CodeTooManyActiveExpressions, map[string]any{"limit": h.limits.MaxActiveExpressions})
+	case errors.As(err, &quotaErr):
+		_, dayEnd := quotaDay(h.limiter.now())
+		details := map[string]any{"limit": h.limits.DailyTaskQuota, "used": quotaErr.Used, "tasks": tasks}
+		tooManyRequests(w, r, dayEnd.Sub(h.limiter.now()), CodeDailyQuotaExceeded, details)
+	default:
+		return false
+	}
+	return true
+}
+
+// quotaDay returns the bounds of the UTC day the daily quota is counted for.
+func quotaDay(now time.Time) (time.Time, time.Time) {
+	start := now.UTC().Truncate(24 * time.Hour)
+	return start, start.Add(24 * time.Hour)
+}
+
+// tooManyRequests answers with 429 and Retry-After in whole seconds.
+func tooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration, code ErrorCode, details map[string]any) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	details["retry_after"] = seconds
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeError(w, r, http.StatusTooManyRequests, code, details)
+}
+
+// countOperations returns the number of tasks the expression is split into.
+func countOperations(node *Node) int {
+	if node == nil || node.Value != nil {
+		return 0
+	}
+	return 1 + countOperations(node.Left) + countOperations(node.Right)
+}
+
+type UsageResponse struct {
+	Limits UsageLimits `json:"limits"`
+	Usage  Usage       `json:"usage"`
+	// QuotaResetsAt is the start of the next UTC day.
+	QuotaResetsAt time.Time `json:"quota_resets_at"`
+}
+
+type UsageLimits struct {
+	RequestsPerSecond     int `json:"requests_per_second"`
+	Burst                 int `json:"burst"`
+	MaxActiveExpressions  int `json:"max_active_expressions"`
+	MaxTasksPerExpression int `json:"max_tasks_per_expression"`
+	DailyTaskQuota        int `json:"daily_task_quota"`
+}
+
+type Usage struct {
+	AvailableRequests int   `json:"available_requests"`
+	ActiveExpressions int64 `json:"active_expressions"`
+	TasksToday        int64 `json:"tasks_today"`
+}
+
+// UsageHandler serves GET /me/usage with the limits of the current user and
+// how much of them is used.
+func (h *HTTPHandlers) UsageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	userID, ok := h.userID(w, r)
+	if !ok {
+		return
+	}
+
+	active, err := h.repo.CountActiveExpressions(userID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "can't count active expressions", "error", err)
+		internalError(w, r)
+		return
+	}
+	dayStart, dayEnd := quotaDay(h.limiter.now())
+	tasks, err := h.repo.CountUserOperationsSince(userID, dayStart)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "can't count operations of the day", "error", err)
+		internalError(w, r)
+		return
+	}
+
+	resp := UsageResponse{
+		Limits: UsageLimits(h.limits),
+		Usage: Usage{
+			AvailableRequests: h.limiter.available(userID),
+			ActiveExpressions: active,
+			TasksToday:        tasks,
+		},
+		QuotaResetsAt: dayEnd,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,154 @@
+package orchestrator
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/internal/constants"
+	"github.com/atadzan/dist-arith-go/internal/repository"
+)
+
+// setupLimitedHandlers returns handlers with the given limits, served through
+// RegisterRoutes, and a clock for the rate limiter.
+func setupLimitedHandlers(t *testing.T, limits Limits) (*HTTPHandlers, http.Handler, *time.Time) {
+	t.Helper()
+	h := setupHandlers(t)
+	h.limits = limits
+	h.limiter = newRateLimiter(limits)
+	now := time.Date(2026, 3, 1, 23, 0, 0, 0, time.UTC)
+	h.limiter.now = func() time.Time { return now }
+
+	mux := http.NewServeMux()
+	h.RegisterRoutes(func(route string, handler http.Handler) { mux.Handle(route, handler) })
+	return h, mux, &now
+}
+
+func serveJSON(handler http.Handler, method, path, body, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept-Language", "en")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func expectTooManyRequests(t *testing.T, rec *httptest.ResponseRecorder, code ErrorCode, retryAfter string) {
+	t.Helper()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected %d, got %d: %s", http.StatusTooManyRequests, rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Retry-After"); got != retryAfter {
+		t.Errorf("expected Retry-After %q, got %q", retryAfter, got)
+	}
+	var resp ErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if resp.Error.Code != code {
+		t.Errorf("expected code %q, got %+v", code, resp.Error)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	h, handler, now := setupLimitedHandlers(t, Limits{RequestsPerSecond: 2, Burst: 3})
+	token := registerAndLogin(t, h, "hasty", "pass123")
+	other := registerAndLogin(t, h, "patient", "pass123")
+
+	for i := 0; i < 3; i++ {
+		if rec := serveJSON(handler, http.MethodGet, "/api/v1/expressions", "", token); rec.Code != http.StatusOK {
+			t.Fatalf("request %d within the burst: expected %d, got %d", i, http.StatusOK, rec.Code)
+		}
+	}
+	expectTooManyRequests(t, serveJSON(handler, http.MethodGet, "/api/v2/expressions", "", token), CodeRateLimited, "1")
+
+	// Buckets are per user.
+	if rec := serveJSON(handler, http.MethodGet, "/api/v1/expressions", "", other); rec.Code != http.StatusOK {
+		t.Fatalf("another user: expected %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	*now = now.Add(500 * time.Millisecond)
+	if rec := serveJSON(handler, http.MethodGet, "/api/v1/expressions", "", token); rec.Code != http.StatusOK {
+		t.Fatalf("after refill: expected %d, got %d", http.StatusOK, rec.Code)
+	}
+	expectTooManyRequests(t, serveJSON(handler, http.MethodGet, "/api/v1/expressions", "", token), CodeRateLimited, "1")
+}
+
+func TestExpressionLimits(t *testing.T) {
+	h, handler, _ := setupLimitedHandlers(t, Limits{MaxActiveExpressions: 1, MaxTasksPerExpression: 2, DailyTaskQuota: 3})
+	token := registerAndLogin(t, h, "greedy", "pass123")
+	userID, _ := h.auth.ValidateJWT(token)
+
+	rec := serveJSON(handler, http.MethodPost, "/api/v1/calculate", `{"expression":"1+2+3+4"}`, token)
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), string(CodeTooManyTasks)) {
+		t.Fatalf("expected %s, got %d: %s", CodeTooManyTasks, rec.Code, rec.Body.String())
+	}
+
+	// The two operations of an earlier expression count towards the daily
+	// quota; it is stamped with the real time, which is later than the fake
+	// day start.
+	done, _, _ := h.repo.CreateExpressionWithOptions(userID, "1+1+1", repository.ExpressionOptions{Operations: 2})
+	h.repo.UpdateExpressionStatusResult(done, constants.StatusDone, sql.NullFloat64{Float64: 3, Valid: true}, sql.NullString{})
+	expectTooManyRequests(t, serveJSON(handler, http.MethodPost, "/api/v1/calculate", `{"expression":"2*2+1"}`, token), CodeDailyQuotaExceeded, "3600")
+
+	rec = serveJSON(handler, http.MethodPost, "/api/v1/calculate", `{"expression":"2*2"}`, token)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+	expectTooManyRequests(t, serveJSON(handler, http.MethodPost, "/api/v1/calculate", `{"expression":"7"}`, token), CodeTooManyActiveExpressions, "5")
+}
+
+func TestIdempotentRetryIgnoresLimits(t *testing.T) {
+	h, handler, _ := setupLimitedHandlers(t, Limits{MaxActiveExpressions: 1, DailyTaskQuota: 1})
+	token := registerAndLogin(t, h, "retrying", "pass123")
+	calculate := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression":"1+2"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set(idempotencyKeyHeader, key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := calculate("retry")
+	if first.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, first.Code, first.Body.String())
+	}
+	// The expression now fills both limits, a retry still gets it.
+	if rec := calculate("retry"); rec.Code != http.StatusOK || rec.Header().Get(idempotentReplayedHeader) != "true" || rec.Body.String() != first.Body.String() {
+		t.Fatalf("expected the replayed expression, got %d: %s", rec.Code, rec.Body.String())
+	}
+	expectTooManyRequests(t, calculate("other"), CodeTooManyActiveExpressions, "5")
+}
+
+func TestUsageHandler(t *testing.T) {
+	limits := Limits{RequestsPerSecond: 1, Burst: 5, MaxActiveExpressions: 4, DailyTaskQuota: 100}
+	h, handler, _ := setupLimitedHandlers(t, limits)
+	token := registerAndLogin(t, h, "counted", "pass123")
+	userID, _ := h.auth.ValidateJWT(token)
+
+	h.repo.CreateExpressionWithOptions(userID, "1+1", repository.ExpressionOptions{Operations: 1})
+
+	rec := serveJSON(handler, http.MethodGet, "/api/v1/me/usage", "", token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var resp UsageResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if resp.Limits != UsageLimits(limits) {
+		t.Errorf("unexpected limits %+v", resp.Limits)
+	}
+	// The usage request itself took a token.
+	if resp.Usage != (Usage{AvailableRequests: 4, ActiveExpressions: 1, TasksToday: 1}) {
+		t.Errorf("unexpected usage %+v", resp.Usage)
+	}
+	if want := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC); !resp.QuotaResetsAt.Equal(want) {
+		t.Errorf("expected quota reset at %v, got %v", want, resp.QuotaResetsAt)
+	}
+}
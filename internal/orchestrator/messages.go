@@ -0,0 +1,136 @@
+package orchestrator
+
+import (
+	"net/http"
+
+	"golang.org/x/text/language"
+)
+
+const (
+	langRussian = "ru"
+	langEnglish = "en"
+)
+
+// Russian comes first: it is used when Accept-Language is missing or names
+// no supported language, as before localization was added.
+var (
+	supportedLanguages = []string{langRussian, langEnglish}
+	languageMatcher    = language.NewMatcher([]language.Tag{language.Russian, language.English})
+)
+
+// requestLanguage picks the catalog for the Accept-Language of the request.
+func requestLanguage(r *http.Request) string {
+	tags, _, err := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	if err != nil || len(tags) == 0 {
+		return langRussian
+	}
+	// A low confidence means a guess such as English for French.
+	_, index, confidence := languageMatcher.Match(tags...)
+	if confidence < language.High {
+		return langRussian
+	}
+	return supportedLanguages[index]
+}
+
+// messageCatalogs map error codes to messages. Placeholders in braces are
+// replaced with the details of the same name.
+var messageCatalogs = map[string]map[ErrorCode]string{
+	langEnglish: {
+		CodeInternal:         "Internal server error",
+		CodeMethodNotAllowed: "Method {method} is not allowed",
+		CodeNotFound:         "Not found",
+
+		CodeInvalidJSON:      "Can't decode the request body: {reason}",
+		CodeInvalidParameter: "Parameter {parameter} ({in}) is invalid: {reason}",
+		CodeInvalidBody:      "Request body doesn't match the API specification: {reason}",
+		CodeInvalidRequest:   "Request doesn't match the API specification: {reason}",
+
+		CodeUnauthorized:       "Authorization required: send the header 'Authorization: Bearer <token>'",
+		CodeInvalidToken:       "Invalid token: {reason}",
+		CodeEmptyCredentials:   "Login and password must not be empty",
+		CodeInvalidCredentials: "Invalid login or password",
+		CodeWeakPassword:       "Password doesn't meet the requirements: {violations}",
+		CodeUserExists:         "User '{login}' already exists",
+		CodeUserNotFound:       "User not found",
+		CodeEmptyPasswords:     "Old and new password must not be empty",
+		CodeWrongPassword:      "Current password is wrong",
+
+		CodeTwoFactorEnabled:     "Two-factor authentication is already enabled",
+		CodeTwoFactorDisabled:    "Two-factor authentication is not enabled",
+		CodeTwoFactorNotEnrolled: "Enroll TOTP first",
+		CodeInvalidCode:          "Invalid code",
+		CodeEmptyChallenge:       "Challenge token and code must not be empty",
+		CodeInvalidChallenge:     "Invalid challenge token: {reason}",
+
+		CodeEmptyExpression:       "Expression must not be empty",
+		CodeInvalidExpression:     "Expression can't be parsed: {reason}",
+		CodeInvalidPriority:       "Priority {priority} is out of range, expected {min} to {max}",
+		CodeInvalidDeadline:       "Deadline {deadline} has already passed",
+		CodeIdempotencyKeyTooLong: "Idempotency key is longer than {max_length} characters",
+		CodeIdempotencyKeyReused:  "Idempotency key was already used for another expression",
+		CodeInvalidExpressionID:   "Invalid expression ID: {id}",
+		CodeExpressionNotFound:    "Expression {id} not found or access denied",
+		CodeExpressionFinished:    "Expression {id} has already finished with status {status}",
+
+		CodeRateLimited:              "Too many requests: the limit is {limit} per second, retry in {retry_after} s",
+		CodeTooManyActiveExpressions: "Too many expressions in progress: the limit is {limit}, retry in {retry_after} s",
+		CodeTooManyTasks:             "Expression has {tasks} operations, the limit is {limit}",
+		CodeDailyQuotaExceeded:       "Daily task quota exceeded: {used} of {limit} used, the expression needs {tasks}; retry in {retry_after} s",
+
+		CodeProviderUnavailable: "Identity provider is unavailable",
+		CodeProviderError:       "Identity provider error: {error} {description}",
+		CodeMissingCodeOrState:  "Missing code or state",
+		CodeInvalidState:        "Unknown or expired state",
+		CodeCodeExchangeFailed:  "Can't exchange the authorization code",
+		CodeInvalidIDToken:      "Invalid ID token",
+	},
+	langRussian: {
+		CodeInternal:         "Внутренняя ошибка сервера",
+		CodeMethodNotAllowed: "Метод {method} не разрешен",
+		CodeNotFound:         "Не найдено",
+
+		CodeInvalidJSON:      "Ошибка декодирования запроса: {reason}",
+		CodeInvalidParameter: "Неверный параметр {parameter} ({in}): {reason}",
+		CodeInvalidBody:      "Тело запроса не соответствует спецификации API: {reason}",
+		CodeInvalidRequest:   "Запрос не соответствует спецификации API: {reason}",
+
+		CodeUnauthorized:       "Требуется авторизация: передайте заголовок 'Authorization: Bearer <token>'",
+		CodeInvalidToken:       "Недействительный токен: {reason}",
+		CodeEmptyCredentials:   "Логин и пароль не могут быть пустыми",
+		CodeInvalidCredentials: "Неверный логин или пароль",
+		CodeWeakPassword:       "Пароль не соответствует требованиям: {violations}",
+		CodeUserExists:         "Пользователь '{login}' уже существует",
+		CodeUserNotFound:       "Пользователь не найден",
+		CodeEmptyPasswords:     "Старый и новый пароль не могут быть пустыми",
+		CodeWrongPassword:      "Неверный текущий пароль",
+
+		CodeTwoFactorEnabled:     "Двухфакторная аутентификация уже включена",
+		CodeTwoFactorDisabled:    "Двухфакторная аутентификация не включена",
+		CodeTwoFactorNotEnrolled: "Сначала выполните регистрацию TOTP",
+		CodeInvalidCode:          "Неверный код",
+		CodeEmptyChallenge:       "Токен подтверждения и код не могут быть пустыми",
+		CodeInvalidChallenge:     "Недействительный токен подтверждения: {reason}",
+
+		CodeEmptyExpression:       "Пустое выражение недопустимо",
+		CodeInvalidExpression:     "Ошибка разбора выражения: {reason}",
+		CodeInvalidPriority:       "Приоритет {priority} вне диапазона от {min} до {max}",
+		CodeInvalidDeadline:       "Срок {deadline} уже прошёл",
+		CodeIdempotencyKeyTooLong: "Ключ идемпотентности длиннее {max_length} символов",
+		CodeIdempotencyKeyReused:  "Ключ идемпотентности уже использован для другого выражения",
+		CodeInvalidExpressionID:   "Неверный ID выражения: {id}",
+		CodeExpressionNotFound:    "Выражение с ID {id} не найдено или доступ запрещен",
+		CodeExpressionFinished:    "Выражение с ID {id} уже завершено со статусом {status}",
+
+		CodeRateLimited:              "Слишком много запросов: лимит {limit} в секунду, повторите через {retry_after} с",
+		CodeTooManyActiveExpressions: "Слишком много выражений в работе: лимит {limit}, повторите через {retry_after} с",
+		CodeTooManyTasks:             "В выражении {tasks} операций, лимит {limit}",
+		CodeDailyQuotaExceeded:       "Дневная квота задач исчерпана: использовано {used} из {limit}, выражению нужно {tasks}; повторите через {retry_after} с",
+
+		CodeProviderUnavailable: "Провайдер идентификации недоступен",
+		CodeProviderError:       "Ошибка провайдера идентификации: {error} {description}",
+		CodeMissingCodeOrState:  "Отсутствует code или state",
+		CodeInvalidState:        "Неизвестный или просроченный state",
+		CodeCodeExchangeFailed:  "Не удалось обменять код авторизации",
+		CodeInvalidIDToken:      "Недействительный ID токен",
+	},
+}
@@ -0,0 +1,210 @@
+package orchestrator
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/internal/constants"
+	"github.com/atadzan/dist-arith-go/internal/repository"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const metricsNamespace = "calc"
+
+// Retry reasons reported by calc_task_retries_total.
+const (
+	retryReasonWorkerError  = "worker_error"
+	retryReasonLeaseExpired = "lease_expired"
+)
+
+// Lookup results reported by calc_result_cache_lookups_total and
+// calc_expression_cache_lookups_total.
+const (
+	cacheResultHit  = "hit"
+	cacheResultMiss = "miss"
+)
+
+// Metrics holds the orchestrator Prometheus series. Each instance owns its
+// registry, so tests can create as many as they need.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	leaseWait     *prometheus.HistogramVec
+	taskExecution *prometheus.HistogramVec
+	taskRetries   *prometheus.CounterVec
+	cacheLookups  *prometheus.CounterVec
+	exprLookups   *prometheus.CounterVec
+	httpDuration  *prometheus.HistogramVec
+	grpcDuration  *prometheus.HistogramVec
+}
+
+func NewMetrics(repo repository.Repository, logger *slog.Logger) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		leaseWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "task_lease_wait_seconds",
+			Help:      "Time a task spent in the queue before a worker leased it.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+		}, []string{"operation"}),
+		taskExecution: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "task_execution_seconds",
+			Help:      "Time between leasing a task and receiving its result.",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+		}, []string{"operation", "outcome"}),
+		taskRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "task_retries_total",
+			Help:      "Tasks returned to the queue, by reason.",
+		}, []string{"reason"}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "result_cache_lookups_total",
+			Help:      "Lookups of sub-task results in the result cache when expressions are submitted, by result.",
+		}, []string{"result"}),
+		exprLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "expression_cache_lookups_total",
+			Help:      "Lookups of whole expressions in the expression cache, by result.",
+		}, []string{"result"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by route.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+		grpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "grpc_request_duration_seconds",
+			Help:      "Worker gRPC call latency by method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "code"}),
+	}
+
+	m.registry.MustRegister(
+		m.leaseWait, m.taskExecution, m.taskRetries, m.cacheLookups, m.exprLookups, m.httpDuration, m.grpcDuration,
+		newStatusCollector(repo, logger.With("component", "metrics")),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	for _, reason := range []string{retryReasonWorkerError, retryReasonLeaseExpired} {
+		m.taskRetries.WithLabelValues(reason)
+	}
+	for _, result := range []string{cacheResultHit, cacheResultMiss} {
+		m.cacheLookups.WithLabelValues(result)
+		m.exprLookups.WithLabelValues(result)
+	}
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// InstrumentHandler records the latency of next under the given route label.
+// The route is the registered pattern, not the request path, to keep the
+// number of series bounded.
+func (m *Metrics) InstrumentHandler(route string, next http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerDuration(m.httpDuration.MustCurryWith(prometheus.Labels{"route": route}), next)
+}
+
+// UnaryInterceptor records the latency and status code of every gRPC call.
+func (m *Metrics) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		m.grpcDuration.WithLabelValues(info.FullMethod, status.Code(err).String()).Observe(time.Since(start).Seconds())
+		return resp, err
+	}
+}
+
+func (m *Metrics) observeLeaseWait(operation string, queuedAt time.Time) {
+	m.leaseWait.WithLabelValues(operation).Observe(secondsSince(queuedAt))
+}
+
+func (m *Metrics) observeTaskExecution(operation, outcome string, leasedAt time.Time) {
+	m.taskExecution.WithLabelValues(operation, outcome).Observe(secondsSince(leasedAt))
+}
+
+func (m *Metrics) addRetries(reason string, n int64) {
+	m.taskRetries.WithLabelValues(reason).Add(float64(n))
+}
+
+func (m *Metrics) observeCacheLookup(hit bool) {
+	m.cacheLookups.WithLabelValues(cacheResult(hit)).Inc()
+}
+
+func (m *Metrics) observeExpressionCacheLookup(hit bool) {
+	m.exprLookups.WithLabelValues(cacheResult(hit)).Inc()
+}
+
+func cacheResult(hit bool) string {
+	if hit {
+		return cacheResultHit
+	}
+	return cacheResultMiss
+}
+
+// secondsSince clamps to zero: timestamps from SQLite may be rounded down.
+func secondsSince(t time.Time) float64 {
+	if d := time.Since(t).Seconds(); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// statusCollector reports task and expression counts by status straight from
+// the database on every scrape, so the numbers survive restarts.
+type statusCollector struct {
+	repo        repository.Repository
+	logger      *slog.Logger
+	tasks       *prometheus.Desc
+	expressions *prometheus.Desc
+}
+
+func newStatusCollector(repo repository.Repository, logger *slog.Logger) *statusCollector {
+	return &statusCollector{
+		repo:   repo,
+		logger: logger,
+		tasks: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "tasks"),
+			"Number of tasks by status.", []string{"status"}, nil),
+		expressions: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "expressions"),
+			"Number of expressions by status.", []string{"status"}, nil),
+	}
+}
+
+func (c *statusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.tasks
+	ch <- c.expressions
+}
+
+func (c *statusCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collect(ch, c.tasks, c.repo.CountTasksByStatus)
+	c.collect(ch, c.expressions, c.repo.CountExpressionsByStatus)
+}
+
+func (c *statusCollector) collect(ch chan<- prometheus.Metric, desc *prometheus.Desc, count func() (map[string]int64, error)) {
+	counts, err := count()
+	if err != nil {
+		c.logger.Error("can't collect status counts", "error", err)
+		ch <- prometheus.NewInvalidMetric(desc, err)
+		return
+	}
+	for _, state := range constants.Statuses {
+		if _, ok := counts[state]; !ok {
+			counts[state] = 0
+		}
+	}
+	for state, n := range counts {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(n), state)
+	}
+}
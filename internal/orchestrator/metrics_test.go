@@ -0,0 +1,86 @@
+package orchestrator
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/internal/constants"
+	"github.com/atadzan/dist-arith-go/internal/logging"
+	pb "github.com/atadzan/dist-arith-go/internal/worker/grpc/calc"
+)
+
+func scrapeMetrics(t *testing.T, m *Metrics) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("metrics expected %d, got %d", http.StatusOK, rec.Code)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	return string(body)
+}
+
+func TestMetricsExposeTaskLifecycle(t *testing.T) {
+	h := setupHandlers(t)
+	m := h.scheduler.metrics
+	server := NewCalculatorGRPCServer(h.repo, h.scheduler.GetOperationTimes(), h.scheduler, m, logging.Discard())
+
+	uid, _ := h.repo.CreateUser("metrics", "h")
+	exprID, _ := h.repo.CreateExpression(uid, "1+2")
+	h.repo.CreateTask(exprID, "+", 1, 2, "")
+	h.repo.CreateTask(exprID, "+", 3, 4, "")
+
+	for _, outcome := range []string{"done", "error"} {
+		resp, err := server.GetTask(context.Background(), &pb.GetTaskRequest{WorkerId: "w"})
+		if err != nil || resp.GetTask() == nil {
+			t.Fatalf("GetTask returned %+v, err %v", resp, err)
+		}
+		submit := &pb.SubmitResultRequest{TaskId: resp.GetTask().GetId(), WorkerId: "w", LeaseToken: resp.GetTask().GetLeaseToken()}
+		if outcome == "done" {
+			submit.ResultStatus = &pb.SubmitResultRequest_Result{Result: 3}
+		} else {
+			submit.ResultStatus = &pb.SubmitResultRequest_Error{Error: &pb.TaskError{Message: "boom"}}
+		}
+		if _, err = server.SubmitResult(context.Background(), submit); err != nil {
+			t.Fatalf("SubmitResult error: %v", err)
+		}
+	}
+
+	// The completed task finishes the expression in the background.
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if expr, _ := h.repo.GetExpressionByIDInternal(exprID); expr.Status == constants.StatusDone {
+			break
+		}
+	}
+
+	instrumented := m.InstrumentHandler("/api/v1/expressions/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	instrumented.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/expressions/42", nil))
+
+	body := scrapeMetrics(t, m)
+	for _, want := range []string{
+		`calc_tasks{status="done"} 1`,
+		`calc_tasks{status="pending"} 1`,
+		`calc_expressions{status="done"} 1`,
+		`calc_expressions{status="cancelled"} 0`,
+		`calc_tasks{status="expired"} 0`,
+		`calc_task_lease_wait_seconds_count{operation="+"} 2`,
+		`calc_task_execution_seconds_count{operation="+",outcome="done"} 1`,
+		`calc_task_execution_seconds_count{operation="+",outcome="error"} 1`,
+		`calc_task_retries_total{reason="worker_error"} 1`,
+		`calc_task_retries_total{reason="lease_expired"} 0`,
+		`calc_result_cache_lookups_total{result="hit"} 0`,
+		`calc_http_request_duration_seconds_count{code="404",method="get",route="/api/v1/expressions/"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output lacks %q", want)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package orchestrator
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/internal/logging"
+	"github.com/atadzan/dist-arith-go/internal/models"
+	"github.com/atadzan/dist-arith-go/internal/repository"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const oidcStateTTL = 10 * time.Minute
+
+var loginSanitizer = regexp.MustCompile(`[^a-zA-Z0-9._@-]+`)
+
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// OIDCConfigFromEnv reads OIDC_* variables. SSO is disabled when OIDC_ISSUER
+// is not set.
+func OIDCConfigFromEnv() (OIDCConfig, bool) {
+	cfg := OIDCConfig{
+		Issuer:       strings.TrimRight(os.Getenv("OIDC_ISSUER"), "/"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:       []string{"openid", "profile", "email"},
+	}
+	if scopes := os.Getenv("OIDC_SCOPES"); scopes != "" {
+		cfg.Scopes = strings.Fields(strings.ReplaceAll(scopes, ",", " "))
+	}
+	return cfg, cfg.Issuer != ""
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcPendingLogin struct {
+	codeVerifier string
+	nonce        string
+	expiresAt    time.Time
+}
+
+type oidcIDTokenClaims struct {
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	PreferredUsername string `json:"preferred_username"`
+	jwt.RegisteredClaims
+}
+
+// OIDCService implements the authorization code flow with PKCE against an
+// external identity provider and exchanges the ID token for our own JWT.
+type OIDCService struct {
+	cfg        OIDCConfig
+	auth       *AuthService
+	repo       repository.Repository
+	httpClient *http.Client
+	now        func() time.Time
+	logger     *slog.Logger
+
+	mx        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+	pending   map[string]*oidcPendingLogin
+}
+
+func NewOIDCService(cfg OIDCConfig, auth *AuthService, repo repository.Repository, logger *slog.Logger) *OIDCService {
+	return &OIDCService{
+		cfg:        cfg,
+		auth:       auth,
+		repo:       repo,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		now:        time.Now,
+		logger:     logger.With("component", "oidc"),
+		keys:       make(map[string]*rsa.PublicKey),
+		pending:    make(map[string]*oidcPendingLogin),
+	}
+}
+
+// LoginHandler redirects the browser to the identity provider.
+func (s *OIDCService) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	discovery, err := s.getDiscovery()
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "discovery failed", "error", err)
+		writeError(w, r, http.StatusBadGateway, CodeProviderUnavailable, nil)
+		return
+	}
+
+	state, err := randomURLSafe(24)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "can't generate state", "error", err)
+		internalError(w, r)
+		return
+	}
+	nonce, err := randomURLSafe(24)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "can't generate nonce", "error", err)
+		internalError(w, r)
+		return
+	}
+	verifier, err := randomURLSafe(32)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "can't generate code verifier", "error", err)
+		internalError(w, r)
+		return
+	}
+
+	s.mx.Lock()
+	now := s.now()
+	for key, p := range s.pending {
+		if now.After(p.expiresAt) {
+			delete(s.pending, key)
+		}
+	}
+	s.pending[state] = &oidcPendingLogin{codeVerifier: verifier, nonce: nonce, expiresAt: now.Add(oidcStateTTL)}
+	s.mx.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", s.cfg.ClientID)
+	q.Set("redirect_uri", s.cfg.RedirectURL)
+	q.Set("scope", strings.Join(s.cfg.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+
+	target := discovery.AuthorizationEndpoint
+	if strings.Contains(target, "?") {
+		target += "&" + q.Encode()
+	} else {
+		target += "?" + q.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// CallbackHandler completes the flow: it redeems the code, verifies the ID
+// token, maps the external subject to a local user and returns our JWT.
+func (s *OIDCService) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	if providerErr := q.Get("error"); providerErr != "" {
+		writeError(w, r, http.StatusUnauthorized, CodeProviderError, map[string]any{"error": providerErr, "description": q.Get("error_description")})
+		return
+	}
+
+	code, state := q.Get("code"), q.Get("state")
+	if code == "" || state == "" {
+		writeError(w, r, http.StatusBadRequest, CodeMissingCodeOrState, nil)
+		return
+	}
+
+	s.mx.Lock()
+	pending, ok := s.pending[state]
+	delete(s.pending, state)
+	s.mx.Unlock()
+	if !ok || s.now().After(pending.expiresAt) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidState, nil)
+		return
+	}
+
+	rawIDToken, err := s.exchangeCode(code, pending.codeVerifier)
+	if err != nil {
+		s.logger.WarnContext(r.Context(), "code exchange failed", "error", err)
+		writeError(w, r, http.StatusUnauthorized, CodeCodeExchangeFailed, nil)
+		return
+	}
+
+	claims, err := s.verifyIDToken(rawIDToken, pending.nonce)
+	if err != nil {
+		s.logger.WarnContext(r.Context(), "invalid ID token", "error", err)
+		writeError(w, r, http.StatusUnauthorized, CodeInvalidIDToken, nil)
+		return
+	}
+
+	user, err := s.resolveUser(claims)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "can't resolve user", "subject", claims.Subject, "error", err)
+		internalError(w, r)
+		return
+	}
+
+	tokenString, err := s.auth.GenerateJWT(user)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "can't generate JWT", logging.UserIDKey, user.ID, "error", err)
+		internalError(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(LoginResponse{Token: tokenString})
+}
+
+func (s *OIDCService) resolveUser(claims *oidcIDTokenClaims) (*models.User, error) {
+	user, err := s.repo.GetUserByIdentity(claims.Issuer, claims.Subject)
+	if err != nil || user != nil {
+		return user, err
+	}
+
+	login := claims.PreferredUsername
+	if login == "" {
+		login = claims.Email
+	}
+	login = loginSanitizer.ReplaceAllString(login, "")
+	if login == "" {
+		login = "oidc-" + loginSanitizer.ReplaceAllString(claims.Subject, "")
+	}
+
+	user, err = s.repo.CreateUserWithIdentity(login, claims.Issuer, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info("provisioned user", logging.UserIDKey, user.ID, "login", user.Login, "subject", claims.Subject)
+	return user, nil
+}
+
+func (s *OIDCService) exchangeCode(code, verifier string) (string, error) {
+	discovery, err := s.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", s.cfg.RedirectURL)
+	form.Set("client_id", s.cfg.ClientID)
+	form.Set("code_verifier", verifier)
+	if s.cfg.ClientSecret != "" {
+		form.Set("client_secret", s.cfg.ClientSecret)
+	}
+
+	resp, err := s.httpClient.PostForm(discovery.TokenEndpoint, form)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+
+	var tokenResp struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("can't decode token response: %w", err)
+	}
+	if tokenResp.IDToken == "" {
+		return "", fmt.Errorf("token response has no id_token")
+	}
+	return tokenResp.IDToken, nil
+}
+
+func (s *OIDCService) verifyIDToken(rawIDToken, nonce string) (*oidcIDTokenClaims, error) {
+	discovery, err := s.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &oidcIDTokenClaims{}
+	_, err = jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return s.getKey(discovery, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512"}),
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(s.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(s.now),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("id token has no subject")
+	}
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("nonce mismatch")
+	}
+	return claims, nil
+}
+
+// getDiscovery returns the cached discovery document, fetching it on first
+// use. The lock isn't held during the request, so concurrent first logins
+// may fetch it more than once.
+func (s *OIDCService) getDiscovery() (*oidcDiscovery, error) {
+	s.mx.Lock()
+	discovery := s.discovery
+	s.mx.Unlock()
+	if discovery != nil {
+		return discovery, nil
+	}
+
+	discovery, err := s.fetchDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	s.mx.Lock()
+	s.discovery = discovery
+	s.mx.Unlock()
+	return discovery, nil
+}
+
+func (s *OIDCService) fetchDiscovery() (*oidcDiscovery, error) {
+	resp, err := s.httpClient.Get(s.cfg.Issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("discovery request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery endpoint returned %s", resp.Status)
+	}
+
+	discovery := new(oidcDiscovery)
+	if err = json.NewDecoder(resp.Body).Decode(discovery); err != nil {
+		return nil, fmt.Errorf("can't decode discovery document: %w", err)
+	}
+	if strings.TrimRight(discovery.Issuer, "/") != s.cfg.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q doesn't match configured %q", discovery.Issuer, s.cfg.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document is incomplete")
+	}
+	return discovery, nil
+}
+
+// getKey returns the signing key by kid, refetching the JWKS once when the
+// kid is unknown to pick up provider key rotation. The lock is only held to
+// read and replace the cached keys.
+func (s *OIDCService) getKey(discovery *oidcDiscovery, kid string) (*rsa.PublicKey, error) {
+	s.mx.Lock()
+	key, ok := lookupKey(s.keys, kid)
+	s.mx.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	keys, err := s.fetchKeys(discovery.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	s.mx.Lock()
+	s.keys = keys
+	s.mx.Unlock()
+	if key, ok = lookupKey(keys, kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func lookupKey(keys map[string]*rsa.PublicKey, kid string) (*rsa.PublicKey, bool) {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	key, ok := keys[kid]
+	return key, ok
+}
+
+func (s *OIDCService) fetchKeys(jwksURI string) (map[string]*rsa.PublicKey, error) {
+	resp, err := s.httpClient.Get(jwksURI)
+	if err != nil {
+		return nil, fmt.Errorf("jwks request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks endpoint returned %s", resp.Status)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, fmt.Errorf("can't decode jwks: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus of key %q: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent of key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+func randomURLSafe(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,289 @@
+package orchestrator
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/internal/logging"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockOIDCProvider is a minimal identity provider: it serves discovery, JWKS,
+// an authorization endpoint that immediately approves and a token endpoint
+// that enforces PKCE.
+type mockOIDCProvider struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	subject  string
+	username string
+
+	mx    sync.Mutex
+	codes map[string]mockAuthorization
+}
+
+type mockAuthorization struct {
+	challenge, nonce, redirectURI string
+}
+
+func newMockOIDCProvider(t *testing.T, clientID string) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockOIDCProvider{key: key, codes: make(map[string]mockAuthorization)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.server.URL,
+			"authorization_endpoint": p.server.URL + "/authorize",
+			"token_endpoint":         p.server.URL + "/token",
+			"jwks_uri":               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": "test-key",
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("client_id") != clientID {
+			http.Error(w, "bad authorization request", http.StatusBadRequest)
+			return
+		}
+		code, _ := randomURLSafe(16)
+		p.mx.Lock()
+		p.codes[code] = mockAuthorization{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), redirectURI: q.Get("redirect_uri")}
+		p.mx.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		p.mx.Lock()
+		auth, ok := p.codes[r.PostForm.Get("code")]
+		delete(p.codes, r.PostForm.Get("code"))
+		p.mx.Unlock()
+
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != auth.challenge ||
+			r.PostForm.Get("redirect_uri") != auth.redirectURI {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, oidcIDTokenClaims{
+			Nonce:             auth.nonce,
+			PreferredUsername: p.username,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    p.server.URL,
+				Subject:   p.subject,
+				Audience:  jwt.ClaimStrings{clientID},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+				IssuedAt:  jwt.NewNumericDate(time.Now()),
+			},
+		})
+		idToken.Header["kid"] = "test-key"
+		signed, err := idToken.SignedString(key)
+		if err != nil {
+			t.Errorf("can't sign id token: %v", err)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "opaque", "token_type": "Bearer", "id_token": signed})
+	})
+	p.server = httptest.NewServer(mux)
+	return p
+}
+
+func (p *mockOIDCProvider) login(t *testing.T, s *OIDCService) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	s.LoginHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/oidc/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("OIDC login expected %d, got %d body=%s", http.StatusFound, rec.Code, rec.Body.String())
+	}
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirect.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("authorize request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize expected %d, got %d", http.StatusFound, resp.StatusCode)
+	}
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	s.CallbackHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/oidc/callback?"+callback.RawQuery, nil))
+	return rec
+}
+
+func TestOIDCLoginProvisionsAndMapsUsers(t *testing.T) {
+	h := setupHandlers(t)
+	provider := newMockOIDCProvider(t, "calc-client")
+	defer provider.server.Close()
+
+	// A local account already owns the login suggested by the provider.
+	registerAndLogin(t, h, "jdoe", "pass123")
+
+	oidc := NewOIDCService(OIDCConfig{
+		Issuer:      provider.server.URL,
+		ClientID:    "calc-client",
+		RedirectURL: "http://orchestrator.local/api/v1/oidc/callback",
+		Scopes:      []string{"openid", "profile"},
+	}, h.auth, h.repo, logging.Discard())
+
+	provider.subject, provider.username = "sub-123", "jdoe"
+	rec := provider.login(t, oidc)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("OIDC callback expected %d, got %d body=%s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var resp LoginResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("callback decode error: %v", err)
+	}
+	userID, err := h.auth.ValidateJWT(resp.Token)
+	if err != nil {
+		t.Fatalf("issued token rejected: %v", err)
+	}
+	user, _ := h.repo.GetUserByID(userID)
+	if user == nil || user.Login != "jdoe-2" {
+		t.Fatalf("expected provisioned user jdoe-2, got %+v", user)
+	}
+
+	rec = provider.login(t, oidc)
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if again, _ := h.auth.ValidateJWT(resp.Token); again != userID {
+		t.Fatalf("second login must map to the same user %d, got %d", userID, again)
+	}
+
+	// Password-less SSO users can't log in locally.
+	rec = httptest.NewRecorder()
+	h.LoginHandler(rec, httptest.NewRequest(http.MethodPost, "/api/v1/login", strings.NewReader(`{"login":"jdoe-2","password":"anything"}`)))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("local login of SSO user expected %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	oidc.CallbackHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/oidc/callback?code=forged&state=unknown", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("callback with unknown state expected %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestOIDCRejectsForeignAudience(t *testing.T) {
+	h := setupHandlers(t)
+	provider := newMockOIDCProvider(t, "calc-client")
+	defer provider.server.Close()
+
+	oidc := NewOIDCService(OIDCConfig{
+		Issuer:      provider.server.URL,
+		ClientID:    "calc-client",
+		RedirectURL: "http://orchestrator.local/api/v1/oidc/callback",
+	}, h.auth, h.repo, logging.Discard())
+
+	claims := &oidcIDTokenClaims{
+		Nonce: "n",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    provider.server.URL,
+			Subject:   "sub-1",
+			Audience:  jwt.ClaimStrings{"other-client"},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test-key"
+	signed, err := token.SignedString(provider.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = oidc.verifyIDToken(signed, "n"); err == nil {
+		t.Fatal("ID token for another audience must be rejected")
+	}
+
+	claims.Audience = jwt.ClaimStrings{"calc-client"}
+	signed, _ = jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(provider.key)
+	if _, err = oidc.verifyIDToken(signed, "other-nonce"); err == nil {
+		t.Fatal("ID token with wrong nonce must be rejected")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestOIDCFetchesKeysWithoutLock(t *testing.T) {
+	h := setupHandlers(t)
+	provider := newMockOIDCProvider(t, "calc-client")
+	defer provider.server.Close()
+
+	oidc := NewOIDCService(OIDCConfig{
+		Issuer:      provider.server.URL,
+		ClientID:    "calc-client",
+		RedirectURL: "http://orchestrator.local/api/v1/oidc/callback",
+	}, h.auth, h.repo, logging.Discard())
+	fetching, release := make(chan struct{}), make(chan struct{})
+	oidc.httpClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path == "/jwks" {
+			close(fetching)
+			<-release
+		}
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+	discovery, err := oidc.getDiscovery()
+	if err != nil {
+		t.Fatalf("getDiscovery error: %v", err)
+	}
+
+	// A slow JWKS endpoint doesn't hold up other logins.
+	fetched := make(chan error)
+	go func() {
+		_, err := oidc.getKey(discovery, "rotated-key")
+		fetched <- err
+	}()
+	<-fetching
+	login := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		oidc.LoginHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/oidc/login", nil))
+		login <- rec.Code
+	}()
+	select {
+	case code := <-login:
+		if code != http.StatusFound {
+			t.Errorf("OIDC login expected %d, got %d", http.StatusFound, code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("login waited for the JWKS request")
+	}
+	close(release)
+	if err = <-fetched; err == nil {
+		t.Error("unknown signing key must be rejected")
+	}
+	if key, err := oidc.getKey(discovery, "test-key"); err != nil || key == nil {
+		t.Errorf("expected the fetched key to be cached, got %v, %v", key, err)
+	}
+}
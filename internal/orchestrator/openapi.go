@@ -0,0 +1,130 @@
+package orchestrator
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+)
+
+// openAPISpec is the contract of the HTTP API. Handlers are checked against it
+// by TestOpenAPIContract, so it has to be updated together with them.
+//
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// LoadOpenAPI parses and validates the embedded OpenAPI document.
+func LoadOpenAPI() (*openapi3.T, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(openAPISpec)
+	if err != nil {
+		return nil, fmt.Errorf("can't load OpenAPI document. Err: %v", err)
+	}
+	if err = doc.Validate(context.Background()); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document. Err: %v", err)
+	}
+	return doc, nil
+}
+
+// OpenAPIHandler serves the document as JSON at /api/v1/openapi.json.
+func OpenAPIHandler(doc *openapi3.T) (http.Handler, error) {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("can't encode OpenAPI document. Err: %v", err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}), nil
+}
+
+// OpenAPIValidator rejects requests that don't match the OpenAPI document
+// before they reach the handlers. Authentication is left to JWTMiddleware, and
+// paths missing from the document are passed through unchanged.
+type OpenAPIValidator struct {
+	router routers.Router
+	logger *slog.Logger
+}
+
+func NewOpenAPIValidator(doc *openapi3.T, logger *slog.Logger) (*OpenAPIValidator, error) {
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, fmt.Errorf("can't build OpenAPI router. Err: %v", err)
+	}
+	return &OpenAPIValidator{router: router, logger: logger.With("component", "openapi")}, nil
+}
+
+func (v *OpenAPIValidator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, pathParams, err := v.router.FindRoute(r)
+		if errors.Is(err, routers.ErrMethodNotAllowed) {
+			methodNotAllowed(w, r)
+			return
+		}
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+			Options:    &openapi3filter.Options{AuthenticationFunc: openapi3filter.NoopAuthenticationFunc},
+		}
+		if err = openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+			v.logger.InfoContext(r.Context(), "request rejected by OpenAPI validation", "path", r.URL.Path, "error", err)
+			code, details := validationError(err)
+			writeError(w, r, http.StatusBadRequest, code, details)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validationError converts a validation error to an error code with the
+// failed parameter and the reason, without the schema and value dumps
+// kin-openapi adds to its messages.
+func validationError(err error) (ErrorCode, map[string]any) {
+	reason := err.Error()
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err, &schemaErr) {
+		reason = schemaErr.Reason
+		if pointer := schemaErr.JSONPointer(); len(pointer) > 0 {
+			reason = fmt.Sprintf("%s: %s", strings.Join(pointer, "."), reason)
+		}
+	}
+
+	var reqErr *openapi3filter.RequestError
+	if !errors.As(err, &reqErr) {
+		return CodeInvalidRequest, map[string]any{"reason": reason}
+	}
+	for inner := reqErr; errors.As(inner.Err, &inner); {
+		reqErr = inner
+	}
+	if schemaErr == nil {
+		reason = reqErr.Reason
+		if reqErr.Err != nil {
+			reason = reqErr.Err.Error()
+		}
+	}
+	switch {
+	case reqErr.Parameter != nil:
+		return CodeInvalidParameter, map[string]any{"parameter": reqErr.Parameter.Name, "in": reqErr.Parameter.In, "reason": reason}
+	case reqErr.RequestBody != nil:
+		return CodeInvalidBody, map[string]any{"reason": reason}
+	}
+	return CodeInvalidRequest, map[string]any{"reason": reason}
+}
@@ -0,0 +1,239 @@
+package orchestrator
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/internal/logging"
+	"github.com/atadzan/dist-arith-go/pkg/totp"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"google.golang.org/grpc/health"
+)
+
+// contractClient sends requests through the validation middleware to the
+// routes registered by RegisterRoutes and checks every response against the
+// OpenAPI document.
+type contractClient struct {
+	t       *testing.T
+	doc     *openapi3.T
+	router  routers.Router
+	handler http.Handler
+	// covered holds "METHOD path status" of the documented responses seen.
+	covered map[string]bool
+}
+
+func newContractClient(t *testing.T, h *HTTPHandlers) *contractClient {
+	t.Helper()
+	doc, err := LoadOpenAPI()
+	if err != nil {
+		t.Fatalf("LoadOpenAPI: %v", err)
+	}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+	validator, err := NewOpenAPIValidator(doc, logging.Discard())
+	if err != nil {
+		t.Fatalf("NewOpenAPIValidator: %v", err)
+	}
+	openAPIHandler, err := OpenAPIHandler(doc)
+	if err != nil {
+		t.Fatalf("OpenAPIHandler: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux.Handle)
+	mux.Handle("/api/v1/openapi.json", openAPIHandler)
+	mux.Handle("/metrics", NewMetrics(h.repo, logging.Discard()).Handler())
+	healthHandlers := NewHealth(h.repo, health.NewServer())
+	mux.HandleFunc("/healthz", healthHandlers.LivenessHandler)
+	mux.HandleFunc("/readyz", healthHandlers.ReadinessHandler)
+
+	return &contractClient{
+		t:       t,
+		doc:     doc,
+		router:  router,
+		handler: validator.Middleware(mux),
+		covered: map[string]bool{},
+	}
+}
+
+func (c *contractClient) do(method, path, body, token string, header ...string) *httptest.ResponseRecorder {
+	c.t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+
+	route, pathParams, err := c.router.FindRoute(req)
+	if err != nil {
+		c.t.Fatalf("%s %s is not documented: %v", method, path, err)
+	}
+	rec := httptest.NewRecorder()
+	c.handler.ServeHTTP(rec, req)
+
+	input := &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: &openapi3filter.RequestValidationInput{Request: req, PathParams: pathParams, Route: route},
+		Status:                 rec.Code,
+		Header:                 rec.Header(),
+		Body:                   io.NopCloser(bytes.NewReader(rec.Body.Bytes())),
+		Options:                &openapi3filter.Options{IncludeResponseStatus: true},
+	}
+	if err = openapi3filter.ValidateResponse(req.Context(), input); err != nil {
+		c.t.Fatalf("%s %s: response %d doesn't match the OpenAPI document: %v\nbody=%s", method, path, rec.Code, err, rec.Body.String())
+	}
+	c.covered[method+" "+route.Path+" "+strconv.Itoa(rec.Code)] = true
+	return rec
+}
+
+// expect sends the request and fails unless it is answered with code.
+func (c *contractClient) expect(code int, method, path, body, token string, header ...string) *httptest.ResponseRecorder {
+	c.t.Helper()
+	rec := c.do(method, path, body, token, header...)
+	if rec.Code != code {
+		c.t.Fatalf("%s %s expected %d, got %d body=%s", method, path, code, rec.Code, rec.Body.String())
+	}
+	return rec
+}
+
+func decodeJSON[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.NewDecoder(rec.Body).Decode(&v); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	return v
+}
+
+// TestOpenAPIContract exercises every documented operation and fails when a
+// handler answers with a status or body the OpenAPI document doesn't describe.
+func TestOpenAPIContract(t *testing.T) {
+	h := setupHandlers(t)
+	c := newContractClient(t, h)
+
+	now := time.Unix(1700000000, 0)
+	h.auth.now = func() time.Time { return now }
+
+	c.expect(http.StatusOK, http.MethodGet, "/api/v1/openapi.json", "", "")
+	c.expect(http.StatusOK, http.MethodGet, "/healthz", "", "")
+	c.expect(http.StatusOK, http.MethodGet, "/readyz", "", "")
+	c.expect(http.StatusOK, http.MethodGet, "/metrics", "", "")
+
+	for _, prefix := range []string{"/api/v1", "/api/v2"} {
+		user := "contract" + strings.TrimPrefix(prefix, "/api/")
+		credentials := `{"login":"` + user + `","password":"pass123"}`
+
+		c.expect(http.StatusBadRequest, http.MethodPost, prefix+"/register", `{"login":"`+user+`"}`, "")
+		c.expect(http.StatusCreated, http.MethodPost, prefix+"/register", credentials, "")
+		c.expect(http.StatusConflict, http.MethodPost, prefix+"/register", credentials, "")
+		c.expect(http.StatusUnauthorized, http.MethodPost, prefix+"/login", `{"login":"`+user+`","password":"wrong"}`, "")
+		token := decodeJSON[LoginResponse](t, c.expect(http.StatusOK, http.MethodPost, prefix+"/login", credentials, "")).Token
+
+		token = decodeJSON[LoginResponse](t, c.expect(http.StatusOK, http.MethodPut, prefix+"/me/password",
+			`{"old_password":"pass123","new_password":"pass456"}`, token)).Token
+		c.expect(http.StatusForbidden, http.MethodPut, prefix+"/me/password", `{"old_password":"wrong","new_password":"pass789"}`, token)
+		credentials = `{"login":"` + user + `","password":"pass456"}`
+
+		enroll := decodeJSON[TOTPEnrollResponse](t, c.expect(http.StatusOK, http.MethodPost, prefix+"/me/2fa/enroll", "", token))
+		key, err := totp.DecodeSecret(enroll.Secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := func() string {
+			now = now.Add(time.Minute)
+			return totp.DefaultConfig.CodeAt(key, now)
+		}
+		c.expect(http.StatusUnauthorized, http.MethodPost, prefix+"/me/2fa/verify", `{"code":"000000"}`, token)
+		c.expect(http.StatusOK, http.MethodPost, prefix+"/me/2fa/verify", `{"code":"`+code()+`"}`, token)
+		c.expect(http.StatusConflict, http.MethodPost, prefix+"/me/2fa/enroll", "", token)
+
+		challenge := decodeJSON[LoginResponse](t, c.expect(http.StatusOK, http.MethodPost, prefix+"/login", credentials, ""))
+		if !challenge.TwoFactorRequired {
+			t.Fatalf("expected a 2FA challenge, got %+v", challenge)
+		}
+		c.expect(http.StatusBadRequest, http.MethodPost, prefix+"/login/2fa", `{"code":"123456"}`, "")
+		c.expect(http.StatusOK, http.MethodPost, prefix+"/login/2fa",
+			`{"challenge_token":"`+challenge.ChallengeToken+`","code":"`+code()+`"}`, "")
+		c.expect(http.StatusNoContent, http.MethodDelete, prefix+"/me/2fa", `{"code":"`+code()+`"}`, token)
+
+		c.expect(http.StatusUnauthorized, http.MethodPost, prefix+"/calculate", `{"expression":"2+2"}`, "")
+		c.expect(http.StatusBadRequest, http.MethodPost, prefix+"/calculate", `{"expression":4}`, token)
+		created := decodeJSON[CalculateResponse](t, c.expect(http.StatusCreated, http.MethodPost, prefix+"/calculate", `{"expression":"2+2"}`, token, idempotencyKeyHeader, "key"))
+		c.expect(http.StatusOK, http.MethodPost, prefix+"/calculate", `{"expression":"2+2"}`, token, idempotencyKeyHeader, "key")
+		c.expect(http.StatusUnprocessableEntity, http.MethodPost, prefix+"/calculate", `{"expression":"3+3"}`, token, idempotencyKeyHeader, "key")
+		deadline := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		c.expect(http.StatusCreated, http.MethodPost, prefix+"/calculate", `{"expression":"4+4","priority":-3,"deadline":"`+deadline+`","rebalance":false}`, token)
+		c.expect(http.StatusBadRequest, http.MethodPost, prefix+"/calculate", `{"expression":"4+4","priority":11}`, token)
+
+		c.expect(http.StatusOK, http.MethodPost, prefix+"/plan", `{"expression":"(1+2)*(3+4)","rebalance":false}`, token)
+		c.expect(http.StatusBadRequest, http.MethodPost, prefix+"/plan", `{"expression":"(1+"}`, token)
+
+		exprPath := prefix + "/expressions/" + strconv.FormatInt(created.ID, 10)
+		c.expect(http.StatusOK, http.MethodGet, prefix+"/expressions", "", token)
+		c.expect(http.StatusOK, http.MethodGet, prefix+"/expressions?status=pending", "", token)
+		c.expect(http.StatusBadRequest, http.MethodGet, prefix+"/expressions?status=unknown", "", token)
+		c.expect(http.StatusOK, http.MethodGet, exprPath, "", token)
+		c.expect(http.StatusNotFound, http.MethodGet, prefix+"/expressions/404", "", token)
+		c.expect(http.StatusBadRequest, http.MethodGet, prefix+"/expressions/abc", "", token)
+		c.expect(http.StatusOK, http.MethodGet, exprPath+"/trace", "", token)
+		c.expect(http.StatusNotFound, http.MethodGet, prefix+"/expressions/404/trace", "", token)
+		c.expect(http.StatusOK, http.MethodGet, exprPath+"/graph", "", token)
+		c.expect(http.StatusOK, http.MethodGet, exprPath+"/graph?format=mermaid", "", token)
+		c.expect(http.StatusBadRequest, http.MethodGet, exprPath+"/graph?format=svg", "", token)
+		c.expect(http.StatusOK, http.MethodPost, exprPath+"/cancel", "", token)
+		c.expect(http.StatusConflict, http.MethodPost, exprPath+"/cancel", "", token)
+		c.expect(http.StatusOK, http.MethodGet, prefix+"/me/usage", "", token)
+		c.expect(http.StatusOK, http.MethodPut, prefix+"/me/settings", `{"result_cache":false}`, token)
+		c.expect(http.StatusOK, http.MethodGet, prefix+"/me/settings", "", token)
+		c.expect(http.StatusBadRequest, http.MethodPut, prefix+"/me/settings", `{}`, token)
+
+		c.expect(http.StatusNoContent, http.MethodDelete, prefix+"/me", "", token)
+		c.expect(http.StatusUnauthorized, http.MethodGet, prefix+"/expressions", "", token)
+	}
+
+	// Methods missing from the document are rejected before the handlers.
+	rec := httptest.NewRecorder()
+	c.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/v2/calculate", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("DELETE /api/v2/calculate expected %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+
+	// Every successful response in the document has to be exercised, so
+	// an operation can't be added without a contract check. OIDC login is
+	// covered by the tests with a fake provider.
+	var missing []string
+	for path, item := range c.doc.Paths.Map() {
+		if strings.HasPrefix(path, "/api/v1/oidc/") {
+			continue
+		}
+		for method, op := range item.Operations() {
+			for status := range op.Responses.Map() {
+				if strings.HasPrefix(status, "2") && !c.covered[method+" "+path+" "+status] {
+					missing = append(missing, method+" "+path+" "+status)
+				}
+			}
+		}
+	}
+	sort.Strings(missing)
+	if len(missing) > 0 {
+		t.Fatalf("documented responses not exercised:\n%s", strings.Join(missing, "\n"))
+	}
+}
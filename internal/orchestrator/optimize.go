@@ -0,0 +1,229 @@
+package orchestrator
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+// Depth is the number of operations on the longest path from n to a number.
+// Tasks along such a path can only be computed one after another.
+func (n *Node) Depth() int {
+	if n == nil || n.Value != nil {
+		return 0
+	}
+	return 1 + max(n.Left.Depth(), n.Right.Depth())
+}
+
+// Rebalance returns a tree with every chain of + or * rebuilt for the least
+// depth, e.g. (((1+2)+3)+4) into ((1+2)+(3+4)), so more of its operations
+// can be computed in parallel. Operands are combined shallowest first, which
+// relies on both associativity and commutativity: the result is the same up
+// to floating-point rounding, which depends on the order of operations. The
+// tree of n is left unchanged.
+func (n *Node) Rebalance() *Node {
+	if n == nil || n.Value != nil {
+		return n
+	}
+	if n.Op != "+" && n.Op != "*" {
+		return &Node{Op: n.Op, Left: n.Left.Rebalance(), Right: n.Right.Rebalance()}
+	}
+
+	var operands []*Node
+	n.collectOperands(n.Op, &operands)
+	return combine(n.Op, operands)
+}
+
+// collectOperands appends the operands of the chain of op starting at n in
+// their original order.
+func (n *Node) collectOperands(op string, operands *[]*Node) {
+	if n.Value != nil || n.Op != op {
+		*operands = append(*operands, n)
+		return
+	}
+	n.Left.collectOperands(op, operands)
+	n.Right.collectOperands(op, operands)
+}
+
+type chainOperand struct {
+	node  *Node
+	depth int
+	// pos is the position of the first original operand, which keeps the
+	// result deterministic and close to the original order.
+	pos int
+}
+
+// combine joins the two shallowest operands until one is left, like Huffman
+// coding with max instead of sum, which gives the least depth.
+func combine(op string, nodes []*Node) *Node {
+	operands := make([]chainOperand, len(nodes))
+	for i, node := range nodes {
+		balanced := node.Rebalance()
+		operands[i] = chainOperand{node: balanced, depth: balanced.Depth(), pos: i}
+	}
+	for len(operands) > 1 {
+		sort.SliceStable(operands, func(i, j int) bool { return operands[i].depth < operands[j].depth })
+		a, b := operands[0], operands[1]
+		if b.pos < a.pos {
+			a, b = b, a
+		}
+		operands = append(operands[2:], chainOperand{
+			node:  &Node{Op: op, Left: a.node, Right: b.node},
+			depth: max(a.depth, b.depth) + 1,
+			pos:   a.pos,
+		})
+	}
+	return operands[0].node
+}
+
+// Optimizer simplifies expression trees before their tasks are planned, so
+// operations whose result is known don't go out to workers.
+type Optimizer struct {
+	opTimes *OperationTimes
+	// maxFoldCost is the largest sum of operation times, in milliseconds, of
+	// a sub-tree of numbers that is computed locally instead.
+	maxFoldCost int
+}
+
+// NewOptimizerFromEnv returns the optimizer enabled with OPTIMIZER_ENABLED, or
+// nil. Sub-trees are folded up to OPTIMIZER_FOLD_COST_MS (1000 by default).
+func NewOptimizerFromEnv(opTimes *OperationTimes) *Optimizer {
+	if os.Getenv("OPTIMIZER_ENABLED") != "true" {
+		return nil
+	}
+	return &Optimizer{opTimes: opTimes, maxFoldCost: readIntEnv("OPTIMIZER_FOLD_COST_MS", 1000)}
+}
+
+// optimization is a single run of the optimizer.
+type optimization struct {
+	*Optimizer
+	rewrites []string
+	// costs holds the cost of the operations folded into a number.
+	costs map[*Node]int
+}
+
+// Optimize returns the simplified tree and the rewrites applied to it, in the
+// order they were made. It applies identity rules (x+0, x-0, x*1, x/1), turns
+// 0*x into 0 when x has no division and can't overflow, either of which could
+// fail or give Inf and a NaN product, folds cheap sub-trees of numbers and
+// removes the -1* nodes of unary minus, e.g. a+(-1*x) into a-x. The tree of n is left unchanged.
+func (o *Optimizer) Optimize(n *Node) (*Node, []string) {
+	run := &optimization{Optimizer: o, costs: make(map[*Node]int)}
+	return run.optimize(n), run.rewrites
+}
+
+func (o *optimization) optimize(n *Node) *Node {
+	if n == nil || n.Value != nil {
+		return n
+	}
+	node := &Node{Op: n.Op, Left: o.optimize(n.Left), Right: o.optimize(n.Right)}
+	for node.Value == nil {
+		rule, next := o.rewrite(node)
+		if next == nil {
+			break
+		}
+		o.rewrites = append(o.rewrites, fmt.Sprintf("%s: %s -> %s", rule, node, next))
+		node = next
+	}
+	return node
+}
+
+// rewrite applies the first matching rule to n, whose operands are already
+// simplified, and returns its name and the result, or nil.
+func (o *optimization) rewrite(n *Node) (string, *Node) {
+	left, right := n.Left, n.Right
+	switch {
+	case isNumber(right, 0) && (n.Op == "+" || n.Op == "-"),
+		isNumber(right, 1) && (n.Op == "*" || n.Op == "/"):
+		return "identity", left
+	case isNumber(left, 0) && n.Op == "+", isNumber(left, 1) && n.Op == "*":
+		return "identity", right
+	case n.Op == "*" && isNumber(left, 0) && !math.IsInf(right.bound(), 1):
+		return "annihilator", left
+	case n.Op == "*" && isNumber(right, 0) && !math.IsInf(left.bound(), 1):
+		return "annihilator", right
+	}
+
+	if left.Value != nil && right.Value != nil {
+		cost := o.costs[left] + o.costs[right] + o.opTimes.forOperation(n.Op)
+		if cost > o.maxFoldCost || (n.Op == "/" && *right.Value == 0) {
+			return "", nil
+		}
+		result := evaluateOperation(n.Op, *left.Value, *right.Value)
+		folded := &Node{Value: &result}
+		o.costs[folded] = cost
+		return "fold", folded
+	}
+
+	leftNegated, rightNegated := negated(left), negated(right)
+	switch {
+	case n.Op == "*" && isNumber(left, -1) && rightNegated != nil:
+		return "negation", rightNegated
+	case n.Op == "+" && rightNegated != nil:
+		return "negation", &Node{Op: "-", Left: left, Right: rightNegated}
+	case n.Op == "+" && leftNegated != nil:
+		return "negation", &Node{Op: "-", Left: right, Right: leftNegated}
+	case n.Op == "-" && rightNegated != nil:
+		return "negation", &Node{Op: "+", Left: left, Right: rightNegated}
+	case n.Op == "*" && leftNegated != nil && rightNegated != nil:
+		return "negation", &Node{Op: "*", Left: leftNegated, Right: rightNegated}
+	case (n.Op == "*" || n.Op == "/") && leftNegated != nil && right.Value != nil:
+		return "negation", &Node{Op: n.Op, Left: leftNegated, Right: o.negate(right)}
+	case n.Op == "*" && rightNegated != nil && left.Value != nil:
+		return "negation", &Node{Op: "*", Left: o.negate(left), Right: rightNegated}
+	}
+	return "", nil
+}
+
+// negate returns the number -n, which costs as much as n.
+func (o *optimization) negate(n *Node) *Node {
+	v := -*n.Value
+	negated := &Node{Value: &v}
+	o.costs[negated] = o.costs[n]
+	return negated
+}
+
+func isNumber(n *Node, v float64) bool {
+	return n.Value != nil && *n.Value == v
+}
+
+// negated returns x for the -1*x of unary minus, or nil.
+func negated(n *Node) *Node {
+	if n.Value == nil && n.Op == "*" && isNumber(n.Left, -1) {
+		return n.Right
+	}
+	return nil
+}
+
+// bound returns an upper bound of the absolute value workers compute for n,
+// +Inf when it can overflow or has a division, which could fail or give Inf.
+func (n *Node) bound() float64 {
+	if n.Value != nil {
+		return math.Abs(*n.Value)
+	}
+	left, right := n.Left.bound(), n.Right.bound()
+	switch n.Op {
+	case "+", "-":
+		return left + right
+	case "*":
+		return left * right
+	default:
+		return math.Inf(1)
+	}
+}
+
+// evaluateOperation computes an operation the way workers do; the divisor
+// must not be zero.
+func evaluateOperation(op string, a, b float64) float64 {
+	switch op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	default:
+		return a / b
+	}
+}
@@ -0,0 +1,115 @@
+package orchestrator
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// evaluate computes the tree locally, in the order a worker pool would.
+func evaluate(n *Node) float64 {
+	if n.Value != nil {
+		return *n.Value
+	}
+	left, right := evaluate(n.Left), evaluate(n.Right)
+	switch n.Op {
+	case "+":
+		return left + right
+	case "-":
+		return left - right
+	case "*":
+		return left * right
+	default:
+		return left / right
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	tests := []struct {
+		input       string
+		want        string
+		depth, opti int
+	}{
+		{"1+2+3+4+5+6+7+8", "(((1+2)+(3+4))+((5+6)+(7+8)))", 7, 3},
+		{"1*2*3*4*5", "(((1*2)*5)*(3*4))", 4, 3},
+		{"1+2*3*4*5+6", "((1+6)+((2*3)*(4*5)))", 5, 3},
+		{"1-2-3-4", "(((1-2)-3)-4)", 3, 3},
+		{"(1+2+3+4)/(5+6+7+8)", "(((1+2)+(3+4))/((5+6)+(7+8)))", 4, 3},
+		{"7", "7", 0, 0},
+	}
+	for _, tc := range tests {
+		ast, err := NewParser(tc.input).Parse()
+		if err != nil {
+			t.Fatalf("Parse(%q) returned error: %v", tc.input, err)
+		}
+		parsed := ast.String()
+		balanced := ast.Rebalance()
+		if got := balanced.String(); got != tc.want {
+			t.Errorf("Rebalance(%q) = %q, want %q", tc.input, got, tc.want)
+		}
+		if ast.Depth() != tc.depth || balanced.Depth() != tc.opti {
+			t.Errorf("%q: depth %d -> %d, want %d -> %d", tc.input, ast.Depth(), balanced.Depth(), tc.depth, tc.opti)
+		}
+		if ast.String() != parsed {
+			t.Errorf("Rebalance(%q) changed the original tree to %q", tc.input, ast.String())
+		}
+		if evaluate(ast) != evaluate(balanced) {
+			t.Errorf("%q: %v before and %v after rebalancing", tc.input, evaluate(ast), evaluate(balanced))
+		}
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	huge := "1" + strings.Repeat("0", 200)
+	optimizer := &Optimizer{
+		opTimes:     &OperationTimes{Addition: 100, Subtraction: 100, Multiplication: 200, Division: 500},
+		maxFoldCost: 300,
+	}
+	tests := []struct {
+		input    string
+		want     string
+		rewrites []string
+	}{
+		{"(1*2*3*4)*1", "(6*4)", []string{"identity: (1*2) -> 2", "fold: (2*3) -> 6", "identity: ((6*4)*1) -> (6*4)"}},
+		{"(2+3)", "5", []string{"fold: (2+3) -> 5"}},
+		{"0*(7*8-6*5*4*3)", "0", []string{"fold: (7*8) -> 56", "fold: (6*5) -> 30", "annihilator: (0*(56-((30*4)*3))) -> 0"}},
+		{"0*(1/0)", "(0*(1/0))", nil},
+		// 1e200*1e200 overflows to Inf, and 0*Inf is NaN.
+		{"0*(" + huge + "*" + huge + "+1)", "(0*+Inf)", nil},
+		{"(" + huge + "*" + huge + "-5)*0", "(+Inf*0)", nil},
+		{"0*(" + huge + "*2*" + huge + "*2)", "(0*((2e+200*1e+200)*2))", nil},
+		{"0*(" + huge + "*1000+" + huge + ")", "0", nil},
+		{"9/(5-5)", "(9/0)", []string{"fold: (5-5) -> 0"}},
+		{"1/2/3/4+0", "(((1/2)/3)/4)", []string{"identity: ((((1/2)/3)/4)+0) -> (((1/2)/3)/4)"}},
+		{"7/8-(-(9/10))", "((7/8)+(9/10))", []string{"negation: ((7/8)-((-1)*(9/10))) -> ((7/8)+(9/10))"}},
+		{"-(7/8)+9/10", "((9/10)-(7/8))", nil},
+		{"-(-(7/8))", "(7/8)", nil},
+		{"-(7/8)*-(9/10)", "((7/8)*(9/10))", nil},
+		{"-(7/8)/4", "((7/8)/(-4))", nil},
+	}
+	for _, tc := range tests {
+		ast, err := NewParser(tc.input).Parse()
+		if err != nil {
+			t.Fatalf("Parse(%q) returned error: %v", tc.input, err)
+		}
+		parsed := ast.String()
+		optimized, rewrites := optimizer.Optimize(ast)
+		if got := optimized.String(); got != tc.want {
+			t.Errorf("Optimize(%q) = %q, want %q", tc.input, got, tc.want)
+		}
+		if tc.rewrites != nil && strings.Join(rewrites, "\n") != strings.Join(tc.rewrites, "\n") {
+			t.Errorf("Optimize(%q) rewrites %q, want %q", tc.input, rewrites, tc.rewrites)
+		}
+		if len(rewrites) == 0 && parsed != optimized.String() {
+			t.Errorf("Optimize(%q) reported no rewrites", tc.input)
+		}
+		if ast.String() != parsed {
+			t.Errorf("Optimize(%q) changed the original tree to %q", tc.input, ast.String())
+		}
+		// Divisions by zero are left to workers, which fail them.
+		before, after := evaluate(ast), evaluate(optimized)
+		if before != after && !(math.IsNaN(before) && math.IsNaN(after)) {
+			t.Errorf("%q: %v before and %v after optimizing", tc.input, before, after)
+		}
+	}
+}
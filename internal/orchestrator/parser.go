@@ -203,3 +203,22 @@ func (n *Node) String() string {
 	}
 	return fmt.Sprintf("(%s%s%s)", n.Left.String(), n.Op, n.Right.String())
 }
+
+// Canonical returns String() of the tree with the operands of + and * put in
+// a fixed order, so expressions that differ only in whitespace, number
+// notation or the order of commutative operands, like "2+3" and "3 + 2.0",
+// have the same canonical form.
+func (n *Node) Canonical() string {
+	return n.canonicalTree().String()
+}
+
+func (n *Node) canonicalTree() *Node {
+	if n == nil || n.Value != nil {
+		return n
+	}
+	left, right := n.Left.canonicalTree(), n.Right.canonicalTree()
+	if (n.Op == "+" || n.Op == "*") && right.String() < left.String() {
+		left, right = right, left
+	}
+	return &Node{Op: n.Op, Left: left, Right: right}
+}
@@ -25,3 +25,28 @@ func TestParserAST(t *testing.T) {
 		}
 	}
 }
+
+func TestCanonical(t *testing.T) {
+	tests := []struct{ a, b string }{
+		{"2+3", "3 + 2"},
+		{"2.0*05", "5*2"},
+		{"(1+2)*(3+4)", "(4+3)*(2+1)"},
+		{"-5+10", "10 + (-5)"},
+		{"1+2+3", "3+(2+1)"},
+	}
+	for _, tc := range tests {
+		a, _ := NewParser(tc.a).Parse()
+		b, _ := NewParser(tc.b).Parse()
+		if a.Canonical() != b.Canonical() {
+			t.Errorf("Canonical(%q) = %q differs from Canonical(%q) = %q", tc.a, a.Canonical(), tc.b, b.Canonical())
+		}
+	}
+
+	for _, pair := range [][2]string{{"5-3", "3-5"}, {"6/2", "2/6"}} {
+		a, _ := NewParser(pair[0]).Parse()
+		b, _ := NewParser(pair[1]).Parse()
+		if a.Canonical() == b.Canonical() {
+			t.Errorf("%q and %q must stay different, got %q", pair[0], pair[1], a.Canonical())
+		}
+	}
+}
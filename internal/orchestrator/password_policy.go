@@ -0,0 +1,169 @@
+package orchestrator
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	PolicyViolationTooShort      = "too_short"
+	PolicyViolationMissingUpper  = "missing_upper"
+	PolicyViolationMissingLower  = "missing_lower"
+	PolicyViolationMissingDigit  = "missing_digit"
+	PolicyViolationMissingSymbol = "missing_symbol"
+	PolicyViolationSameAsLogin   = "same_as_login"
+	PolicyViolationBreached      = "breached"
+)
+
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// breached holds lowercased plain passwords and upper-case hex SHA-1 digests.
+	breached map[string]struct{}
+}
+
+type PasswordPolicyError struct {
+	Violations []string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return fmt.Sprintf("password policy violated: %s", strings.Join(e.Violations, ", "))
+}
+
+func NewPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{
+		MinLength: 6,
+		breached:  make(map[string]struct{}),
+	}
+}
+
+// NewPasswordPolicyFromEnv builds the policy from PASSWORD_* variables.
+// PASSWORD_BREACHED_LIST points to a local file with one password per line;
+// lines in the "SHA1:count" format of breach dumps are accepted as well.
+func NewPasswordPolicyFromEnv() (*PasswordPolicy, error) {
+	p := NewPasswordPolicy()
+	p.MinLength = readIntEnv("PASSWORD_MIN_LENGTH", p.MinLength)
+	p.RequireUpper = readBoolEnv("PASSWORD_REQUIRE_UPPER", false)
+	p.RequireLower = readBoolEnv("PASSWORD_REQUIRE_LOWER", false)
+	p.RequireDigit = readBoolEnv("PASSWORD_REQUIRE_DIGIT", false)
+	p.RequireSymbol = readBoolEnv("PASSWORD_REQUIRE_SYMBOL", false)
+
+	if path := os.Getenv("PASSWORD_BREACHED_LIST"); path != "" {
+		if err := p.LoadBreachedList(path); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *PasswordPolicy) LoadBreachedList(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("can't open breached password list %s: %w", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if hash, _, found := strings.Cut(line, ":"); found && isSHA1Hex(hash) {
+			p.breached[strings.ToUpper(hash)] = struct{}{}
+			continue
+		}
+		p.breached[strings.ToLower(line)] = struct{}{}
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("can't read breached password list %s: %w", path, err)
+	}
+	return nil
+}
+
+func (p *PasswordPolicy) Validate(login, password string) error {
+	var (
+		violations                              []string
+		hasUpper, hasLower, hasDigit, hasSymbol bool
+	)
+	for _, ch := range password {
+		switch {
+		case unicode.IsUpper(ch):
+			hasUpper = true
+		case unicode.IsLower(ch):
+			hasLower = true
+		case unicode.IsDigit(ch):
+			hasDigit = true
+		case unicode.IsPunct(ch) || unicode.IsSymbol(ch):
+			hasSymbol = true
+		}
+	}
+
+	if len([]rune(password)) < p.MinLength {
+		violations = append(violations, PolicyViolationTooShort)
+	}
+	if p.RequireUpper && !hasUpper {
+		violations = append(violations, PolicyViolationMissingUpper)
+	}
+	if p.RequireLower && !hasLower {
+		violations = append(violations, PolicyViolationMissingLower)
+	}
+	if p.RequireDigit && !hasDigit {
+		violations = append(violations, PolicyViolationMissingDigit)
+	}
+	if p.RequireSymbol && !hasSymbol {
+		violations = append(violations, PolicyViolationMissingSymbol)
+	}
+	if login != "" && strings.EqualFold(login, password) {
+		violations = append(violations, PolicyViolationSameAsLogin)
+	}
+	if p.isBreached(password) {
+		violations = append(violations, PolicyViolationBreached)
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+func (p *PasswordPolicy) isBreached(password string) bool {
+	if len(p.breached) == 0 {
+		return false
+	}
+	if _, ok := p.breached[strings.ToLower(password)]; ok {
+		return true
+	}
+	sum := sha1.Sum([]byte(password))
+	_, ok := p.breached[strings.ToUpper(hex.EncodeToString(sum[:]))]
+	return ok
+}
+
+func isSHA1Hex(s string) bool {
+	if len(s) != sha1.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func readBoolEnv(key string, defaultValue bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		} else {
+			slog.Warn("invalid boolean in environment, using default", "key", key, "value", v, "default", defaultValue)
+		}
+	}
+	return defaultValue
+}
@@ -0,0 +1,61 @@
+package orchestrator
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	dir := t.TempDir()
+	listPath := filepath.Join(dir, "breached.txt")
+	// "Sunshine2024!" is listed in plain text, "Qwerty!234" by its SHA-1 digest.
+	list := "# local breach dump\nSunshine2024!\nC889C6A02D212F10EB48228EF29EB1E2D6B73D72:12\n"
+	if err := os.WriteFile(listPath, []byte(list), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewPasswordPolicy()
+	p.MinLength = 8
+	p.RequireUpper = true
+	p.RequireLower = true
+	p.RequireDigit = true
+	p.RequireSymbol = true
+	if err := p.LoadBreachedList(listPath); err != nil {
+		t.Fatalf("LoadBreachedList error: %v", err)
+	}
+
+	tests := []struct {
+		login, password string
+		want            []string
+	}{
+		{"alice", "C0rrect-Horse", nil},
+		{"alice", "Ab1!", []string{PolicyViolationTooShort}},
+		{"alice", "alllowercase1!", []string{PolicyViolationMissingUpper}},
+		{"alice", "ALLUPPERCASE1!", []string{PolicyViolationMissingLower}},
+		{"alice", "NoDigitsHere!", []string{PolicyViolationMissingDigit}},
+		{"alice", "NoSymbols123", []string{PolicyViolationMissingSymbol}},
+		{"Alice1!x", "alice1!X", []string{PolicyViolationSameAsLogin}},
+		{"alice", "sunshine2024!", []string{PolicyViolationMissingUpper, PolicyViolationBreached}},
+		{"alice", "Qwerty!234", []string{PolicyViolationBreached}},
+	}
+	for _, tc := range tests {
+		err := p.Validate(tc.login, tc.password)
+		if tc.want == nil {
+			if err != nil {
+				t.Errorf("Validate(%q) = %v, want nil", tc.password, err)
+			}
+			continue
+		}
+		var policyErr *PasswordPolicyError
+		if !errors.As(err, &policyErr) {
+			t.Errorf("Validate(%q) = %v, want PasswordPolicyError", tc.password, err)
+			continue
+		}
+		if !reflect.DeepEqual(policyErr.Violations, tc.want) {
+			t.Errorf("Validate(%q) violations = %v, want %v", tc.password, policyErr.Violations, tc.want)
+		}
+	}
+}
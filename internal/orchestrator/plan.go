@@ -0,0 +1,141 @@
+package orchestrator
+
+import "time"
+
+// PlanRequest is the body of POST /plan.
+type PlanRequest struct {
+	Expression string `json:"expression"`
+	// Rebalance works as in CalculateRequest.
+	Rebalance *bool `json:"rebalance,omitempty"`
+}
+
+// ExpressionPlan is the answer to POST /plan: the tasks an expression would
+// be computed with and what they would cost, without creating anything.
+type ExpressionPlan struct {
+	Expression string `json:"expression"`
+	// AST is the expression as parsed, Tree the planning tree after the
+	// optimizer and the rebalancing, see Scheduler.planningTree.
+	AST  *PlanNode `json:"ast"`
+	Tree *PlanNode `json:"tree"`
+	// Rewrites are the simplifications of the optimizer, see Optimizer.
+	Rewrites []string `json:"rewrites"`
+	// Tasks are in dependency order: every task comes after the tasks whose
+	// results it takes.
+	Tasks []PlannedTask `json:"tasks"`
+	Cost  PlanCost      `json:"cost"`
+}
+
+// PlanNode is a node of a tree: a number, or an operation with its operands.
+type PlanNode struct {
+	Op    string    `json:"op,omitempty"`
+	Value *float64  `json:"value,omitempty"`
+	Left  *PlanNode `json:"left,omitempty"`
+	Right *PlanNode `json:"right,omitempty"`
+}
+
+// PlannedTask is a task of the plan. IDs number the tasks of the plan from 1
+// and aren't the IDs the tasks would get.
+type PlannedTask struct {
+	ID        int    `json:"id"`
+	Operation string `json:"operation"`
+	// Arg1 and Arg2 are null for arguments computed by the tasks in
+	// DependsOn.
+	Arg1      *float64 `json:"arg1"`
+	Arg2      *float64 `json:"arg2"`
+	DependsOn []int    `json:"depends_on"`
+	// StartMs is the earliest start after submission with a free worker for
+	// every task, DurationMs the time of the operation.
+	StartMs    int `json:"start_ms"`
+	DurationMs int `json:"duration_ms"`
+}
+
+// PlanCost estimates the work of a plan from the operation times.
+type PlanCost struct {
+	Tasks int `json:"tasks"`
+	// Depth is the number of operations on the longest path of the parsed
+	// expression, PlannedDepth of the planning tree.
+	Depth        int `json:"depth"`
+	PlannedDepth int `json:"planned_depth"`
+	// CriticalPathMs is the time of the longest chain of dependent tasks,
+	// the least time the expression takes however many workers there are.
+	CriticalPathMs int `json:"critical_path_ms"`
+	// TotalMs is the time of all tasks, what a single worker would take.
+	TotalMs int `json:"total_ms"`
+	// Operations counts the tasks of every operation.
+	Operations map[string]int `json:"operations"`
+	// Workers is the number of live workers, see Scheduler.Estimate, and
+	// DurationMs the expected time with them, null while no worker is live.
+	Workers    int  `json:"workers"`
+	DurationMs *int `json:"duration_ms"`
+}
+
+// Plan plans the tasks of ast in memory like ScheduleTasks at the time now.
+// Results in the cache aren't looked up, so every operation is counted.
+func (s *Scheduler) Plan(expression string, ast *Node, rebalanceDisabled bool, now time.Time) ExpressionPlan {
+	plan := ExpressionPlan{
+		Expression: expression,
+		AST:        newPlanNode(ast),
+		Tasks:      []PlannedTask{},
+		Cost: PlanCost{
+			Depth:      ast.Depth(),
+			Operations: map[string]int{},
+		},
+	}
+
+	tree, rewrites := s.planningTree(ast, rebalanceDisabled)
+	plan.Tree = newPlanNode(tree)
+	plan.Rewrites = rewrites
+	if plan.Rewrites == nil {
+		plan.Rewrites = []string{}
+	}
+	plan.Cost.PlannedDepth = tree.Depth()
+
+	s.planTask(tree, &plan)
+	plan.Cost.Tasks = len(plan.Tasks)
+	if workers := s.workers.live(now); workers > 0 {
+		duration := max(plan.Cost.CriticalPathMs, plan.Cost.TotalMs/workers)
+		plan.Cost.Workers = workers
+		plan.Cost.DurationMs = &duration
+	}
+	return plan
+}
+
+// planTask appends the tasks of the operations of n after those of their
+// operands to the plan and returns the ID of the task computing n, 0 for
+// numbers, and when it is done.
+func (s *Scheduler) planTask(n *Node, plan *ExpressionPlan) (int, int) {
+	if n == nil || n.Value != nil {
+		return 0, 0
+	}
+	leftID, leftDone := s.planTask(n.Left, plan)
+	rightID, rightDone := s.planTask(n.Right, plan)
+
+	task := PlannedTask{
+		ID:         len(plan.Tasks) + 1,
+		Operation:  n.Op,
+		Arg1:       n.Left.Value,
+		Arg2:       n.Right.Value,
+		DependsOn:  []int{},
+		StartMs:    max(leftDone, rightDone),
+		DurationMs: s.opTimes.forOperation(n.Op),
+	}
+	for _, id := range []int{leftID, rightID} {
+		if id != 0 {
+			task.DependsOn = append(task.DependsOn, id)
+		}
+	}
+	plan.Tasks = append(plan.Tasks, task)
+
+	done := task.StartMs + task.DurationMs
+	plan.Cost.CriticalPathMs = max(plan.Cost.CriticalPathMs, done)
+	plan.Cost.TotalMs += task.DurationMs
+	plan.Cost.Operations[n.Op]++
+	return task.ID, done
+}
+
+func newPlanNode(n *Node) *PlanNode {
+	if n == nil {
+		return nil
+	}
+	return &PlanNode{Op: n.Op, Value: n.Value, Left: newPlanNode(n.Left), Right: newPlanNode(n.Right)}
+}
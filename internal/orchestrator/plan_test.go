@@ -0,0 +1,80 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanExpression(t *testing.T) {
+	h, handler, _ := setupLimitedHandlers(t, NewLimits())
+	token := registerAndLogin(t, h, "analyst", "pass123")
+	userID, _ := h.auth.ValidateJWT(token)
+	*h.scheduler.opTimes = OperationTimes{Addition: 1000, Subtraction: 1000, Multiplication: 2000, Division: 2000}
+	h.scheduler.optimizer = &Optimizer{opTimes: h.scheduler.opTimes, maxFoldCost: 0}
+
+	plan := func(body string) ExpressionPlan {
+		t.Helper()
+		rec := serveJSON(handler, http.MethodPost, "/api/v1/plan", body, token)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		var plan ExpressionPlan
+		if err := json.NewDecoder(rec.Body).Decode(&plan); err != nil {
+			t.Fatalf("decode error: %v", err)
+		}
+		return plan
+	}
+
+	// 4*1 is dropped, the chain of + is balanced into (1+2)+(3+4).
+	p := plan(`{"expression":"1+2+3+4*1"}`)
+	if p.AST.Op != "+" || p.AST.Right.Op != "*" || p.Tree.Left.Op != "+" || p.Tree.Right.Op != "+" || len(p.Rewrites) != 1 {
+		t.Errorf("expected the parsed and the balanced tree, got %+v", p)
+	}
+	wantTasks := []struct {
+		dependsOn       []int
+		start, duration int
+	}{
+		{[]int{}, 0, 1000},
+		{[]int{}, 0, 1000},
+		{[]int{1, 2}, 1000, 1000},
+	}
+	if len(p.Tasks) != len(wantTasks) {
+		t.Fatalf("expected %d tasks, got %+v", len(wantTasks), p.Tasks)
+	}
+	for i, w := range wantTasks {
+		task := p.Tasks[i]
+		if task.ID != i+1 || !reflect.DeepEqual(task.DependsOn, w.dependsOn) || task.StartMs != w.start || task.DurationMs != w.duration {
+			t.Errorf("task %d: expected %+v, got %+v", i+1, w, task)
+		}
+	}
+	if first := p.Tasks[0]; first.Arg1 == nil || *first.Arg1 != 1 || first.Arg2 == nil || *first.Arg2 != 2 {
+		t.Errorf("expected 1+2 first, got %+v", first)
+	}
+	if last := p.Tasks[2]; last.Arg1 != nil || last.Arg2 != nil {
+		t.Errorf("expected the arguments of the last task to be computed, got %+v", last)
+	}
+	wantCost := PlanCost{Tasks: 3, Depth: 3, PlannedDepth: 2, CriticalPathMs: 2000, TotalMs: 3000, Operations: map[string]int{"+": 3}}
+	if !reflect.DeepEqual(p.Cost, wantCost) {
+		t.Errorf("expected cost %+v, got %+v", wantCost, p.Cost)
+	}
+
+	// Two workers share 3000 ms of work but wait for the critical path.
+	h.scheduler.workers.seen("w1", time.Now())
+	h.scheduler.workers.seen("w2", time.Now())
+	p = plan(`{"expression":"1+2+3+4","rebalance":false}`)
+	if p.Cost.PlannedDepth != 3 || p.Cost.CriticalPathMs != 3000 || p.Cost.Workers != 2 || p.Cost.DurationMs == nil || *p.Cost.DurationMs != 3000 {
+		t.Errorf("expected the chain to take 3000 ms, got %+v", p.Cost)
+	}
+
+	if exprs, _ := h.repo.GetExpressionsByUserID(userID); len(exprs) != 0 {
+		t.Errorf("expected no expressions to be created, got %+v", exprs)
+	}
+	rec := serveJSON(handler, http.MethodPost, "/api/v1/plan", `{"expression":"(1+"}`, token)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), string(CodeInvalidExpression)) {
+		t.Errorf("expected %s, got %d: %s", CodeInvalidExpression, rec.Code, rec.Body.String())
+	}
+}
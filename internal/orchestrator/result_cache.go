@@ -0,0 +1,117 @@
+package orchestrator
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+)
+
+// resultCacheKey addresses a result by the operation and the exact bits of
+// its arguments, so 0 and -0 are different inputs.
+type resultCacheKey struct {
+	op         string
+	arg1, arg2 uint64
+}
+
+type resultCacheEntry[K comparable] struct {
+	key       K
+	result    float64
+	expiresAt time.Time
+}
+
+// resultCache is a least recently used cache of computed results: of tasks
+// by resultCacheKey, shared by all expressions, and of whole expressions by
+// their canonical form. A cache with size 0 stores nothing.
+type resultCache[K comparable] struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mx      sync.Mutex
+	entries map[K]*list.Element
+	// order holds *resultCacheEntry[K], most recently used first.
+	order *list.List
+}
+
+func newResultCache[K comparable](size int, ttl time.Duration) *resultCache[K] {
+	return &resultCache[K]{
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[K]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func newResultCacheKey(op string, arg1, arg2 float64) resultCacheKey {
+	return resultCacheKey{op: op, arg1: math.Float64bits(arg1), arg2: math.Float64bits(arg2)}
+}
+
+// get returns the cached result for key.
+func (c *resultCache[K]) get(key K) (float64, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return 0, false
+	}
+	entry := elem.Value.(*resultCacheEntry[K])
+	if !c.now().Before(entry.expiresAt) {
+		c.remove(elem)
+		return 0, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.result, true
+}
+
+// peek returns the cached result for key like get, without marking it as
+// recently used.
+func (c *resultCache[K]) peek(key K) (float64, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return 0, false
+	}
+	entry := elem.Value.(*resultCacheEntry[K])
+	if !c.now().Before(entry.expiresAt) {
+		return 0, false
+	}
+	return entry.result, true
+}
+
+// put stores a result, evicting the least recently used one when the cache
+// is full.
+func (c *resultCache[K]) put(key K, result float64) {
+	if c.size <= 0 {
+		return
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	expiresAt := c.now().Add(c.ttl)
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*resultCacheEntry[K])
+		entry.result, entry.expiresAt = result, expiresAt
+		c.order.MoveToFront(elem)
+		return
+	}
+	for c.order.Len() >= c.size {
+		c.remove(c.order.Back())
+	}
+	c.entries[key] = c.order.PushFront(&resultCacheEntry[K]{key: key, result: result, expiresAt: expiresAt})
+}
+
+func (c *resultCache[K]) len() int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.order.Len()
+}
+
+func (c *resultCache[K]) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*resultCacheEntry[K]).key)
+}
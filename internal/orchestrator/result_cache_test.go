@@ -0,0 +1,153 @@
+package orchestrator
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/internal/constants"
+)
+
+func TestResultCache(t *testing.T) {
+	cache := newResultCache[resultCacheKey](2, time.Minute)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return now }
+
+	cache.put(newResultCacheKey("+", 1, 2), 3)
+	cache.put(newResultCacheKey("*", 2, 3), 6)
+	if v, ok := cache.get(newResultCacheKey("+", 1, 2)); !ok || v != 3 {
+		t.Fatalf("expected cached 3, got %v, %v", v, ok)
+	}
+	if _, ok := cache.get(newResultCacheKey("+", 2, 1)); ok {
+		t.Fatal("arguments in another order must miss")
+	}
+
+	// "+" was used last, so "*" is evicted.
+	cache.put(newResultCacheKey("-", 5, 1), 4)
+	if _, ok := cache.get(newResultCacheKey("*", 2, 3)); ok {
+		t.Fatal("the least recently used result must be evicted")
+	}
+	if cache.len() != 2 {
+		t.Fatalf("expected 2 entries, got %d", cache.len())
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := cache.get(newResultCacheKey("+", 1, 2)); ok {
+		t.Fatal("results must expire after the TTL")
+	}
+	if cache.len() != 1 {
+		t.Fatalf("expired entry must be dropped, got %d entries", cache.len())
+	}
+
+	disabled := newResultCache[resultCacheKey](0, time.Minute)
+	disabled.put(newResultCacheKey("+", 1, 2), 3)
+	if _, ok := disabled.get(newResultCacheKey("+", 1, 2)); ok {
+		t.Fatal("a cache of size 0 must not store results")
+	}
+}
+
+// computePending computes all pending tasks in place of a worker.
+func computePending(t *testing.T, h *HTTPHandlers) {
+	t.Helper()
+	for {
+		task, err := h.repo.GetAndLeasePendingTask("w")
+		if err != nil {
+			t.Fatalf("GetAndLeasePendingTask error: %v", err)
+		}
+		if task == nil {
+			return
+		}
+		var result float64
+		switch task.Operation {
+		case "+":
+			result = task.Arg1 + task.Arg2
+		case "*":
+			result = task.Arg1 * task.Arg2
+		}
+		if err = h.repo.CompleteTask(task.ID, "w", task.LeaseToken, result); err != nil {
+			t.Fatalf("CompleteTask error: %v", err)
+		}
+		h.scheduler.ProcessTaskCompletion(context.Background(), task.ID)
+	}
+}
+
+// scheduleAndCompute creates and schedules an expression, returning its ID
+// and the number of tasks created for it by ScheduleTasks.
+func scheduleAndCompute(t *testing.T, h *HTTPHandlers, userID int64, expression string) (int64, int) {
+	t.Helper()
+	exprID, _ := h.repo.CreateExpression(userID, expression)
+	if err := h.scheduler.ScheduleTasks(context.Background(), exprID, expression); err != nil {
+		t.Fatalf("ScheduleTasks error: %v", err)
+	}
+	tasks, _ := h.repo.GetAllTasksForExpression(exprID)
+	computePending(t, h)
+	return exprID, len(tasks)
+}
+
+func expectDone(t *testing.T, h *HTTPHandlers, exprID int64, result float64) {
+	t.Helper()
+	if expr, _ := h.repo.GetExpressionByIDInternal(exprID); expr.Status != constants.StatusDone || expr.Result.Float64 != result {
+		t.Fatalf("expected done with %v, got %+v", result, expr)
+	}
+}
+
+func TestScheduleTasksReusesCachedResults(t *testing.T) {
+	h := setupHandlers(t)
+	uid, _ := h.repo.CreateUser("cached", "h")
+
+	if _, n := scheduleAndCompute(t, h, uid, "(1+2)*(3+4)"); n != 2 {
+		t.Fatalf("expected 2 initial tasks, got %d", n)
+	}
+
+	// The sums and the product are cached, only the last addition is left
+	// to a worker.
+	exprID, n := scheduleAndCompute(t, h, uid, "(1+2)*(3+4)+1")
+	if n != 1 {
+		t.Fatalf("expected a single task for the uncached addition, got %d", n)
+	}
+	expectDone(t, h, exprID, 22)
+
+	// The product of the first expression is looked up when it is replanned
+	// and isn't counted, nor are the lookups repeated by replans.
+	body := scrapeMetrics(t, h.scheduler.metrics)
+	for _, want := range []string{`calc_result_cache_lookups_total{result="hit"} 3`, `calc_result_cache_lookups_total{result="miss"} 3`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %s, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestScheduleTasksAnswersFromExpressionCache(t *testing.T) {
+	h := setupHandlers(t)
+	uid, _ := h.repo.CreateUser("cached", "h")
+	h.scheduler.results = newResultCache[resultCacheKey](0, time.Minute)
+
+	if _, n := scheduleAndCompute(t, h, uid, "2*(3+4)"); n != 1 {
+		t.Fatalf("expected 1 initial task, got %d", n)
+	}
+
+	// The same expression in another notation is answered from the cache
+	// even with the sub-task cache disabled.
+	exprID, n := scheduleAndCompute(t, h, uid, "( 4 + 3.0 ) * 2")
+	if n != 0 {
+		t.Fatalf("expected no tasks for a cached expression, got %d", n)
+	}
+	expectDone(t, h, exprID, 14)
+	if body := scrapeMetrics(t, h.scheduler.metrics); !strings.Contains(body, `calc_expression_cache_lookups_total{result="hit"} 1`) {
+		t.Error("expected one expression cache hit")
+	}
+
+	// Users that opted out get every expression computed again.
+	if err := h.repo.SetResultCacheDisabled(uid, true); err != nil {
+		t.Fatalf("SetResultCacheDisabled error: %v", err)
+	}
+	h.scheduler.results = newResultCache[resultCacheKey](100, time.Minute)
+	h.scheduler.results.put(newResultCacheKey("+", 3, 4), 7)
+	h.scheduler.results.put(newResultCacheKey("*", 2, 7), 14)
+	exprID, n = scheduleAndCompute(t, h, uid, "2*(3+4)")
+	if n != 1 {
+		t.Fatalf("expected the expression to be recomputed, got %d tasks", n)
+	}
+	expectDone(t, h, exprID, 14)
+}
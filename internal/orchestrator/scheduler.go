@@ -1,16 +1,27 @@
 package orchestrator
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/atadzan/dist-arith-go/internal/constants"
+	"github.com/atadzan/dist-arith-go/internal/logging"
 	"github.com/atadzan/dist-arith-go/internal/models"
 	"github.com/atadzan/dist-arith-go/internal/repository"
+	"github.com/atadzan/dist-arith-go/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type OperationTimes struct {
@@ -20,64 +31,221 @@ type OperationTimes struct {
 	Division       int
 }
 
+// forOperation returns the time of op in milliseconds.
+func (t *OperationTimes) forOperation(op string) int {
+	switch op {
+	case "+":
+		return t.Addition
+	case "-":
+		return t.Subtraction
+	case "*":
+		return t.Multiplication
+	default:
+		return t.Division
+	}
+}
+
 type Scheduler struct {
-	repo    repository.Repository
-	opTimes *OperationTimes
+	repo         repository.Repository
+	opTimes      *OperationTimes
+	leaseTimeout time.Duration
+	// results holds results of computed tasks, so identical sub-tasks of
+	// any expression are answered without a worker.
+	results *resultCache[resultCacheKey]
+	// expressions holds results of completed expressions by their canonical
+	// form, see Node.Canonical.
+	expressions *resultCache[string]
+	// optimizer simplifies expressions before planning; nil disables it.
+	optimizer *Optimizer
+	// workers are the workers that called recently, for ETAs.
+	workers *workerTracker
+	metrics *Metrics
+	logger  *slog.Logger
 }
 
-func NewScheduler(db repository.Repository) *Scheduler {
+func NewScheduler(db repository.Repository, metrics *Metrics, logger *slog.Logger) *Scheduler {
+	opTimes := initOperationTimes()
 	return &Scheduler{
-		repo:    db,
-		opTimes: initOperationTimes(),
+		repo:         db,
+		metrics:      metrics,
+		logger:       logger.With("component", "scheduler"),
+		opTimes:      opTimes,
+		optimizer:    NewOptimizerFromEnv(opTimes),
+		workers:      newWorkerTracker(time.Duration(readTimeEnv("WORKER_LIVENESS_MS", 30000)) * time.Millisecond),
+		leaseTimeout: time.Duration(readTimeEnv("TASK_LEASE_TIMEOUT_MS", 60000)) * time.Millisecond,
+		results: newResultCache[resultCacheKey](readIntEnv("RESULT_CACHE_SIZE", 10000),
+			time.Duration(readTimeEnv("RESULT_CACHE_TTL_MS", 600000))*time.Millisecond),
+		expressions: newResultCache[string](readIntEnv("EXPRESSION_CACHE_SIZE", 10000),
+			time.Duration(readTimeEnv("EXPRESSION_CACHE_TTL_MS", 600000))*time.Millisecond),
+	}
+}
+
+// useCache reports whether cached results may be used for expressions of
+// the user; users can opt out to get fresh computations.
+func (s *Scheduler) useCache(ctx context.Context, userID int64) bool {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "can't get owner of expression, results are not reused", "error", err)
+		return false
+	}
+	return user != nil && !user.ResultCacheDisabled
+}
+
+// RunLeaseReaper periodically requeues tasks whose workers didn't report back
+// within the lease timeout. It stops when ctx is cancelled.
+func (s *Scheduler) RunLeaseReaper(ctx context.Context) {
+	interval := s.leaseTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			requeued, err := s.repo.RequeueExpiredLeases(s.leaseTimeout)
+			if err != nil {
+				s.logger.ErrorContext(ctx, "can't requeue expired leases", "error", err)
+			} else if requeued > 0 {
+				s.metrics.addRetries(retryReasonLeaseExpired, requeued)
+				s.logger.WarnContext(ctx, "requeued tasks with expired leases", "count", requeued, "lease_timeout", s.leaseTimeout)
+			}
+		}
 	}
 }
 
-func (s *Scheduler) ScheduleTasks(expressionID int64, expression string) error {
+// RunDeadlineReaper expires expressions that have passed their deadline every
+// second. It stops when ctx is cancelled.
+func (s *Scheduler) RunDeadlineReaper(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			expired, err := s.repo.ExpireOverdueExpressions()
+			if err != nil {
+				s.logger.ErrorContext(ctx, "can't expire overdue expressions", "error", err)
+			} else if expired > 0 {
+				s.logger.InfoContext(ctx, "expired overdue expressions", "count", expired)
+			}
+		}
+	}
+}
+
+func (s *Scheduler) ScheduleTasks(ctx context.Context, expressionID int64, expression string) error {
+	ctx, span := tracing.Tracer().Start(ctx, "ScheduleTasks", trace.WithAttributes(attribute.Int64("expression.id", expressionID)))
+	defer span.End()
+	ctx = logging.With(ctx, logging.ExpressionIDKey, expressionID)
+
 	parser := NewParser(expression)
 	ast, err := parser.Parse()
 	if err != nil {
 		errMsg := fmt.Sprintf("parse error: %v", err)
 		s.repo.UpdateExpressionStatusResult(expressionID, constants.StatusError, sql.NullFloat64{}, sql.NullString{String: errMsg, Valid: true})
+		span.SetStatus(codes.Error, errMsg)
 		return fmt.Errorf("parse error, expression ID %d: %w", expressionID, err)
 	}
 
-	err = s.planTasksRecursive(ast, expressionID)
+	expr, err := s.repo.GetExpressionByIDInternal(expressionID)
+	if err != nil || expr == nil {
+		span.SetStatus(codes.Error, "expression not found")
+		return fmt.Errorf("can't get expression ID %d: %v", expressionID, err)
+	}
+	ast, rewrites := s.planningTree(ast, expr.RebalanceDisabled)
+	useCache := s.useCache(ctx, expr.UserID)
+	canonical := ast.Canonical()
+	if useCache && ast.Value == nil {
+		result, hit := s.expressions.get(canonical)
+		s.metrics.observeExpressionCacheLookup(hit)
+		if hit {
+			s.logger.InfoContext(ctx, "expression answered from cache", "result", result)
+			err = s.repo.UpdateExpressionStatusResult(expressionID,
+				constants.StatusDone,
+				sql.NullFloat64{Float64: result, Valid: true},
+				stepsJSON(rewrites),
+			)
+			if err != nil {
+				s.logger.ErrorContext(ctx, "can't store expression result", "error", err)
+			}
+			return nil
+		}
+	}
+
+	err = s.planTasksRecursive(ctx, ast, expressionID, useCache, nil)
+	if errors.Is(err, repository.ErrExpressionCancelled) {
+		s.logger.InfoContext(ctx, "expression cancelled or expired before scheduling")
+		return nil
+	}
 	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
 		errMsg := fmt.Sprintf("occured error: %v", err)
 		s.repo.UpdateExpressionStatusResult(expressionID, constants.StatusError, sql.NullFloat64{}, sql.NullString{String: errMsg, Valid: true})
 		return fmt.Errorf("occured error, expression ID %d: %w", expressionID, err)
 	}
 
 	if ast.Value == nil {
-		err = s.repo.UpdateExpressionStatusResult(expressionID, constants.StatusInProgress, sql.NullFloat64{}, sql.NullString{})
+		err = s.repo.UpdateExpressionStatusResult(expressionID, constants.StatusInProgress, sql.NullFloat64{}, stepsJSON(rewrites))
 		if err != nil {
-			log.Printf("occured error, expression ID %d: %v", expressionID, err)
+			s.logger.ErrorContext(ctx, "can't mark expression in progress", "error", err)
 		}
+		s.logger.InfoContext(ctx, "expression scheduled")
 	} else {
-		log.Printf("Expression ID %d. Value (%f)", expressionID, *ast.Value)
-		stepsJSON, _ := json.Marshal([]string{fmt.Sprintf("Result: %f", *ast.Value)})
+		s.logger.InfoContext(ctx, "expression computed without workers", "result", *ast.Value)
+		s.expressions.put(canonical, *ast.Value)
 		err = s.repo.UpdateExpressionStatusResult(expressionID,
 			constants.StatusDone,
 			sql.NullFloat64{Float64: *ast.Value, Valid: true},
-			sql.NullString{String: string(stepsJSON), Valid: true},
+			stepsJSON(append(rewrites, fmt.Sprintf("Result: %f", *ast.Value))),
 		)
 		if err != nil {
-			log.Printf("can't update status to done для числового выражения ID %d: %v", expressionID, err)
+			s.logger.ErrorContext(ctx, "can't store expression result", "error", err)
 		}
 	}
 
 	return nil
 }
 
-func (s *Scheduler) planTasksRecursive(node *Node, expressionID int64) error {
+// planningTree returns the tree the tasks of an expression are planned from
+// and the rewrites of the optimizer. It must be the same on every call, so
+// completed tasks match its nodes.
+func (s *Scheduler) planningTree(ast *Node, rebalanceDisabled bool) (*Node, []string) {
+	var rewrites []string
+	if s.optimizer != nil {
+		ast, rewrites = s.optimizer.Optimize(ast)
+	}
+	if rebalanceDisabled {
+		return ast, rewrites
+	}
+	return ast.Rebalance(), rewrites
+}
+
+// stepsJSON encodes steps for the steps column, which is NULL without steps.
+func stepsJSON(steps []string) sql.NullString {
+	if len(steps) == 0 {
+		return sql.NullString{}
+	}
+	encoded, _ := json.Marshal(steps)
+	return sql.NullString{String: string(encoded), Valid: true}
+}
+
+// planTasksRecursive creates tasks for the operations whose operands are
+// known. With useCache, cached results are filled in instead. Operations
+// counted in active already have a pending or leased task and are skipped.
+func (s *Scheduler) planTasksRecursive(ctx context.Context, node *Node, expressionID int64, useCache bool, active map[resultCacheKey]int) error {
 	if node == nil || node.Value != nil { // Базовый случай: лист (число) или пустой узел
 		return nil
 	}
 
-	if err := s.planTasksRecursive(node.Left, expressionID); err != nil {
+	if err := s.planTasksRecursive(ctx, node.Left, expressionID, useCache, active); err != nil {
 		return err
 	}
-	if err := s.planTasksRecursive(node.Right, expressionID); err != nil {
+	if err := s.planTasksRecursive(ctx, node.Right, expressionID, useCache, active); err != nil {
 		return err
 	}
 
@@ -85,14 +253,33 @@ func (s *Scheduler) planTasksRecursive(node *Node, expressionID int64) error {
 	rightReady := node.Right != nil && node.Right.Value != nil
 
 	if leftReady && rightReady {
+		key := newResultCacheKey(node.Op, *node.Left.Value, *node.Right.Value)
+		if active[key] > 0 {
+			active[key]--
+			return nil
+		}
+		if useCache {
+			result, hit := s.results.get(key)
+			// Replans look up again the operations answered from the cache
+			// before, so only the lookups of ScheduleTasks are counted.
+			if active == nil {
+				s.metrics.observeCacheLookup(hit)
+			}
+			if hit {
+				node.Value = &result
+				return nil
+			}
+		}
+
 		_, err := s.repo.CreateTask(
 			expressionID,
 			node.Op,
 			*node.Left.Value,
 			*node.Right.Value,
+			tracing.Serialize(ctx),
 		)
 		if err != nil {
-			return fmt.Errorf("occured err '%s' expression ID:%d, err: %v", node.Op, expressionID, err)
+			return fmt.Errorf("occured err '%s' expression ID:%d, err: %w", node.Op, expressionID, err)
 		}
 	}
 
@@ -124,26 +311,38 @@ func fillASTValues(node *Node, doneTasks []models.Task) {
 	}
 }
 
-func (s *Scheduler) ProcessTaskCompletion(taskID int64) {
-	log.Printf("Scheduler: Processing task ID %d", taskID)
+func (s *Scheduler) ProcessTaskCompletion(ctx context.Context, taskID int64) {
+	ctx, span := tracing.Tracer().Start(ctx, "ProcessTaskCompletion", trace.WithAttributes(attribute.Int64("task.id", taskID)))
+	defer span.End()
+	ctx = logging.With(ctx, logging.TaskIDKey, taskID)
+
+	s.logger.DebugContext(ctx, "processing task completion")
 
 	task, err := s.repo.GetTaskByID(taskID)
 	if err != nil {
-		log.Printf("Scheduler: error can't get task %d from db: %v", taskID, err)
+		s.logger.ErrorContext(ctx, "can't get task", "error", err)
 		return
 	}
 	if task == nil {
-		log.Printf("Scheduler: Task ID %d not found", taskID)
+		s.logger.WarnContext(ctx, "task not found")
 		return
 	}
 
 	expr, err := s.repo.GetExpressionByIDInternal(task.ExpressionID)
 	if err != nil {
-		log.Printf("Scheduler: fetch error of expression %d. Err: %v", task.ExpressionID, err)
+		s.logger.ErrorContext(ctx, "can't get expression", "expression_id", task.ExpressionID, "error", err)
 		return
 	}
 	if expr == nil {
-		log.Printf("Scheduler: Expression ID %d for task ID %d not found", task.ExpressionID, taskID)
+		s.logger.WarnContext(ctx, "expression of task not found", "expression_id", task.ExpressionID)
+		return
+	}
+	ctx = logging.With(ctx, logging.ExpressionIDKey, expr.ID)
+	if task.Status == constants.StatusDone && task.Result.Valid {
+		s.results.put(newResultCacheKey(task.Operation, task.Arg1, task.Arg2), task.Result.Float64)
+	}
+	if expr.Status == constants.StatusCancelled || expr.Status == constants.StatusExpired {
+		s.logger.InfoContext(ctx, "expression is no longer computed, result ignored", "status", expr.Status)
 		return
 	}
 
@@ -151,7 +350,7 @@ func (s *Scheduler) ProcessTaskCompletion(taskID int64) {
 	ast, err := parser.Parse()
 	if err != nil {
 		errMsg := fmt.Sprintf("parsing error. TaskId: %d, err: %v", taskID, err)
-		log.Printf("Scheduler: %s", errMsg)
+		s.logger.ErrorContext(ctx, "can't parse expression", "error", err)
 		s.repo.UpdateExpressionStatusResult(expr.ID,
 			constants.StatusError,
 			sql.NullFloat64{},
@@ -160,42 +359,85 @@ func (s *Scheduler) ProcessTaskCompletion(taskID int64) {
 		return
 	}
 
+	ast, rewrites := s.planningTree(ast, expr.RebalanceDisabled)
+	canonical := ast.Canonical()
+
 	allTasks, err := s.repo.GetAllTasksForExpression(expr.ID)
 	if err != nil {
-		log.Printf("Scheduler: error fetching expressions. ID:%d, err:%v", expr.ID, err)
+		s.logger.ErrorContext(ctx, "can't get tasks of expression", "error", err)
 	}
 	doneTasks := make([]models.Task, 0)
+	active := make(map[resultCacheKey]int)
 	for _, t := range allTasks {
-		if t.Status == constants.StatusDone {
+		switch t.Status {
+		case constants.StatusDone:
 			doneTasks = append(doneTasks, t)
+		case constants.StatusPending, constants.StatusInProgress:
+			active[newResultCacheKey(t.Operation, t.Arg1, t.Arg2)]++
 		}
 	}
 
 	fillASTValues(ast, doneTasks)
 
-	err = s.planTasksRecursive(ast, expr.ID)
+	useCache := s.useCache(ctx, expr.UserID)
+	err = s.planTasksRecursive(ctx, ast, expr.ID, useCache, active)
+	if errors.Is(err, repository.ErrExpressionCancelled) {
+		s.logger.InfoContext(ctx, "expression cancelled or expired while planning")
+		return
+	}
 	if err != nil {
-		log.Printf("Scheduler: Occured error expression ID %d: %v", expr.ID, err)
+		span.SetStatus(codes.Error, err.Error())
+		s.logger.ErrorContext(ctx, "can't plan tasks", "error", err)
 		return
 	}
 
 	if ast.Value != nil {
 		result := *ast.Value
+		trace := s.Trace(*expr, allTasks, useCache)
+		trace.Result = &result
 		s.repo.UpdateExpressionStatusResult(expr.ID,
 			constants.StatusDone,
 			sql.NullFloat64{Float64: result, Valid: true},
-			sql.NullString{},
+			stepsJSON(trace.Steps()),
 		)
-		log.Printf("Scheduler: Expression ID %d result %f.", expr.ID, result)
+		s.expressions.put(canonical, result)
+		s.logger.InfoContext(ctx, "expression done", "result", result)
 	} else {
 		s.repo.UpdateExpressionStatusResult(expr.ID,
 			constants.StatusInProgress,
 			sql.NullFloat64{},
-			sql.NullString{},
+			stepsJSON(rewrites),
 		)
 	}
 }
 
+// SchedulingWeightsFromEnv reads "login=weight" pairs from SCHEDULING_WEIGHTS
+// (comma separated). A user with weight 2 gets twice the worker capacity of a
+// user with the default weight 1 while both have pending tasks.
+func SchedulingWeightsFromEnv() (map[string]float64, error) {
+	weights := make(map[string]float64)
+	for _, pair := range strings.Split(os.Getenv("SCHEDULING_WEIGHTS"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		login, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid scheduling weight entry %q, expected login=weight", pair)
+		}
+		login = strings.TrimSpace(login)
+		weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || weight <= 0 || math.IsInf(weight, 0) {
+			return nil, fmt.Errorf("invalid scheduling weight of %q: %q, expected a positive number", login, value)
+		}
+		if _, exists := weights[login]; exists {
+			return nil, fmt.Errorf("duplicate scheduling weight for %q", login)
+		}
+		weights[login] = weight
+	}
+	return weights, nil
+}
+
 func initOperationTimes() *OperationTimes {
 	return &OperationTimes{
 		Addition:       readTimeEnv("TIME_ADDITION_MS", 1000),
@@ -205,13 +447,20 @@ func initOperationTimes() *OperationTimes {
 	}
 }
 
-func readTimeEnv(key string, defaultValue int) int {
+// readIntEnv reads a non-negative integer setting.
+func readIntEnv(key string, defaultValue int) int {
 	if v := os.Getenv(key); v != "" {
-		if t, err := strconv.Atoi(v); err == nil && t >= 0 {
-			return t
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			return n
 		} else {
-			log.Println(err)
+			slog.Warn("invalid number in environment, using default", "key", key, "value", v, "default", defaultValue)
 		}
 	}
 	return defaultValue
 }
+
+// readTimeEnv reads a duration in milliseconds, like the TIME_*_MS
+// operation times.
+func readTimeEnv(key string, defaultValue int) int {
+	return readIntEnv(key, defaultValue)
+}
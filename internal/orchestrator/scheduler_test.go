@@ -0,0 +1,129 @@
+package orchestrator
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/atadzan/dist-arith-go/internal/models"
+	"github.com/atadzan/dist-arith-go/internal/repository"
+)
+
+func TestSchedulingWeightsFromEnv(t *testing.T) {
+	tests := []struct {
+		env     string
+		weights map[string]float64
+		wantErr bool
+	}{
+		{"", map[string]float64{}, false},
+		{"alice=3, bob = 0.5,", map[string]float64{"alice": 3, "bob": 0.5}, false},
+		{"alice", nil, true},
+		{"alice=0", nil, true},
+		{"alice=-1", nil, true},
+		{"alice=fast", nil, true},
+		{"alice=1,alice=2", nil, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("SCHEDULING_WEIGHTS", tt.env)
+		weights, err := SchedulingWeightsFromEnv()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: unexpected error %v", tt.env, err)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(weights, tt.weights) {
+			t.Errorf("%q: expected %v, got %v", tt.env, tt.weights, weights)
+		}
+	}
+}
+
+func TestScheduleTasksRebalances(t *testing.T) {
+	h := setupHandlers(t)
+	uid, _ := h.repo.CreateUser("parallel", "h")
+	h.repo.SetResultCacheDisabled(uid, true)
+
+	for _, tt := range []struct {
+		rebalanceDisabled bool
+		tasks             int
+	}{
+		{false, 4},
+		{true, 1},
+	} {
+		const expression = "1+2+3+4+5+6+7+8"
+		exprID, _, _ := h.repo.CreateExpressionWithOptions(uid, expression, repository.ExpressionOptions{RebalanceDisabled: tt.rebalanceDisabled})
+		if err := h.scheduler.ScheduleTasks(context.Background(), exprID, expression); err != nil {
+			t.Fatalf("ScheduleTasks error: %v", err)
+		}
+		if tasks, _ := h.repo.GetAllTasksForExpression(exprID); len(tasks) != tt.tasks {
+			t.Errorf("rebalance disabled %v: expected %d parallel tasks, got %d", tt.rebalanceDisabled, tt.tasks, len(tasks))
+		}
+		computePending(t, h)
+		expectDone(t, h, exprID, 36)
+	}
+}
+
+func TestScheduleTasksOptimizes(t *testing.T) {
+	h := setupHandlers(t)
+	h.scheduler.optimizer = &Optimizer{opTimes: h.scheduler.opTimes, maxFoldCost: 0}
+	uid, _ := h.repo.CreateUser("simple", "h")
+	h.repo.SetResultCacheDisabled(uid, true)
+
+	const expression = "(2+3)*1 - -(4+0)"
+	exprID, _ := h.repo.CreateExpression(uid, expression)
+	if err := h.scheduler.ScheduleTasks(context.Background(), exprID, expression); err != nil {
+		t.Fatalf("ScheduleTasks error: %v", err)
+	}
+	if tasks, _ := h.repo.GetAllTasksForExpression(exprID); len(tasks) != 1 || tasks[0].Operation != "+" || tasks[0].Arg1 != 2 || tasks[0].Arg2 != 3 {
+		t.Fatalf("expected only the task 2+3, got %+v", tasks)
+	}
+	computePending(t, h)
+	expectDone(t, h, exprID, 9)
+
+	want := []string{
+		"identity: ((2+3)*1) -> (2+3)",
+		"identity: (4+0) -> 4",
+		"negation: ((2+3)-((-1)*4)) -> ((2+3)+4)",
+		"Task 1: 2 + 3 = 5 (worker w, retries 0)",
+		"Task 2: 5 + 4 = 9 (worker w, retries 0)",
+		"Result: 9.000000",
+	}
+	expr, _ := h.repo.GetExpressionByIDInternal(exprID)
+	if steps := NewExpressionResponse(*expr).Steps; !reflect.DeepEqual(steps, want) {
+		t.Errorf("expected steps %q, got %q", want, steps)
+	}
+}
+
+func TestProcessTaskCompletionSkipsActiveTasks(t *testing.T) {
+	h := setupHandlers(t)
+	uid, _ := h.repo.CreateUser("busy", "h")
+	h.repo.SetResultCacheDisabled(uid, true)
+
+	const expression = "(1+2)*(3+4)+(5+6)"
+	exprID, _ := h.repo.CreateExpression(uid, expression)
+	if err := h.scheduler.ScheduleTasks(context.Background(), exprID, expression); err != nil {
+		t.Fatalf("ScheduleTasks error: %v", err)
+	}
+
+	// One sum is completed while another is leased and the third pending:
+	// replanning must not create second tasks for them.
+	first, _ := h.repo.GetAndLeasePendingTask("w")
+	leased, _ := h.repo.GetAndLeasePendingTask("w")
+	complete := func(task *models.Task) {
+		t.Helper()
+		if err := h.repo.CompleteTask(task.ID, "w", task.LeaseToken, task.Arg1+task.Arg2); err != nil {
+			t.Fatalf("CompleteTask error: %v", err)
+		}
+		h.scheduler.ProcessTaskCompletion(context.Background(), task.ID)
+	}
+	complete(first)
+
+	tasks, _ := h.repo.GetAllTasksForExpression(exprID)
+	if len(tasks) != 3 {
+		t.Fatalf("expected the 3 sums only, got %+v", tasks)
+	}
+	complete(leased)
+	computePending(t, h)
+	if tasks, _ := h.repo.GetAllTasksForExpression(exprID); len(tasks) != 5 {
+		t.Errorf("expected 5 tasks in total, got %d", len(tasks))
+	}
+	expectDone(t, h, exprID, 32)
+}
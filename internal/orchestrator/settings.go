@@ -0,0 +1,70 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/atadzan/dist-arith-go/internal/repository"
+)
+
+// UserSettings are the preferences of the current user.
+type UserSettings struct {
+	// ResultCache lets the orchestrator answer expressions and their
+	// sub-tasks from results computed earlier. Disable it to have every
+	// expression computed by the workers anew.
+	ResultCache bool `json:"result_cache"`
+}
+
+type UpdateSettingsRequest struct {
+	ResultCache *bool `json:"result_cache"`
+}
+
+// SettingsHandler serves GET /me/settings and PUT /me/settings.
+func (h *HTTPHandlers) SettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	userID, ok := h.userID(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var req UpdateSettingsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			invalidJSON(w, r, err)
+			return
+		}
+		if req.ResultCache == nil {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidBody, map[string]any{"reason": "property \"result_cache\" is missing"})
+			return
+		}
+		err := h.repo.SetResultCacheDisabled(userID, !*req.ResultCache)
+		if errors.Is(err, repository.ErrUserNotFound) {
+			writeError(w, r, http.StatusNotFound, CodeUserNotFound, nil)
+			return
+		}
+		if err != nil {
+			h.logger.ErrorContext(r.Context(), "can't update settings", "error", err)
+			internalError(w, r)
+			return
+		}
+	}
+
+	user, err := h.repo.GetUserByID(userID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "can't get user", "error", err)
+		internalError(w, r)
+		return
+	}
+	if user == nil {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UserSettings{ResultCache: !user.ResultCacheDisabled})
+}
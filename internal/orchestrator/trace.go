@@ -0,0 +1,197 @@
+package orchestrator
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/internal/constants"
+	"github.com/atadzan/dist-arith-go/internal/models"
+)
+
+// ExpressionTrace is the answer to GET /expressions/{id}/trace.
+type ExpressionTrace struct {
+	ID         int64    `json:"id"`
+	Expression string   `json:"expression"`
+	Status     string   `json:"status"`
+	Result     *float64 `json:"result"`
+	// Rewrites are the simplifications of the optimizer, see Optimizer.
+	Rewrites []string `json:"rewrites"`
+	// Tasks are in dependency order: every task comes after the tasks whose
+	// results it takes.
+	Tasks []TaskTrace `json:"tasks"`
+}
+
+// TaskTrace is a task of an expression with its execution details.
+type TaskTrace struct {
+	ID        int64    `json:"id"`
+	Operation string   `json:"operation"`
+	Arg1      float64  `json:"arg1"`
+	Arg2      float64  `json:"arg2"`
+	Result    *float64 `json:"result"`
+	Status    string   `json:"status"`
+	// WorkerID is the worker holding or having computed the task.
+	WorkerID    string     `json:"worker_id"`
+	LeasedAt    *time.Time `json:"leased_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	Retries     int        `json:"retries"`
+	// DependsOn are the tasks that computed the arguments; arguments of
+	// the expression or from the cache have none.
+	DependsOn []int64 `json:"depends_on"`
+}
+
+// Trace returns the trace of expr from its tasks. The tasks are matched to
+// the nodes of the planning tree like in ProcessTaskCompletion; tasks that
+// match no node, e.g. of an expression that failed to parse, are appended
+// in the order they were created. useCache tells whether the owner of expr
+// reuses cached results, see traceTree.
+func (s *Scheduler) Trace(expr models.Expression, tasks []models.Task, useCache bool) ExpressionTrace {
+	trace := ExpressionTrace{
+		ID:         expr.ID,
+		Expression: expr.Expression,
+		Status:     expr.Status,
+		Rewrites:   []string{},
+		Tasks:      make([]TaskTrace, 0, len(tasks)),
+	}
+	if expr.Result.Valid {
+		result := expr.Result.Float64
+		trace.Result = &result
+	}
+
+	trace.Rewrites, _, _ = s.traceTree(expr, tasks, useCache, &trace.Tasks)
+	return trace
+}
+
+// treeNodes tells how the operations of a planning tree are computed:
+// tasks maps them to the IDs of their tasks, cached holds those answered
+// from the result cache without a task.
+type treeNodes struct {
+	tasks  map[*Node]int64
+	cached map[*Node]bool
+}
+
+// traceTree appends the traces of tasks to traces and returns the rewrites,
+// the planning tree, nil if the expression can't be parsed, and how its
+// operations are computed.
+//
+// An operation whose operands are known but that has no task was answered
+// from the cache when it was planned. Its result is taken from the cache
+// while expr is computed, and from the operands once expr is done, as the
+// entry may have been evicted since; useCache false leaves such operations
+// of expressions being computed unresolved.
+func (s *Scheduler) traceTree(expr models.Expression, tasks []models.Task, useCache bool, traces *[]TaskTrace) ([]string, *Node, treeNodes) {
+	rewrites := []string{}
+	nodes := treeNodes{tasks: make(map[*Node]int64), cached: make(map[*Node]bool)}
+	cached := func(op string, a, b float64) (float64, bool) {
+		switch {
+		case expr.Status == constants.StatusDone:
+			return evaluateOperation(op, a, b), true
+		case useCache && (expr.Status == constants.StatusPending || expr.Status == constants.StatusInProgress):
+			return s.results.peek(newResultCacheKey(op, a, b))
+		}
+		return 0, false
+	}
+
+	used := make(map[int64]bool, len(tasks))
+	ast, err := NewParser(expr.Expression).Parse()
+	if err == nil {
+		var applied []string
+		if ast, applied = s.planningTree(ast, expr.RebalanceDisabled); applied != nil {
+			rewrites = applied
+		}
+		traceTasks(ast, tasks, used, traces, nodes, cached)
+	}
+	for _, task := range tasks {
+		if !used[task.ID] {
+			*traces = append(*traces, newTaskTrace(task, nil))
+		}
+	}
+	if err != nil {
+		return rewrites, nil, nodes
+	}
+	return rewrites, ast, nodes
+}
+
+// traceTasks appends the tasks of the operations of n after those of their
+// operands and returns the ID of the task that computed n, or 0. Operations
+// without a task are looked up with cached.
+func traceTasks(n *Node, tasks []models.Task, used map[int64]bool, traces *[]TaskTrace, nodes treeNodes, cached func(op string, a, b float64) (float64, bool)) int64 {
+	if n == nil || n.Value != nil {
+		return 0
+	}
+	leftID := traceTasks(n.Left, tasks, used, traces, nodes, cached)
+	rightID := traceTasks(n.Right, tasks, used, traces, nodes, cached)
+	if n.Left.Value == nil || n.Right.Value == nil {
+		return 0
+	}
+
+	for _, task := range tasks {
+		if used[task.ID] || task.Operation != n.Op || task.Arg1 != *n.Left.Value || task.Arg2 != *n.Right.Value {
+			continue
+		}
+		used[task.ID] = true
+		dependsOn := make([]int64, 0, 2)
+		for _, id := range []int64{leftID, rightID} {
+			if id != 0 {
+				dependsOn = append(dependsOn, id)
+			}
+		}
+		*traces = append(*traces, newTaskTrace(task, dependsOn))
+		nodes.tasks[n] = task.ID
+		if task.Status == constants.StatusDone && task.Result.Valid {
+			result := task.Result.Float64
+			n.Value = &result
+		}
+		return task.ID
+	}
+
+	if result, ok := cached(n.Op, *n.Left.Value, *n.Right.Value); ok {
+		n.Value = &result
+		nodes.cached[n] = true
+	}
+	return 0
+}
+
+func newTaskTrace(task models.Task, dependsOn []int64) TaskTrace {
+	if dependsOn == nil {
+		dependsOn = []int64{}
+	}
+	trace := TaskTrace{
+		ID:        task.ID,
+		Operation: task.Operation,
+		Arg1:      task.Arg1,
+		Arg2:      task.Arg2,
+		Status:    task.Status,
+		WorkerID:  task.WorkerID,
+		Retries:   task.Retries,
+		DependsOn: dependsOn,
+	}
+	if task.Result.Valid {
+		result := task.Result.Float64
+		trace.Result = &result
+	}
+	if task.LeasedAt.Valid {
+		leasedAt := task.LeasedAt.Time
+		trace.LeasedAt = &leasedAt
+	}
+	if task.CompletedAt.Valid {
+		completedAt := task.CompletedAt.Time
+		trace.CompletedAt = &completedAt
+	}
+	return trace
+}
+
+// Steps returns the steps of a finished trace: the rewrites, every computed
+// task and the result.
+func (t ExpressionTrace) Steps() []string {
+	steps := append([]string{}, t.Rewrites...)
+	for _, task := range t.Tasks {
+		if task.Result != nil {
+			steps = append(steps, fmt.Sprintf("Task %d: %v %s %v = %v (worker %s, retries %d)",
+				task.ID, task.Arg1, task.Operation, task.Arg2, *task.Result, task.WorkerID, task.Retries))
+		}
+	}
+	if t.Result != nil {
+		steps = append(steps, fmt.Sprintf("Result: %f", *t.Result))
+	}
+	return steps
+}
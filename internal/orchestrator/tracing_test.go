@@ -0,0 +1,120 @@
+package orchestrator
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/internal/logging"
+	"github.com/atadzan/dist-arith-go/internal/tracing"
+	pb "github.com/atadzan/dist-arith-go/internal/worker/grpc/calc"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestTracePropagatesFromHTTPToWorkerAndBack(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := tracing.NewProvider("test", sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+
+	h := setupHandlers(t)
+	token := registerAndLogin(t, h, "tracer", "pass123")
+
+	lis := bufconn.Listen(bufSize)
+	srv := grpc.NewServer()
+	pb.RegisterCalcWorkerServiceServer(srv, NewCalculatorGRPCServer(h.repo, h.scheduler.GetOperationTimes(), h.scheduler, h.scheduler.metrics, logging.Discard()))
+	go srv.Serve(lis)
+	defer srv.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewCalcWorkerServiceClient(conn)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", strings.NewReader(`{"expression":"2+3"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	h.auth.JWTMiddleware(http.HandlerFunc(h.CalculateHandler)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Calculate expected %d, got %d body=%s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	// Act as a worker: take the task, compute it in a span and report back.
+	var (
+		header metadata.MD
+		task   *pb.Task
+	)
+	for deadline := time.Now().Add(2 * time.Second); task == nil && time.Now().Before(deadline); {
+		resp, err := client.GetTask(context.Background(), &pb.GetTaskRequest{WorkerId: "w"}, grpc.Header(&header))
+		if err != nil {
+			t.Fatalf("GetTask error: %v", err)
+		}
+		if task = resp.GetTask(); task == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if task == nil {
+		t.Fatal("task was not scheduled")
+	}
+	workerCtx, workerSpan := tracing.Tracer().Start(tracing.ExtractMetadata(context.Background(), header), "ProcessTask")
+	_, err = client.SubmitResult(tracing.OutgoingContext(workerCtx), &pb.SubmitResultRequest{
+		TaskId: task.Id, WorkerId: "w", LeaseToken: task.LeaseToken,
+		ResultStatus: &pb.SubmitResultRequest_Result{Result: 5},
+	})
+	workerSpan.End()
+	if err != nil {
+		t.Fatalf("SubmitResult error: %v", err)
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	want := []string{"CalculateHandler", "ScheduleTasks", "task.queued", "GetTask", "ProcessTask", "SubmitResult", "ProcessTaskCompletion"}
+	for deadline := time.Now().Add(2 * time.Second); len(spans) < len(want) && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, span := range exporter.GetSpans() {
+			spans[span.Name] = span
+		}
+	}
+
+	traceID := spans["CalculateHandler"].SpanContext.TraceID()
+	for _, name := range want {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("span %q not recorded, got %v", name, exporter.GetSpans())
+		}
+		if span.SpanContext.TraceID() != traceID {
+			t.Errorf("span %q belongs to trace %s, want %s", name, span.SpanContext.TraceID(), traceID)
+		}
+	}
+
+	parents := map[string]string{
+		"ScheduleTasks":         "CalculateHandler",
+		"task.queued":           "ScheduleTasks",
+		"GetTask":               "ScheduleTasks",
+		"ProcessTask":           "GetTask",
+		"SubmitResult":          "ProcessTask",
+		"ProcessTaskCompletion": "SubmitResult",
+	}
+	for child, parent := range parents {
+		if got := spans[child].Parent.SpanID(); got != spans[parent].SpanContext.SpanID() {
+			t.Errorf("parent of %q is %s, want %q (%s)", child, got, parent, spans[parent].SpanContext.SpanID())
+		}
+	}
+	if spans["GetTask"].SpanKind != trace.SpanKindServer {
+		t.Errorf("GetTask span kind = %v, want server", spans["GetTask"].SpanKind)
+	}
+}
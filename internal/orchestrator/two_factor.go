@@ -0,0 +1,378 @@
+package orchestrator
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/internal/logging"
+	"github.com/atadzan/dist-arith-go/internal/models"
+	"github.com/atadzan/dist-arith-go/internal/repository"
+	"github.com/atadzan/dist-arith-go/pkg/totp"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultTOTPIssuer     = "dist-arith-go"
+	challengeTTL          = 5 * time.Minute
+	maxChallengeAttempts  = 5
+	recoveryCodesCount    = 10
+	recoveryCodeByteCount = 5
+)
+
+type challengeAttempts struct {
+	failures  int
+	expiresAt time.Time
+}
+
+type TOTPEnrollResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type TOTPCodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+type TOTPVerifyResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type LoginTwoFactorRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code,omitempty"`
+}
+
+// GenerateChallengeToken issues the token returned by the first login step
+// for users with 2FA enabled.
+func (s *AuthService) GenerateChallengeToken(user *models.User) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", fmt.Errorf("can't generate challenge id: %w", err)
+	}
+
+	now := s.now()
+	claims := &Claims{
+		UserID:       user.ID,
+		TokenVersion: user.TokenVersion,
+		Purpose:      challengePurpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(jti),
+			ExpiresAt: jwt.NewNumericDate(now.Add(challengeTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			Issuer:    "calc_orchestrator",
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtKey)
+}
+
+func (s *AuthService) ValidateChallengeToken(tokenStr string) (*Claims, error) {
+	claims, err := s.parseToken(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != challengePurpose {
+		return nil, fmt.Errorf("not a challenge token")
+	}
+
+	s.challengeMx.Lock()
+	defer s.challengeMx.Unlock()
+	if attempts, ok := s.challengeFailures[claims.ID]; ok && attempts.failures >= maxChallengeAttempts {
+		return nil, fmt.Errorf("too many failed attempts")
+	}
+	return claims, nil
+}
+
+// registerChallengeFailure counts wrong codes per challenge so a single
+// challenge token can't be used to brute-force the 6-digit space.
+func (s *AuthService) registerChallengeFailure(claims *Claims) {
+	s.challengeMx.Lock()
+	defer s.challengeMx.Unlock()
+
+	now := s.now()
+	for id, attempts := range s.challengeFailures {
+		if now.After(attempts.expiresAt) {
+			delete(s.challengeFailures, id)
+		}
+	}
+
+	attempts, ok := s.challengeFailures[claims.ID]
+	if !ok {
+		attempts = &challengeAttempts{expiresAt: claims.ExpiresAt.Time}
+		s.challengeFailures[claims.ID] = attempts
+	}
+	attempts.failures++
+}
+
+// VerifySecondFactor accepts either a TOTP code or an unused recovery code.
+// Each TOTP time step can only be used once.
+func (s *AuthService) VerifySecondFactor(user *models.User, code, recoveryCode string) (bool, error) {
+	if recoveryCode = strings.TrimSpace(recoveryCode); recoveryCode != "" {
+		return s.dbStore.ConsumeRecoveryCode(user.ID, hashRecoveryCode(recoveryCode))
+	}
+
+	key, err := totp.DecodeSecret(user.TOTPSecret)
+	if err != nil {
+		return false, err
+	}
+	step, ok := s.totp.Validate(key, code, s.now())
+	if !ok {
+		return false, nil
+	}
+	return s.dbStore.ConsumeTOTPStep(user.ID, step)
+}
+
+func generateRecoveryCodes() (codes []string, hashes []string, err error) {
+	encoder := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for i := 0; i < recoveryCodesCount; i++ {
+		buf := make([]byte, recoveryCodeByteCount)
+		if _, err = rand.Read(buf); err != nil {
+			return nil, nil, fmt.Errorf("can't generate recovery code: %w", err)
+		}
+		raw := strings.ToLower(encoder.EncodeToString(buf))
+		code := raw[:4] + "-" + raw[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode normalizes case and dashes, so codes can be typed loosely.
+// Codes carry 40 random bits, which makes a plain SHA-256 sufficient.
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// TOTPEnrollHandler generates a new pending secret for the current user.
+// 2FA is not enforced until the secret is confirmed via TOTPVerifyHandler.
+func (h *HTTPHandlers) TOTPEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	user, ok := h.currentUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabled {
+		writeError(w, r, http.StatusConflict, CodeTwoFactorEnabled, nil)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "can't generate TOTP secret", "error", err)
+		internalError(w, r)
+		return
+	}
+	err = h.repo.SetUserTOTPSecret(user.ID, secret)
+	if errors.Is(err, repository.ErrUserNotFound) {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, nil)
+		return
+	}
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "can't store TOTP secret", "error", err)
+		internalError(w, r)
+		return
+	}
+
+	resp := TOTPEnrollResponse{
+		Secret:     secret,
+		OTPAuthURI: h.auth.totp.URI(h.auth.totpIssuer, user.Login, secret),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// TOTPVerifyHandler confirms enrollment with a code from the authenticator app
+// and returns one-time recovery codes. They are shown only once.
+func (h *HTTPHandlers) TOTPVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	user, ok := h.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		invalidJSON(w, r, err)
+		return
+	}
+
+	if user.TOTPEnabled {
+		writeError(w, r, http.StatusConflict, CodeTwoFactorEnabled, nil)
+		return
+	}
+	if user.TOTPSecret == "" {
+		writeError(w, r, http.StatusBadRequest, CodeTwoFactorNotEnrolled, nil)
+		return
+	}
+
+	valid, err := h.auth.VerifySecondFactor(user, req.Code, "")
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "can't verify second factor", logging.UserIDKey, user.ID, "error", err)
+		internalError(w, r)
+		return
+	}
+	if !valid {
+		writeError(w, r, http.StatusUnauthorized, CodeInvalidCode, nil)
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "can't generate recovery codes", "error", err)
+		internalError(w, r)
+		return
+	}
+	if err = h.repo.EnableUserTOTP(user.ID, hashes); err != nil {
+		h.logger.ErrorContext(r.Context(), "can't enable TOTP", "error", err)
+		internalError(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(TOTPVerifyResponse{RecoveryCodes: codes})
+}
+
+// TOTPDisableHandler turns 2FA off. It requires a valid code or recovery code.
+func (h *HTTPHandlers) TOTPDisableHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	user, ok := h.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		invalidJSON(w, r, err)
+		return
+	}
+
+	if !user.TOTPEnabled {
+		writeError(w, r, http.StatusConflict, CodeTwoFactorDisabled, nil)
+		return
+	}
+
+	valid, err := h.auth.VerifySecondFactor(user, req.Code, req.RecoveryCode)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "can't verify second factor", logging.UserIDKey, user.ID, "error", err)
+		internalError(w, r)
+		return
+	}
+	if !valid {
+		writeError(w, r, http.StatusUnauthorized, CodeInvalidCode, nil)
+		return
+	}
+
+	if err = h.repo.DisableUserTOTP(user.ID); err != nil {
+		h.logger.ErrorContext(r.Context(), "can't disable TOTP", "error", err)
+		internalError(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LoginTwoFactorHandler is the second login step: it exchanges a challenge
+// token plus a TOTP or recovery code for the API token.
+func (h *HTTPHandlers) LoginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	var req LoginTwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		invalidJSON(w, r, err)
+		return
+	}
+	if req.ChallengeToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+		writeError(w, r, http.StatusBadRequest, CodeEmptyChallenge, nil)
+		return
+	}
+
+	claims, err := h.auth.ValidateChallengeToken(req.ChallengeToken)
+	if err != nil {
+		writeError(w, r, http.StatusUnauthorized, CodeInvalidChallenge, map[string]any{"reason": err.Error()})
+		return
+	}
+
+	user, err := h.repo.GetUserByID(claims.UserID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "can't get user", logging.UserIDKey, claims.UserID, "error", err)
+		internalError(w, r)
+		return
+	}
+	if user == nil || !user.TOTPEnabled {
+		writeError(w, r, http.StatusUnauthorized, CodeInvalidCredentials, nil)
+		return
+	}
+
+	valid, err := h.auth.VerifySecondFactor(user, req.Code, req.RecoveryCode)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "can't verify second factor", logging.UserIDKey, user.ID, "error", err)
+		internalError(w, r)
+		return
+	}
+	if !valid {
+		h.auth.registerChallengeFailure(claims)
+		writeError(w, r, http.StatusUnauthorized, CodeInvalidCode, nil)
+		return
+	}
+
+	tokenString, err := h.auth.GenerateJWT(user)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "can't generate JWT", logging.UserIDKey, user.ID, "error", err)
+		internalError(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(LoginResponse{Token: tokenString})
+}
+
+func (h *HTTPHandlers) currentUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	userID, ok := h.userID(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	user, err := h.repo.GetUserByID(userID)
+	if err != nil {
+		h.logger.ErrorContext(r.Context(), "can't get user", "error", err)
+		internalError(w, r)
+		return nil, false
+	}
+	if user == nil {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, nil)
+		return nil, false
+	}
+	return user, true
+}
@@ -0,0 +1,134 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/pkg/totp"
+)
+
+func TestTwoFactorEnrollmentAndLogin(t *testing.T) {
+	h := setupHandlers(t)
+	token := registerAndLogin(t, h, "secure", "pass123")
+
+	now := time.Unix(1700000000, 0)
+	h.auth.now = func() time.Time { return now }
+
+	call := func(handler http.HandlerFunc, method, body, bearer string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/", strings.NewReader(body))
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+			h.auth.JWTMiddleware(handler).ServeHTTP(rec, req)
+		} else {
+			handler(rec, req)
+		}
+		return rec
+	}
+
+	rec := call(h.TOTPEnrollHandler, http.MethodPost, "", token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Enroll expected %d, got %d body=%s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var enroll TOTPEnrollResponse
+	if err := json.NewDecoder(rec.Body).Decode(&enroll); err != nil {
+		t.Fatalf("Enroll decode error: %v", err)
+	}
+	if !strings.HasPrefix(enroll.OTPAuthURI, "otpauth://totp/") || enroll.Secret == "" {
+		t.Fatalf("unexpected enrollment: %+v", enroll)
+	}
+	key, err := totp.DecodeSecret(enroll.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codeAt := func(at time.Time) string { return totp.DefaultConfig.CodeAt(key, at) }
+
+	rec = call(h.TOTPVerifyHandler, http.MethodPost, `{"code":"abcdef"}`, token)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Verify with wrong code expected %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+
+	rec = call(h.TOTPVerifyHandler, http.MethodPost, `{"code":"`+codeAt(now)+`"}`, token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Verify expected %d, got %d body=%s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var verify TOTPVerifyResponse
+	if err := json.NewDecoder(rec.Body).Decode(&verify); err != nil {
+		t.Fatalf("Verify decode error: %v", err)
+	}
+	if len(verify.RecoveryCodes) != recoveryCodesCount {
+		t.Fatalf("expected %d recovery codes, got %d", recoveryCodesCount, len(verify.RecoveryCodes))
+	}
+
+	login := func() LoginResponse {
+		rec := call(h.LoginHandler, http.MethodPost, `{"login":"secure","password":"pass123"}`, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Login expected %d, got %d", http.StatusOK, rec.Code)
+		}
+		var resp LoginResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("Login decode error: %v", err)
+		}
+		return resp
+	}
+
+	first := login()
+	if !first.TwoFactorRequired || first.Token != "" || first.ChallengeToken == "" {
+		t.Fatalf("Login must return only a challenge, got %+v", first)
+	}
+	if _, err := h.auth.ValidateJWT(first.ChallengeToken); err == nil {
+		t.Fatal("challenge token must not grant API access")
+	}
+
+	// The code used for enrollment belongs to an already consumed time step.
+	rec = call(h.LoginTwoFactorHandler, http.MethodPost,
+		`{"challenge_token":"`+first.ChallengeToken+`","code":"`+codeAt(now)+`"}`, "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Replayed code expected %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+
+	now = now.Add(30 * time.Second)
+	rec = call(h.LoginTwoFactorHandler, http.MethodPost,
+		`{"challenge_token":"`+first.ChallengeToken+`","code":"`+codeAt(now)+`"}`, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Second step expected %d, got %d body=%s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var second LoginResponse
+	if err := json.NewDecoder(rec.Body).Decode(&second); err != nil {
+		t.Fatalf("Second step decode error: %v", err)
+	}
+	if _, err := h.auth.ValidateJWT(second.Token); err != nil {
+		t.Fatalf("token from second step rejected: %v", err)
+	}
+
+	recovery := `{"challenge_token":"` + login().ChallengeToken + `","recovery_code":"` + strings.ToUpper(verify.RecoveryCodes[0]) + `"}`
+	if rec = call(h.LoginTwoFactorHandler, http.MethodPost, recovery, ""); rec.Code != http.StatusOK {
+		t.Fatalf("Recovery code login expected %d, got %d", http.StatusOK, rec.Code)
+	}
+	recovery = `{"challenge_token":"` + login().ChallengeToken + `","recovery_code":"` + verify.RecoveryCodes[0] + `"}`
+	if rec = call(h.LoginTwoFactorHandler, http.MethodPost, recovery, ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Reused recovery code expected %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+
+	challenge := login().ChallengeToken
+	for i := 0; i < maxChallengeAttempts; i++ {
+		call(h.LoginTwoFactorHandler, http.MethodPost, `{"challenge_token":"`+challenge+`","code":"abcdef"}`, "")
+	}
+	now = now.Add(30 * time.Second)
+	rec = call(h.LoginTwoFactorHandler, http.MethodPost,
+		`{"challenge_token":"`+challenge+`","code":"`+codeAt(now)+`"}`, "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Challenge after too many failures expected %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+
+	now = now.Add(10 * time.Minute)
+	rec = call(h.LoginTwoFactorHandler, http.MethodPost,
+		`{"challenge_token":"`+challenge+`","code":"`+codeAt(now)+`"}`, "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expired challenge expected %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+}
@@ -0,0 +1,131 @@
+package orchestrator
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const workerServicePrefix = "/calc.CalcWorkerService/"
+
+type workerIdentityKey struct{}
+
+// WorkerAuthenticator checks per-worker bearer tokens on the worker gRPC
+// service. Tokens are kept only as SHA-256 digests.
+type WorkerAuthenticator struct {
+	workers map[[sha256.Size]byte]string
+}
+
+func NewWorkerAuthenticator(tokens map[string]string) (*WorkerAuthenticator, error) {
+	a := &WorkerAuthenticator{workers: make(map[[sha256.Size]byte]string)}
+	for name, token := range tokens {
+		if name == "" || token == "" {
+			return nil, fmt.Errorf("worker name and token can't be empty")
+		}
+		digest := sha256.Sum256([]byte(token))
+		if other, ok := a.workers[digest]; ok {
+			return nil, fmt.Errorf("workers %s and %s share the same token", other, name)
+		}
+		a.workers[digest] = name
+	}
+	return a, nil
+}
+
+// WorkerTokensFromEnv reads "name:token" pairs from WORKER_TOKENS (comma
+// separated) and from the file in WORKER_TOKENS_FILE (one pair per line).
+func WorkerTokensFromEnv() (map[string]string, error) {
+	tokens := make(map[string]string)
+	add := func(pair string) error {
+		pair = strings.TrimSpace(pair)
+		if pair == "" || strings.HasPrefix(pair, "#") {
+			return nil
+		}
+		name, token, ok := strings.Cut(pair, ":")
+		if !ok {
+			return fmt.Errorf("invalid worker token entry %q, expected name:token", pair)
+		}
+		name, token = strings.TrimSpace(name), strings.TrimSpace(token)
+		if _, exists := tokens[name]; exists {
+			return fmt.Errorf("duplicate worker name %q", name)
+		}
+		tokens[name] = token
+		return nil
+	}
+
+	for _, pair := range strings.Split(os.Getenv("WORKER_TOKENS"), ",") {
+		if err := add(pair); err != nil {
+			return nil, err
+		}
+	}
+
+	if path := os.Getenv("WORKER_TOKENS_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("can't open worker tokens file %s: %w", path, err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if err = add(scanner.Text()); err != nil {
+				return nil, err
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, fmt.Errorf("can't read worker tokens file %s: %w", path, err)
+		}
+	}
+	return tokens, nil
+}
+
+// UnaryInterceptor authenticates calls to CalcWorkerService and stores the
+// worker name in the context. Other services are left untouched.
+func (a *WorkerAuthenticator) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !strings.HasPrefix(info.FullMethod, workerServicePrefix) {
+			return handler(ctx, req)
+		}
+
+		name, err := a.authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return handler(context.WithValue(ctx, workerIdentityKey{}, name), req)
+	}
+}
+
+func (a *WorkerAuthenticator) authenticate(ctx context.Context) (string, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", status.Error(codes.Unauthenticated, "missing metadata")
+	}
+	values := md.Get("authorization")
+	if len(values) != 1 {
+		return "", status.Error(codes.Unauthenticated, "missing authorization token")
+	}
+
+	parts := strings.SplitN(values[0], " ", 2)
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" || parts[1] == "" {
+		return "", status.Error(codes.Unauthenticated, "invalid authorization header (expected 'Bearer <token>')")
+	}
+
+	name, ok := a.workers[sha256.Sum256([]byte(parts[1]))]
+	if !ok {
+		return "", status.Error(codes.Unauthenticated, "unknown worker token")
+	}
+	return name, nil
+}
+
+// WorkerIdentityFromContext returns the authenticated worker name.
+func WorkerIdentityFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(workerIdentityKey{}).(string)
+	return name, ok
+}
@@ -1,12 +1,16 @@
 package repository
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/atadzan/dist-arith-go/internal/constants"
 	"github.com/atadzan/dist-arith-go/internal/models"
@@ -15,29 +19,150 @@ import (
 
 type Repository interface {
 	CreateTables() error
+	Ping(ctx context.Context) error
+	CheckMigrations() error
 	CreateUser(login, passwordHash string) (int64, error)
 	GetUserByLogin(login string) (*models.User, error)
+	GetUserByID(id int64) (*models.User, error)
+	UpdateUserPassword(userID int64, passwordHash string) (int64, error)
+	SetResultCacheDisabled(userID int64, disabled bool) error
+	DeleteUser(userID int64) error
+	SetUserTOTPSecret(userID int64, secret string) error
+	EnableUserTOTP(userID int64, recoveryCodeHashes []string) error
+	DisableUserTOTP(userID int64) error
+	ConsumeTOTPStep(userID, step int64) (bool, error)
+	ConsumeRecoveryCode(userID int64, codeHash string) (bool, error)
+	GetUserByIdentity(issuer, subject string) (*models.User, error)
+	CreateUserWithIdentity(preferredLogin, issuer, subject string) (*models.User, error)
 	CreateExpression(userID int64, expression string) (int64, error)
+	CreateExpressionWithOptions(userID int64, expression string, opts ExpressionOptions) (int64, bool, error)
+	GetExpressionIDByIdempotencyKey(userID int64, key string) (int64, error)
 	GetExpressionByID(id, userID int64) (*models.Expression, error)
 	GetExpressionsByUserID(userID int64) ([]models.Expression, error)
 	UpdateExpressionStatusResult(id int64, status string, result sql.NullFloat64, stepsJSON sql.NullString) error
-	CreateTask(expressionID int64, operation string, arg1, arg2 float64) (int64, error)
-	GetAndLeasePendingTask() (*models.Task, error)
-	CompleteTask(taskID int64, result float64) error
-	FailTask(taskID int64) error
+	CancelExpression(id, userID int64) (bool, error)
+	ExpireOverdueExpressions() (int64, error)
+	CreateTask(expressionID int64, operation string, arg1, arg2 float64, traceContext string) (int64, error)
+	GetAndLeasePendingTask(workerID string) (*models.Task, error)
+	SetSchedulingWeights(weights map[string]float64) error
+	CompleteTask(taskID int64, workerID, leaseToken string, result float64) error
+	FailTask(taskID int64, workerID, leaseToken string) error
+	RequeueExpiredLeases(timeout time.Duration) (int64, error)
 	GetTaskByID(taskID int64) (*models.Task, error)
 	HasPendingTasks(expressionID int64) (bool, error)
 	GetExpressionByIDInternal(id int64) (*models.Expression, error)
 	GetAllTasksForExpression(expressionID int64) ([]models.Task, error)
+	GetActiveTasksByUserID(userID int64) (map[int64][]models.Task, error)
+	CountDoneTasksByUserID(userID int64) (map[int64]int, error)
+	CountTasksByStatus() (map[string]int64, error)
+	CountExpressionsByStatus() (map[string]int64, error)
+	CountActiveExpressions(userID int64) (int64, error)
+	CountUserOperationsSince(userID int64, since time.Time) (int64, error)
 }
 
+// ErrStaleLease is returned when a result is submitted for a task that is not
+// (or no longer) leased by the submitting worker with the given lease token.
+var ErrStaleLease = errors.New("task is not leased by this worker")
+
+// ErrExpressionCancelled is returned when a task is planned for an expression
+// that has been cancelled or has expired in the meantime.
+var ErrExpressionCancelled = errors.New("expression is cancelled")
+
+// ExpressionOptions are the optional parameters of a new expression.
+type ExpressionOptions struct {
+	// IdempotencyKey, if set, makes the creation idempotent per user.
+	IdempotencyKey string
+	// Priority ranges from constants.MinPriority to constants.MaxPriority.
+	Priority int
+	// Deadline is the time the expression expires at if it isn't done.
+	Deadline sql.NullTime
+	// RebalanceDisabled keeps the tree of the expression as parsed.
+	RebalanceDisabled bool
+	// Depth and PlannedDepth are the depths of the parsed tree and of the
+	// tree the tasks are planned from.
+	Depth, PlannedDepth int
+	// Operations is the number of tasks the expression is split into.
+	Operations int
+
+	// MaxActive, if positive, fails the creation with
+	// ErrTooManyActiveExpressions when the user already has that many
+	// pending and in-progress expressions.
+	MaxActive int
+	// TaskQuota, if positive, fails the creation with a *QuotaExceededError
+	// when the operations of the expressions of the user since QuotaSince,
+	// see CountUserOperationsSince, and the Operations of the new expression
+	// exceed it.
+	TaskQuota  int
+	QuotaSince time.Time
+}
+
+// ErrTooManyActiveExpressions is returned by CreateExpressionWithOptions when
+// the user has ExpressionOptions.MaxActive unfinished expressions.
+var ErrTooManyActiveExpressions = errors.New("too many active expressions")
+
+// QuotaExceededError is returned by CreateExpressionWithOptions when the new
+// expression doesn't fit into ExpressionOptions.TaskQuota.
+type QuotaExceededError struct {
+	// Used is the number of tasks counted against the quota.
+	Used int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("daily task quota exceeded, %d tasks used", e.Used)
+}
+
+// timestampFormat matches strftime('%Y-%m-%d %H:%M:%f', 'now'), so stored
+// times compare correctly with it as text.
+const timestampFormat = "2006-01-02 15:04:05.000"
+
+// ErrUserExists is returned by CreateUser for a login that is already taken.
+var ErrUserExists = errors.New("user already exists")
+
+// ErrUserNotFound is returned by updates of a user that doesn't exist.
+var ErrUserNotFound = errors.New("user not found")
+
 type repo struct {
-	db *sql.DB
-	mx *sync.RWMutex
+	db     *sql.DB
+	mx     *sync.RWMutex
+	logger *slog.Logger
+}
+
+func New(db *sql.DB, logger *slog.Logger) (Repository, error) {
+	return &repo{db: db, mx: new(sync.RWMutex), logger: logger.With("component", "repository")}, nil
+}
+
+// schemaTables are the tables created by CreateTables.
+var schemaTables = []string{"users", "expressions", "tasks", "recovery_codes", "user_identities", "scheduling_weights", "scheduling_state"}
+
+// migrationColumns were added after the first release; CreateTables adds them
+// to existing databases.
+var migrationColumns = []struct{ table, column, definition string }{
+	{"users", "token_version", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "totp_secret", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "totp_enabled", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+	{"tasks", "worker_id", "TEXT NOT NULL DEFAULT ''"},
+	{"tasks", "lease_token", "TEXT NOT NULL DEFAULT ''"},
+	{"tasks", "leased_at", "DATETIME"},
+	{"tasks", "trace_context", "TEXT NOT NULL DEFAULT ''"},
+	{"expressions", "idempotency_key", "TEXT"},
+	{"users", "scheduling_pass", "REAL NOT NULL DEFAULT 0"},
+	{"expressions", "priority", "INTEGER NOT NULL DEFAULT 0"},
+	{"expressions", "deadline", "DATETIME"},
+	{"users", "result_cache_disabled", "INTEGER NOT NULL DEFAULT 0"},
+	{"expressions", "rebalance_disabled", "INTEGER NOT NULL DEFAULT 0"},
+	{"expressions", "depth", "INTEGER NOT NULL DEFAULT 0"},
+	{"expressions", "planned_depth", "INTEGER NOT NULL DEFAULT 0"},
+	{"tasks", "completed_at", "DATETIME"},
+	{"expressions", "operations", "INTEGER NOT NULL DEFAULT 0"},
 }
 
-func New(db *sql.DB) (Repository, error) {
-	return &repo{db: db, mx: new(sync.RWMutex)}, nil
+// migrationIndexes are created after the columns they cover.
+var migrationIndexes = []string{
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_expressions_idempotency_key
+		ON expressions(user_id, idempotency_key) WHERE idempotency_key IS NOT NULL`,
+	`CREATE INDEX IF NOT EXISTS idx_tasks_expression_id ON tasks(expression_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_tasks_status ON tasks(status)`,
 }
 
 func (r *repo) CreateTables() error {
@@ -72,12 +197,123 @@ func (r *repo) CreateTables() error {
 			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			FOREIGN KEY(expression_id) REFERENCES expressions(id)
 		)`,
+		`CREATE TABLE IF NOT EXISTS recovery_codes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			code_hash TEXT NOT NULL,
+			used_at DATETIME,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_identities (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			issuer TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(issuer, subject),
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS scheduling_weights (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			login TEXT NOT NULL UNIQUE,
+			weight REAL NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS scheduling_state (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			virtual_time REAL NOT NULL DEFAULT 0
+		)`,
+		`INSERT OR IGNORE INTO scheduling_state (id, virtual_time) VALUES (1, 0)`,
 	}
 	for _, tableCreateQuery := range migrationTables {
 		if _, err := r.db.Exec(tableCreateQuery); err != nil {
 			return fmt.Errorf("occured error while applying db migration. Err: %v", err)
 		}
 	}
+
+	for _, c := range migrationColumns {
+		if err := r.addColumnIfMissing(c.table, c.column, c.definition); err != nil {
+			return fmt.Errorf("occured error while applying db migration. Err: %v", err)
+		}
+	}
+	for _, indexQuery := range migrationIndexes {
+		if _, err := r.db.Exec(indexQuery); err != nil {
+			return fmt.Errorf("occured error while applying db migration. Err: %v", err)
+		}
+	}
+	return nil
+}
+
+// addColumnIfMissing extends tables created by older versions of the service,
+// since CREATE TABLE IF NOT EXISTS leaves existing tables untouched.
+func (r *repo) addColumnIfMissing(table, column, definition string) error {
+	exists, err := r.hasColumn(table, column)
+	if err != nil || exists {
+		return err
+	}
+	if _, err = r.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("can't add column %s.%s: %v", table, column, err)
+	}
+	return nil
+}
+
+func (r *repo) hasColumn(table, column string) (bool, error) {
+	rows, err := r.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, fmt.Errorf("can't read columns of table %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			defaultValue     sql.NullString
+		)
+		if err = rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, fmt.Errorf("can't scan column of table %s: %v", table, err)
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return false, fmt.Errorf("can't iterate columns of table %s: %v", table, err)
+	}
+	return false, nil
+}
+
+// Ping checks that the database is reachable.
+func (r *repo) Ping(ctx context.Context) error {
+	if err := r.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("database is unreachable. Err: %v", err)
+	}
+	return nil
+}
+
+// CheckMigrations reports the first table or column created by CreateTables
+// that is missing in the database.
+func (r *repo) CheckMigrations() error {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	for _, table := range schemaTables {
+		exists, err := r.hasColumn(table, "id")
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("table %s is missing", table)
+		}
+	}
+	for _, c := range migrationColumns {
+		exists, err := r.hasColumn(c.table, c.column)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("column %s.%s is missing", c.table, c.column)
+		}
+	}
 	return nil
 }
 
@@ -89,7 +325,7 @@ func (r *repo) CreateUser(login, passwordHash string) (int64, error) {
 	res, err := r.db.Exec(query, login, passwordHash)
 	if err != nil {
 		if strings.Contains(err.Error(), "UNIQUE constraint failed: users.login") {
-			return 0, fmt.Errorf("user with this login '%s' exists", login)
+			return 0, fmt.Errorf("%w: login '%s'", ErrUserExists, login)
 		}
 		return 0, fmt.Errorf("can't create user. Err: %v", err)
 	}
@@ -102,15 +338,29 @@ func (r *repo) CreateUser(login, passwordHash string) (int64, error) {
 	return id, nil
 }
 
+const (
+	userColumns         = `id, login, password_hash, token_version, totp_secret, totp_enabled, totp_last_step, result_cache_disabled, created_at`
+	prefixedUserColumns = `u.id, u.login, u.password_hash, u.token_version, u.totp_secret, u.totp_enabled, u.totp_last_step, u.result_cache_disabled, u.created_at`
+)
+
+func scanUser(row *sql.Row) (*models.User, error) {
+	user := new(models.User)
+	err := row.Scan(
+		&user.ID, &user.Login, &user.PasswordHash, &user.TokenVersion,
+		&user.TOTPSecret, &user.TOTPEnabled, &user.TOTPLastStep, &user.ResultCacheDisabled, &user.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
 func (r *repo) GetUserByLogin(login string) (*models.User, error) {
 	r.mx.RLock()
 	defer r.mx.RUnlock()
 
-	query := `SELECT id, login, password_hash, created_at FROM users WHERE login = ?`
-	row := r.db.QueryRow(query, login)
-
-	user := new(models.User)
-	err := row.Scan(&user.ID, &user.Login, &user.PasswordHash, &user.CreatedAt)
+	query := `SELECT ` + userColumns + ` FROM users WHERE login = ?`
+	user, err := scanUser(r.db.QueryRow(query, login))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -121,35 +371,389 @@ func (r *repo) GetUserByLogin(login string) (*models.User, error) {
 	return user, nil
 }
 
+func (r *repo) GetUserByID(id int64) (*models.User, error) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = ?`
+	user, err := scanUser(r.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("can't find user. Id: %d. Err: %v", id, err)
+	}
+
+	return user, nil
+}
+
+// UpdateUserPassword stores the new hash and bumps token_version, which
+// invalidates every JWT issued before the change. It returns the new
+// token_version.
+func (r *repo) UpdateUserPassword(userID int64, passwordHash string) (int64, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	var tokenVersion int64
+	query := `UPDATE users SET password_hash = ?, token_version = token_version + 1 WHERE id = ? RETURNING token_version`
+	err := r.db.QueryRow(query, passwordHash, userID).Scan(&tokenVersion)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("%w: id %d", ErrUserNotFound, userID)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("can't update password. UserId: %d. Err: %v", userID, err)
+	}
+	return tokenVersion, nil
+}
+
+// SetResultCacheDisabled makes the orchestrator recompute every expression of
+// the user instead of reusing cached results.
+func (r *repo) SetResultCacheDisabled(userID int64, disabled bool) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	res, err := r.db.Exec(`UPDATE users SET result_cache_disabled = ? WHERE id = ?`, disabled, userID)
+	if err != nil {
+		return fmt.Errorf("can't update result cache setting. UserId: %d. Err: %v", userID, err)
+	}
+
+	rowsAffected, _ := res.RowsAffected()
+	if rowsAffected == 0 {
+		return fmt.Errorf("%w: id %d", ErrUserNotFound, userID)
+	}
+	return nil
+}
+
+// DeleteUser removes the user together with all of their expressions and tasks.
+func (r *repo) DeleteUser(userID int64) (err error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("can't run transaction. Err: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	queries := []string{
+		`DELETE FROM tasks WHERE expression_id IN (SELECT id FROM expressions WHERE user_id = ?)`,
+		`DELETE FROM expressions WHERE user_id = ?`,
+		`DELETE FROM recovery_codes WHERE user_id = ?`,
+		`DELETE FROM user_identities WHERE user_id = ?`,
+		`DELETE FROM users WHERE id = ?`,
+	}
+	for _, query := range queries {
+		if _, err = tx.Exec(query, userID); err != nil {
+			return fmt.Errorf("can't delete user data. UserId: %d. Err: %v", userID, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("can't commit user deletion. UserId: %d. Err: %v", userID, err)
+	}
+	return nil
+}
+
+// SetUserTOTPSecret stores a pending secret; it only becomes active after
+// EnableUserTOTP is called with a verified code.
+func (r *repo) SetUserTOTPSecret(userID int64, secret string) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	query := `UPDATE users SET totp_secret = ?, totp_enabled = 0, totp_last_step = 0 WHERE id = ?`
+	res, err := r.db.Exec(query, secret, userID)
+	if err != nil {
+		return fmt.Errorf("can't store totp secret. UserId: %d. Err: %v", userID, err)
+	}
+	rowsAffected, _ := res.RowsAffected()
+	if rowsAffected == 0 {
+		return fmt.Errorf("%w: id %d", ErrUserNotFound, userID)
+	}
+	return nil
+}
+
+// EnableUserTOTP activates 2FA and replaces the user's recovery codes.
+func (r *repo) EnableUserTOTP(userID int64, recoveryCodeHashes []string) (err error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("can't run transaction. Err: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.Exec(`UPDATE users SET totp_enabled = 1 WHERE id = ?`, userID); err != nil {
+		return fmt.Errorf("can't enable totp. UserId: %d. Err: %v", userID, err)
+	}
+	if _, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("can't drop recovery codes. UserId: %d. Err: %v", userID, err)
+	}
+	for _, codeHash := range recoveryCodeHashes {
+		if _, err = tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)`, userID, codeHash); err != nil {
+			return fmt.Errorf("can't store recovery code. UserId: %d. Err: %v", userID, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("can't commit totp enrollment. UserId: %d. Err: %v", userID, err)
+	}
+	return nil
+}
+
+func (r *repo) DisableUserTOTP(userID int64) (err error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("can't run transaction. Err: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.Exec(`UPDATE users SET totp_secret = '', totp_enabled = 0, totp_last_step = 0 WHERE id = ?`, userID); err != nil {
+		return fmt.Errorf("can't disable totp. UserId: %d. Err: %v", userID, err)
+	}
+	if _, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("can't drop recovery codes. UserId: %d. Err: %v", userID, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("can't commit totp removal. UserId: %d. Err: %v", userID, err)
+	}
+	return nil
+}
+
+// ConsumeTOTPStep records the time step of an accepted code. It returns false
+// when the step (or a later one) was already used, i.e. the code is replayed.
+func (r *repo) ConsumeTOTPStep(userID, step int64) (bool, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	query := `UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?`
+	res, err := r.db.Exec(query, step, userID, step)
+	if err != nil {
+		return false, fmt.Errorf("can't store totp step. UserId: %d. Err: %v", userID, err)
+	}
+	rowsAffected, _ := res.RowsAffected()
+	return rowsAffected > 0, nil
+}
+
+// ConsumeRecoveryCode marks an unused recovery code as used. It returns false
+// when no such unused code exists.
+func (r *repo) ConsumeRecoveryCode(userID int64, codeHash string) (bool, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	query := `UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP
+	         WHERE id = (SELECT id FROM recovery_codes WHERE user_id = ? AND code_hash = ? AND used_at IS NULL LIMIT 1)`
+	res, err := r.db.Exec(query, userID, codeHash)
+	if err != nil {
+		return false, fmt.Errorf("can't use recovery code. UserId: %d. Err: %v", userID, err)
+	}
+	rowsAffected, _ := res.RowsAffected()
+	return rowsAffected > 0, nil
+}
+
+func (r *repo) GetUserByIdentity(issuer, subject string) (*models.User, error) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	query := `SELECT ` + prefixedUserColumns + ` FROM users u
+	         JOIN user_identities i ON i.user_id = u.id
+	         WHERE i.issuer = ? AND i.subject = ?`
+	user, err := scanUser(r.db.QueryRow(query, issuer, subject))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("can't find user by identity. Issuer: '%s'. Err: %v", issuer, err)
+	}
+	return user, nil
+}
+
+// CreateUserWithIdentity provisions a password-less user linked to an external
+// identity. When preferredLogin is taken, a numeric suffix is appended.
+func (r *repo) CreateUserWithIdentity(preferredLogin, issuer, subject string) (user *models.User, err error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("can't run transaction. Err: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	login := preferredLogin
+	for suffix := 2; ; suffix++ {
+		var exists int
+		err = tx.QueryRow(`SELECT 1 FROM users WHERE login = ?`, login).Scan(&exists)
+		if errors.Is(err, sql.ErrNoRows) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't check login '%s'. Err: %v", login, err)
+		}
+		login = fmt.Sprintf("%s-%d", preferredLogin, suffix)
+	}
+
+	res, err := tx.Exec(`INSERT INTO users (login, password_hash) VALUES (?, '')`, login)
+	if err != nil {
+		return nil, fmt.Errorf("can't create user. Err: %v", err)
+	}
+	userID, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("occured error while getting userId. Err: %v", err)
+	}
+
+	query := `INSERT INTO user_identities (user_id, issuer, subject) VALUES (?, ?, ?)`
+	if _, err = tx.Exec(query, userID, issuer, subject); err != nil {
+		return nil, fmt.Errorf("can't link identity. UserId: %d. Err: %v", userID, err)
+	}
+
+	user, err = scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, userID))
+	if err != nil {
+		return nil, fmt.Errorf("can't load created user. UserId: %d. Err: %v", userID, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("can't commit user creation. Err: %v", err)
+	}
+	return user, nil
+}
+
 func (r *repo) CreateExpression(userID int64, expression string) (int64, error) {
+	id, _, err := r.CreateExpressionWithOptions(userID, expression, ExpressionOptions{Priority: constants.DefaultPriority})
+	return id, err
+}
+
+// CreateExpressionWithOptions creates the expression with the priority and
+// deadline of opts. With an idempotency key it creates the expression once
+// per user and key: a repeated call returns the ID of the expression created
+// first and false.
+func (r *repo) CreateExpressionWithOptions(userID int64, expression string, opts ExpressionOptions) (id int64, created bool, err error) {
 	r.mx.Lock()
 	defer r.mx.Unlock()
 
-	query := `INSERT INTO expressions (user_id, expression, status) VALUES (?, ?, ?)`
-	res, err := r.db.Exec(query, userID, expression, constants.StatusPending)
+	// The limits are counted in the transaction of the insert, so concurrent
+	// requests can't both pass them.
+	tx, err := r.db.Begin()
 	if err != nil {
-		return 0, fmt.Errorf("can't create expression. Err: %v", err)
+		return 0, false, fmt.Errorf("can't run transaction. Err: %v", err)
 	}
+	defer func() {
+		if err != nil || !created {
+			_ = tx.Rollback()
+		}
+	}()
 
-	id, err := res.LastInsertId()
+	var idempotencyKey any
+	if opts.IdempotencyKey != "" {
+		idempotencyKey = opts.IdempotencyKey
+		if id, err = idempotentExpressionID(tx, userID, opts.IdempotencyKey); err != nil || id != 0 {
+			return id, false, err
+		}
+	}
+
+	if opts.MaxActive > 0 {
+		active, err := countActiveExpressions(tx, userID)
+		if err != nil {
+			return 0, false, err
+		}
+		if active >= int64(opts.MaxActive) {
+			return 0, false, ErrTooManyActiveExpressions
+		}
+	}
+	if opts.TaskQuota > 0 {
+		// The quota is charged with all operations of an expression when it
+		// is created: tasks are only created as their operands are computed.
+		used, err := countUserOperationsSince(tx, userID, opts.QuotaSince)
+		if err != nil {
+			return 0, false, err
+		}
+		if used+int64(opts.Operations) > int64(opts.TaskQuota) {
+			return 0, false, &QuotaExceededError{Used: used}
+		}
+	}
+
+	var deadline any
+	if opts.Deadline.Valid {
+		deadline = opts.Deadline.Time.UTC().Format(timestampFormat)
+	}
+	query := `INSERT INTO expressions (user_id, expression, status, idempotency_key, priority, deadline, rebalance_disabled, depth, planned_depth, operations)
+	         VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	res, err := tx.Exec(query, userID, expression, constants.StatusPending, idempotencyKey, opts.Priority, deadline,
+		opts.RebalanceDisabled, opts.Depth, opts.PlannedDepth, opts.Operations)
+	if err != nil {
+		return 0, false, fmt.Errorf("can't create expression. Err: %v", err)
+	}
+	if id, err = res.LastInsertId(); err != nil {
+		return 0, false, fmt.Errorf("can't get expression ID. Err: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, false, fmt.Errorf("can't commit expression. Err: %v", err)
+	}
+	return id, true, nil
+}
+
+// GetExpressionIDByIdempotencyKey returns the ID of the expression the user
+// created with the key, 0 if there is none.
+func (r *repo) GetExpressionIDByIdempotencyKey(userID int64, key string) (int64, error) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return idempotentExpressionID(r.db, userID, key)
+}
+
+// queryRower is implemented by *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func idempotentExpressionID(q queryRower, userID int64, key string) (int64, error) {
+	var id int64
+	query := `SELECT id FROM expressions WHERE user_id = ? AND idempotency_key = ?`
+	err := q.QueryRow(query, userID, key).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
 	if err != nil {
-		return 0, fmt.Errorf("can't get userId. Err: %v", err)
+		return 0, fmt.Errorf("can't look up idempotency key. Err: %v", err)
 	}
 	return id, nil
 }
 
+const expressionColumns = `id, user_id, expression, status, result, steps, priority, deadline,
+	rebalance_disabled, depth, planned_depth, operations, created_at, updated_at`
+
 func (r *repo) GetExpressionByID(id, userID int64) (*models.Expression, error) {
 	r.mx.RLock()
 	defer r.mx.RUnlock()
 
-	query := `SELECT id, user_id, expression, status, result, steps, created_at, updated_at
+	query := `SELECT ` + expressionColumns + `
 	         FROM expressions WHERE id = ? AND user_id = ?`
 	row := r.db.QueryRow(query, id, userID)
 
 	expr := new(models.Expression)
 	err := row.Scan(
 		&expr.ID, &expr.UserID, &expr.Expression, &expr.Status,
-		&expr.Result, &expr.Steps, &expr.CreatedAt, &expr.UpdatedAt,
+		&expr.Result, &expr.Steps, &expr.Priority, &expr.Deadline,
+		&expr.RebalanceDisabled, &expr.Depth, &expr.PlannedDepth, &expr.Operations, &expr.CreatedAt, &expr.UpdatedAt,
 	)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -164,7 +768,7 @@ func (r *repo) GetExpressionsByUserID(userID int64) ([]models.Expression, error)
 	r.mx.RLock()
 	defer r.mx.RUnlock()
 
-	query := `SELECT id, user_id, expression, status, result, steps, created_at, updated_at
+	query := `SELECT ` + expressionColumns + `
 	         FROM expressions WHERE user_id = ? ORDER BY created_at DESC`
 	rows, err := r.db.Query(query, userID)
 	if err != nil {
@@ -177,9 +781,10 @@ func (r *repo) GetExpressionsByUserID(userID int64) ([]models.Expression, error)
 		expr := models.Expression{}
 		if err = rows.Scan(
 			&expr.ID, &expr.UserID, &expr.Expression, &expr.Status,
-			&expr.Result, &expr.Steps, &expr.CreatedAt, &expr.UpdatedAt,
+			&expr.Result, &expr.Steps, &expr.Priority, &expr.Deadline,
+			&expr.RebalanceDisabled, &expr.Depth, &expr.PlannedDepth, &expr.Operations, &expr.CreatedAt, &expr.UpdatedAt,
 		); err != nil {
-			log.Printf("error while scanning expressions. Err: %v", err)
+			r.logger.Error("can't scan expression", "user_id", userID, "error", err)
 			continue
 		}
 		expressions = append(expressions, expr)
@@ -192,13 +797,15 @@ func (r *repo) GetExpressionsByUserID(userID int64) ([]models.Expression, error)
 	return expressions, nil
 }
 
+// UpdateExpressionStatusResult leaves cancelled and expired expressions
+// untouched, so a result that arrives after them doesn't resurrect them.
 func (r *repo) UpdateExpressionStatusResult(id int64, status string, result sql.NullFloat64, stepsJSON sql.NullString) error {
 	r.mx.Lock()
 	defer r.mx.Unlock()
 
 	query := `UPDATE expressions SET status = ?, result = ?, steps = ?, updated_at = CURRENT_TIMESTAMP
-	         WHERE id = ?`
-	_, err := r.db.Exec(query, status, result, stepsJSON, id)
+	         WHERE id = ? AND status NOT IN (?, ?)`
+	_, err := r.db.Exec(query, status, result, stepsJSON, id, constants.StatusCancelled, constants.StatusExpired)
 	if err != nil {
 		return fmt.Errorf("can't update expression. Id: %d. Err: %v", id, err)
 	}
@@ -206,15 +813,116 @@ func (r *repo) UpdateExpressionStatusResult(id int64, status string, result sql.
 	return nil
 }
 
-func (r *repo) CreateTask(expressionID int64, operation string, arg1, arg2 float64) (int64, error) {
+// CancelExpression stops an unfinished expression of the user and drops its
+// queued and leased tasks; results for those are rejected as stale. It
+// returns false when the expression doesn't exist or has already finished.
+func (r *repo) CancelExpression(id, userID int64) (cancelled bool, err error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("can't run transaction. Err: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	query := `UPDATE expressions SET status = ?, updated_at = CURRENT_TIMESTAMP
+	         WHERE id = ? AND user_id = ? AND status IN (?, ?)`
+	res, err := tx.Exec(query, constants.StatusCancelled, id, userID, constants.StatusPending, constants.StatusInProgress)
+	if err != nil {
+		return false, fmt.Errorf("can't cancel expression. Id: %d. Err: %v", id, err)
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("can't cancel expression. Id: %d. Err: %v", id, err)
+	}
+	if rowsAffected == 0 {
+		return false, tx.Rollback()
+	}
+
+	query = `UPDATE tasks SET status = ?, worker_id = '', lease_token = '', leased_at = NULL, updated_at = CURRENT_TIMESTAMP
+	        WHERE expression_id = ? AND status IN (?, ?)`
+	if _, err = tx.Exec(query, constants.StatusCancelled, id, constants.StatusPending, constants.StatusInProgress); err != nil {
+		return false, fmt.Errorf("can't cancel tasks. ExpressionId: %d. Err: %v", id, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, fmt.Errorf("can't commit cancellation. Id: %d. Err: %v", id, err)
+	}
+	return true, nil
+}
+
+// ExpireOverdueExpressions marks unfinished expressions past their deadline
+// as expired and drops their queued and leased tasks; results for those are
+// rejected as stale. It returns the number of expired expressions.
+func (r *repo) ExpireOverdueExpressions() (expired int64, err error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("can't run transaction. Err: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	query := `UPDATE expressions SET status = ?, updated_at = CURRENT_TIMESTAMP
+	         WHERE status IN (?, ?) AND deadline IS NOT NULL AND deadline <= strftime('%Y-%m-%d %H:%M:%f', 'now')`
+	res, err := tx.Exec(query, constants.StatusExpired, constants.StatusPending, constants.StatusInProgress)
+	if err != nil {
+		return 0, fmt.Errorf("can't expire expressions. Err: %v", err)
+	}
+	if expired, err = res.RowsAffected(); err != nil {
+		return 0, fmt.Errorf("can't expire expressions. Err: %v", err)
+	}
+	if expired == 0 {
+		return 0, tx.Rollback()
+	}
+
+	query = `UPDATE tasks SET status = ?, worker_id = '', lease_token = '', leased_at = NULL, updated_at = CURRENT_TIMESTAMP
+	        WHERE status IN (?, ?) AND expression_id IN (SELECT id FROM expressions WHERE status = ?)`
+	if _, err = tx.Exec(query, constants.StatusExpired, constants.StatusPending, constants.StatusInProgress, constants.StatusExpired); err != nil {
+		return 0, fmt.Errorf("can't drop tasks of expired expressions. Err: %v", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("can't commit expiration. Err: %v", err)
+	}
+	return expired, nil
+}
+
+// CreateTask queues a task. traceContext is the traceparent of the span that
+// planned it, so the worker's spans join the expression's trace. Tasks of
+// cancelled and expired expressions are not queued.
+func (r *repo) CreateTask(expressionID int64, operation string, arg1, arg2 float64, traceContext string) (int64, error) {
 	r.mx.Lock()
 	defer r.mx.Unlock()
 
-	query := `INSERT INTO tasks (expression_id, operation, arg1, arg2, status) VALUES (?, ?, ?, ?, ?)`
-	res, err := r.db.Exec(query, expressionID, operation, arg1, arg2, constants.StatusPending)
+	if _, err := r.db.Exec(activateUserQuery, expressionID, constants.StatusPending, constants.StatusInProgress); err != nil {
+		return 0, fmt.Errorf("can't activate user. Id:%d. Err:%v", expressionID, err)
+	}
+
+	query := `INSERT INTO tasks (expression_id, operation, arg1, arg2, status, trace_context)
+	         SELECT ?, ?, ?, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM expressions WHERE id = ? AND status IN (?, ?))`
+	res, err := r.db.Exec(query, expressionID, operation, arg1, arg2, constants.StatusPending, traceContext,
+		expressionID, constants.StatusCancelled, constants.StatusExpired)
 	if err != nil {
 		return 0, fmt.Errorf("can't create task. Id:%d. Err:%v", expressionID, err)
 	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("can't create task. Id:%d. Err:%v", expressionID, err)
+	}
+	if rowsAffected == 0 {
+		return 0, ErrExpressionCancelled
+	}
 
 	id, err := res.LastInsertId()
 	if err != nil {
@@ -224,7 +932,51 @@ func (r *repo) CreateTask(expressionID int64, operation string, arg1, arg2 float
 	return id, nil
 }
 
-func (r *repo) GetAndLeasePendingTask() (*models.Task, error) {
+// leaseQuery picks the next task by stride scheduling across users. Each
+// lease advances the pass of the user by 1/weight, and the task with the
+// lowest rank is served next, so active users share the workers in proportion
+// to their weights. A user becoming active starts at the virtual time, see
+// activateUserQuery.
+//
+// The priority of the expression is subtracted from the pass, so a
+// high-priority task overtakes a bounded number of leases of other users
+// without changing their long-term share. Waiting raises the priority by one
+// every priorityAging up to constants.MaxPriority, so low-priority tasks
+// aren't starved. Ties go to the earliest deadline, then to the oldest task.
+// Tasks of expressions past their deadline are skipped.
+const leaseQuery = `SELECT t.id, t.expression_id, t.operation, t.arg1, t.arg2, t.status, t.retries, t.trace_context, t.created_at, t.updated_at,
+		u.id, u.scheduling_pass, COALESCE(w.weight, 1.0)
+	FROM tasks t
+	JOIN expressions e ON e.id = t.expression_id
+	JOIN users u ON u.id = e.user_id
+	LEFT JOIN scheduling_weights w ON w.login = u.login
+	WHERE t.status = ? AND (e.deadline IS NULL OR e.deadline > strftime('%Y-%m-%d %H:%M:%f', 'now'))
+	ORDER BY u.scheduling_pass - MIN(e.priority + CAST((julianday('now') - julianday(t.created_at)) * 86400 / ? AS INTEGER), ?) ASC,
+		e.deadline IS NULL, e.deadline ASC, t.created_at ASC, t.id ASC
+	LIMIT 1`
+
+// advanceVirtualTimeQuery moves the virtual time up to the lowest pass of the
+// users with pending tasks. It never goes back, so time spent alone on the
+// workers isn't charged to a user later.
+const advanceVirtualTimeQuery = `UPDATE scheduling_state SET virtual_time = MAX(virtual_time, COALESCE((
+		SELECT MIN(u.scheduling_pass) FROM users u
+		WHERE EXISTS (SELECT 1 FROM tasks t JOIN expressions e ON e.id = t.expression_id WHERE e.user_id = u.id AND t.status = ?)
+	), virtual_time)) WHERE id = 1`
+
+// activateUserQuery moves the pass of an idle user up to the virtual time
+// before its first task is queued, so it doesn't catch up on the leases it
+// missed while it had nothing to compute.
+const activateUserQuery = `UPDATE users SET scheduling_pass = MAX(scheduling_pass, (SELECT virtual_time FROM scheduling_state WHERE id = 1))
+	WHERE id = (SELECT user_id FROM expressions WHERE id = ?)
+		AND NOT EXISTS (SELECT 1 FROM tasks t JOIN expressions e ON e.id = t.expression_id WHERE e.user_id = users.id AND t.status IN (?, ?))`
+
+// priorityAging is how long a task waits for its priority to grow by one.
+const priorityAging = time.Minute
+
+// GetAndLeasePendingTask hands the next pending task to workerID under a
+// fresh lease token, see leaseQuery for the order. Results are only accepted
+// for the same worker and token.
+func (r *repo) GetAndLeasePendingTask(workerID string) (*models.Task, error) {
 	r.mx.Lock()
 	defer r.mx.Unlock()
 
@@ -241,19 +993,23 @@ func (r *repo) GetAndLeasePendingTask() (*models.Task, error) {
 		} else {
 			err = tx.Commit()
 			if err != nil {
-				log.Printf("can't commit changes. Err: %v", err)
+				r.logger.Error("can't commit task lease", "worker_id", workerID, "error", err)
 			}
 		}
 	}()
 
-	querySelect := `SELECT id, expression_id, operation, arg1, arg2, status, retries, created_at, updated_at
-	                FROM tasks WHERE status = ? ORDER BY created_at ASC LIMIT 1`
-	row := tx.QueryRow(querySelect, constants.StatusPending)
+	row := tx.QueryRow(leaseQuery, constants.StatusPending, priorityAging.Seconds(), constants.MaxPriority)
 
-	task := new(models.Task)
+	var (
+		task   = new(models.Task)
+		userID int64
+		pass   float64
+		weight float64
+	)
 	if err = row.Scan(
 		&task.ID, &task.ExpressionID, &task.Operation, &task.Arg1, &task.Arg2,
-		&task.Status, &task.Retries, &task.CreatedAt, &task.UpdatedAt,
+		&task.Status, &task.Retries, &task.TraceContext, &task.CreatedAt, &task.UpdatedAt,
+		&userID, &pass, &weight,
 	); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -261,62 +1017,146 @@ func (r *repo) GetAndLeasePendingTask() (*models.Task, error) {
 		return nil, fmt.Errorf("can't fetch task.Err: %v", err)
 	}
 
-	queryUpdate := `UPDATE tasks SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
-	_, err = tx.Exec(queryUpdate, constants.StatusInProgress, task.ID)
+	if _, err = tx.Exec(`UPDATE users SET scheduling_pass = ? WHERE id = ?`, pass+1/weight, userID); err != nil {
+		return nil, fmt.Errorf("can't advance scheduling pass. UserId: %d. Err: %v", userID, err)
+	}
+	if _, err = tx.Exec(advanceVirtualTimeQuery, constants.StatusPending); err != nil {
+		return nil, fmt.Errorf("can't advance virtual time. Err: %v", err)
+	}
+
+	leaseToken, err := newLeaseToken()
+	if err != nil {
+		return nil, err
+	}
+
+	queryUpdate := `UPDATE tasks SET status = ?, worker_id = ?, lease_token = ?, leased_at = strftime('%Y-%m-%d %H:%M:%f', 'now'), updated_at = CURRENT_TIMESTAMP
+	                WHERE id = ?`
+	_, err = tx.Exec(queryUpdate, constants.StatusInProgress, workerID, leaseToken, task.ID)
 	if err != nil {
 		return nil, fmt.Errorf("can't update task status.TaskId: %d. Err: %v", task.ID, err)
 	}
 
 	task.Status = constants.StatusInProgress
+	task.WorkerID = workerID
+	task.LeaseToken = leaseToken
 	return task, nil
 }
 
-func (r *repo) CompleteTask(taskID int64, result float64) error {
+// SetSchedulingWeights replaces the scheduling weights of users by login.
+// Users without a weight have weight 1.
+func (r *repo) SetSchedulingWeights(weights map[string]float64) (err error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("can't run transaction. Err: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.Exec(`DELETE FROM scheduling_weights`); err != nil {
+		return fmt.Errorf("can't clear scheduling weights. Err: %v", err)
+	}
+	for login, weight := range weights {
+		if weight <= 0 {
+			err = fmt.Errorf("scheduling weight of '%s' must be positive, got %g", login, weight)
+			return err
+		}
+		if _, err = tx.Exec(`INSERT INTO scheduling_weights (login, weight) VALUES (?, ?)`, login, weight); err != nil {
+			return fmt.Errorf("can't store scheduling weight of '%s'. Err: %v", login, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("can't commit scheduling weights. Err: %v", err)
+	}
+	return nil
+}
+
+func (r *repo) CompleteTask(taskID int64, workerID, leaseToken string, result float64) error {
 	r.mx.Lock()
 	defer r.mx.Unlock()
 
-	query := `UPDATE tasks SET status = ?, result = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status = ?`
-	res, err := r.db.Exec(query, constants.StatusDone, result, taskID, constants.StatusInProgress)
+	query := `UPDATE tasks SET status = ?, result = ?, completed_at = strftime('%Y-%m-%d %H:%M:%f', 'now'), updated_at = CURRENT_TIMESTAMP
+	         WHERE id = ? AND status = ? AND worker_id = ? AND lease_token = ?`
+	res, err := r.db.Exec(query, constants.StatusDone, result, taskID, constants.StatusInProgress, workerID, leaseToken)
 	if err != nil {
 		return fmt.Errorf("can't finish task. TaskId: %d. Err: %v", taskID, err)
 	}
 
-	rowsAffected, _ := res.RowsAffected()
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("can't finish task. TaskId: %d. Err: %v", taskID, err)
+	}
 	if rowsAffected == 0 {
-		log.Printf("can't update task status. TaskId: %d", taskID)
+		return ErrStaleLease
 	}
 
 	return nil
 }
 
-func (r *repo) FailTask(taskID int64) error {
+// FailTask returns the task to the queue and counts a retry.
+func (r *repo) FailTask(taskID int64, workerID, leaseToken string) error {
 	r.mx.Lock()
 	defer r.mx.Unlock()
 
-	query := `UPDATE tasks SET status = ?, retries = retries + 1, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status = ?`
-	res, err := r.db.Exec(query, constants.StatusPending, taskID, constants.StatusInProgress)
+	query := `UPDATE tasks SET status = ?, worker_id = '', lease_token = '', leased_at = NULL, retries = retries + 1, updated_at = CURRENT_TIMESTAMP
+	         WHERE id = ? AND status = ? AND worker_id = ? AND lease_token = ?`
+	res, err := r.db.Exec(query, constants.StatusPending, taskID, constants.StatusInProgress, workerID, leaseToken)
+	if err != nil {
+		return fmt.Errorf("occured error while update process. TaskId: %d. Err: %v", taskID, err)
+	}
+	rowsAffected, err := res.RowsAffected()
 	if err != nil {
 		return fmt.Errorf("occured error while update process. TaskId: %d. Err: %v", taskID, err)
 	}
-	rowsAffected, _ := res.RowsAffected()
 	if rowsAffected == 0 {
-		log.Printf("operation failed. TaskId: %d", taskID)
+		return ErrStaleLease
 	}
 	return nil
 }
 
+// RequeueExpiredLeases returns tasks whose lease is older than timeout back to
+// the queue, e.g. when the worker died. Late results for them become stale.
+func (r *repo) RequeueExpiredLeases(timeout time.Duration) (int64, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	query := `UPDATE tasks SET status = ?, worker_id = '', lease_token = '', leased_at = NULL, retries = retries + 1, updated_at = CURRENT_TIMESTAMP
+	         WHERE status = ? AND leased_at <= strftime('%Y-%m-%d %H:%M:%f', 'now', ?)`
+	modifier := fmt.Sprintf("-%.3f seconds", timeout.Seconds())
+	res, err := r.db.Exec(query, constants.StatusPending, constants.StatusInProgress, modifier)
+	if err != nil {
+		return 0, fmt.Errorf("can't requeue expired leases. Err: %v", err)
+	}
+	return res.RowsAffected()
+}
+
+func newLeaseToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("can't generate lease token: %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
 func (r *repo) GetTaskByID(taskID int64) (*models.Task, error) {
 	r.mx.RLock()
 	defer r.mx.RUnlock()
 
-	query := `SELECT id, expression_id, operation, arg1, arg2, result, status, retries, created_at, updated_at
+	query := `SELECT id, expression_id, operation, arg1, arg2, result, status, worker_id, lease_token, leased_at, completed_at, retries, created_at, updated_at
 	         FROM tasks WHERE id = ?`
 	row := r.db.QueryRow(query, taskID)
 
 	task := new(models.Task)
 	err := row.Scan(
 		&task.ID, &task.ExpressionID, &task.Operation, &task.Arg1, &task.Arg2,
-		&task.Result, &task.Status, &task.Retries, &task.CreatedAt, &task.UpdatedAt,
+		&task.Result, &task.Status, &task.WorkerID, &task.LeaseToken, &task.LeasedAt,
+		&task.CompletedAt, &task.Retries, &task.CreatedAt, &task.UpdatedAt,
 	)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -346,14 +1186,15 @@ func (r *repo) GetExpressionByIDInternal(id int64) (*models.Expression, error) {
 	r.mx.RLock()
 	defer r.mx.RUnlock()
 
-	query := `SELECT id, user_id, expression, status, result, steps, created_at, updated_at
+	query := `SELECT ` + expressionColumns + `
 	         FROM expressions WHERE id = ?`
 	row := r.db.QueryRow(query, id)
 
 	expr := new(models.Expression)
 	err := row.Scan(
 		&expr.ID, &expr.UserID, &expr.Expression, &expr.Status,
-		&expr.Result, &expr.Steps, &expr.CreatedAt, &expr.UpdatedAt,
+		&expr.Result, &expr.Steps, &expr.Priority, &expr.Deadline,
+		&expr.RebalanceDisabled, &expr.Depth, &expr.PlannedDepth, &expr.Operations, &expr.CreatedAt, &expr.UpdatedAt,
 	)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -368,8 +1209,8 @@ func (r *repo) GetAllTasksForExpression(expressionID int64) ([]models.Task, erro
 	r.mx.RLock()
 	defer r.mx.RUnlock()
 
-	query := `SELECT id, expression_id, operation, arg1, arg2, result, status, retries, created_at, updated_at
-		FROM tasks WHERE expression_id = ?`
+	query := `SELECT id, expression_id, operation, arg1, arg2, result, status, worker_id, leased_at, completed_at, retries, created_at, updated_at
+		FROM tasks WHERE expression_id = ? ORDER BY id`
 	rows, err := r.db.Query(query, expressionID)
 	if err != nil {
 		return nil, fmt.Errorf("occured error. ExpressionId: %d. Err: %v", expressionID, err)
@@ -377,22 +1218,162 @@ func (r *repo) GetAllTasksForExpression(expressionID int64) ([]models.Task, erro
 	defer rows.Close()
 
 	tasks := make([]models.Task, 0)
+	err = r.scanTasks(rows, func(task models.Task) {
+		tasks = append(tasks, task)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// GetActiveTasksByUserID returns the tasks of the pending and in-progress
+// expressions of a user by expression ID, each in the order they were
+// created.
+func (r *repo) GetActiveTasksByUserID(userID int64) (map[int64][]models.Task, error) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	query := `SELECT t.id, t.expression_id, t.operation, t.arg1, t.arg2, t.result, t.status, t.worker_id, t.leased_at, t.completed_at, t.retries, t.created_at, t.updated_at
+		FROM tasks t JOIN expressions e ON e.id = t.expression_id WHERE e.user_id = ? AND e.status IN (?, ?) ORDER BY t.id`
+	rows, err := r.db.Query(query, userID, constants.StatusPending, constants.StatusInProgress)
+	if err != nil {
+		return nil, fmt.Errorf("occured error. UserId: %d. Err: %v", userID, err)
+	}
+	defer rows.Close()
+
+	tasks := make(map[int64][]models.Task)
+	err = r.scanTasks(rows, func(task models.Task) {
+		tasks[task.ExpressionID] = append(tasks[task.ExpressionID], task)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// CountDoneTasksByUserID returns the number of computed tasks of the
+// expressions of a user by expression ID.
+func (r *repo) CountDoneTasksByUserID(userID int64) (map[int64]int, error) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	query := `SELECT t.expression_id, COUNT(*) FROM tasks t JOIN expressions e ON e.id = t.expression_id
+		WHERE e.user_id = ? AND t.status = ? GROUP BY t.expression_id`
+	rows, err := r.db.Query(query, userID, constants.StatusDone)
+	if err != nil {
+		return nil, fmt.Errorf("can't count done tasks. UserId: %d. Err: %v", userID, err)
+	}
+	defer rows.Close()
+
+	counts := make(map[int64]int)
+	for rows.Next() {
+		var (
+			exprID int64
+			count  int
+		)
+		if err = rows.Scan(&exprID, &count); err != nil {
+			return nil, fmt.Errorf("can't scan done tasks count. Err: %v", err)
+		}
+		counts[exprID] = count
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("occured error: %v", err)
+	}
+	return counts, nil
+}
+
+// scanTasks passes the tasks of rows to add, skipping rows that can't be
+// scanned.
+func (r *repo) scanTasks(rows *sql.Rows, add func(models.Task)) error {
 	for rows.Next() {
 		var task models.Task
 		if err := rows.Scan(
 			&task.ID, &task.ExpressionID, &task.Operation,
 			&task.Arg1, &task.Arg2, &task.Result,
-			&task.Status, &task.Retries, &task.CreatedAt, &task.UpdatedAt,
+			&task.Status, &task.WorkerID, &task.LeasedAt, &task.CompletedAt, &task.Retries, &task.CreatedAt, &task.UpdatedAt,
 		); err != nil {
-			log.Printf("can't scan err: %v", err)
+			r.logger.Error("can't scan task", "expression_id", task.ExpressionID, "error", err)
 			continue
 		}
-		tasks = append(tasks, task)
+		add(task)
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("occured error: %v", err)
 	}
+	return nil
+}
+
+func (r *repo) CountTasksByStatus() (map[string]int64, error) {
+	return r.countByStatus("tasks")
+}
 
+func (r *repo) CountExpressionsByStatus() (map[string]int64, error) {
+	return r.countByStatus("expressions")
+}
+
+// CountActiveExpressions returns the number of pending and in-progress
+// expressions of the user.
+func (r *repo) CountActiveExpressions(userID int64) (int64, error) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return countActiveExpressions(r.db, userID)
+}
+
+func countActiveExpressions(q queryRower, userID int64) (int64, error) {
+	var count int64
+	query := `SELECT COUNT(*) FROM expressions WHERE user_id = ? AND status IN (?, ?)`
+	err := q.QueryRow(query, userID, constants.StatusPending, constants.StatusInProgress).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("can't count active expressions. UserId: %d. Err: %v", userID, err)
+	}
+	return count, nil
+}
+
+// CountUserOperationsSince returns the number of operations of the
+// expressions the user created since the given time, which the daily task
+// quota is charged with.
+func (r *repo) CountUserOperationsSince(userID int64, since time.Time) (int64, error) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return countUserOperationsSince(r.db, userID, since)
+}
+
+func countUserOperationsSince(q queryRower, userID int64, since time.Time) (int64, error) {
+	var count int64
+	query := `SELECT COALESCE(SUM(operations), 0) FROM expressions WHERE user_id = ? AND created_at >= ?`
+	// created_at is filled by CURRENT_TIMESTAMP, i.e. UTC text in this format.
+	err := q.QueryRow(query, userID, since.UTC().Format(time.DateTime)).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("can't count operations. UserId: %d. Err: %v", userID, err)
+	}
+	return count, nil
+}
+
+func (r *repo) countByStatus(table string) (map[string]int64, error) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	rows, err := r.db.Query(fmt.Sprintf("SELECT status, COUNT(*) FROM %s GROUP BY status", table))
+	if err != nil {
+		return nil, fmt.Errorf("can't count %s by status. Err: %v", table, err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var (
+			status string
+			count  int64
+		)
+		if err = rows.Scan(&status, &count); err != nil {
+			return nil, fmt.Errorf("can't scan %s count. Err: %v", table, err)
+		}
+		counts[status] = count
+	}
 	if err = rows.Err(); err != nil {
 		return nil, fmt.Errorf("occured error: %v", err)
 	}
-
-	return tasks, nil
+	return counts, nil
 }
@@ -1,20 +1,59 @@
 package repository
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/atadzan/dist-arith-go/internal/constants"
+	"github.com/atadzan/dist-arith-go/internal/logging"
 	"github.com/atadzan/dist-arith-go/pkg/database"
 )
 
+// openTestRepo returns a repository on a fresh in-memory database closed
+// with the test.
+func openTestRepo(t *testing.T) Repository {
+	t.Helper()
+	testingDb, err := database.GetMemoryDBConn()
+	if err != nil {
+		if strings.Contains(err.Error(), "requires cgo") {
+			t.Skipf("skip DB tests: %v", err)
+		}
+		t.Fatalf("can't establish db connection")
+	}
+	t.Cleanup(func() { testingDb.Close() })
+	repo, err := New(testingDb, logging.Discard())
+	if err != nil {
+		if strings.Contains(err.Error(), "requires cgo") {
+			t.Skipf("skip DB tests: %v", err)
+		}
+		t.Fatalf("New error: %v", err)
+	}
+	return repo
+}
+
+// newTestRepo returns a migrated repository from openTestRepo.
+func newTestRepo(t *testing.T) Repository {
+	t.Helper()
+	repo := openTestRepo(t)
+	if err := repo.CreateTables(); err != nil {
+		t.Fatalf("InitDB error: %v", err)
+	}
+	return repo
+}
+
 func TestUserAndExpressionCRUD(t *testing.T) {
 	testingDb, err := database.GetTestingDBConn()
 	if err != nil {
 		t.Fatalf("can't establish db connection")
 	}
 	defer testingDb.Close()
-	repo, err := New(testingDb)
+	repo, err := New(testingDb, logging.Discard())
 	if err != nil {
 		if strings.Contains(err.Error(), "requires cgo") {
 			t.Skipf("skip DB tests: %v", err)
@@ -67,7 +106,7 @@ func TestTaskLifecycle(t *testing.T) {
 		t.Fatalf("can't establish db connection")
 	}
 	defer testingDb.Close()
-	repo, err := New(testingDb)
+	repo, err := New(testingDb, logging.Discard())
 	if err != nil {
 		if strings.Contains(err.Error(), "requires cgo") {
 			t.Skipf("skip DB tests: %v", err)
@@ -90,20 +129,20 @@ func TestTaskLifecycle(t *testing.T) {
 		t.Fatalf("CreateExpression error: %v", err)
 	}
 
-	tid, err := repo.CreateTask(exprID, "*", 2, 3)
+	tid, err := repo.CreateTask(exprID, "*", 2, 3, "")
 	if err != nil {
 		t.Fatalf("CreateTask error: %v", err)
 	}
 
-	task, err := repo.GetAndLeasePendingTask()
+	task, err := repo.GetAndLeasePendingTask("worker-a")
 	if err != nil {
 		t.Fatalf("GetAndLeasePendingTask error: %v", err)
 	}
-	if task == nil || task.ID != tid || task.Status != constants.StatusInProgress {
+	if task == nil || task.ID != tid || task.Status != constants.StatusInProgress || task.WorkerID != "worker-a" {
 		t.Fatalf("GetAndLeasePendingTask returned wrong: %+v", task)
 	}
 
-	if err = repo.CompleteTask(tid, 6); err != nil {
+	if err = repo.CompleteTask(tid, "worker-a", task.LeaseToken, 6); err != nil {
 		t.Fatalf("CompleteTask error: %v", err)
 	}
 	t2, err := repo.GetTaskByID(tid)
@@ -114,19 +153,19 @@ func TestTaskLifecycle(t *testing.T) {
 		t.Fatalf("GetTaskByID after complete wrong: %+v", t2)
 	}
 
-	tid2, err := repo.CreateTask(exprID, "+", 1, 1)
+	tid2, err := repo.CreateTask(exprID, "+", 1, 1, "")
 	if err != nil {
 		t.Fatalf("CreateTask error: %v", err)
 	}
-	task2, _ := repo.GetAndLeasePendingTask()
+	task2, _ := repo.GetAndLeasePendingTask("worker-b")
 	if task2 == nil {
 		t.Fatalf("Expected task2 leased, got nil")
 	}
-	if err := repo.FailTask(tid2); err != nil {
+	if err := repo.FailTask(tid2, "worker-b", task2.LeaseToken); err != nil {
 		t.Fatalf("FailTask error: %v", err)
 	}
 	t3, _ := repo.GetTaskByID(tid2)
-	if t3.Status != constants.StatusPending || t3.Retries != 1 {
+	if t3.Status != constants.StatusPending || t3.Retries != 1 || t3.WorkerID != "" {
 		t.Fatalf("FailTask not applied: %+v", t3)
 	}
 
@@ -142,4 +181,482 @@ func TestTaskLifecycle(t *testing.T) {
 	if has2 {
 		t.Fatalf("HasPendingTasks for unknown expr should be false")
 	}
+
+	otherID, _ := repo.CreateUser("u3", "h3")
+	otherExprID, _ := repo.CreateExpression(otherID, "4-1")
+	if _, err := repo.CreateTask(otherExprID, "-", 4, 1, ""); err != nil {
+		t.Fatalf("CreateTask error: %v", err)
+	}
+	byExpression, err := repo.GetActiveTasksByUserID(uid)
+	if err != nil {
+		t.Fatalf("GetActiveTasksByUserID error: %v", err)
+	}
+	if tasks := byExpression[exprID]; len(byExpression) != 1 || len(tasks) != 2 || tasks[0].ID != tid || tasks[1].ID != tid2 {
+		t.Fatalf("GetActiveTasksByUserID returned wrong: %+v", byExpression)
+	}
+	if done, err := repo.CountDoneTasksByUserID(uid); err != nil || len(done) != 1 || done[exprID] != 1 {
+		t.Fatalf("CountDoneTasksByUserID = %v, %v; expected 1 task of %d", done, err, exprID)
+	}
+	if cancelled, err := repo.CancelExpression(exprID, uid); err != nil || !cancelled {
+		t.Fatalf("CancelExpression = %v, %v", cancelled, err)
+	}
+	if byExpression, _ = repo.GetActiveTasksByUserID(uid); len(byExpression) != 0 {
+		t.Fatalf("expected no tasks of finished expressions, got %+v", byExpression)
+	}
+}
+
+func TestDeleteUserCascades(t *testing.T) {
+	repo := newTestRepo(t)
+
+	uid, _ := repo.CreateUser("leaving", "h")
+	otherID, _ := repo.CreateUser("staying", "h")
+	exprID, _ := repo.CreateExpression(uid, "1+2")
+	otherExprID, _ := repo.CreateExpression(otherID, "3+4")
+	taskID, _ := repo.CreateTask(exprID, "+", 1, 2, "")
+	otherTaskID, _ := repo.CreateTask(otherExprID, "+", 3, 4, "")
+
+	if version, err := repo.UpdateUserPassword(uid, "h2"); err != nil || version != 1 {
+		t.Fatalf("UpdateUserPassword = %d, %v; expected token version 1", version, err)
+	}
+	user, _ := repo.GetUserByID(uid)
+	if user == nil || user.PasswordHash != "h2" || user.TokenVersion != 1 {
+		t.Fatalf("UpdateUserPassword not applied: %+v", user)
+	}
+	if _, err := repo.UpdateUserPassword(9999, "h"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound for an unknown user, got %v", err)
+	}
+
+	if err := repo.DeleteUser(uid); err != nil {
+		t.Fatalf("DeleteUser error: %v", err)
+	}
+	if user, _ = repo.GetUserByID(uid); user != nil {
+		t.Fatalf("user not deleted: %+v", user)
+	}
+	if expr, _ := repo.GetExpressionByIDInternal(exprID); expr != nil {
+		t.Fatalf("expression not deleted: %+v", expr)
+	}
+	if task, _ := repo.GetTaskByID(taskID); task != nil {
+		t.Fatalf("task not deleted: %+v", task)
+	}
+	if task, _ := repo.GetTaskByID(otherTaskID); task == nil {
+		t.Fatal("task of another user must survive")
+	}
+}
+
+func TestLeaseValidation(t *testing.T) {
+	repo := newTestRepo(t)
+
+	uid, _ := repo.CreateUser("u", "h")
+	exprID, _ := repo.CreateExpression(uid, "1+2")
+	tid, _ := repo.CreateTask(exprID, "+", 1, 2, "")
+
+	task, err := repo.GetAndLeasePendingTask("worker-a")
+	if err != nil || task == nil || task.LeaseToken == "" {
+		t.Fatalf("GetAndLeasePendingTask returned %+v, err %v", task, err)
+	}
+
+	if err = repo.CompleteTask(tid, "worker-b", task.LeaseToken, 3); !errors.Is(err, ErrStaleLease) {
+		t.Fatalf("foreign worker expected ErrStaleLease, got %v", err)
+	}
+	if err = repo.CompleteTask(tid, "worker-a", "forged", 3); !errors.Is(err, ErrStaleLease) {
+		t.Fatalf("wrong lease token expected ErrStaleLease, got %v", err)
+	}
+	if err = repo.FailTask(tid, "worker-b", task.LeaseToken); !errors.Is(err, ErrStaleLease) {
+		t.Fatalf("foreign failure expected ErrStaleLease, got %v", err)
+	}
+
+	requeued, err := repo.RequeueExpiredLeases(0)
+	if err != nil || requeued != 1 {
+		t.Fatalf("RequeueExpiredLeases = %d, %v; want 1", requeued, err)
+	}
+	if err = repo.CompleteTask(tid, "worker-a", task.LeaseToken, 3); !errors.Is(err, ErrStaleLease) {
+		t.Fatalf("result for expired lease expected ErrStaleLease, got %v", err)
+	}
+
+	again, _ := repo.GetAndLeasePendingTask("worker-b")
+	if again == nil || again.ID != tid || again.Retries != 1 || again.LeaseToken == task.LeaseToken {
+		t.Fatalf("requeued task must be leased again with a new token: %+v", again)
+	}
+	if err = repo.CompleteTask(tid, "worker-b", again.LeaseToken, 3); err != nil {
+		t.Fatalf("CompleteTask error: %v", err)
+	}
+	if err = repo.CompleteTask(tid, "worker-b", again.LeaseToken, 3); !errors.Is(err, ErrStaleLease) {
+		t.Fatalf("duplicate submission expected ErrStaleLease, got %v", err)
+	}
+}
+
+func TestRequeueExpiredLeasesBelowOneSecond(t *testing.T) {
+	repo := newTestRepo(t)
+	uid, _ := repo.CreateUser("u", "h")
+	exprID, _ := repo.CreateExpression(uid, "1+2")
+	repo.CreateTask(exprID, "+", 1, 2, "")
+	if task, err := repo.GetAndLeasePendingTask("worker-a"); err != nil || task == nil {
+		t.Fatalf("GetAndLeasePendingTask returned %+v, err %v", task, err)
+	}
+
+	const timeout = 300 * time.Millisecond
+	if requeued, err := repo.RequeueExpiredLeases(timeout); err != nil || requeued != 0 {
+		t.Fatalf("fresh lease: RequeueExpiredLeases = %d, %v; want 0", requeued, err)
+	}
+	time.Sleep(timeout + 100*time.Millisecond)
+	if requeued, err := repo.RequeueExpiredLeases(timeout); err != nil || requeued != 1 {
+		t.Fatalf("expired lease: RequeueExpiredLeases = %d, %v; want 1", requeued, err)
+	}
+}
+
+func TestPingAndCheckMigrations(t *testing.T) {
+	// A fresh database, since the shared testing one is already migrated.
+	repo := openTestRepo(t)
+
+	if err := repo.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if err := repo.CheckMigrations(); err == nil {
+		t.Fatal("expected CheckMigrations to fail before CreateTables")
+	}
+	if err := repo.CreateTables(); err != nil {
+		t.Fatalf("InitDB error: %v", err)
+	}
+	if err := repo.CheckMigrations(); err != nil {
+		t.Fatalf("CheckMigrations after CreateTables: %v", err)
+	}
+}
+
+func TestUsageCounters(t *testing.T) {
+	repo := newTestRepo(t)
+
+	uid, _ := repo.CreateUser("busy", "h")
+	otherID, _ := repo.CreateUser("idle", "h")
+	exprID, _ := repo.CreateExpression(uid, "1+2*3")
+	doneID, _ := repo.CreateExpression(uid, "4")
+	otherExprID, _ := repo.CreateExpression(otherID, "3+4")
+	repo.UpdateExpressionStatusResult(doneID, constants.StatusDone, sql.NullFloat64{Float64: 4, Valid: true}, sql.NullString{})
+	repo.CreateTask(exprID, "*", 2, 3, "")
+	repo.CreateTask(exprID, "+", 1, 6, "")
+	repo.CreateTask(otherExprID, "+", 3, 4, "")
+
+	active, err := repo.CountActiveExpressions(uid)
+	if err != nil || active != 1 {
+		t.Fatalf("CountActiveExpressions = %d, %v; expected 1", active, err)
+	}
+
+	repo.CreateExpressionWithOptions(uid, "5*6", ExpressionOptions{Operations: 1})
+	repo.CreateExpressionWithOptions(otherID, "7*8", ExpressionOptions{Operations: 1})
+	operations, err := repo.CountUserOperationsSince(uid, time.Now().Add(-time.Hour))
+	if err != nil || operations != 1 {
+		t.Fatalf("CountUserOperationsSince = %d, %v; expected 1", operations, err)
+	}
+	if operations, _ = repo.CountUserOperationsSince(uid, time.Now().Add(time.Hour)); operations != 0 {
+		t.Fatalf("expressions created before since must not count, got %d", operations)
+	}
+}
+
+func TestCreateExpressionLimits(t *testing.T) {
+	repo := newTestRepo(t)
+	uid, _ := repo.CreateUser("racer", "h")
+
+	// Concurrent requests can't all pass the active limit.
+	const requests = 10
+	var wg sync.WaitGroup
+	var mx sync.Mutex
+	var created, limited int
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, ok, err := repo.CreateExpressionWithOptions(uid, "1+2", ExpressionOptions{Operations: 1, MaxActive: 2})
+			mx.Lock()
+			defer mx.Unlock()
+			switch {
+			case ok:
+				created++
+			case errors.Is(err, ErrTooManyActiveExpressions):
+				limited++
+			default:
+				t.Errorf("CreateExpressionWithOptions = %v, %v", ok, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if created != 2 || limited != requests-2 {
+		t.Fatalf("expected 2 expressions and %d rejections, got %d and %d", requests-2, created, limited)
+	}
+
+	// The quota is charged with all operations of an expression when it is
+	// created, not as its tasks are planned; a repeated idempotency key
+	// returns the expression regardless.
+	uid, _ = repo.CreateUser("thrifty", "h")
+	quota := ExpressionOptions{Operations: 3, TaskQuota: 5, QuotaSince: time.Now().Add(-time.Hour), IdempotencyKey: "first"}
+	firstID, ok, err := repo.CreateExpressionWithOptions(uid, "1+2+3+4", quota)
+	if !ok || err != nil {
+		t.Fatalf("expected the first expression within the quota, got %v, %v", ok, err)
+	}
+	// Only the first operation of the chain is planned so far.
+	repo.CreateTask(firstID, "+", 1, 2, "")
+	var quotaErr *QuotaExceededError
+	quota.IdempotencyKey = "second"
+	if _, _, err := repo.CreateExpressionWithOptions(uid, "5+6+7+8", quota); !errors.As(err, &quotaErr) || quotaErr.Used != 3 {
+		t.Fatalf("expected QuotaExceededError with 3 tasks used, got %v", err)
+	}
+	quota.IdempotencyKey = "first"
+	if id, ok, err := repo.CreateExpressionWithOptions(uid, "1+2+3+4", quota); ok || err != nil || id != firstID {
+		t.Fatalf("expected the first expression to be replayed, got %d, %v, %v", id, ok, err)
+	}
+}
+
+// newSchedulingRepo returns a fresh database with a user per login, each
+// with one expression of the given number of pending tasks, created in the
+// order of logins.
+func newSchedulingRepo(t *testing.T, logins []string, tasks []int) (Repository, map[int64]string) {
+	t.Helper()
+	repo := newTestRepo(t)
+
+	owners := make(map[int64]string)
+	for i, login := range logins {
+		addTasks(t, repo, owners, login, tasks[i])
+	}
+	return repo, owners
+}
+
+// addTasks queues n tasks of a new expression of login, registering the
+// user on first use, and records the owner of the expression.
+func addTasks(t *testing.T, repo Repository, owners map[int64]string, login string, n int) {
+	t.Helper()
+	user, _ := repo.GetUserByLogin(login)
+	if user == nil {
+		if _, err := repo.CreateUser(login, "h"); err != nil {
+			t.Fatalf("CreateUser error: %v", err)
+		}
+		user, _ = repo.GetUserByLogin(login)
+	}
+	exprID, err := repo.CreateExpression(user.ID, login)
+	if err != nil {
+		t.Fatalf("CreateExpression error: %v", err)
+	}
+	owners[exprID] = login
+	for i := 0; i < n; i++ {
+		if _, err = repo.CreateTask(exprID, "+", float64(i), 1, ""); err != nil {
+			t.Fatalf("CreateTask error: %v", err)
+		}
+	}
+}
+
+// lease takes n tasks and returns the owners in the order they were served.
+func lease(t *testing.T, repo Repository, owners map[int64]string, n int) []string {
+	t.Helper()
+	served := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		task, err := repo.GetAndLeasePendingTask("worker")
+		if err != nil || task == nil {
+			t.Fatalf("GetAndLeasePendingTask = %v, %v", task, err)
+		}
+		served = append(served, owners[task.ExpressionID])
+	}
+	return served
+}
+
+func count(served []string, login string) int {
+	n := 0
+	for _, s := range served {
+		if s == login {
+			n++
+		}
+	}
+	return n
+}
+
+func TestFairSchedulingSimulation(t *testing.T) {
+	// One user floods the queue first, then nine others submit small
+	// expressions; workers lease and complete tasks concurrently.
+	logins := []string{"flood"}
+	tasks := []int{1000}
+	for i := 0; i < 9; i++ {
+		logins = append(logins, "user"+strconv.Itoa(i))
+		tasks = append(tasks, 10)
+	}
+	repo, owners := newSchedulingRepo(t, logins, tasks)
+
+	var (
+		mx     sync.Mutex
+		served []string
+		wg     sync.WaitGroup
+	)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(workerID string) {
+			defer wg.Done()
+			for {
+				task, err := repo.GetAndLeasePendingTask(workerID)
+				if err != nil {
+					t.Errorf("GetAndLeasePendingTask error: %v", err)
+					return
+				}
+				if task == nil {
+					return
+				}
+				mx.Lock()
+				served = append(served, owners[task.ExpressionID])
+				mx.Unlock()
+				if err = repo.CompleteTask(task.ID, workerID, task.LeaseToken, 0); err != nil {
+					t.Errorf("CompleteTask error: %v", err)
+					return
+				}
+			}
+		}("worker" + strconv.Itoa(w))
+	}
+	wg.Wait()
+
+	if len(served) != 1090 {
+		t.Fatalf("expected 1090 leases, got %d", len(served))
+	}
+	// With ten active users every one of them gets every tenth lease, so
+	// the small expressions are through after about a hundred leases
+	// instead of waiting behind the thousand tasks of the flood.
+	for _, login := range logins[1:] {
+		last := 0
+		for i, s := range served {
+			if s == login {
+				last = i
+			}
+		}
+		if last >= 110 {
+			t.Errorf("last task of %s was leased at position %d", login, last)
+		}
+	}
+	if n := count(served[:100], "flood"); n < 8 || n > 12 {
+		t.Errorf("flood got %d of the first 100 leases, expected about 10", n)
+	}
+}
+
+func TestSchedulingWeights(t *testing.T) {
+	repo, owners := newSchedulingRepo(t, []string{"gold", "basic"}, []int{500, 500})
+	if err := repo.SetSchedulingWeights(map[string]float64{"gold": 3}); err != nil {
+		t.Fatalf("SetSchedulingWeights error: %v", err)
+	}
+	if err := repo.SetSchedulingWeights(map[string]float64{"basic": 0}); err == nil {
+		t.Fatal("expected an error for a zero weight")
+	}
+
+	served := lease(t, repo, owners, 400)
+	if n := count(served, "gold"); n < 298 || n > 302 {
+		t.Errorf("gold got %d of 400 leases, expected 300", n)
+	}
+}
+
+func TestSchedulingLateUser(t *testing.T) {
+	repo, owners := newSchedulingRepo(t, []string{"early"}, []int{200})
+	lease(t, repo, owners, 100)
+
+	// The late user starts at the current virtual time instead of catching
+	// up on the hundred leases it missed.
+	addTasks(t, repo, owners, "late", 50)
+	served := lease(t, repo, owners, 40)
+	if n := count(served, "late"); n < 19 || n > 21 {
+		t.Errorf("late user got %d of 40 leases, expected 20", n)
+	}
+
+	// A user that drained its queue and comes back isn't penalized for the
+	// time it was alone either.
+	repo, owners = newSchedulingRepo(t, []string{"solo"}, []int{30})
+	lease(t, repo, owners, 30)
+	addTasks(t, repo, owners, "other", 50)
+	addTasks(t, repo, owners, "solo", 50)
+	served = lease(t, repo, owners, 40)
+	if n := count(served, "solo"); n < 19 || n > 21 {
+		t.Errorf("returning user got %d of 40 leases, expected 20", n)
+	}
+}
+
+func TestSchedulingPriorities(t *testing.T) {
+	store, owners := newSchedulingRepo(t, []string{"batch"}, []int{0})
+	batch, _ := store.GetUserByLogin("batch")
+	add := func(userID int64, name string, n int, opts ExpressionOptions) int64 {
+		exprID, _, err := store.CreateExpressionWithOptions(userID, name, opts)
+		if err != nil {
+			t.Fatalf("CreateExpressionWithOptions error: %v", err)
+		}
+		owners[exprID] = name
+		for i := 0; i < n; i++ {
+			store.CreateTask(exprID, "+", float64(i), 1, "")
+		}
+		return exprID
+	}
+
+	// Within a user, priority comes first and the earliest deadline breaks
+	// ties.
+	add(batch.ID, "nightly", 40, ExpressionOptions{Priority: -10})
+	add(batch.ID, "later", 1, ExpressionOptions{Deadline: sql.NullTime{Time: time.Now().Add(time.Hour), Valid: true}})
+	add(batch.ID, "sooner", 1, ExpressionOptions{Deadline: sql.NullTime{Time: time.Now().Add(time.Minute), Valid: true}})
+	add(batch.ID, "interactive", 1, ExpressionOptions{Priority: 10})
+	served := lease(t, store, owners, 4)
+	if want := []string{"interactive", "sooner", "later", "nightly"}; strings.Join(served, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected lease order %v, got %v", want, served)
+	}
+
+	// Across users a high priority overtakes as many leases of the others as
+	// the priorities differ by, then the users take turns again.
+	uid, _ := store.CreateUser("urgent", "h")
+	add(uid, "urgent", 100, ExpressionOptions{Priority: 10})
+	served = lease(t, store, owners, 40)
+	if n := count(served, "nightly"); n < 8 || n > 11 {
+		t.Errorf("low-priority tasks got %d of 40 leases, expected about 10", n)
+	}
+
+	// Waiting raises the priority: an old low-priority task catches up with
+	// fresh urgent ones.
+	if _, err := store.(*repo).db.Exec(`UPDATE tasks SET created_at = datetime('now', '-30 minutes')
+		WHERE status = ? AND expression_id IN (SELECT id FROM expressions WHERE expression = 'nightly')`, constants.StatusPending); err != nil {
+		t.Fatal(err)
+	}
+	served = lease(t, store, owners, 10)
+	if n := count(served, "nightly"); n < 4 {
+		t.Errorf("aged low-priority tasks got %d of 10 leases, expected about half", n)
+	}
+}
+
+func TestExpireOverdueExpressions(t *testing.T) {
+	repo, owners := newSchedulingRepo(t, []string{"owner"}, []int{0})
+	user, _ := repo.GetUserByLogin("owner")
+
+	overdueID, _, _ := repo.CreateExpressionWithOptions(user.ID, "1+2", ExpressionOptions{
+		Deadline: sql.NullTime{Time: time.Now().Add(-time.Second), Valid: true},
+	})
+	futureID, _, _ := repo.CreateExpressionWithOptions(user.ID, "3+4", ExpressionOptions{
+		Deadline: sql.NullTime{Time: time.Now().Add(time.Hour), Valid: true},
+	})
+	owners[overdueID], owners[futureID] = "overdue", "future"
+	overdueTask, _ := repo.CreateTask(overdueID, "+", 1, 2, "")
+	repo.CreateTask(futureID, "+", 3, 4, "")
+
+	// Tasks of overdue expressions aren't leased even before they expire.
+	if served := lease(t, repo, owners, 1); served[0] != "future" {
+		t.Fatalf("expected the task of the future expression, got %v", served)
+	}
+	if task, _ := repo.GetAndLeasePendingTask("worker"); task != nil {
+		t.Fatalf("leased task %d of an overdue expression", task.ID)
+	}
+
+	expired, err := repo.ExpireOverdueExpressions()
+	if err != nil || expired != 1 {
+		t.Fatalf("ExpireOverdueExpressions = %d, %v; expected 1", expired, err)
+	}
+	if expr, _ := repo.GetExpressionByID(overdueID, user.ID); expr.Status != constants.StatusExpired || !expr.Deadline.Valid {
+		t.Fatalf("expected an expired expression with its deadline, got %+v", expr)
+	}
+	if expr, _ := repo.GetExpressionByID(futureID, user.ID); expr.Status != constants.StatusPending {
+		t.Fatalf("expression before its deadline must stay pending, got %s", expr.Status)
+	}
+	if task, _ := repo.GetTaskByID(overdueTask); task.Status != constants.StatusExpired {
+		t.Fatalf("expected the task to be dropped, got %s", task.Status)
+	}
+	if _, err = repo.CreateTask(overdueID, "+", 3, 3, ""); !errors.Is(err, ErrExpressionCancelled) {
+		t.Fatalf("expected ErrExpressionCancelled for an expired expression, got %v", err)
+	}
+	repo.UpdateExpressionStatusResult(overdueID, constants.StatusDone, sql.NullFloat64{Float64: 3, Valid: true}, sql.NullString{})
+	if expr, _ := repo.GetExpressionByID(overdueID, user.ID); expr.Status != constants.StatusExpired {
+		t.Fatalf("a late result must not resurrect an expired expression, got %s", expr.Status)
+	}
+	if expired, _ = repo.ExpireOverdueExpressions(); expired != 0 {
+		t.Fatalf("expected nothing left to expire, got %d", expired)
+	}
 }
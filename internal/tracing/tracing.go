@@ -0,0 +1,210 @@
+// Package tracing wires OpenTelemetry for the orchestrator and the workers.
+// Trace context travels as a W3C traceparent: in HTTP headers, in the tasks
+// table and in gRPC metadata.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+const instrumentationName = "github.com/atadzan/dist-arith-go"
+
+const (
+	exporterEnv = "TRACING_EXPORTER"
+	fileEnv     = "TRACING_FILE"
+)
+
+// ExporterFactory builds a span exporter. Factories are looked up by the
+// name in TRACING_EXPORTER.
+type ExporterFactory func(ctx context.Context) (sdktrace.SpanExporter, error)
+
+var (
+	exportersMx sync.RWMutex
+	exporters   = map[string]ExporterFactory{
+		"stdout": func(context.Context) (sdktrace.SpanExporter, error) {
+			return stdouttrace.New(stdouttrace.WithPrettyPrint())
+		},
+		"file": newFileExporter,
+	}
+)
+
+// RegisterExporter makes an exporter available under name, e.g. an OTLP
+// exporter in a deployment-specific build.
+func RegisterExporter(name string, factory ExporterFactory) {
+	exportersMx.Lock()
+	defer exportersMx.Unlock()
+	exporters[name] = factory
+}
+
+var propagator = propagation.TraceContext{}
+
+// Setup installs the global tracer provider for serviceName using the
+// exporter named in TRACING_EXPORTER. With no exporter configured spans are
+// not recorded, but trace context is still propagated. The returned function
+// flushes and stops the exporter.
+func Setup(ctx context.Context, serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+
+	name := strings.TrimSpace(os.Getenv(exporterEnv))
+	if name == "" || name == "none" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exportersMx.RLock()
+	factory, ok := exporters[name]
+	exportersMx.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown %s %q, available: %s", exporterEnv, name, strings.Join(exporterNames(), ", "))
+	}
+
+	exporter, err := factory(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't create %s trace exporter: %w", name, err)
+	}
+	provider := NewProvider(serviceName, sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// NewProvider creates a tracer provider that tags spans with serviceName.
+func NewProvider(serviceName string, opts ...sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	res, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", serviceName)))
+	if err != nil {
+		res = resource.Default()
+	}
+	return sdktrace.NewTracerProvider(append([]sdktrace.TracerProviderOption{sdktrace.WithResource(res)}, opts...)...)
+}
+
+func exporterNames() []string {
+	exportersMx.RLock()
+	defer exportersMx.RUnlock()
+
+	names := make([]string, 0, len(exporters))
+	for name := range exporters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fileExporter writes spans as JSON lines to TRACING_FILE.
+type fileExporter struct {
+	*stdouttrace.Exporter
+	file *os.File
+}
+
+func newFileExporter(context.Context) (sdktrace.SpanExporter, error) {
+	path := os.Getenv(fileEnv)
+	if path == "" {
+		return nil, fmt.Errorf("%s must be set for the file exporter", fileEnv)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("can't open trace file %s: %w", path, err)
+	}
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileExporter{Exporter: exporter, file: f}, nil
+}
+
+func (e *fileExporter) Shutdown(ctx context.Context) error {
+	err := e.Exporter.Shutdown(ctx)
+	if closeErr := e.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Tracer returns the tracer used for all spans of this module.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// ExtractHTTP continues a trace started by the HTTP client, if any.
+func ExtractHTTP(r *http.Request) context.Context {
+	return propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+}
+
+// Serialize returns the traceparent of the span in ctx for storing next to
+// the data it belongs to. It is empty when ctx carries no sampled span.
+func Serialize(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// Restore puts a traceparent produced by Serialize back into ctx.
+func Restore(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier{"traceparent": traceparent})
+}
+
+// metadataCarrier adapts gRPC metadata to the propagation API.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// InjectMetadata writes the trace context of ctx into md.
+func InjectMetadata(ctx context.Context, md metadata.MD) {
+	propagator.Inject(ctx, metadataCarrier(md))
+}
+
+// ExtractMetadata continues the trace carried in md.
+func ExtractMetadata(ctx context.Context, md metadata.MD) context.Context {
+	return propagator.Extract(ctx, metadataCarrier(md))
+}
+
+// OutgoingContext attaches the trace context of ctx to outgoing gRPC metadata.
+func OutgoingContext(ctx context.Context) context.Context {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	InjectMetadata(ctx, md)
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// IncomingContext continues the trace sent by the gRPC client, if any.
+func IncomingContext(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	return ExtractMetadata(ctx, md)
+}
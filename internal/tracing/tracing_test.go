@@ -0,0 +1,79 @@
+package tracing
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestSetupFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	t.Setenv(exporterEnv, "file")
+	t.Setenv(fileEnv, path)
+
+	previous := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(previous)
+
+	shutdown, err := Setup(context.Background(), "test-service")
+	if err != nil {
+		t.Fatalf("Setup error: %v", err)
+	}
+	_, span := Tracer().Start(context.Background(), "file-exported")
+	span.End()
+	if err = shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown error: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"Name":"file-exported"`) || !strings.Contains(string(data), "test-service") {
+		t.Fatalf("span not written to file: %s", data)
+	}
+}
+
+func TestSetupUnknownExporter(t *testing.T) {
+	t.Setenv(exporterEnv, "carrier-pigeon")
+	if _, err := Setup(context.Background(), "test-service"); err == nil {
+		t.Fatal("unknown exporter must be rejected")
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	provider := NewProvider("test-service")
+	defer provider.Shutdown(context.Background())
+
+	ctx, span := provider.Tracer("test").Start(context.Background(), "parent")
+	defer span.End()
+	want := span.SpanContext()
+
+	stored := Serialize(ctx)
+	if stored == "" {
+		t.Fatal("Serialize returned empty traceparent")
+	}
+	if got := trace.SpanContextFromContext(Restore(context.Background(), stored)); !got.Equal(want.WithRemote(true)) {
+		t.Fatalf("Restore = %v, want %v", got, want)
+	}
+	if got := Restore(context.Background(), ""); trace.SpanContextFromContext(got).IsValid() {
+		t.Fatal("empty traceparent must not produce a span context")
+	}
+
+	md := metadata.MD{}
+	InjectMetadata(ctx, md)
+	if got := trace.SpanContextFromContext(ExtractMetadata(context.Background(), md)); got.TraceID() != want.TraceID() || got.SpanID() != want.SpanID() {
+		t.Fatalf("metadata round trip = %v, want %v", got, want)
+	}
+
+	outgoing, _ := metadata.FromOutgoingContext(OutgoingContext(ctx))
+	incoming := metadata.NewIncomingContext(context.Background(), outgoing)
+	if got := trace.SpanContextFromContext(IncomingContext(incoming)); got.TraceID() != want.TraceID() {
+		t.Fatalf("gRPC round trip = %v, want trace %v", got, want.TraceID())
+	}
+}
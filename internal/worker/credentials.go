@@ -0,0 +1,27 @@
+package worker
+
+import (
+	"context"
+
+	"google.golang.org/grpc/credentials"
+)
+
+type bearerToken struct {
+	token      string
+	requireTLS bool
+}
+
+// NewBearerToken attaches the worker token to every call to the orchestrator.
+// requireTLS should be true whenever the connection is encrypted, so the
+// token is never sent in clear text by accident.
+func NewBearerToken(token string, requireTLS bool) credentials.PerRPCCredentials {
+	return bearerToken{token: token, requireTLS: requireTLS}
+}
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + t.token}, nil
+}
+
+func (t bearerToken) RequireTransportSecurity() bool {
+	return t.requireTLS
+}
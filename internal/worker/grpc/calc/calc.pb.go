@@ -154,6 +154,7 @@ type Task struct {
 	Arg2            float64                `protobuf:"fixed64,3,opt,name=arg2,proto3" json:"arg2,omitempty"`
 	Operation       string                 `protobuf:"bytes,4,opt,name=operation,proto3" json:"operation,omitempty"`
 	OperationTimeMs int32                  `protobuf:"varint,5,opt,name=operation_time_ms,json=operationTimeMs,proto3" json:"operation_time_ms,omitempty"`
+	LeaseToken      string                 `protobuf:"bytes,6,opt,name=lease_token,json=leaseToken,proto3" json:"lease_token,omitempty"`
 	unknownFields   protoimpl.UnknownFields
 	sizeCache       protoimpl.SizeCache
 }
@@ -223,6 +224,13 @@ func (x *Task) GetOperationTimeMs() int32 {
 	return 0
 }
 
+func (x *Task) GetLeaseToken() string {
+	if x != nil {
+		return x.LeaseToken
+	}
+	return ""
+}
+
 type NoTaskAvailable struct {
 	state             protoimpl.MessageState `protogen:"open.v1"`
 	RetryAfterSeconds int32                  `protobuf:"varint,1,opt,name=retry_after_seconds,json=retryAfterSeconds,proto3" json:"retry_after_seconds,omitempty"`
@@ -276,6 +284,7 @@ type SubmitResultRequest struct {
 	//	*SubmitResultRequest_Error
 	ResultStatus  isSubmitResultRequest_ResultStatus `protobuf_oneof:"result_status"`
 	WorkerId      string                             `protobuf:"bytes,4,opt,name=worker_id,json=workerId,proto3" json:"worker_id,omitempty"`
+	LeaseToken    string                             `protobuf:"bytes,5,opt,name=lease_token,json=leaseToken,proto3" json:"lease_token,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -349,6 +358,13 @@ func (x *SubmitResultRequest) GetWorkerId() string {
 	return ""
 }
 
+func (x *SubmitResultRequest) GetLeaseToken() string {
+	if x != nil {
+		return x.LeaseToken
+	}
+	return ""
+}
+
 type isSubmitResultRequest_ResultStatus interface {
 	isSubmitResultRequest_ResultStatus()
 }
@@ -464,20 +480,24 @@ const file_pkg_grpc_calc_proto_rawDesc = "" +
 	"\x04task\x18\x01 \x01(\v2\n" +
 	".calc.TaskH\x00R\x04task\x120\n" +
 	"\ano_task\x18\x02 \x01(\v2\x15.calc.NoTaskAvailableH\x00R\x06noTaskB\v\n" +
-	"\ttask_info\"\x88\x01\n" +
+	"\ttask_info\"\xa9\x01\n" +
 	"\x04Task\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\x03R\x02id\x12\x12\n" +
 	"\x04arg1\x18\x02 \x01(\x01R\x04arg1\x12\x12\n" +
 	"\x04arg2\x18\x03 \x01(\x01R\x04arg2\x12\x1c\n" +
 	"\toperation\x18\x04 \x01(\tR\toperation\x12*\n" +
-	"\x11operation_time_ms\x18\x05 \x01(\x05R\x0foperationTimeMs\"A\n" +
+	"\x11operation_time_ms\x18\x05 \x01(\x05R\x0foperationTimeMs\x12\x1f\n" +
+	"\vlease_token\x18\x06 \x01(\tR\n" +
+	"leaseToken\"A\n" +
 	"\x0fNoTaskAvailable\x12.\n" +
-	"\x13retry_after_seconds\x18\x01 \x01(\x05R\x11retryAfterSeconds\"\x9f\x01\n" +
+	"\x13retry_after_seconds\x18\x01 \x01(\x05R\x11retryAfterSeconds\"\xc0\x01\n" +
 	"\x13SubmitResultRequest\x12\x17\n" +
 	"\atask_id\x18\x01 \x01(\x03R\x06taskId\x12\x18\n" +
 	"\x06result\x18\x02 \x01(\x01H\x00R\x06result\x12'\n" +
 	"\x05error\x18\x03 \x01(\v2\x0f.calc.TaskErrorH\x00R\x05error\x12\x1b\n" +
-	"\tworker_id\x18\x04 \x01(\tR\bworkerIdB\x0f\n" +
+	"\tworker_id\x18\x04 \x01(\tR\bworkerId\x12\x1f\n" +
+	"\vlease_token\x18\x05 \x01(\tR\n" +
+	"leaseTokenB\x0f\n" +
 	"\rresult_status\"%\n" +
 	"\tTaskError\x12\x18\n" +
 	"\amessage\x18\x01 \x01(\tR\amessage\":\n" +
@@ -0,0 +1,119 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	pb "github.com/atadzan/dist-arith-go/internal/worker/grpc/calc"
+
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	DefaultHealthInterval = 5 * time.Second
+	healthCheckTimeout    = 2 * time.Second
+)
+
+// HealthMonitor periodically asks the orchestrator's grpc.health.v1 service
+// whether the worker service is serving. The worker is healthy while the
+// orchestrator answers SERVING.
+type HealthMonitor struct {
+	client   healthpb.HealthClient
+	interval time.Duration
+	logger   *slog.Logger
+
+	mx        sync.RWMutex
+	healthy   bool
+	lastError string
+	checkedAt time.Time
+}
+
+func NewHealthMonitor(conn grpc.ClientConnInterface, interval time.Duration, logger *slog.Logger) *HealthMonitor {
+	if interval <= 0 {
+		interval = DefaultHealthInterval
+	}
+	return &HealthMonitor{
+		client:    healthpb.NewHealthClient(conn),
+		interval:  interval,
+		logger:    logger.With("component", "health"),
+		lastError: "not checked yet",
+	}
+}
+
+// Run checks the orchestrator until ctx is done.
+func (m *HealthMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.Check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check queries the orchestrator once and records the result.
+func (m *HealthMonitor) Check(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	var errMsg string
+	resp, err := m.client.Check(ctx, &healthpb.HealthCheckRequest{Service: pb.CalcWorkerService_ServiceDesc.ServiceName})
+	switch {
+	case err != nil:
+		errMsg = err.Error()
+	case resp.GetStatus() != healthpb.HealthCheckResponse_SERVING:
+		errMsg = "orchestrator is " + resp.GetStatus().String()
+	}
+
+	m.mx.Lock()
+	changed := m.healthy != (errMsg == "")
+	m.healthy, m.lastError, m.checkedAt = errMsg == "", errMsg, time.Now()
+	m.mx.Unlock()
+
+	if changed && errMsg == "" {
+		m.logger.InfoContext(ctx, "orchestrator is reachable")
+	} else if changed {
+		m.logger.WarnContext(ctx, "orchestrator is unreachable", "error", errMsg)
+	}
+	return errMsg == ""
+}
+
+// Healthy reports the result of the last check.
+func (m *HealthMonitor) Healthy() bool {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	return m.healthy
+}
+
+type healthResponse struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at,omitempty"`
+}
+
+// Handler serves the last check result: 200 when the orchestrator is
+// reachable, 503 otherwise.
+func (m *HealthMonitor) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mx.RLock()
+		resp, code := healthResponse{Status: "ok", CheckedAt: m.checkedAt}, http.StatusOK
+		if !m.healthy {
+			resp.Status, resp.Error, code = "unavailable", m.lastError, http.StatusServiceUnavailable
+		}
+		m.mx.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(resp)
+	})
+}
@@ -0,0 +1,60 @@
+package worker
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/atadzan/dist-arith-go/internal/logging"
+	pb "github.com/atadzan/dist-arith-go/internal/worker/grpc/calc"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestHealthMonitorFollowsOrchestrator(t *testing.T) {
+	lis := bufconn.Listen(1024 * 1024)
+	srv := grpc.NewServer()
+	orchestratorHealth := health.NewServer()
+	orchestratorHealth.SetServingStatus(pb.CalcWorkerService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(srv, orchestratorHealth)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	m := NewHealthMonitor(conn, 0, logging.Discard())
+	status := func() int {
+		rr := httptest.NewRecorder()
+		m.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		return rr.Code
+	}
+
+	if status() != http.StatusServiceUnavailable {
+		t.Fatal("expected unhealthy before the first check")
+	}
+	if !m.Check(context.Background()) || status() != http.StatusOK {
+		t.Fatal("expected healthy while the orchestrator is serving")
+	}
+
+	orchestratorHealth.Shutdown()
+	if m.Check(context.Background()) || m.Healthy() || status() != http.StatusServiceUnavailable {
+		t.Fatal("expected unhealthy after the orchestrator stopped serving")
+	}
+
+	srv.Stop()
+	if m.Check(context.Background()) {
+		t.Fatal("expected unhealthy when the orchestrator is unreachable")
+	}
+}
@@ -0,0 +1,45 @@
+package worker
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics counts the work done by every worker goroutine; the "worker" label
+// is the goroutine number passed to Worker.
+type Metrics struct {
+	tasks          *prometheus.CounterVec
+	computeSeconds *prometheus.CounterVec
+	sleepSeconds   *prometheus.CounterVec
+}
+
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		tasks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "calc_worker",
+			Name:      "tasks_total",
+			Help:      "Tasks processed, by worker, operation and outcome.",
+		}, []string{"worker", "operation", "outcome"}),
+		computeSeconds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "calc_worker",
+			Name:      "compute_seconds_total",
+			Help:      "Time spent computing task results.",
+		}, []string{"worker"}),
+		sleepSeconds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "calc_worker",
+			Name:      "sleep_seconds_total",
+			Help:      "Time spent waiting out the configured operation time.",
+		}, []string{"worker"}),
+	}
+	reg.MustRegister(m.tasks, m.computeSeconds, m.sleepSeconds)
+	return m
+}
+
+func (m *Metrics) observeTask(workerID int, operation, outcome string, compute, sleep time.Duration) {
+	worker := strconv.Itoa(workerID)
+	m.tasks.WithLabelValues(worker, operation, outcome).Inc()
+	m.computeSeconds.WithLabelValues(worker).Add(compute.Seconds())
+	m.sleepSeconds.WithLabelValues(worker).Add(sleep.Seconds())
+}
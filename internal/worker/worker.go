@@ -3,29 +3,49 @@ package worker
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"os"
 	"time"
 
+	"github.com/atadzan/dist-arith-go/internal/logging"
+	"github.com/atadzan/dist-arith-go/internal/tracing"
 	pb "github.com/atadzan/dist-arith-go/internal/worker/grpc/calc"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
-func Worker(workerID int, grpcClient pb.CalcWorkerServiceClient) {
-	log.Printf("Worker %d run.", workerID)
-	ctx := context.Background()
-	workerId := fmt.Sprintf("worker-%d", workerID)
+// instance tells apart worker processes, which may share a token: the
+// orchestrator counts live workers by the IDs they report.
+var instance = func() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}()
+
+func Worker(workerID int, grpcClient pb.CalcWorkerServiceClient, metrics *Metrics, logger *slog.Logger) {
+	workerId := fmt.Sprintf("worker-%d@%s", workerID, instance)
+	ctx := logging.With(context.Background(), logging.WorkerIDKey, workerId)
+	logger.InfoContext(ctx, "worker started")
 
 	for {
-		log.Printf("Worker %d: Request for task...", workerID)
+		logger.DebugContext(ctx, "requesting task")
 		var (
 			task *pb.Task
 			err  error
 		)
 		retryAfter := 1 * time.Second
 
+		var header metadata.MD
 		getTaskReq := &pb.GetTaskRequest{WorkerId: workerId}
-		getTaskResp, err := grpcClient.GetTask(ctx, getTaskReq)
+		getTaskResp, err := grpcClient.GetTask(ctx, getTaskReq, grpc.Header(&header))
 		if err != nil {
-			log.Printf("Worker %d: can't get task: %v. Retry after %v...", workerID, err, retryAfter)
+			logger.WarnContext(ctx, "can't get task", "error", err, "retry_after", retryAfter)
 			time.Sleep(retryAfter)
 			continue
 		}
@@ -33,52 +53,79 @@ func Worker(workerID int, grpcClient pb.CalcWorkerServiceClient) {
 		switch taskInfo := getTaskResp.TaskInfo.(type) {
 		case *pb.GetTaskResponse_Task:
 			task = taskInfo.Task
-			log.Printf("Worker %d: Received task %d: %f %s %f (time: %dms)",
-				workerID, task.Id, task.Arg1, task.Operation, task.Arg2, task.OperationTimeMs)
+			logger.DebugContext(ctx, "received task", logging.TaskIDKey, task.Id,
+				"arg1", task.Arg1, "operation", task.Operation, "arg2", task.Arg2, "operation_time_ms", task.OperationTimeMs)
 		case *pb.GetTaskResponse_NoTask:
 			if taskInfo.NoTask != nil && taskInfo.NoTask.RetryAfterSeconds > 0 {
 				retryAfter = time.Duration(taskInfo.NoTask.RetryAfterSeconds) * time.Second
 			}
-			log.Printf("Worker %d: No available tasks. Retry after %v...", workerID, retryAfter)
+			logger.DebugContext(ctx, "no tasks available", "retry_after", retryAfter)
 			time.Sleep(retryAfter)
 			continue
 		default:
-			log.Printf("Worker %d: Received unknown response. Retry after %v...", workerID, retryAfter)
+			logger.WarnContext(ctx, "unknown response", "retry_after", retryAfter)
 			time.Sleep(retryAfter)
 			continue
 		}
 
+		// The orchestrator sends the trace of the task's expression in the header.
+		taskCtx := logging.With(ctx, logging.TaskIDKey, task.Id)
+		taskCtx, span := tracing.Tracer().Start(tracing.ExtractMetadata(taskCtx, header), "ProcessTask",
+			trace.WithAttributes(
+				attribute.Int64("task.id", task.Id),
+				attribute.String("task.operation", task.Operation),
+				attribute.String("worker.id", workerId),
+			))
+
 		startTime := time.Now()
 		result, computeErr := compute(task.Arg1, task.Arg2, task.Operation)
 		computationDuration := time.Since(startTime)
 
+		var sleepDuration time.Duration
 		if task.OperationTimeMs > 0 {
 			requiredDuration := time.Duration(task.OperationTimeMs) * time.Millisecond
 			if computationDuration < requiredDuration {
-				time.Sleep(requiredDuration - computationDuration)
+				sleepDuration = requiredDuration - computationDuration
+				time.Sleep(sleepDuration)
 			}
 		}
 
 		submitReq := &pb.SubmitResultRequest{
-			TaskId:   task.Id,
-			WorkerId: workerId,
+			TaskId:     task.Id,
+			WorkerId:   workerId,
+			LeaseToken: task.LeaseToken,
 		}
+		span.SetAttributes(
+			attribute.Int64("compute.us", computationDuration.Microseconds()),
+			attribute.Int64("sleep.ms", sleepDuration.Milliseconds()),
+		)
 		if computeErr != nil {
-			log.Printf("Worker %d: can't calculate task %d: %v", workerID, task.Id, computeErr)
+			span.SetStatus(codes.Error, computeErr.Error())
+			logger.WarnContext(taskCtx, "can't calculate task", "error", computeErr)
 			submitReq.ResultStatus = &pb.SubmitResultRequest_Error{
 				Error: &pb.TaskError{Message: computeErr.Error()},
 			}
 		} else {
-			log.Printf("Worker %d: Calculated task %d. Result: %f", workerID, task.Id, result)
+			logger.DebugContext(taskCtx, "calculated task", "result", result)
 			submitReq.ResultStatus = &pb.SubmitResultRequest_Result{Result: result}
 		}
 
-		_, err = grpcClient.SubmitResult(ctx, submitReq)
+		outcome := "done"
+		if computeErr != nil {
+			outcome = "error"
+		}
+		_, err = grpcClient.SubmitResult(tracing.OutgoingContext(taskCtx), submitReq)
 		if err != nil {
-			log.Printf("Worker %d: occured error taskId:%d. Err: %v.", workerID, task.Id, err)
-			time.Sleep(retryAfter)
+			outcome = "rejected"
+			span.SetStatus(codes.Error, err.Error())
+			logger.WarnContext(taskCtx, "can't submit result", "error", err)
 		} else {
-			log.Printf("Worker %d: task result %d sent.", workerID, task.Id)
+			logger.InfoContext(taskCtx, "task result sent", "outcome", outcome)
+		}
+		span.End()
+		metrics.observeTask(workerID, task.Operation, outcome, computationDuration, sleepDuration)
+		if err != nil {
+			time.Sleep(retryAfter)
 		}
 
 	}
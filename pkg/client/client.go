@@ -0,0 +1,609 @@
+// Package client is a typed Go client for the orchestrator's HTTP API.
+//
+// With WithCredentials the client logs in by itself and logs in again when
+// the token is about to expire or is rejected. Reads and expression
+// submissions are retried on network errors and 429/502/503/504 responses;
+// submissions carry an Idempotency-Key, so a retry never creates a second
+// expression.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBaseURL      = "http://localhost:8080"
+	DefaultPollInterval = 500 * time.Millisecond
+	DefaultMaxAttempts  = 3
+	DefaultRetryBackoff = 200 * time.Millisecond
+
+	apiPrefix            = "/api/v2"
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	// tokenRefreshMargin is how long before its expiry a token is renewed.
+	tokenRefreshMargin = time.Minute
+	maxRetryDelay      = 10 * time.Second
+)
+
+type Client struct {
+	baseURL      string
+	httpClient   *http.Client
+	maxAttempts  int
+	retryBackoff time.Duration
+	pollInterval time.Duration
+	language     string
+
+	login, password string
+
+	mx    sync.RWMutex
+	token string
+	// refreshMx lets a single goroutine log in when the token goes stale.
+	refreshMx sync.Mutex
+}
+
+type Option func(*Client)
+
+// WithHTTPClient replaces http.DefaultClient, e.g. to set timeouts or TLS.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// WithToken sets a JWT obtained earlier, so Login can be skipped.
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithCredentials makes the client log in on its own before the first
+// authenticated request and whenever the token expires or is revoked.
+func WithCredentials(login, password string) Option {
+	return func(c *Client) { c.login, c.password = login, password }
+}
+
+// WithRetry sets how many times a retriable request is attempted in total
+// and the initial delay, which doubles with every attempt. One attempt
+// disables retries.
+func WithRetry(maxAttempts int, backoff time.Duration) Option {
+	return func(c *Client) { c.maxAttempts, c.retryBackoff = maxAttempts, backoff }
+}
+
+// WithPollInterval sets how often Calculate checks the expression.
+func WithPollInterval(interval time.Duration) Option {
+	return func(c *Client) { c.pollInterval = interval }
+}
+
+// WithLanguage sets the Accept-Language of requests, which selects the
+// language of APIError messages, e.g. "en". The server defaults to Russian.
+func WithLanguage(language string) Option {
+	return func(c *Client) { c.language = language }
+}
+
+// New returns a client for the orchestrator at baseURL, e.g.
+// "http://localhost:8080".
+func New(baseURL string, opts ...Option) *Client {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	c := &Client{
+		baseURL:      strings.TrimRight(baseURL, "/"),
+		httpClient:   http.DefaultClient,
+		maxAttempts:  DefaultMaxAttempts,
+		retryBackoff: DefaultRetryBackoff,
+		pollInterval: DefaultPollInterval,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.maxAttempts < 1 {
+		c.maxAttempts = 1
+	}
+	return c
+}
+
+// Token returns the JWT used for authenticated requests.
+func (c *Client) Token() string {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	return c.token
+}
+
+func (c *Client) SetToken(token string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.token = token
+}
+
+// LoginResult is either a token or, for users with 2FA enabled, a challenge
+// to be completed with LoginTwoFactor.
+type LoginResult struct {
+	Token             string `json:"token,omitempty"`
+	TwoFactorRequired bool   `json:"two_factor_required,omitempty"`
+	ChallengeToken    string `json:"challenge_token,omitempty"`
+}
+
+type credentials struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+func (c *Client) Register(ctx context.Context, login, password string) error {
+	return c.do(ctx, request{method: http.MethodPost, path: "/register", in: credentials{login, password}})
+}
+
+// Login exchanges the credentials for a token and keeps it for further
+// requests, unless a second factor is required.
+func (c *Client) Login(ctx context.Context, login, password string) (*LoginResult, error) {
+	var result LoginResult
+	err := c.do(ctx, request{method: http.MethodPost, path: "/login", in: credentials{login, password}, out: &result, retry: true})
+	if err != nil {
+		return nil, err
+	}
+	if result.Token != "" {
+		c.SetToken(result.Token)
+	}
+	return &result, nil
+}
+
+// LoginTwoFactor completes a login with a TOTP code or, when code is empty,
+// with a recovery code.
+func (c *Client) LoginTwoFactor(ctx context.Context, challengeToken, code, recoveryCode string) (string, error) {
+	req := struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code,omitempty"`
+	}{challengeToken, code, recoveryCode}
+
+	var result LoginResult
+	if err := c.do(ctx, request{method: http.MethodPost, path: "/login/2fa", in: req, out: &result}); err != nil {
+		return "", err
+	}
+	c.SetToken(result.Token)
+	return result.Token, nil
+}
+
+// Calculate submits the expression and waits until it is finished or ctx is
+// done. An expression that fails or is cancelled is returned together with
+// an *ExpressionError.
+func (c *Client) Calculate(ctx context.Context, expression string) (*Expression, error) {
+	expr, err := c.Submit(ctx, expression)
+	if err != nil {
+		return nil, err
+	}
+	if expr, err = c.Wait(ctx, expr.ID, c.pollInterval); err != nil {
+		return expr, err
+	}
+	return expr, expr.Err()
+}
+
+// Submit queues an expression under a fresh idempotency key and returns it
+// in the pending state.
+func (c *Client) Submit(ctx context.Context, expression string) (*Expression, error) {
+	key, err := NewIdempotencyKey()
+	if err != nil {
+		return nil, err
+	}
+	return c.SubmitWithKey(ctx, expression, key)
+}
+
+// SubmitWithKey queues an expression at most once per idempotency key: a
+// repeated call returns the expression created first. Reusing a key for
+// another expression fails with ErrConflict.
+func (c *Client) SubmitWithKey(ctx context.Context, expression, idempotencyKey string) (*Expression, error) {
+	return c.SubmitWithOptions(ctx, expression, SubmitOptions{IdempotencyKey: idempotencyKey})
+}
+
+// SubmitOptions are the optional parameters of SubmitWithOptions.
+type SubmitOptions struct {
+	// IdempotencyKey works as in SubmitWithKey; a fresh key is generated
+	// when it is empty.
+	IdempotencyKey string
+	// Priority ranges from -10 to 10; tasks of higher priority are computed
+	// first.
+	Priority int
+	// Deadline, when set, expires the expression if it isn't computed by
+	// then.
+	Deadline time.Time
+	// NoRebalance keeps the order of operations as written, for
+	// expressions whose floating-point result must not depend on the
+	// server balancing chains of + and *.
+	NoRebalance bool
+}
+
+// SubmitWithOptions queues an expression with a priority and a deadline.
+func (c *Client) SubmitWithOptions(ctx context.Context, expression string, opts SubmitOptions) (*Expression, error) {
+	if opts.IdempotencyKey == "" {
+		key, err := NewIdempotencyKey()
+		if err != nil {
+			return nil, err
+		}
+		opts.IdempotencyKey = key
+	}
+	in := struct {
+		Expression string     `json:"expression"`
+		Priority   int        `json:"priority,omitempty"`
+		Deadline   *time.Time `json:"deadline,omitempty"`
+		Rebalance  *bool      `json:"rebalance,omitempty"`
+	}{Expression: expression, Priority: opts.Priority}
+	if !opts.Deadline.IsZero() {
+		in.Deadline = &opts.Deadline
+	}
+	if opts.NoRebalance {
+		rebalance := false
+		in.Rebalance = &rebalance
+	}
+
+	var expr Expression
+	err := c.do(ctx, request{
+		method: http.MethodPost, path: "/calculate", in: in, out: &expr,
+		auth: true, retry: true, idempotencyKey: opts.IdempotencyKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &expr, nil
+}
+
+func (c *Client) Get(ctx context.Context, id int64) (*Expression, error) {
+	var expr Expression
+	err := c.do(ctx, request{method: http.MethodGet, path: "/expressions/" + strconv.FormatInt(id, 10), out: &expr, auth: true, retry: true})
+	if err != nil {
+		return nil, err
+	}
+	return &expr, nil
+}
+
+// List returns the user's expressions, newest first. An empty status returns
+// all of them.
+func (c *Client) List(ctx context.Context, status string) ([]Expression, error) {
+	path := "/expressions"
+	if status != "" {
+		path += "?status=" + url.QueryEscape(status)
+	}
+	var list []Expression
+	if err := c.do(ctx, request{method: http.MethodGet, path: path, out: &list, auth: true, retry: true}); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Cancel stops an unfinished expression. Cancelling a finished one fails
+// with ErrConflict.
+func (c *Client) Cancel(ctx context.Context, id int64) (*Expression, error) {
+	var expr Expression
+	err := c.do(ctx, request{method: http.MethodPost, path: "/expressions/" + strconv.FormatInt(id, 10) + "/cancel", out: &expr, auth: true})
+	if err != nil {
+		return nil, err
+	}
+	return &expr, nil
+}
+
+// Trace returns the tasks the expression was computed with, see Trace.
+func (c *Client) Trace(ctx context.Context, id int64) (*Trace, error) {
+	var trace Trace
+	err := c.do(ctx, request{method: http.MethodGet, path: "/expressions/" + strconv.FormatInt(id, 10) + "/trace", out: &trace, auth: true, retry: true})
+	if err != nil {
+		return nil, err
+	}
+	return &trace, nil
+}
+
+// Plan returns the tasks expression would be computed with and their cost
+// without submitting it, see Plan.
+func (c *Client) Plan(ctx context.Context, expression string, noRebalance bool) (*Plan, error) {
+	in := struct {
+		Expression string `json:"expression"`
+		Rebalance  *bool  `json:"rebalance,omitempty"`
+	}{Expression: expression}
+	if noRebalance {
+		rebalance := false
+		in.Rebalance = &rebalance
+	}
+
+	var plan Plan
+	if err := c.do(ctx, request{method: http.MethodPost, path: "/plan", in: in, out: &plan, auth: true, retry: true}); err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// Graph formats.
+const (
+	GraphJSON    = "json"
+	GraphDOT     = "dot"
+	GraphMermaid = "mermaid"
+)
+
+// Graph returns the task graph of the expression rendered in format:
+// GraphJSON, GraphDOT for Graphviz or GraphMermaid.
+func (c *Client) Graph(ctx context.Context, id int64, format string) ([]byte, error) {
+	var graph []byte
+	path := "/expressions/" + strconv.FormatInt(id, 10) + "/graph?format=" + url.QueryEscape(format)
+	if err := c.do(ctx, request{method: http.MethodGet, path: path, out: &graph, auth: true, retry: true}); err != nil {
+		return nil, err
+	}
+	return graph, nil
+}
+
+// Usage describes the per-user limits of the orchestrator and how much of
+// them is used. A limit of 0 is disabled.
+type Usage struct {
+	Limits struct {
+		RequestsPerSecond     int `json:"requests_per_second"`
+		Burst                 int `json:"burst"`
+		MaxActiveExpressions  int `json:"max_active_expressions"`
+		MaxTasksPerExpression int `json:"max_tasks_per_expression"`
+		DailyTaskQuota        int `json:"daily_task_quota"`
+	} `json:"limits"`
+	Usage struct {
+		AvailableRequests int   `json:"available_requests"`
+		ActiveExpressions int64 `json:"active_expressions"`
+		TasksToday        int64 `json:"tasks_today"`
+	} `json:"usage"`
+	QuotaResetsAt time.Time `json:"quota_resets_at"`
+}
+
+// Usage returns the limits of the current user. Requests over a limit fail
+// with ErrRateLimited.
+func (c *Client) Usage(ctx context.Context) (*Usage, error) {
+	var usage Usage
+	if err := c.do(ctx, request{method: http.MethodGet, path: "/me/usage", out: &usage, auth: true, retry: true}); err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+// Settings are the preferences of the current user.
+type Settings struct {
+	// ResultCache lets the server answer expressions from results computed
+	// earlier; disable it to have every expression computed anew.
+	ResultCache bool `json:"result_cache"`
+}
+
+func (c *Client) Settings(ctx context.Context) (*Settings, error) {
+	var settings Settings
+	if err := c.do(ctx, request{method: http.MethodGet, path: "/me/settings", out: &settings, auth: true, retry: true}); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// UpdateSettings replaces the settings of the current user and returns them.
+func (c *Client) UpdateSettings(ctx context.Context, settings Settings) (*Settings, error) {
+	var updated Settings
+	if err := c.do(ctx, request{method: http.MethodPut, path: "/me/settings", in: settings, out: &updated, auth: true, retry: true}); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// Wait polls the expression every interval until it is finished or ctx is
+// done.
+func (c *Client) Wait(ctx context.Context, id int64, interval time.Duration) (*Expression, error) {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		expr, err := c.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if expr.Finished() {
+			return expr, nil
+		}
+		select {
+		case <-ctx.Done():
+			return expr, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// NewIdempotencyKey returns a random key for SubmitWithKey.
+func NewIdempotencyKey() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("can't generate idempotency key: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+type request struct {
+	method, path   string
+	in, out        any
+	auth           bool
+	retry          bool
+	idempotencyKey string
+}
+
+func (c *Client) do(ctx context.Context, r request) error {
+	var body []byte
+	if r.in != nil {
+		var err error
+		if body, err = json.Marshal(r.in); err != nil {
+			return fmt.Errorf("can't encode request: %w", err)
+		}
+	}
+
+	attempts := 1
+	if r.retry {
+		attempts = c.maxAttempts
+	}
+	refreshed := false
+	for attempt := 1; ; attempt++ {
+		token, err := c.authenticate(ctx, r.auth)
+		if err != nil {
+			return err
+		}
+
+		err = c.send(ctx, r, body, token)
+		var apiErr *APIError
+		switch {
+		case err == nil:
+			return nil
+		case errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized && r.auth && c.login != "" && !refreshed:
+			// The token was revoked or expired early: log in again once.
+			if err = c.refresh(ctx, token); err != nil {
+				return err
+			}
+			refreshed = true
+			attempt--
+			continue
+		case attempt >= attempts || ctx.Err() != nil:
+			return err
+		case apiErr != nil && !apiErr.temporary():
+			return err
+		}
+
+		var delay time.Duration
+		if apiErr != nil {
+			delay = apiErr.RetryAfter
+		}
+		if delay <= 0 {
+			delay = c.backoff(attempt)
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, r request, body []byte, token string) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, r.method, c.baseURL+apiPrefix+r.path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.language != "" {
+		req.Header.Set("Accept-Language", c.language)
+	}
+	if r.auth && token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if r.idempotencyKey != "" {
+		req.Header.Set(idempotencyKeyHeader, r.idempotencyKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return newAPIError(resp)
+	}
+	if r.out == nil {
+		return nil
+	}
+	if raw, ok := r.out.(*[]byte); ok {
+		*raw, err = io.ReadAll(resp.Body)
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(r.out); err != nil {
+		return fmt.Errorf("can't decode %s %s response: %w", r.method, r.path, err)
+	}
+	return nil
+}
+
+// authenticate returns the token for the request, logging in first when
+// credentials are configured and the token is missing or about to expire.
+func (c *Client) authenticate(ctx context.Context, auth bool) (string, error) {
+	if !auth {
+		return "", nil
+	}
+	token := c.Token()
+	if c.login == "" || (token != "" && !tokenExpiresSoon(token)) {
+		return token, nil
+	}
+	if err := c.refresh(ctx, token); err != nil {
+		return "", err
+	}
+	return c.Token(), nil
+}
+
+// refresh logs in with the configured credentials unless another goroutine
+// has already replaced the stale token.
+func (c *Client) refresh(ctx context.Context, stale string) error {
+	c.refreshMx.Lock()
+	defer c.refreshMx.Unlock()
+
+	if token := c.Token(); token != stale && token != "" {
+		return nil
+	}
+	result, err := c.Login(ctx, c.login, c.password)
+	if err != nil {
+		return fmt.Errorf("can't log in as %s: %w", c.login, err)
+	}
+	if result.TwoFactorRequired {
+		return ErrTwoFactorRequired
+	}
+	return nil
+}
+
+// tokenExpiresSoon reads the exp claim without verifying the signature;
+// the server remains the judge, this only avoids a rejected request.
+func tokenExpiresSoon(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	var claims struct {
+		ExpiresAt int64 `json:"exp"`
+	}
+	if err = json.Unmarshal(payload, &claims); err != nil || claims.ExpiresAt == 0 {
+		return false
+	}
+	return time.Until(time.Unix(claims.ExpiresAt, 0)) < tokenRefreshMargin
+}
+
+// backoff doubles the delay with every attempt and adds up to 50% jitter.
+func (c *Client) backoff(attempt int) time.Duration {
+	delay := c.retryBackoff << (attempt - 1)
+	if delay <= 0 || delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay + mrand.N(delay/2+1)
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return min(time.Duration(seconds)*time.Second, maxRetryDelay)
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return min(time.Until(t), maxRetryDelay)
+	}
+	return 0
+}
@@ -0,0 +1,341 @@
+package client_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/atadzan/dist-arith-go/internal/logging"
+	"github.com/atadzan/dist-arith-go/internal/orchestrator"
+	"github.com/atadzan/dist-arith-go/internal/repository"
+	"github.com/atadzan/dist-arith-go/pkg/client"
+	"github.com/atadzan/dist-arith-go/pkg/database"
+)
+
+// testOrchestrator serves the real HTTP handlers and, when started, computes
+// tasks in place of a worker.
+type testOrchestrator struct {
+	*httptest.Server
+	repo      repository.Repository
+	scheduler *orchestrator.Scheduler
+
+	logins atomic.Int32
+
+	mx sync.Mutex
+	// faults maps a path to the number of upcoming responses replaced by a
+	// 503; with dropAfterHandling the handler still runs first, as if the
+	// response was lost on the way back.
+	faults            map[string]int
+	dropAfterHandling bool
+}
+
+func newTestOrchestrator(t *testing.T) *testOrchestrator {
+	t.Helper()
+	dbConn, err := database.GetMemoryDBConn()
+	if err != nil {
+		t.Fatalf("GetMemoryDBConn: %v", err)
+	}
+	t.Cleanup(func() { dbConn.Close() })
+
+	repo, err := repository.New(dbConn, logging.Discard())
+	if err != nil {
+		if strings.Contains(err.Error(), "requires cgo") {
+			t.Skipf("skip client tests: %v", err)
+		}
+		t.Fatalf("New: %v", err)
+	}
+	if err = repo.CreateTables(); err != nil {
+		t.Fatalf("CreateTables: %v", err)
+	}
+
+	auth := orchestrator.NewAuthService(repo, "testsecret")
+	scheduler := orchestrator.NewScheduler(repo, orchestrator.NewMetrics(repo, logging.Discard()), logging.Discard())
+	handlers := orchestrator.NewHTTPHandlers(auth, repo, scheduler, orchestrator.NewPasswordPolicy(), orchestrator.NewLimits(), logging.Discard())
+
+	o := &testOrchestrator{repo: repo, scheduler: scheduler, faults: map[string]int{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/register", handlers.RegisterHandler)
+	mux.HandleFunc("/api/v2/login", func(w http.ResponseWriter, r *http.Request) {
+		o.logins.Add(1)
+		handlers.LoginHandler(w, r)
+	})
+	mux.Handle("/api/v2/calculate", auth.JWTMiddleware(http.HandlerFunc(handlers.CalculateV2Handler)))
+	mux.Handle("/api/v2/expressions", auth.JWTMiddleware(http.HandlerFunc(handlers.ExpressionsV2Handler)))
+	mux.Handle("/api/v2/expressions/", auth.JWTMiddleware(http.HandlerFunc(handlers.ExpressionsV2Handler)))
+	mux.Handle("/api/v2/me/usage", auth.JWTMiddleware(http.HandlerFunc(handlers.UsageHandler)))
+	mux.Handle("/api/v2/plan", auth.JWTMiddleware(http.HandlerFunc(handlers.PlanHandler)))
+	mux.Handle("/api/v2/me/settings", auth.JWTMiddleware(http.HandlerFunc(handlers.SettingsHandler)))
+
+	o.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !o.takeFault(r.URL.Path) {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		if o.dropAfterHandling {
+			mux.ServeHTTP(httptest.NewRecorder(), r)
+		}
+		w.Header().Set("Retry-After", "0")
+		http.Error(w, "temporarily unavailable", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(o.Close)
+	return o
+}
+
+func (o *testOrchestrator) failNext(path string, n int, dropAfterHandling bool) {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+	o.faults[path] = n
+	o.dropAfterHandling = dropAfterHandling
+}
+
+func (o *testOrchestrator) takeFault(path string) bool {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+	if o.faults[path] == 0 {
+		return false
+	}
+	o.faults[path]--
+	return true
+}
+
+// runWorker leases and computes tasks until the test ends.
+func (o *testOrchestrator) runWorker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		for ctx.Err() == nil {
+			task, err := o.repo.GetAndLeasePendingTask("test-worker")
+			if err != nil || task == nil {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			var result float64
+			switch task.Operation {
+			case "+":
+				result = task.Arg1 + task.Arg2
+			case "-":
+				result = task.Arg1 - task.Arg2
+			case "*":
+				result = task.Arg1 * task.Arg2
+			case "/":
+				result = task.Arg1 / task.Arg2
+			}
+			if err = o.repo.CompleteTask(task.ID, "test-worker", task.LeaseToken, result); err == nil {
+				o.scheduler.ProcessTaskCompletion(ctx, task.ID)
+			}
+		}
+	}()
+}
+
+func newClient(t *testing.T, o *testOrchestrator, opts ...client.Option) *client.Client {
+	t.Helper()
+	if err := client.New(o.URL).Register(context.Background(), "sdk-user", "pass123"); err != nil && !errors.Is(err, client.ErrConflict) {
+		t.Fatalf("Register: %v", err)
+	}
+	opts = append([]client.Option{
+		client.WithCredentials("sdk-user", "pass123"),
+		client.WithRetry(3, time.Millisecond),
+		client.WithPollInterval(10 * time.Millisecond),
+	}, opts...)
+	return client.New(o.URL, opts...)
+}
+
+func TestCalculateWaitsForResult(t *testing.T) {
+	o := newTestOrchestrator(t)
+	o.runWorker(t)
+	c := newClient(t, o)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	expr, err := c.Calculate(ctx, "(2+3)*4")
+	if err != nil {
+		t.Fatalf("Calculate: %v", err)
+	}
+	if expr.Status != client.StatusDone || expr.Result == nil || *expr.Result != 20 {
+		t.Fatalf("expected done with result 20, got %+v", expr)
+	}
+	if expr.Progress != (client.Progress{Done: 2, Total: 2}) || expr.ETA != nil {
+		t.Fatalf("expected all operations done and no ETA, got %+v", expr)
+	}
+	if o.logins.Load() != 1 {
+		t.Fatalf("expected a single automatic login, got %d", o.logins.Load())
+	}
+
+	trace, err := c.Trace(ctx, expr.ID)
+	if err != nil {
+		t.Fatalf("Trace: %v", err)
+	}
+	if len(trace.Tasks) != 2 || trace.Tasks[1].Operation != "*" || trace.Tasks[1].Arg1 != 5 ||
+		len(trace.Tasks[1].DependsOn) != 1 || trace.Tasks[1].DependsOn[0] != trace.Tasks[0].ID ||
+		trace.Tasks[1].WorkerID != "test-worker" || trace.Tasks[1].CompletedAt == nil {
+		t.Fatalf("expected 2+3 followed by 5*4, got %+v", trace.Tasks)
+	}
+	graph, err := c.Graph(ctx, expr.ID, client.GraphDOT)
+	if err != nil || !strings.HasPrefix(string(graph), "digraph") {
+		t.Fatalf("expected a DOT graph, got %q, %v", graph, err)
+	}
+
+	plan, err := c.Plan(ctx, "(2+3)*4", false)
+	if err != nil || len(plan.Tasks) != 2 || plan.Tree.Op != "*" || plan.Cost.Operations["+"] != 1 || plan.Cost.Tasks != 2 {
+		t.Fatalf("expected a plan of 2+3 and 5*4, got %+v, %v", plan, err)
+	}
+
+	expr, err = c.Calculate(ctx, "(1+")
+	var exprErr *client.ExpressionError
+	if !errors.As(err, &exprErr) || !errors.Is(err, client.ErrExpressionFailed) || expr.Error == "" {
+		t.Fatalf("expected ExpressionError with a reason, got %+v, %v", expr, err)
+	}
+}
+
+func TestSubmitRetriesWithoutDuplicates(t *testing.T) {
+	o := newTestOrchestrator(t)
+	c := newClient(t, o)
+	ctx := context.Background()
+
+	// The first two responses are lost after the expression was stored.
+	o.failNext("/api/v2/calculate", 2, true)
+	expr, err := c.Submit(ctx, "1+1")
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	list, err := c.List(ctx, "")
+	if err != nil || len(list) != 1 || list[0].ID != expr.ID {
+		t.Fatalf("expected exactly the submitted expression, got %+v, %v", list, err)
+	}
+
+	again, err := c.SubmitWithKey(ctx, "1+1", "fixed-key")
+	if err != nil {
+		t.Fatalf("SubmitWithKey: %v", err)
+	}
+	if replay, err := c.SubmitWithKey(ctx, "1+1", "fixed-key"); err != nil || replay.ID != again.ID {
+		t.Fatalf("expected replay of expression %d, got %+v, %v", again.ID, replay, err)
+	}
+	if _, err = c.SubmitWithKey(ctx, "2+2", "fixed-key"); !errors.Is(err, client.ErrConflict) {
+		t.Fatalf("expected ErrConflict for a reused key, got %v", err)
+	}
+
+	o.failNext("/api/v2/calculate", 3, false)
+	if _, err = c.Submit(ctx, "3+3"); !errors.Is(err, client.ErrServer) {
+		t.Fatalf("expected ErrServer after exhausting retries, got %v", err)
+	}
+}
+
+func TestTokenRefresh(t *testing.T) {
+	o := newTestOrchestrator(t)
+	ctx := context.Background()
+
+	// A rejected token is replaced by logging in again.
+	c := newClient(t, o, client.WithToken("revoked-token"))
+	if _, err := c.List(ctx, ""); err != nil {
+		t.Fatalf("List with revoked token: %v", err)
+	}
+	if c.Token() == "revoked-token" || o.logins.Load() != 1 {
+		t.Fatalf("expected one login replacing the token, got %d logins", o.logins.Load())
+	}
+
+	// A token about to expire is renewed before it is sent.
+	expiring := "x." + base64URL(`{"exp":`+itoa(time.Now().Add(10*time.Second).Unix())+`}`) + ".y"
+	c.SetToken(expiring)
+	if _, err := c.List(ctx, ""); err != nil {
+		t.Fatalf("List with expiring token: %v", err)
+	}
+	if c.Token() == expiring || o.logins.Load() != 2 {
+		t.Fatalf("expected the expiring token to be renewed, got %d logins", o.logins.Load())
+	}
+
+	// Without credentials there's nothing to refresh with.
+	anonymous := client.New(o.URL, client.WithToken("revoked-token"))
+	if _, err := anonymous.List(ctx, ""); !errors.Is(err, client.ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized, got %v", err)
+	}
+	if _, err := client.New(o.URL).Login(ctx, "sdk-user", "wrong"); !errors.Is(err, client.ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized for a wrong password, got %v", err)
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	o := newTestOrchestrator(t)
+	c := newClient(t, o, client.WithLanguage("en"))
+	ctx := context.Background()
+
+	var apiErr *client.APIError
+	_, err := c.Get(ctx, 404)
+	if !errors.Is(err, client.ErrNotFound) || !errors.As(err, &apiErr) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if apiErr.Code != "expression_not_found" || apiErr.Message != "Expression 404 not found or access denied" {
+		t.Fatalf("expected the decoded error envelope, got %+v", apiErr)
+	}
+	if _, err = c.Submit(ctx, " "); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || apiErr.Code != "empty_expression" {
+		t.Fatalf("expected a 400 APIError, got %v", err)
+	}
+
+	// No worker runs, so the expression is still unfinished.
+	expr, err := c.Submit(ctx, "2*3")
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	if expr, err = c.Cancel(ctx, expr.ID); err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+	if err = expr.Err(); !errors.Is(err, client.ErrCancelled) {
+		t.Fatalf("expected ErrCancelled, got %v", err)
+	}
+	if _, err = c.Cancel(ctx, expr.ID); !errors.Is(err, client.ErrConflict) {
+		t.Fatalf("expected ErrConflict for a second cancel, got %v", err)
+	}
+
+	deadline := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	expr, err = c.SubmitWithOptions(ctx, "4*5*6", client.SubmitOptions{Priority: 5, Deadline: deadline, NoRebalance: true})
+	if err != nil {
+		t.Fatalf("SubmitWithOptions: %v", err)
+	}
+	if expr.Priority != 5 || expr.Deadline == nil || !expr.Deadline.Equal(deadline) {
+		t.Fatalf("expected priority 5 and deadline %v, got %+v", deadline, expr)
+	}
+	if expr.Rebalance || expr.Depth != 2 || expr.PlannedDepth != 2 {
+		t.Fatalf("expected an unbalanced tree of depth 2, got %+v", expr)
+	}
+	if _, err = c.SubmitWithOptions(ctx, "4*5*6", client.SubmitOptions{Priority: 11}); !errors.As(err, &apiErr) || apiErr.Code != "invalid_priority" {
+		t.Fatalf("expected invalid_priority, got %v", err)
+	}
+	if _, err = c.Cancel(ctx, expr.ID); err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+	expired := &client.Expression{ID: 7, Status: client.StatusExpired}
+	if err = expired.Err(); !expired.Finished() || !errors.Is(err, client.ErrExpired) {
+		t.Fatalf("expected ErrExpired for an expired expression, got %v", err)
+	}
+
+	usage, err := c.Usage(ctx)
+	if err != nil {
+		t.Fatalf("Usage: %v", err)
+	}
+	if usage.Limits.DailyTaskQuota != orchestrator.NewLimits().DailyTaskQuota || usage.Usage.ActiveExpressions != 0 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+
+	if settings, err := c.UpdateSettings(ctx, client.Settings{ResultCache: false}); err != nil || settings.ResultCache {
+		t.Fatalf("expected the result cache disabled, got %+v, %v", settings, err)
+	}
+	if settings, err := c.Settings(ctx); err != nil || settings.ResultCache {
+		t.Fatalf("expected the stored settings, got %+v, %v", settings, err)
+	}
+}
+
+func base64URL(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func itoa(v int64) string {
+	return strconv.FormatInt(v, 10)
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Errors matched by APIError and ExpressionError, for use with errors.Is.
+var (
+	ErrBadRequest   = errors.New("bad request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+	// ErrConflict is returned for finished expressions that can't be
+	// cancelled and for idempotency keys reused with another expression.
+	ErrConflict    = errors.New("conflict")
+	ErrRateLimited = errors.New("rate limited")
+	ErrServer      = errors.New("server error")
+
+	// ErrTwoFactorRequired is returned by automatic logins with
+	// WithCredentials for accounts with 2FA enabled; use Login and
+	// LoginTwoFactor for them instead.
+	ErrTwoFactorRequired = errors.New("two-factor authentication required")
+
+	ErrExpressionFailed = errors.New("expression failed")
+	ErrCancelled        = errors.New("expression was cancelled")
+	ErrExpired          = errors.New("expression missed its deadline")
+)
+
+// APIError is returned for every response with a 4xx or 5xx status.
+type APIError struct {
+	StatusCode int
+	// Code is the stable error code from the response body, e.g.
+	// "expression_not_found". It is empty for errors not produced by the
+	// API itself, such as those of a proxy.
+	Code    string
+	Message string
+	Details map[string]any
+	// RetryAfter is the delay requested by the server, if any.
+	RetryAfter time.Duration
+}
+
+// newAPIError reads the error envelope of resp, falling back to the body as
+// plain text.
+func newAPIError(resp *http.Response) *APIError {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	var envelope struct {
+		Error struct {
+			Code    string         `json:"code"`
+			Message string         `json:"message"`
+			Details map[string]any `json:"details"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &envelope); err == nil && envelope.Error.Code != "" {
+		apiErr.Code = envelope.Error.Code
+		apiErr.Message = envelope.Error.Message
+		apiErr.Details = envelope.Error.Details
+		return apiErr
+	}
+	apiErr.Message = strings.TrimSpace(string(body))
+	return apiErr
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("orchestrator responded %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	if e.Code != "" {
+		return fmt.Sprintf("orchestrator responded %d %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("orchestrator responded %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *APIError) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusBadRequest:
+		return target == ErrBadRequest
+	case http.StatusUnauthorized:
+		return target == ErrUnauthorized
+	case http.StatusForbidden:
+		return target == ErrForbidden
+	case http.StatusNotFound:
+		return target == ErrNotFound
+	case http.StatusConflict, http.StatusUnprocessableEntity:
+		return target == ErrConflict
+	case http.StatusTooManyRequests:
+		return target == ErrRateLimited
+	}
+	return e.StatusCode >= http.StatusInternalServerError && target == ErrServer
+}
+
+// temporary reports whether the same request may succeed when retried.
+func (e *APIError) temporary() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// ExpressionError is returned for expressions that finished without a
+// result. It matches ErrExpressionFailed, ErrCancelled or ErrExpired.
+type ExpressionError struct {
+	Expression *Expression
+}
+
+func (e *ExpressionError) Error() string {
+	switch e.Expression.Status {
+	case StatusCancelled:
+		return fmt.Sprintf("expression %d was cancelled", e.Expression.ID)
+	case StatusExpired:
+		return fmt.Sprintf("expression %d missed its deadline", e.Expression.ID)
+	}
+	if e.Expression.Error == "" {
+		return fmt.Sprintf("expression %d failed", e.Expression.ID)
+	}
+	return fmt.Sprintf("expression %d failed: %s", e.Expression.ID, e.Expression.Error)
+}
+
+func (e *ExpressionError) Is(target error) bool {
+	switch e.Expression.Status {
+	case StatusCancelled:
+		return target == ErrCancelled
+	case StatusExpired:
+		return target == ErrExpired
+	}
+	return target == ErrExpressionFailed
+}
@@ -0,0 +1,289 @@
+package client
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Expression statuses.
+const (
+	StatusPending    = "pending"
+	StatusInProgress = "in_progress"
+	StatusDone       = "done"
+	StatusError      = "error"
+	StatusCancelled  = "cancelled"
+	StatusExpired    = "expired"
+)
+
+type Expression struct {
+	ID         int64  `json:"id"`
+	Expression string `json:"expression"`
+	Status     string `json:"status"`
+	// Result is nil until the expression is done.
+	Result *float64 `json:"result"`
+	Steps  []string `json:"steps,omitempty"`
+	// Error describes why the expression failed.
+	Error    string `json:"error,omitempty"`
+	Priority int    `json:"priority"`
+	// Deadline is nil for expressions without a deadline.
+	Deadline *time.Time `json:"deadline"`
+	// Rebalance tells whether chains of + and * were balanced; Depth and
+	// PlannedDepth are the depths of the tree before and after.
+	Rebalance    bool     `json:"rebalance"`
+	Depth        int      `json:"depth"`
+	PlannedDepth int      `json:"planned_depth"`
+	Progress     Progress `json:"progress"`
+	// ETA is when the server expects the expression to be done; nil for
+	// finished expressions and while no worker is connected.
+	ETA       *time.Time `json:"eta"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// Progress counts the computed operations of an expression.
+type Progress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+// Trace is the step-by-step evaluation of an expression.
+type Trace struct {
+	ID         int64    `json:"id"`
+	Expression string   `json:"expression"`
+	Status     string   `json:"status"`
+	Result     *float64 `json:"result"`
+	// Rewrites are the simplifications applied before planning.
+	Rewrites []string `json:"rewrites"`
+	// Tasks come after the tasks they depend on.
+	Tasks []TraceTask `json:"tasks"`
+}
+
+// TraceTask is an operation computed by a worker.
+type TraceTask struct {
+	ID          int64      `json:"id"`
+	Operation   string     `json:"operation"`
+	Arg1        float64    `json:"arg1"`
+	Arg2        float64    `json:"arg2"`
+	Result      *float64   `json:"result"`
+	Status      string     `json:"status"`
+	WorkerID    string     `json:"worker_id"`
+	LeasedAt    *time.Time `json:"leased_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	Retries     int        `json:"retries"`
+	// DependsOn are the IDs of the tasks that computed the arguments.
+	DependsOn []int64 `json:"depends_on"`
+}
+
+// Plan is how an expression would be computed.
+type Plan struct {
+	Expression string `json:"expression"`
+	// AST is the expression as parsed, Tree the one the tasks are planned
+	// from after the server's simplifications and rebalancing.
+	AST      *PlanNode `json:"ast"`
+	Tree     *PlanNode `json:"tree"`
+	Rewrites []string  `json:"rewrites"`
+	// Tasks come after the tasks they depend on.
+	Tasks []PlanTask `json:"tasks"`
+	Cost  PlanCost   `json:"cost"`
+}
+
+// PlanNode is a number with its value or an operation with its operands.
+type PlanNode struct {
+	Op    string    `json:"op"`
+	Value *float64  `json:"value"`
+	Left  *PlanNode `json:"left"`
+	Right *PlanNode `json:"right"`
+}
+
+// PlanTask is an operation of a plan. IDs number the tasks of the plan.
+type PlanTask struct {
+	ID        int    `json:"id"`
+	Operation string `json:"operation"`
+	// Arg1 and Arg2 are nil for arguments computed by the tasks in
+	// DependsOn.
+	Arg1       *float64 `json:"arg1"`
+	Arg2       *float64 `json:"arg2"`
+	DependsOn  []int    `json:"depends_on"`
+	StartMs    int      `json:"start_ms"`
+	DurationMs int      `json:"duration_ms"`
+}
+
+// PlanCost estimates the work of a plan from the operation times of the
+// server.
+type PlanCost struct {
+	Tasks          int            `json:"tasks"`
+	Depth          int            `json:"depth"`
+	PlannedDepth   int            `json:"planned_depth"`
+	CriticalPathMs int            `json:"critical_path_ms"`
+	TotalMs        int            `json:"total_ms"`
+	Operations     map[string]int `json:"operations"`
+	Workers        int            `json:"workers"`
+	// DurationMs is the expected time with the live workers, nil while no
+	// worker is live.
+	DurationMs *int `json:"duration_ms"`
+}
+
+// Finished reports whether the expression has reached a final status.
+func (e *Expression) Finished() bool {
+	switch e.Status {
+	case StatusDone, StatusError, StatusCancelled, StatusExpired:
+		return true
+	}
+	return false
+}
+
+// Err returns an *ExpressionError when the expression finished with an
+// error, was cancelled or expired, and nil otherwise.
+func (e *Expression) Err() error {
+	switch e.Status {
+	case StatusError, StatusCancelled, StatusExpired:
+		return &ExpressionError{Expression: e}
+	}
+	return nil
+}
+
+// UnmarshalJSON accepts the v1 representation, where result, steps and
+// deadline are encoded as {"Float64":..,"Valid":..}, {"String":..,"Valid":..}
+// and {"Time":..,"Valid":..}, as well as plain values.
+func (e *Expression) UnmarshalJSON(data []byte) error {
+	var wire struct {
+		ID         int64           `json:"id"`
+		Expression string          `json:"expression"`
+		Status     string          `json:"status"`
+		Result     json.RawMessage `json:"result"`
+		Steps      json.RawMessage `json:"steps"`
+		Error      string          `json:"error"`
+		Priority   int             `json:"priority"`
+		Deadline   json.RawMessage `json:"deadline"`
+		// Rebalance is v2, RebalanceDisabled v1.
+		Rebalance         *bool      `json:"rebalance"`
+		RebalanceDisabled bool       `json:"rebalance_disabled"`
+		Depth             int        `json:"depth"`
+		PlannedDepth      int        `json:"planned_depth"`
+		Progress          Progress   `json:"progress"`
+		ETA               *time.Time `json:"eta"`
+		CreatedAt         time.Time  `json:"created_at"`
+		UpdatedAt         time.Time  `json:"updated_at"`
+	}
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return err
+	}
+	*e = Expression{
+		ID:         wire.ID,
+		Expression: wire.Expression,
+		Status:     wire.Status,
+		Error:      wire.Error,
+		Priority:   wire.Priority,
+		Rebalance:  !wire.RebalanceDisabled,
+		Depth:      wire.Depth,
+		Progress:   wire.Progress,
+		ETA:        wire.ETA,
+		CreatedAt:  wire.CreatedAt,
+		UpdatedAt:  wire.UpdatedAt,
+	}
+
+	e.PlannedDepth = wire.PlannedDepth
+	if wire.Rebalance != nil {
+		e.Rebalance = *wire.Rebalance
+	}
+
+	result, err := decodeResult(wire.Result)
+	if err != nil {
+		return err
+	}
+	e.Result = result
+
+	deadline, err := decodeDeadline(wire.Deadline)
+	if err != nil {
+		return err
+	}
+	e.Deadline = deadline
+
+	steps, text, err := decodeSteps(wire.Steps)
+	if err != nil {
+		return err
+	}
+	e.Steps = steps
+	// v1 stores the failure reason in steps.
+	if text != "" && e.Error == "" {
+		e.Error = text
+	}
+	return nil
+}
+
+func decodeResult(raw json.RawMessage) (*float64, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var nullable struct {
+		Float64 float64
+		Valid   bool
+	}
+	if raw[0] == '{' {
+		if err := json.Unmarshal(raw, &nullable); err != nil {
+			return nil, err
+		}
+		if !nullable.Valid {
+			return nil, nil
+		}
+		return &nullable.Float64, nil
+	}
+	var v float64
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func decodeDeadline(raw json.RawMessage) (*time.Time, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var nullable struct {
+		Time  time.Time
+		Valid bool
+	}
+	if raw[0] == '{' {
+		if err := json.Unmarshal(raw, &nullable); err != nil {
+			return nil, err
+		}
+		if !nullable.Valid {
+			return nil, nil
+		}
+		return &nullable.Time, nil
+	}
+	var v time.Time
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// decodeSteps returns the steps, or the raw text when the stored value is
+// not a JSON array.
+func decodeSteps(raw json.RawMessage) ([]string, string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, "", nil
+	}
+	if raw[0] == '[' {
+		var steps []string
+		err := json.Unmarshal(raw, &steps)
+		return steps, "", err
+	}
+
+	var nullable struct {
+		String string
+		Valid  bool
+	}
+	if err := json.Unmarshal(raw, &nullable); err != nil {
+		return nil, "", err
+	}
+	if !nullable.Valid || nullable.String == "" {
+		return nil, "", nil
+	}
+	var steps []string
+	if err := json.Unmarshal([]byte(nullable.String), &steps); err != nil {
+		return nil, nullable.String, nil
+	}
+	return steps, "", nil
+}
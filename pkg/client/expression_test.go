@@ -0,0 +1,66 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestExpressionDecodesV1AndPlainJSON(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		wantResult   *float64
+		wantSteps    int
+		wantError    string
+		wantDeadline bool
+	}{
+		{
+			name:       "v1 done",
+			body:       `{"id":1,"status":"done","result":{"Float64":20,"Valid":true},"steps":{"String":"[\"Result: 5\",\"Result: 20\"]","Valid":true}}`,
+			wantResult: ptr(20),
+			wantSteps:  2,
+		},
+		{
+			name: "v1 pending",
+			body: `{"id":2,"status":"pending","result":{"Float64":0,"Valid":false},"steps":{"String":"","Valid":false},"deadline":{"Time":"0001-01-01T00:00:00Z","Valid":false}}`,
+		},
+		{
+			name:         "v1 deadline",
+			body:         `{"id":5,"status":"pending","priority":3,"deadline":{"Time":"2026-03-01T12:00:00Z","Valid":true}}`,
+			wantDeadline: true,
+		},
+		{
+			name:      "v1 error keeps the reason",
+			body:      `{"id":3,"status":"error","result":{"Float64":0,"Valid":false},"steps":{"String":"parse error: unexpected end","Valid":true}}`,
+			wantError: "parse error: unexpected end",
+		},
+		{
+			name:       "plain values",
+			body:       `{"id":4,"status":"done","result":0,"steps":["Result: 0"],"deadline":null}`,
+			wantResult: ptr(0),
+			wantSteps:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var expr Expression
+			if err := json.Unmarshal([]byte(tt.body), &expr); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if (expr.Result == nil) != (tt.wantResult == nil) || (expr.Result != nil && *expr.Result != *tt.wantResult) {
+				t.Errorf("Result = %v, want %v", expr.Result, tt.wantResult)
+			}
+			if len(expr.Steps) != tt.wantSteps {
+				t.Errorf("Steps = %v, want %d steps", expr.Steps, tt.wantSteps)
+			}
+			if expr.Error != tt.wantError {
+				t.Errorf("Error = %q, want %q", expr.Error, tt.wantError)
+			}
+			if (expr.Deadline != nil) != tt.wantDeadline {
+				t.Errorf("Deadline = %v, want set: %v", expr.Deadline, tt.wantDeadline)
+			}
+		})
+	}
+}
+
+func ptr(v float64) *float64 { return &v }
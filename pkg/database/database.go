@@ -32,3 +32,15 @@ func GetTestingDBConn() (*sql.DB, error) {
 
 	return db, nil
 }
+
+// GetMemoryDBConn opens a private in-memory database for tests. Every
+// connection to ":memory:" opens a separate empty database, so the pool is
+// limited to a single connection.
+func GetMemoryDBConn() (*sql.DB, error) {
+	db, err := NewDBConn(":memory:")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
@@ -0,0 +1,133 @@
+// Package totp implements time-based one-time passwords (RFC 6238) on top of
+// HOTP (RFC 4226), compatible with common authenticator apps.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Algorithm string
+
+const (
+	SHA1   Algorithm = "SHA1"
+	SHA256 Algorithm = "SHA256"
+	SHA512 Algorithm = "SHA512"
+)
+
+type Config struct {
+	Digits    int
+	Period    time.Duration
+	Algorithm Algorithm
+	// Skew is the number of periods accepted before and after the current one.
+	Skew int
+}
+
+var DefaultConfig = Config{
+	Digits:    6,
+	Period:    30 * time.Second,
+	Algorithm: SHA1,
+	Skew:      1,
+}
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a random 160-bit secret encoded as unpadded base32.
+func GenerateSecret() (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("can't generate secret: %w", err)
+	}
+	return encoding.EncodeToString(buf), nil
+}
+
+func DecodeSecret(secret string) ([]byte, error) {
+	normalized := strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := encoding.DecodeString(strings.TrimRight(normalized, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base32 secret: %w", err)
+	}
+	return key, nil
+}
+
+// HOTP computes the RFC 4226 value for the given counter.
+func HOTP(key []byte, counter uint64, digits int, alg Algorithm) string {
+	mac := hmac.New(hashFunc(alg), key)
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	binCode := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, binCode%mod)
+}
+
+func (c Config) Step(t time.Time) int64 {
+	return t.Unix() / int64(c.Period/time.Second)
+}
+
+func (c Config) CodeAt(key []byte, t time.Time) string {
+	return HOTP(key, uint64(c.Step(t)), c.Digits, c.Algorithm)
+}
+
+// Validate checks the code against the allowed window around t and returns
+// the matched time step, so callers can reject replays of the same step.
+func (c Config) Validate(key []byte, code string, t time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != c.Digits {
+		return 0, false
+	}
+	current := c.Step(t)
+	for delta := -c.Skew; delta <= c.Skew; delta++ {
+		step := current + int64(delta)
+		if step < 0 {
+			continue
+		}
+		expected := HOTP(key, uint64(step), c.Digits, c.Algorithm)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// URI builds the otpauth:// provisioning URI understood by authenticator apps.
+func (c Config) URI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", string(c.Algorithm))
+	q.Set("digits", strconv.Itoa(c.Digits))
+	q.Set("period", strconv.Itoa(int(c.Period/time.Second)))
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+func hashFunc(alg Algorithm) func() hash.Hash {
+	switch alg {
+	case SHA256:
+		return sha256.New
+	case SHA512:
+		return sha512.New
+	default:
+		return sha1.New
+	}
+}
@@ -0,0 +1,95 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHOTPRFC4226Vectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+	want := []string{
+		"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489",
+	}
+	for counter, code := range want {
+		if got := HOTP(key, uint64(counter), 6, SHA1); got != code {
+			t.Errorf("HOTP(counter=%d) = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+func TestTOTPRFC6238Vectors(t *testing.T) {
+	keys := map[Algorithm][]byte{
+		SHA1:   []byte("12345678901234567890"),
+		SHA256: []byte("12345678901234567890123456789012"),
+		SHA512: []byte("1234567890123456789012345678901234567890123456789012345678901234"),
+	}
+	tests := []struct {
+		unix int64
+		alg  Algorithm
+		want string
+	}{
+		{59, SHA1, "94287082"},
+		{59, SHA256, "46119246"},
+		{59, SHA512, "90693936"},
+		{1111111109, SHA1, "07081804"},
+		{1111111109, SHA256, "68084774"},
+		{1111111109, SHA512, "25091201"},
+		{1111111111, SHA1, "14050471"},
+		{1111111111, SHA256, "67062674"},
+		{1111111111, SHA512, "99943326"},
+		{1234567890, SHA1, "89005924"},
+		{1234567890, SHA256, "91819424"},
+		{1234567890, SHA512, "93441116"},
+		{2000000000, SHA1, "69279037"},
+		{2000000000, SHA256, "90698825"},
+		{2000000000, SHA512, "38618901"},
+		{20000000000, SHA1, "65353130"},
+		{20000000000, SHA256, "77737706"},
+		{20000000000, SHA512, "47863826"},
+	}
+	for _, tc := range tests {
+		cfg := Config{Digits: 8, Period: 30 * time.Second, Algorithm: tc.alg}
+		if got := cfg.CodeAt(keys[tc.alg], time.Unix(tc.unix, 0)); got != tc.want {
+			t.Errorf("TOTP(%s, t=%d) = %s, want %s", tc.alg, tc.unix, got, tc.want)
+		}
+	}
+}
+
+func TestValidateWindow(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := DecodeSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig
+	now := time.Unix(1111111111, 0)
+
+	code := cfg.CodeAt(key, now.Add(-30*time.Second))
+	step, ok := cfg.Validate(key, code, now)
+	if !ok || step != cfg.Step(now)-1 {
+		t.Fatalf("code from previous period must be accepted, got step=%d ok=%v", step, ok)
+	}
+	if _, ok = cfg.Validate(key, cfg.CodeAt(key, now.Add(-90*time.Second)), now); ok {
+		t.Fatal("code outside the skew window must be rejected")
+	}
+	if _, ok = cfg.Validate(key, "12345", now); ok {
+		t.Fatal("code of wrong length must be rejected")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := DefaultConfig.URI("dist-arith-go", "alice@example.com", "JBSWY3DPEHPK3PXP")
+	if !strings.HasPrefix(uri, "otpauth://totp/dist-arith-go:alice@example.com?") {
+		t.Fatalf("unexpected label in %s", uri)
+	}
+	for _, part := range []string{"secret=JBSWY3DPEHPK3PXP", "issuer=dist-arith-go", "digits=6", "period=30", "algorithm=SHA1"} {
+		if !strings.Contains(uri, part) {
+			t.Errorf("URI %s is missing %s", uri, part)
+		}
+	}
+}